@@ -0,0 +1,326 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode"
+
+	"github.com/foxcpp/mailbox/proto/common"
+	"github.com/foxcpp/mailbox/proto/imap"
+)
+
+// ForwardMode selects how original message is included in forwarded one.
+type ForwardMode int
+
+const (
+	// Original message is attached as message/rfc822 part.
+	ForwardAttached ForwardMode = iota
+	// Original text is included in body, attachments are copied.
+	ForwardInline
+)
+
+// ComposeReply creates reply to message with specified UID. Reply is
+// addressed to message author (Mail-Reply-To, Reply-To or From header, in
+// this order of preference), text of original message is quoted.
+//
+// Reply is sent from identity original message was addressed to (see
+// Identities) or from primary one.
+//
+// Returned message is not saved anywhere, frontend is expected to let user
+// edit it and then pass it to SaveDraft or SendMessage.
+func (c *Client) ComposeReply(accountId, dir string, uid uint32) (*common.Msg, error) {
+	return c.ComposeReplyContext(context.Background(), accountId, dir, uid)
+}
+
+// ComposeReplyContext is like ComposeReply but can be cancelled using ctx (see context.go).
+func (c *Client) ComposeReplyContext(ctx context.Context, accountId, dir string, uid uint32) (*common.Msg, error) {
+	return c.composeReply(ctx, accountId, dir, uid, false)
+}
+
+// ComposeReplyAll is like ComposeReply but reply is addressed to all
+// recipients of original message (except ourselves) or to addresses listed in
+// Mail-Followup-To header, if present and valid.
+func (c *Client) ComposeReplyAll(accountId, dir string, uid uint32) (*common.Msg, error) {
+	return c.ComposeReplyAllContext(context.Background(), accountId, dir, uid)
+}
+
+// ComposeReplyAllContext is like ComposeReplyAll but can be cancelled using ctx (see context.go).
+func (c *Client) ComposeReplyAllContext(ctx context.Context, accountId, dir string, uid uint32) (*common.Msg, error) {
+	return c.composeReply(ctx, accountId, dir, uid, true)
+}
+
+func (c *Client) composeReply(ctx context.Context, accountId, dir string, uid uint32, all bool) (*common.Msg, error) {
+	orig, err := c.GetMsgTextContext(ctx, accountId, dir, uid, true)
+	if err != nil {
+		return nil, err
+	}
+
+	id := c.replyIdentity(accountId, &orig.Msg)
+	res := newMsg(id)
+	res.Subject = prefixSubject("Re: ", orig.Msg.Subject, "re:")
+	res.InReplyTo = orig.Msg.MessageId
+	res.References = replyReferences(&orig.Msg)
+
+	own := c.ownAddresses(accountId)
+	author := replyAuthor(&orig.Msg)
+	if len(author) == 1 && own.Present(strings.ToLower(author[0].Address)) {
+		// Reply to our own message, continue conversation with original
+		// recipients.
+		author = orig.Msg.To
+	}
+
+	var followup []common.Address
+	if hdr := orig.Msg.Misc.Get("Mail-Followup-To"); all && hdr != "" {
+		list, err := common.ConvertAddrList(mail.ParseAddressList(hdr))
+		if err != nil {
+			// Broken header shouldn't prevent reply, all recipients are used instead.
+			c.logger.Printf("Malformed Mail-Followup-To in (%v, %v, %v), ignoring: %v\n", accountId, dir, uid, err)
+		}
+		followup = list
+	}
+
+	if !all {
+		res.To = filterAddrs(author, own, nil)
+	} else if len(followup) != 0 {
+		res.To = filterAddrs(followup, own, nil)
+	} else {
+		seen := make(StrSet)
+		res.To = filterAddrs(append(author, orig.Msg.To...), own, seen)
+		res.Cc = filterAddrs(orig.Msg.Cc, own, seen)
+	}
+
+	text := bodyText(&orig.Msg.Body)
+	quote := fmt.Sprintf("On %v, %v wrote:\n%v", common.MarshalDate(orig.Msg.Date), common.MarshalAddress(orig.Msg.From), quoteText(text))
+	res.Body = textPart("\n\n" + quote + signatureText(id))
+	return res, nil
+}
+
+// ComposeForward creates message that forwards message with specified UID.
+// Recipients are not set, identity is selected like for ComposeReply.
+//
+// Full original message is downloaded from server.
+func (c *Client) ComposeForward(accountId, dir string, uid uint32, mode ForwardMode) (*common.Msg, error) {
+	return c.ComposeForwardContext(context.Background(), accountId, dir, uid, mode)
+}
+
+// ComposeForwardContext is like ComposeForward but can be cancelled using ctx (see context.go).
+func (c *Client) ComposeForwardContext(ctx context.Context, accountId, dir string, uid uint32, mode ForwardMode) (*common.Msg, error) {
+	raw, err := c.fetchRaw(ctx, accountId, dir, uid)
+	if err != nil {
+		return nil, err
+	}
+	orig, err := common.ReadMsg(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("forward %v, %v, %v: %v", accountId, dir, uid, err)
+	}
+
+	id := c.replyIdentity(accountId, orig)
+	res := newMsg(id)
+	res.Subject = prefixSubject("Fwd: ", orig.Subject, "fwd:", "fw:")
+
+	if mode == ForwardAttached {
+		res.Body = common.Part{
+			Type: common.ParametrizedHeader{Value: "multipart/mixed"},
+			Children: []common.Part{
+				textPart(signatureText(id)),
+				{
+					Type: common.ParametrizedHeader{Value: "message/rfc822"},
+					Disposition: common.ParametrizedHeader{
+						Value:  "attachment",
+						Params: map[string]string{"filename": forwardFilename(orig.Subject)},
+					},
+					Body: raw,
+				},
+			},
+		}
+		res.Body.AssignPaths()
+		return res, nil
+	}
+
+	hdr := strings.Builder{}
+	hdr.WriteString("\n\n---------- Forwarded message ----------\n")
+	fmt.Fprintf(&hdr, "From: %v\n", common.MarshalAddress(orig.From))
+	fmt.Fprintf(&hdr, "Date: %v\n", common.MarshalDate(orig.Date))
+	fmt.Fprintf(&hdr, "Subject: %v\n", orig.Subject)
+	fmt.Fprintf(&hdr, "To: %v\n", common.MarshalAddressList(orig.To))
+	if len(orig.Cc) != 0 {
+		fmt.Fprintf(&hdr, "Cc: %v\n", common.MarshalAddressList(orig.Cc))
+	}
+	hdr.WriteString("\n")
+	text := textPart(hdr.String() + bodyText(&orig.Body) + signatureText(id))
+
+	// Text is already included, copy everything else (attachments, inline
+	// images).
+	attachments := []common.Part{}
+	for _, leaf := range orig.Body.Leaves() {
+		if leaf.Disposition.Value != "attachment" && strings.HasPrefix(strings.ToLower(leaf.Type.Value), "text/") {
+			continue
+		}
+		attachments = append(attachments, *leaf)
+	}
+	if len(attachments) == 0 {
+		res.Body = text
+		return res, nil
+	}
+
+	res.Body = common.Part{
+		Type:     common.ParametrizedHeader{Value: "multipart/mixed"},
+		Children: append([]common.Part{text}, attachments...),
+	}
+	res.Body.AssignPaths()
+	return res, nil
+}
+
+func (c *Client) fetchRaw(ctx context.Context, accountId, dir string, uid uint32) ([]byte, error) {
+	c.logger.Printf("Downloading full message (%v, %v, %v)...\n", accountId, dir, uid)
+	var raw []byte
+	var err error
+	err = c.session(accountId).do(ctx, func(conn *imap.Client) error {
+		raw, err = conn.FetchRawContext(ctx, c.rawDirName(accountId, dir), uid)
+		return err
+	})
+	if err != nil {
+		c.logger.Printf("Message download (%v, %v, %v) failed: %v\n", accountId, dir, uid, err)
+		return nil, fmt.Errorf("fetchraw %v, %v, %v: %w", accountId, dir, uid, err)
+	}
+	return raw, nil
+}
+
+// ownAddresses returns set of (lower-cased) addresses that belong to
+// account.
+func (c *Client) ownAddresses(accountId string) StrSet {
+	res := make(StrSet)
+	for _, id := range c.Identities(accountId) {
+		res.Add(strings.ToLower(id.Email))
+	}
+	return res
+}
+
+// replyAuthor returns addresses reply should be sent to.
+func replyAuthor(msg *common.Msg) []common.Address {
+	if mailReplyTo := msg.Misc.Get("Mail-Reply-To"); mailReplyTo != "" {
+		list, err := common.ConvertAddrList(mail.ParseAddressList(mailReplyTo))
+		if err == nil && len(list) != 0 {
+			return list
+		}
+	}
+	if msg.ReplyTo.Address != "" {
+		return []common.Address{msg.ReplyTo}
+	}
+	return []common.Address{msg.From}
+}
+
+// filterAddrs removes own and duplicate addresses from list. If seen is not
+// nil, addresses from it are removed too and remaining ones are added to it.
+func filterAddrs(list []common.Address, own, seen StrSet) []common.Address {
+	if seen == nil {
+		seen = make(StrSet)
+	}
+	res := []common.Address{}
+	for _, addr := range list {
+		key := strings.ToLower(addr.Address)
+		if key == "" || own.Present(key) || seen.Present(key) {
+			continue
+		}
+		seen.Add(key)
+		res = append(res, addr)
+	}
+	return res
+}
+
+// replyReferences returns References list for reply to msg (RFC 5322, section 3.6.4).
+func replyReferences(msg *common.Msg) []string {
+	res := []string{}
+	if len(msg.References) != 0 {
+		res = append(res, msg.References...)
+	} else if msg.InReplyTo != "" {
+		res = append(res, msg.InReplyTo)
+	}
+	if msg.MessageId != "" {
+		res = append(res, msg.MessageId)
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+// prefixSubject adds prefix to subject unless it already starts with one of
+// (lower-case) existing prefixes.
+func prefixSubject(prefix, subject string, existing ...string) string {
+	lower := strings.ToLower(strings.TrimSpace(subject))
+	for _, p := range existing {
+		if strings.HasPrefix(lower, p) {
+			return strings.TrimSpace(subject)
+		}
+	}
+	return prefix + strings.TrimSpace(subject)
+}
+
+// bodyText returns text of first text/plain part (or text/html part with
+// tags stripped if there is no plain text).
+func bodyText(body *common.Part) string {
+	html := ""
+	for _, leaf := range body.Leaves() {
+		if leaf.Body == nil || leaf.Disposition.Value == "attachment" {
+			continue
+		}
+		switch strings.ToLower(leaf.Type.Value) {
+		case "text/plain":
+			return string(leaf.Body)
+		case "text/html":
+			if html == "" {
+				html = common.StripHTMLTags(string(leaf.Body), "")
+			}
+		}
+	}
+	return html
+}
+
+// quoteText prefixes each line of text with "> ".
+func quoteText(text string) string {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, ">") {
+			lines[i] = ">" + line
+		} else {
+			lines[i] = "> " + line
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// forwardFilename returns name of attachment with forwarded message. Subject
+// is used with path separators and control characters replaced, so name is
+// safe to use when attachment is saved to disk.
+func forwardFilename(subject string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '_'
+		case unicode.IsControl(r):
+			return ' '
+		}
+		return r
+	}, subject)
+	// Leading dots would make name hidden or refer to parent directory.
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if name == "" {
+		name = "message"
+	}
+	return name + ".eml"
+}
+
+func textPart(text string) common.Part {
+	return common.Part{
+		Type: common.ParametrizedHeader{
+			Value:  "text/plain",
+			Params: map[string]string{"charset": "utf-8"},
+		},
+		Body: []byte(text),
+	}
+}
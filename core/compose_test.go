@@ -0,0 +1,178 @@
+package core
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	eimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/mailbox/proto/common"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+// addTestMsg stores message from Alice to us and Bob (Carol in Cc) with
+// specified subject and additional headers in INBOX and returns its UID.
+func addTestMsg(t *testing.T, inbox backend.Mailbox, subject string, hdrs map[string]string) uint32 {
+	msg := &common.Msg{
+		Date:      time.Date(2018, 9, 1, 12, 0, 0, 0, time.UTC),
+		Subject:   subject,
+		From:      common.Address{Name: "Alice", Address: "alice@example.org"},
+		To:        []common.Address{{Address: "me@example.org"}, {Address: "bob@example.org"}},
+		Cc:        []common.Address{{Address: "carol@example.org"}},
+		MessageId: "1234@example.org",
+		Misc:      make(common.Header),
+		Body: common.Part{
+			Type:     common.ParametrizedHeader{Value: "multipart/mixed"},
+			Children: []common.Part{textPart("See you\nat noon\n")},
+		},
+	}
+	msg.Body.AssignPaths()
+	for k, v := range hdrs {
+		msg.Misc.Add(k, v)
+	}
+	status, err := inbox.Status([]eimap.StatusItem{eimap.StatusUidNext})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.Buffer{}
+	if err := msg.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := inbox.CreateMessage(nil, msg.Date, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return status.UidNext
+}
+
+// newComposeTestClient returns test client (see newTestClient) with our
+// address set and INBOX of server.
+func newComposeTestClient(t *testing.T) (*Client, backend.Mailbox) {
+	be := newTestBackend()
+	user, err := be.Login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestClient(t, be)
+	c.Accounts[testAccount] = storage.AccountCfg{
+		SenderName:  "Me",
+		SenderEmail: "me@example.org",
+	}
+	if err := c.cache(testAccount).AddDir("INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	return c, inbox
+}
+
+func addrList(list []common.Address) string {
+	res := make([]string, len(list))
+	for i, addr := range list {
+		res[i] = addr.Address
+	}
+	return strings.Join(res, " ")
+}
+
+func TestComposeReply(t *testing.T) {
+	c, inbox := newComposeTestClient(t)
+	plain := addTestMsg(t, inbox, "Lunch", nil)
+	followup := addTestMsg(t, inbox, "Lunch", map[string]string{"Mail-Followup-To": "list@example.org"})
+	malformed := addTestMsg(t, inbox, "Lunch", map[string]string{"Mail-Followup-To": "<<broken"})
+
+	reply, err := c.ComposeReply(testAccount, "INBOX", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Subject != "Re: Lunch" {
+		t.Errorf("Wrong subject: %q", reply.Subject)
+	}
+	if reply.From.Address != "me@example.org" {
+		t.Errorf("Wrong identity used: %v", reply.From)
+	}
+	if reply.InReplyTo != "1234@example.org" || len(reply.References) != 1 || reply.References[0] != "1234@example.org" {
+		t.Errorf("Wrong In-Reply-To or References: %q, %q", reply.InReplyTo, reply.References)
+	}
+	if to := addrList(reply.To); to != "alice@example.org" || len(reply.Cc) != 0 {
+		t.Errorf("Wrong recipients: %v, cc %v", to, addrList(reply.Cc))
+	}
+	if text := string(reply.Body.Body); !strings.Contains(text, "> See you\n> at noon\n") {
+		t.Errorf("Original text is not quoted: %q", text)
+	}
+
+	cases := []struct {
+		name   string
+		uid    uint32
+		to, cc string
+	}{
+		{"all recipients", plain, "alice@example.org bob@example.org", "carol@example.org"},
+		{"Mail-Followup-To", followup, "list@example.org", ""},
+		{"malformed Mail-Followup-To", malformed, "alice@example.org bob@example.org", "carol@example.org"},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			reply, err := c.ComposeReplyAll(testAccount, "INBOX", cs.uid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if to, cc := addrList(reply.To), addrList(reply.Cc); to != cs.to || cc != cs.cc {
+				t.Errorf("Wrong recipients: %v, cc %v (expected %v, cc %v)", to, cc, cs.to, cs.cc)
+			}
+		})
+	}
+}
+
+func TestComposeForward(t *testing.T) {
+	c, inbox := newComposeTestClient(t)
+	uid := addTestMsg(t, inbox, "../reports/q3", nil)
+
+	fwd, err := c.ComposeForward(testAccount, "INBOX", uid, ForwardAttached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fwd.Subject != "Fwd: ../reports/q3" || len(fwd.To) != 0 {
+		t.Errorf("Wrong subject or recipients: %q, %v", fwd.Subject, addrList(fwd.To))
+	}
+	if len(fwd.Body.Children) != 2 {
+		t.Fatalf("Expected 2 parts, got %+v", fwd.Body)
+	}
+	attachment := fwd.Body.Children[1]
+	if attachment.Type.Value != "message/rfc822" || !strings.Contains(string(attachment.Body), "See you") {
+		t.Errorf("Original message is not attached: %+v", attachment)
+	}
+	if name := attachment.Disposition.Params["filename"]; name != "_reports_q3.eml" {
+		t.Errorf("Wrong attachment name: %q", name)
+	}
+
+	fwd, err = c.ComposeForward(testAccount, "INBOX", uid, ForwardInline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(fwd.Body.Body)
+	if !strings.Contains(text, "Forwarded message") || !strings.Contains(text, "See you\nat noon") {
+		t.Errorf("Original text is not included: %q", text)
+	}
+}
+
+func TestForwardFilename(t *testing.T) {
+	cases := []struct {
+		subject, name string
+	}{
+		{"Report", "Report.eml"},
+		{"", "message.eml"},
+		{" \t", "message.eml"},
+		{"..", "message.eml"},
+		{"a/b\\c", "a_b_c.eml"},
+		{"../../etc/passwd", "_.._etc_passwd.eml"},
+		{"line\r\nbreak\x00", "line  break.eml"},
+	}
+	for _, cs := range cases {
+		if name := forwardFilename(cs.subject); name != cs.name {
+			t.Errorf("%q: got %q (expected %q)", cs.subject, name, cs.name)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"path/filepath"
 
 	"github.com/foxcpp/mailbox/storage"
@@ -20,23 +21,47 @@ func (c *Client) AddAccount(name string, conf storage.AccountCfg) {
 // UnloadAccount is called automatically to clean-up partially initialized account
 // in case of error.
 func (c *Client) LoadAccount(name string, conf storage.AccountCfg) *AccountError {
+	return c.LoadAccountContext(context.Background(), name, conf)
+}
+
+// LoadAccountContext is like LoadAccount but can be cancelled using ctx (see context.go).
+func (c *Client) LoadAccountContext(ctx context.Context, name string, conf storage.AccountCfg) *AccountError {
+	c.stateLock.Lock()
 	c.Accounts[name] = conf
-	c.prepareServerConfig(name)
+	c.fileCfgs[name] = conf
+	c.stateLock.Unlock()
+	if err := c.prepareServerConfig(name); err != nil {
+		c.UnloadAccount(name)
+		return &AccountError{name, err}
+	}
 
-	var dberr error
-	c.caches[name], dberr = storage.OpenCacheDB(filepath.Join(storage.GetDirectory(), "accounts", name+".db"))
+	cache, dberr := storage.OpenCacheDB(filepath.Join(storage.GetDirectory(), "accounts", name+".db"))
 	if dberr != nil {
 		c.UnloadAccount(name)
 		return &AccountError{name, dberr}
 	}
 
-	err := c.connectToServer(name)
+	s := newSession(c, name)
+	c.stateLock.Lock()
+	c.caches[name] = cache
+	c.sessions[name] = s
+	c.stateLock.Unlock()
+	err := s.connect(ctx)
 	if err != nil {
 		c.UnloadAccount(name)
 		return err
 	}
-	c.prefetchData(name)
-	// TODO: c.setSpecialUseDirs()
+	c.setSpecialUseDirs(ctx, name)
+	c.prefetchData(ctx, name)
+	c.replayJournal(ctx, name)
+	if err := ctx.Err(); err != nil {
+		// Don't leave account half-initialized (special directories may
+		// be not detected).
+		c.UnloadAccount(name)
+		return &AccountError{name, err}
+	}
+	c.startOutbox(name)
+	c.startMonitor(name)
 
 	return nil
 }
@@ -46,23 +71,28 @@ func (c *Client) LoadAccount(name string, conf storage.AccountCfg) *AccountError
 // After this operation account no longer can be used in any Client methods
 // before corresponding LoadAccount or Client restart.
 func (c *Client) UnloadAccount(name string) {
+	c.stopOutbox(name)
+	c.stopMonitor(name)
+
+	c.stateLock.Lock()
 	conn := c.imapConns[name]
 	delete(c.imapConns, name)
+	delete(c.sessions, name)
+	cache := c.caches[name]
+	delete(c.caches, name)
+	delete(c.Accounts, name)
+	delete(c.fileCfgs, name)
+	delete(c.serverCfgs, name)
+	delete(c.prefetchDirs, name)
+	c.stateLock.Unlock()
+
 	if conn != nil {
 		conn.Close()
 	}
-
-	cache := c.caches[name]
-	delete(c.caches, name)
 	if cache != nil {
 		cache.Close()
 	}
-
-	delete(c.Accounts, name)
-	delete(c.serverCfgs, name)
-
 	c.imapDirSep.Delete(name)
-	delete(c.prefetchDirs, name)
 }
 
 // DeleteAccount deletes account from configuration.
@@ -70,3 +100,27 @@ func (c *Client) DeleteAccount(name string) error {
 	c.UnloadAccount(name)
 	return storage.DeleteAccount(name)
 }
+
+// EffectiveConfig returns global configuration with overrides from account
+// configuration applied.
+//
+// Encryption section is always taken from global configuration since master
+// key is shared by all accounts (storage.LoadAccount rejects overrides for
+// it).
+func (c *Client) EffectiveConfig(accountId string) storage.GlobalCfg {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	res := c.GlobalCfg.Override(c.Accounts[accountId].Overrides)
+	res.Encryption = c.GlobalCfg.Encryption
+	return res
+}
+
+// maxTries returns amount of attempts to perform operation before giving up
+// for account.
+func (c *Client) maxTries(accountId string) int {
+	tries := *c.EffectiveConfig(accountId).Connection.MaxTries
+	if tries < 1 {
+		return 1
+	}
+	return tries
+}
@@ -0,0 +1,47 @@
+package core
+
+import (
+	"context"
+	"errors"
+)
+
+/*
+Cancellation.
+
+Each Client method that may perform network I/O has context-aware variant
+(FooContext for each Foo). When context is cancelled or its deadline
+expires, in-flight I/O is aborted (see proto/imap/context.go), retry loops
+are stopped and error for which errors.Is(err, ctx.Err()) is true is
+returned.
+
+Cache is updated only after server confirmed operation, so it's never left
+in partially updated state. Server state is unknown after cancellation of
+mutating operation (server may have received command), so affected
+directories are re-synchronized in background. Cancelled operations are
+never recorded in offline journal.
+
+Connection closed to abort operation is restored transparently by the next
+operation or by IDLE goroutine.
+*/
+
+// resyncCancelled re-synchronizes directories affected by cancelled
+// operation since it's unknown whether server received it.
+func (c *Client) resyncCancelled(accountId, op, dir string, args offlineOp) {
+	ctx := context.Background()
+	switch op {
+	case opCreateDir, opRemoveDir, opMoveDir, opRenameDir:
+		if _, err := c.GetDirsContext(ctx, accountId, true); err != nil {
+			c.debugLog.Printf("Directory list reload after cancellation (%v) failed: %v\n", accountId, err)
+		}
+		return
+	}
+	c.reloadMaillist(ctx, accountId, dir)
+	if args.ToDir != "" {
+		c.reloadMaillist(ctx, accountId, args.ToDir)
+	}
+}
+
+// ctxError reports whether err is caused by cancelled context.
+func ctxError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
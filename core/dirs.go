@@ -1,8 +1,11 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"strings"
+
+	"github.com/foxcpp/mailbox/proto/imap"
 )
 
 /*
@@ -41,34 +44,36 @@ func (c *Client) joinWithParentDir(parentDir, childDir string) string {
 //
 // To create directory with root as parent pass "" as parentDir.
 // Invalid account ID will lead to error.
+//
+// If server is not reachable, directory is added to cache and created later
+// (see journal.go).
 func (c *Client) CreateDir(accountId, parentDir, newDir string) error {
+	return c.CreateDirContext(context.Background(), accountId, parentDir, newDir)
+}
+
+// CreateDirContext is like CreateDir but can be cancelled using ctx (see context.go).
+func (c *Client) CreateDirContext(ctx context.Context, accountId, parentDir, newDir string) error {
 	if strings.Contains(newDir, "|") {
 		return errors.New("create dir: dir name may not contain |")
 	}
 
 	c.debugLog.Printf("Creating directory (%v, %v, %v)...\n", accountId, parentDir, newDir)
 
-	var err error
-	for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-		err = c.imapConns[accountId].CreateDir(c.rawDirName(accountId, c.joinWithParentDir(parentDir, newDir)))
-		if err == nil || !connectionError(err) {
-			break
-		}
-		if err := c.connectToServer(accountId); err != nil {
-			return err
-		}
-	}
+	dirName := c.joinWithParentDir(parentDir, newDir)
+	_, err := c.runOrQueue(ctx, accountId, opCreateDir, dirName, offlineOp{}, func(conn *imap.Client) error {
+		return conn.CreateDirContext(ctx, c.rawDirName(accountId, dirName))
+	})
 	if err != nil {
 		c.debugLog.Printf("CreateSubdir failed (%v, %v, %v): %v\n", accountId, parentDir, newDir, err)
 	} else {
 		// Add all parents to cache (AddDir no-op if dirs already exist).
 		splittenDirname := c.splitDirName(parentDir)
 		for len(splittenDirname) != 0 {
-			c.caches[accountId].AddDir(c.joinDirName(splittenDirname))
+			c.cache(accountId).AddDir(c.joinDirName(splittenDirname))
 			splittenDirname = splittenDirname[:len(splittenDirname)-1]
 		}
 
-		c.caches[accountId].AddDir(c.joinWithParentDir(parentDir, newDir))
+		c.cache(accountId).AddDir(c.joinWithParentDir(parentDir, newDir))
 	}
 	return err
 }
@@ -79,7 +84,15 @@ func (c *Client) CreateDir(accountId, parentDir, newDir string) error {
 //
 // To remove directory from tree root pass "" as parentDir.
 // Invalid account ID will lead to error.
+//
+// If server is not reachable, directory is removed from cache and from server
+// later (see journal.go).
 func (c *Client) RemoveDir(accountId, parentDir, dir string) error {
+	return c.RemoveDirContext(context.Background(), accountId, parentDir, dir)
+}
+
+// RemoveDirContext is like RemoveDir but can be cancelled using ctx (see context.go).
+func (c *Client) RemoveDirContext(ctx context.Context, accountId, parentDir, dir string) error {
 	// TODO: Remove children directories.
 
 	c.debugLog.Printf("Removing directory (%v, %v, %v)...\n", accountId, parentDir, dir)
@@ -89,22 +102,14 @@ func (c *Client) RemoveDir(accountId, parentDir, dir string) error {
 		return errors.New("remove dir: can't remove INBOX")
 	}
 
-	var err error
-
-	for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-		err = c.imapConns[accountId].RemoveDir(c.rawDirName(accountId, dirName))
-		if err == nil || !connectionError(err) {
-			break
-		}
-		if err := c.connectToServer(accountId); err != nil {
-			return err
-		}
-	}
+	_, err := c.runOrQueue(ctx, accountId, opRemoveDir, dirName, offlineOp{}, func(conn *imap.Client) error {
+		return conn.RemoveDirContext(ctx, c.rawDirName(accountId, dirName))
+	})
 
 	if err != nil {
 		c.debugLog.Printf("RemoveSubdir failed (%v, %v, %v): %v\n", accountId, parentDir, dir, err)
 	} else {
-		c.caches[accountId].RemoveDir(dirName)
+		c.cache(accountId).RemoveDir(dirName)
 	}
 	return err
 }
@@ -117,27 +122,26 @@ func (c *Client) RemoveDir(accountId, parentDir, dir string) error {
 // It's recommended to temporary block UI during this operation to avoid race
 // conditions (user trying to interact using old directory name while moving
 // is in progress).
+//
+// If server is not reachable, directory is renamed in cache and on server
+// later (see journal.go).
 func (c *Client) MoveDir(accountId, oldParentDir, newParentDir, dir string) error {
+	return c.MoveDirContext(context.Background(), accountId, oldParentDir, newParentDir, dir)
+}
+
+// MoveDirContext is like MoveDir but can be cancelled using ctx (see context.go).
+func (c *Client) MoveDirContext(ctx context.Context, accountId, oldParentDir, newParentDir, dir string) error {
 	c.debugLog.Printf("Moving directory (%v, %v from %v to %v)...\n", accountId, dir, oldParentDir, newParentDir)
 	fromNorm := c.joinWithParentDir(oldParentDir, dir)
-	fromRaw := c.rawDirName(accountId, fromNorm)
-	toRaw := c.rawDirName(accountId, c.joinWithParentDir(newParentDir, dir))
-
-	var err error
-	for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-		err = c.imapConns[accountId].RenameDir(fromRaw, toRaw)
-		if err == nil || !connectionError(err) {
-			break
-		}
-		if err := c.connectToServer(accountId); err != nil {
-			return err
-		}
-	}
+	toNorm := c.joinWithParentDir(newParentDir, dir)
 
+	_, err := c.runOrQueue(ctx, accountId, opMoveDir, fromNorm, offlineOp{ToDir: toNorm}, func(conn *imap.Client) error {
+		return conn.RenameDirContext(ctx, c.rawDirName(accountId, fromNorm), c.rawDirName(accountId, toNorm))
+	})
 	if err != nil {
 		c.debugLog.Printf("MoveDir failed (%v, %v from %v to %v): %v\n", accountId, dir, oldParentDir, newParentDir, err)
 	} else {
-		c.caches[accountId].RenameDir(fromNorm, c.joinWithParentDir(newParentDir, dir))
+		c.cache(accountId).RenameDir(fromNorm, toNorm)
 	}
 	return err
 }
@@ -147,28 +151,30 @@ func (c *Client) MoveDir(accountId, oldParentDir, newParentDir, dir string) erro
 // It's recommended to temporary block UI during this operation to avoid race
 // conditions (user trying to interact using old directory name while renaming
 // is in progress).
+//
+// If server is not reachable, directory is renamed in cache and on server
+// later (see journal.go).
 func (c *Client) RenameDir(accountId, oldName, newName string) error {
+	return c.RenameDirContext(context.Background(), accountId, oldName, newName)
+}
+
+// RenameDirContext is like RenameDir but can be cancelled using ctx (see context.go).
+func (c *Client) RenameDirContext(ctx context.Context, accountId, oldName, newName string) error {
 	if strings.Contains(newName, "|") {
 		return errors.New("rename dir: dir name may not contain |")
 	}
 
 	c.debugLog.Printf("Renaming directory (%v, from %v to %v)...\n", accountId, oldName, newName)
 
-	var err error
-	for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-		err = c.imapConns[accountId].RenameDir(c.rawDirName(accountId, oldName), c.rawDirName(accountId, newName))
-		if err == nil || !connectionError(err) {
-			break
-		}
-		if err := c.connectToServer(accountId); err != nil {
-			return err
-		}
-	}
+	// Same operation as MoveDir on server side.
+	_, err := c.runOrQueue(ctx, accountId, opRenameDir, oldName, offlineOp{ToDir: newName}, func(conn *imap.Client) error {
+		return conn.RenameDirContext(ctx, c.rawDirName(accountId, oldName), c.rawDirName(accountId, newName))
+	})
 
 	if err != nil {
 		c.debugLog.Printf("RenameDir failed (%v, from %v to %v): %v\n", accountId, oldName, newName, err)
 	} else {
-		c.caches[accountId].RenameDir(oldName, newName)
+		c.cache(accountId).RenameDir(oldName, newName)
 	}
 	return err
 }
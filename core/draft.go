@@ -1,34 +1,50 @@
 package core
 
 import (
+	"bytes"
+	"context"
 	"time"
 
 	"github.com/foxcpp/mailbox/proto/common"
+	"github.com/foxcpp/mailbox/proto/imap"
 	"github.com/foxcpp/mailbox/proto/smtp"
+	"github.com/foxcpp/mailbox/storage"
 )
 
 // SaveDraft saves "draft" message to account's draft directory.
 //
 // draft argument must not be null. Invalid accountId leads to undefined behavior (probably panic).
 //
-// UID of saved message is returned.
+// UID of saved message is returned. If server is not reachable, draft will be
+// saved later (see journal.go) and zero UID is returned, until then draft is
+// present in cache with temporary UID.
 func (c *Client) SaveDraft(accountId string, draft *common.Msg) (uint32, error) {
-	draftDir := c.Accounts[accountId].Dirs.Drafts
+	return c.SaveDraftContext(context.Background(), accountId, draft)
+}
 
-	var uid uint32
-	var err error
-	for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-		uid, err = c.imapConns[accountId].Create(c.rawDirName(accountId, draftDir), []string{`\Draft`}, time.Now(), draft)
-		if err == nil || !connectionError(err) {
-			break
-		}
-		if err := c.connectToServer(accountId); err != nil {
-			return 0, err
-		}
+// SaveDraftContext is like SaveDraft but can be cancelled using ctx (see context.go).
+func (c *Client) SaveDraftContext(ctx context.Context, accountId string, draft *common.Msg) (uint32, error) {
+	draftDir := c.account(accountId).Dirs.Drafts
+
+	buf := bytes.Buffer{}
+	if err := draft.Write(&buf); err != nil {
+		return 0, err
 	}
+
+	var uid uint32
+	localUid := c.newLocalUid(accountId, draftDir)
+	queued, err := c.runOrQueue(ctx, accountId, opSaveDraft, draftDir, offlineOp{Msg: buf.Bytes(), LocalUid: localUid}, func(conn *imap.Client) error {
+		var err error
+		uid, err = conn.CreateContext(ctx, c.rawDirName(accountId, draftDir), []string{`\Draft`}, time.Now(), draft)
+		return err
+	})
 	if err != nil {
 		return 0, err
 	}
+	if queued {
+		c.cacheQueuedDraft(accountId, draftDir, localUid, draft)
+		return 0, nil
+	}
 
 	// Server is free to modify message somehow so we can't just
 	// add message to cache. Fortunately, drafts directory rarely
@@ -36,7 +52,7 @@ func (c *Client) SaveDraft(accountId string, draft *common.Msg) (uint32, error)
 	//
 	// TODO: Do servers actually modify messages? Is there anything
 	// we can't predict (like, flags automatically set by server)?
-	c.reloadMaillist(accountId, draftDir)
+	c.reloadMaillist(ctx, accountId, draftDir)
 
 	return uid, nil
 }
@@ -47,25 +63,39 @@ func (c *Client) SaveDraft(accountId string, draft *common.Msg) (uint32, error)
 //
 // Old message is removed and new one is created because IMAP doesn't allows to change existing
 // messages. If error happens - older message is preserved.
+//
+// If server is not reachable, old draft is replaced in cache using temporary
+// UID, new one will be saved later (see journal.go) and zero UID is returned.
 func (c *Client) UpdateDraft(accountId string, oldUid uint32, new *common.Msg) (uint32, error) {
-	draftDir := c.Accounts[accountId].Dirs.Drafts
+	return c.UpdateDraftContext(context.Background(), accountId, oldUid, new)
+}
 
-	var uid uint32
-	var err error
-	for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-		uid, err = c.imapConns[accountId].Replace(c.rawDirName(accountId, draftDir), oldUid, []string{`\Draft`}, time.Now(), new)
-		if err == nil || !connectionError(err) {
-			break
-		}
-		if err := c.connectToServer(accountId); err != nil {
-			return 0, err
-		}
+// UpdateDraftContext is like UpdateDraft but can be cancelled using ctx (see context.go).
+func (c *Client) UpdateDraftContext(ctx context.Context, accountId string, oldUid uint32, new *common.Msg) (uint32, error) {
+	draftDir := c.account(accountId).Dirs.Drafts
+
+	buf := bytes.Buffer{}
+	if err := new.Write(&buf); err != nil {
+		return 0, err
 	}
+
+	var uid uint32
+	localUid := c.newLocalUid(accountId, draftDir)
+	queued, err := c.runOrQueue(ctx, accountId, opUpdateDraft, draftDir, offlineOp{Uids: []uint32{oldUid}, Msg: buf.Bytes(), LocalUid: localUid}, func(conn *imap.Client) error {
+		var err error
+		uid, err = conn.ReplaceContext(ctx, c.rawDirName(accountId, draftDir), oldUid, []string{`\Draft`}, time.Now(), new)
+		return err
+	})
 	if err != nil {
 		return 0, err
 	}
+	if queued {
+		c.cache(accountId).Dir(draftDir).DelMsg(oldUid)
+		c.cacheQueuedDraft(accountId, draftDir, localUid, new)
+		return 0, nil
+	}
 
-	c.reloadMaillist(accountId, draftDir)
+	c.reloadMaillist(ctx, accountId, draftDir)
 
 	return uid, nil
 }
@@ -73,45 +103,97 @@ func (c *Client) UpdateDraft(accountId string, oldUid uint32, new *common.Msg) (
 // SendMessage of course... Sends message!
 //
 // Recipient and other important information is parsed from message headers.
+// Message is delivered to all To, Cc and Bcc recipients, Bcc header is stripped
+// from transmitted copy but preserved in copy placed in Sent directory.
 // Function will return UID of message copy placed in Sent directory, if any
 // and zero if user disabled this.
+//
+// If server rejected only some recipients, message is still copied to Sent
+// directory and smtp.RejectedRcptsError is returned together with UID.
+//
+// If SMTP server is not reachable or temporarily rejected message, it is
+// placed in outbox to be delivered later (see outbox.go) and zero UID is
+// returned without error.
+//
+// ErrUnknownSender is returned if From doesn't match any of account
+// identities (see Identities). Options of matching identity (Bcc to self,
+// directory for sent messages) are applied.
 func (c *Client) SendMessage(accountId string, msg *common.Msg) (uint32, error) {
+	return c.SendMessageContext(context.Background(), accountId, msg)
+}
+
+// SendMessageContext is like SendMessage but can be cancelled using ctx (see context.go).
+func (c *Client) SendMessageContext(ctx context.Context, accountId string, msg *common.Msg) (uint32, error) {
+	msg, err := c.prepareOutgoing(accountId, msg)
+	if err != nil {
+		return 0, err
+	}
+
+	sendErr := c.deliver(ctx, accountId, msg)
+	if sendErr != nil {
+		rcptErr, ok := sendErr.(smtp.RejectedRcptsError)
+		if ok && rcptErr.Delivered {
+			c.logger.Println("Some recipients were rejected:", sendErr)
+		} else if !ctxError(sendErr) && retryableSendError(sendErr) {
+			id, err := c.queueMessage(accountId, msg, storage.OutboxEntry{
+				Attempts:    1,
+				NextAttempt: time.Now().Add(outboxDelay(1)),
+				LastError:   sendErr.Error(),
+			})
+			if err != nil {
+				return 0, err
+			}
+			c.logger.Printf("Message is placed in outbox (%v, %v): %v\n", accountId, id, sendErr)
+			return 0, nil
+		} else {
+			return 0, sendErr
+		}
+	}
+
+	return c.copyToSent(ctx, accountId, msg), sendErr
+}
+
+// deliver submits message to account's SMTP server.
+func (c *Client) deliver(ctx context.Context, accountId string, msg *common.Msg) error {
 	c.logger.Printf("Connecting to SMTP server (%v:%v)...\n",
-		c.serverCfgs[accountId].smtp.Host,
-		c.serverCfgs[accountId].smtp.Port)
-	client, err := smtp.Connect(c.serverCfgs[accountId].smtp)
+		c.serverCfg(accountId).smtp.Host,
+		c.serverCfg(accountId).smtp.Port)
+	client, err := smtp.ConnectContext(ctx, c.serverCfg(accountId).smtp)
 	if err != nil {
 		c.logger.Println("Connection failed:", err)
-		return 0, err
+		return err
 	}
 	c.logger.Println("Authenticating to SMTP server...")
-	err = client.Auth(c.serverCfgs[accountId].smtp)
+	err = client.AuthContext(ctx, c.serverCfg(accountId).smtp)
 	if err != nil {
 		c.logger.Println("Authentication failed:", err)
-		return 0, err
+		client.Close()
+		return err
 	}
 
-	err = client.Send(*msg)
-	if err != nil {
-		return 0, err
+	err = client.SendContext(ctx, *msg)
+	client.Close()
+	return err
+}
+
+// copyToSent places copy of sent message in Sent directory if enabled and
+// returns its UID.
+//
+// Message is already sent, so failure to save copy is only logged.
+func (c *Client) copyToSent(ctx context.Context, accountId string, msg *common.Msg) uint32 {
+	if !*c.account(accountId).CopyToSent {
+		return 0
 	}
 
-	if *c.Accounts[accountId].CopyToSent {
-		var uid uint32
-		var err error
-		for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-			uid, err = c.imapConns[accountId].Create(c.rawDirName(accountId, c.Accounts[accountId].Dirs.Sent), []string{`\Seen`}, time.Now(), msg)
-			if err == nil || !connectionError(err) {
-				break
-			}
-			if err := c.connectToServer(accountId); err != nil {
-				return 0, err
-			}
-		}
-		if err != nil {
-			c.logger.Printf("Failed to copy message to Sent (%v) directory: %v", c.Accounts[accountId].Dirs.Sent, err)
-		}
-		return uid, nil
+	sentDir := c.sentDir(accountId, msg.From.Address)
+	var uid uint32
+	var err error
+	err = c.session(accountId).do(ctx, func(conn *imap.Client) error {
+		uid, err = conn.CreateContext(ctx, c.rawDirName(accountId, sentDir), []string{`\Seen`}, time.Now(), msg)
+		return err
+	})
+	if err != nil {
+		c.logger.Printf("Failed to copy message to Sent (%v) directory: %v", sentDir, err)
 	}
-	return 0, nil
+	return uid
 }
@@ -7,6 +7,8 @@ import (
 	"crypto/subtle"
 	"encoding/hex"
 	"errors"
+
+	"github.com/foxcpp/mailbox/proto/common"
 	"github.com/foxcpp/mailbox/storage"
 
 	"github.com/foxcpp/go-sysid"
@@ -53,21 +55,40 @@ func (c *Client) ChangeMasterPass(pass string) error {
 	// NOTE: For master key initalization on client startup use prepareMasterKey
 	// directly.
 	havePass := pass != ""
-	c.GlobalCfg.Encryption.UseMasterPass = &havePass
-	c.GlobalCfg.Encryption.MasterKeySalt = "" // prepareMasterKey will generate new salt.
+	c.updateGlobalCfg(func(cfg *storage.GlobalCfg) {
+		cfg.Encryption.UseMasterPass = &havePass
+		cfg.Encryption.MasterKeySalt = "" // prepareMasterKey will generate new salt.
+	})
 
 	if err := c.prepareMasterKey(pass); err != nil {
 		return err
 	}
 
 	// Re-encrypt all things.
+	c.stateLock.RLock()
+	serverCfgs := make(map[string]serverConfig, len(c.serverCfgs))
 	for acc, conf := range c.serverCfgs {
-		cfg := c.Accounts[acc]
-		cfg.Credentials.Pass = hex.EncodeToString(c.EncryptUsingMaster([]byte(conf.imap.Pass)))
-		c.Accounts[acc] = cfg
+		serverCfgs[acc] = conf
+	}
+	c.stateLock.RUnlock()
+	for acc, conf := range serverCfgs {
+		encPass := hex.EncodeToString(c.EncryptUsingMaster([]byte(conf.imap.Pass)))
+		encToken := ""
+		if src, ok := conf.imap.Token.(*common.RefreshTokenSource); ok {
+			encToken = hex.EncodeToString(c.EncryptUsingMaster([]byte(src.RefreshToken())))
+		}
+		fileCfg, ok := c.updateAccount(acc, func(cfg *storage.AccountCfg) {
+			cfg.Credentials.Pass = encPass
+			if encToken != "" {
+				cfg.Credentials.OAuth.RefreshToken = encToken
+			}
+		})
+		if !ok {
+			continue
+		}
 
 		// Write new encrypted password to file.
-		storage.SaveAccount(acc, c.Accounts[acc])
+		storage.SaveAccount(acc, fileCfg)
 	}
 
 	/*
@@ -91,20 +112,23 @@ func (c *Client) prepareMasterKey(pass string) error {
 
 	// TODO: Way to check if password is correct.
 
-	if c.GlobalCfg.Encryption.MasterKeySalt == "" {
+	cfg := c.globalCfg()
+	if cfg.Encryption.MasterKeySalt == "" {
 		salt := make([]byte, 64)
 		_, err := rand.Read(salt)
 		if err != nil {
 			return err
 		}
-		c.GlobalCfg.Encryption.MasterKeySalt = hex.EncodeToString(salt)
-		if err := storage.SaveGlobal(&c.GlobalCfg); err != nil {
+		cfg = c.updateGlobalCfg(func(cfg *storage.GlobalCfg) {
+			cfg.Encryption.MasterKeySalt = hex.EncodeToString(salt)
+		})
+		if err := storage.SaveGlobal(&cfg); err != nil {
 			c.logger.Println("Failed to write new master key salt to config. Aborting.")
 			return err
 		}
 	}
 
-	salt, err := hex.DecodeString(c.GlobalCfg.Encryption.MasterKeySalt)
+	salt, err := hex.DecodeString(cfg.Encryption.MasterKeySalt)
 	if err != nil {
 		return ErrInvalidSalt
 	}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"github.com/foxcpp/mailbox/proto/common"
 	"github.com/foxcpp/mailbox/proto/imap"
@@ -21,7 +22,12 @@ import (
 // Function arguments are NOT checked for validity, invalid account ID will
 // lead to undefined behavior (usually panic).
 func (c *Client) GetDirs(accountId string, forceUpdate bool) (StrSet, error) {
-	list, err := c.caches[accountId].DirList()
+	return c.GetDirsContext(context.Background(), accountId, forceUpdate)
+}
+
+// GetDirsContext is like GetDirs but can be cancelled using ctx (see context.go).
+func (c *Client) GetDirsContext(ctx context.Context, accountId string, forceUpdate bool) (StrSet, error) {
+	list, err := c.cache(accountId).DirList()
 	if err != nil {
 		return nil, err
 	}
@@ -38,33 +44,29 @@ func (c *Client) GetDirs(accountId string, forceUpdate bool) (StrSet, error) {
 	c.debugLog.Printf("Downloading directories list for %v...\n", accountId)
 	// Cache miss, go and ask server.
 	var separator string
-	for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-		separator, list, err = c.imapConns[accountId].DirList()
-		if err == nil || !connectionError(err) {
-			break
-		}
-		if err := c.connectToServer(accountId); err != nil {
-			return nil, err
-		}
-	}
+	var infos []imap.DirInfo
+	err = c.session(accountId).do(ctx, func(conn *imap.Client) error {
+		separator, infos, err = conn.DirListContext(ctx)
+		return err
+	})
 	if err != nil {
 		c.logger.Printf("Directories list download (%v) failed: %v\n", accountId, err)
-		return nil, fmt.Errorf("dirs %v: %v", accountId, err)
+		return nil, fmt.Errorf("dirs %v: %w", accountId, err)
 	}
 
 	c.imapDirSep.Store(accountId, separator)
 	resSet := make(StrSet)
-	for _, name := range list {
-		c.caches[accountId].AddDir(c.normalizeDirName(accountId, name))
-		resSet.Add(c.normalizeDirName(accountId, name))
+	for _, info := range infos {
+		c.cache(accountId).AddDir(c.normalizeDirName(accountId, info.Name))
+		resSet.Add(c.normalizeDirName(accountId, info.Name))
 	}
-	cached, err := c.caches[accountId].DirList()
+	cached, err := c.cache(accountId).DirList()
 	if err != nil {
 		return nil, err
 	}
 	for _, dir := range cached {
 		if !resSet.Present(dir) {
-			if err := c.caches[accountId].RemoveDir(dir); err != nil {
+			if err := c.cache(accountId).RemoveDir(dir); err != nil {
 				return nil, err
 			}
 		}
@@ -79,7 +81,12 @@ func (c *Client) GetDirs(accountId string, forceUpdate bool) (StrSet, error) {
 // Function arguments are NOT checked for validity, invalid account ID or
 // directory name will lead to undefined behavior (usually panic).
 func (c *Client) GetUnreadCount(accountId, dirName string) (uint, error) {
-	count, err := c.caches[accountId].Dir(dirName).UnreadCount()
+	return c.GetUnreadCountContext(context.Background(), accountId, dirName)
+}
+
+// GetUnreadCountContext is like GetUnreadCount but can be cancelled using ctx (see context.go).
+func (c *Client) GetUnreadCountContext(ctx context.Context, accountId, dirName string) (uint, error) {
+	count, err := c.cache(accountId).Dir(dirName).UnreadCount()
 	if err != nil {
 		// Cache hit!
 		return count, nil
@@ -87,22 +94,17 @@ func (c *Client) GetUnreadCount(accountId, dirName string) (uint, error) {
 
 	var status *imap.DirStatus
 	// Cache miss, go and ask server.
-	for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-		status, err = c.imapConns[accountId].Status(c.rawDirName(accountId, dirName))
-		if err == nil || !connectionError(err) {
-			break
-		}
-		if err := c.connectToServer(accountId); err != nil {
-			return 0, err
-		}
-	}
+	err = c.session(accountId).do(ctx, func(conn *imap.Client) error {
+		status, err = conn.StatusContext(ctx, c.rawDirName(accountId, dirName))
+		return err
+	})
 	if err != nil {
 		c.logger.Printf("Directories status download (%v, %v) failed: %v\n", accountId, dirName, err)
-		return 0, fmt.Errorf("unreadcount %v, %v: %v", accountId, dirName, err)
+		return 0, fmt.Errorf("unreadcount %v, %v: %w", accountId, dirName, err)
 	}
 
 	count = uint(status.Unseen)
-	c.caches[accountId].Dir(dirName).SetUnreadCount(count)
+	c.cache(accountId).Dir(dirName).SetUnreadCount(count)
 
 	return count, nil
 }
@@ -115,12 +117,17 @@ func (c *Client) GetUnreadCount(accountId, dirName string) (uint, error) {
 // Function arguments are NOT checked for validity, invalid account ID or
 // directory name will lead to undefined behavior (probably panic).
 func (c *Client) GetMsgsList(accountId, dirName string) ([]imap.MessageInfo, error) {
-	return c.getMsgsList(accountId, dirName, false)
+	return c.GetMsgsListContext(context.Background(), accountId, dirName)
+}
+
+// GetMsgsListContext is like GetMsgsList but can be cancelled using ctx (see context.go).
+func (c *Client) GetMsgsListContext(ctx context.Context, accountId, dirName string) ([]imap.MessageInfo, error) {
+	return c.getMsgsList(ctx, accountId, dirName, false)
 }
 
-func (c *Client) getMsgsList(accountId, dirName string, forceDownload bool) ([]imap.MessageInfo, error) {
+func (c *Client) getMsgsList(ctx context.Context, accountId, dirName string, forceDownload bool) ([]imap.MessageInfo, error) {
 	if !forceDownload {
-		list, err := c.caches[accountId].Dir(dirName).ListMsgs()
+		list, err := c.cache(accountId).Dir(dirName).ListMsgs()
 		if err == nil {
 			return list, nil
 		}
@@ -129,46 +136,79 @@ func (c *Client) getMsgsList(accountId, dirName string, forceDownload bool) ([]i
 		}
 	}
 
-	c.debugLog.Printf("Downloading message list for %v, %v...\n", accountId, dirName)
-	// Cache miss, go and ask server.
-	var list []imap.MessageInfo
-	var err error
-	for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-		list, err = c.imapConns[accountId].FetchMaillist(c.rawDirName(accountId, dirName))
-		if err == nil || !connectionError(err) {
-			break
-		}
-		if err := c.connectToServer(accountId); err != nil {
-			return nil, err
-		}
+	if err := c.syncMaillist(ctx, accountId, dirName); err != nil {
+		return nil, err
 	}
-	if err != nil {
+	return c.cache(accountId).Dir(dirName).ListMsgs()
+}
+
+// syncMaillist brings cached message list for directory up to date with
+// server. Only changes since last synchronization are downloaded if server
+// supports it (see imap.Client.SyncDir).
+func (c *Client) syncMaillist(ctx context.Context, accountId, dirName string) error {
+	c.debugLog.Printf("Synchronizing message list for %v, %v...\n", accountId, dirName)
+	if _, err := c.applyDirChanges(ctx, accountId, dirName); err != nil {
 		c.logger.Printf("Message list download (%v, %v) failed: %v\n", accountId, dirName, err)
-		return nil, fmt.Errorf("msgslist %v, %v: %v", accountId, dirName, err)
+		return fmt.Errorf("msgslist %v, %v: %w", accountId, dirName, err)
 	}
+	return nil
+}
 
-	if err := c.caches[accountId].Dir(dirName).UpdateMsglist(list); err != nil {
-		c.debugLog.Println("cachedb.UpdateMsgList failed:", err)
+// applyDirChanges requests changes for directory from server using account
+// session and applies them to cache. Applied changes are returned. Errors
+// from IMAP client and cache are returned as is.
+func (c *Client) applyDirChanges(ctx context.Context, accountId, dirName string) (*imap.DirChanges, error) {
+	cache := c.cache(accountId).Dir(dirName)
+
+	// Unknown values are left zero, this causes full download.
+	state := imap.DirSyncState{}
+	state.UidValidity, _ = cache.UidValidity()
+	state.HighestModSeq, _ = cache.HighestModSeq()
+	uids, err := cache.Uids()
+	if err != nil {
+		return nil, err
 	}
-	if err := c.caches[accountId].Dir(dirName).MarkAsValid(); err != nil {
-		c.debugLog.Println("cachedb.MarkAsValid failed:", err)
+	for _, uid := range uids {
+		// Drafts saved offline are not on server yet (see journal.go).
+		if !isLocalUid(uid) {
+			state.KnownUids = append(state.KnownUids, uid)
+		}
 	}
 
-	return list, nil
+	var changes *imap.DirChanges
+	err = c.session(accountId).do(ctx, func(conn *imap.Client) error {
+		changes, err = conn.SyncDirContext(ctx, c.rawDirName(accountId, dirName), state)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.debugLog.Printf("Changes for %v, %v: reset: %v, new: %v, changed: %v, vanished: %v, modseq: %v\n",
+		accountId, dirName, changes.Reset, len(changes.New), len(changes.Changed), len(changes.Vanished), changes.HighestModSeq)
+
+	if err := cache.ApplyChanges(changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
 }
 
 // GetMsgText returns all message headers (not only limited set like
-// GetMsgsList does) + text parts (with MIME type text/*). Information about
-// non-text parts is present but Body slice is nil.
+// GetMsgsList does) + full MIME tree with bodies of text parts (with MIME type
+// text/*). Information about non-text parts is present but Body slice is nil.
 //
 // Returned value is cached if allowOutdated is true, it's fine to
 // call it repeatly. Function arguments are NOT checked for validity, invalid
 // account ID or directory name will lead to undefined behavior (usually
 // panic).
 func (c *Client) GetMsgText(accountId, dirName string, uid uint32, allowOutdated bool) (*imap.MessageInfo, error) {
+	return c.GetMsgTextContext(context.Background(), accountId, dirName, uid, allowOutdated)
+}
+
+// GetMsgTextContext is like GetMsgText but can be cancelled using ctx (see context.go).
+func (c *Client) GetMsgTextContext(ctx context.Context, accountId, dirName string, uid uint32, allowOutdated bool) (*imap.MessageInfo, error) {
 	if allowOutdated {
-		msg, err := c.caches[accountId].Dir(dirName).GetMsg(uid)
-		if err == nil && len(msg.Msg.Parts) != 0 {
+		msg, err := c.cache(accountId).Dir(dirName).GetMsg(uid)
+		if err == nil && msg.Msg.Body.Type.Value != "" {
 			return msg, nil
 		}
 		if err != nil && err != storage.ErrNullValue {
@@ -179,74 +219,72 @@ func (c *Client) GetMsgText(accountId, dirName string, uid uint32, allowOutdated
 	c.logger.Printf("Downloading message text for (%v, %v, %v)...\n", accountId, dirName, uid)
 	var msg *imap.MessageInfo
 	var err error
-	for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-		msg, err = c.imapConns[accountId].FetchPartialMail(c.rawDirName(accountId, dirName), uid, imap.TextOnly)
-		if err == nil || !connectionError(err) {
-			break
-		}
-		if err := c.connectToServer(accountId); err != nil {
-			return nil, err
-		}
-	}
+	err = c.session(accountId).do(ctx, func(conn *imap.Client) error {
+		msg, err = conn.FetchPartialMailContext(ctx, c.rawDirName(accountId, dirName), uid, imap.TextOnly)
+		return err
+	})
 	if err != nil {
 		c.logger.Printf("Message text download (%v, %v, %v) failed: %v\n", accountId, dirName, uid, err)
-		return nil, fmt.Errorf("msgtext %v, %v, %v: %v", accountId, dirName, uid, err)
+		return nil, fmt.Errorf("msgtext %v, %v, %v: %w", accountId, dirName, uid, err)
 	}
 
 	// Update information in cache.
-	if err := c.caches[accountId].Dir(dirName).ReplacePartList(msg.UID, msg.Parts); err != nil {
+	if err := c.cache(accountId).Dir(dirName).ReplacePartTree(msg.UID, &msg.Msg.Body); err != nil {
 		c.debugLog.Println("Cache ReplacePartList:", err)
 	}
 
 	return msg, nil
 }
 
-// GetMsgPart downloads message part specified by part index (literally index
-// of element in Parts slice got form GetMsgText).
+// GetMsgPart downloads message part specified by IMAP section path (Path
+// field of part in MIME tree got from GetMsgText).
 //
 // Returned value is NOT cached, you should be careful to not call this
 // function more than needed. Function arguments are NOT checked for validity,
 // invalid account ID or directory name will lead to undefined behavior
 // (usually anic).
-func (c *Client) GetMsgPart(accountId, dirName string, uid uint32, partIndex int) (*common.Part, error) {
+func (c *Client) GetMsgPart(accountId, dirName string, uid uint32, path string) (*common.Part, error) {
+	return c.GetMsgPartContext(context.Background(), accountId, dirName, uid, path)
+}
+
+// GetMsgPartContext is like GetMsgPart but can be cancelled using ctx (see context.go).
+func (c *Client) GetMsgPartContext(ctx context.Context, accountId, dirName string, uid uint32, path string) (*common.Part, error) {
 	var prt *common.Part
 	var err error
-	for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-		prt, err = c.imapConns[accountId].DownloadPart(c.rawDirName(accountId, dirName), uid, partIndex)
-		if err == nil || !connectionError(err) {
-			break
-		}
-		if err := c.connectToServer(accountId); err != nil {
-			return nil, err
-		}
-	}
+	err = c.session(accountId).do(ctx, func(conn *imap.Client) error {
+		prt, err = conn.DownloadPartContext(ctx, c.rawDirName(accountId, dirName), uid, path)
+		return err
+	})
 	return prt, err
 }
 
-func (c *Client) resolveUid(accountId, dir string, seqnum uint32) (uint32, error) {
+func (c *Client) resolveUid(ctx context.Context, accountId, dir string, seqnum uint32) (uint32, error) {
 	var uid uint32
 	var err error
-	for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-		uid, err = c.imapConns[accountId].ResolveUid(c.rawDirName(accountId, dir), seqnum)
-		if err == nil || !connectionError(err) {
-			break
-		}
-		if err := c.connectToServer(accountId); err != nil {
-			return 0, err
-		}
-	}
+	err = c.session(accountId).do(ctx, func(conn *imap.Client) error {
+		uid, err = conn.ResolveUidContext(ctx, c.rawDirName(accountId, dir), seqnum)
+		return err
+	})
 	return uid, err
 }
 
 func (c *Client) DownloadOfflineDirs(accountId string) {
+	c.DownloadOfflineDirsContext(context.Background(), accountId)
+}
+
+// DownloadOfflineDirsContext is like DownloadOfflineDirs but can be cancelled using ctx (see context.go).
+func (c *Client) DownloadOfflineDirsContext(ctx context.Context, accountId string) {
 	c.logger.Println("Downloading messages for offline use...")
-	for _, dir := range c.Accounts[accountId].Dirs.DownloadForOffline {
-		list, err := c.GetMsgsList(accountId, dir)
+	for _, dir := range c.account(accountId).Dirs.DownloadForOffline {
+		list, err := c.GetMsgsListContext(ctx, accountId, dir)
 		if err != nil {
 			return
 		}
 		for _, msg := range list {
-			c.GetMsgText(accountId, dir, msg.UID, true)
+			if ctx.Err() != nil {
+				return
+			}
+			c.GetMsgTextContext(ctx, accountId, dir, msg.UID, true)
 		}
 	}
 }
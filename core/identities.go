@@ -0,0 +1,156 @@
+package core
+
+import (
+	"errors"
+	"html"
+	"net/mail"
+	"strings"
+
+	"github.com/foxcpp/mailbox/proto/common"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+// ErrUnknownSender is returned when From address of message being sent
+// doesn't match any identity of account.
+var ErrUnknownSender = errors.New("send: From address doesn't match any identity")
+
+// Identities returns list of addresses messages can be sent from using
+// account, primary identity is first.
+func (c *Client) Identities(accountId string) []storage.Identity {
+	return c.account(accountId).AllIdentities()
+}
+
+// identity returns identity with specified address or nil if there is
+// none.
+func (c *Client) identity(accountId, addr string) *storage.Identity {
+	for _, id := range c.Identities(accountId) {
+		if strings.EqualFold(id.Email, addr) {
+			return &id
+		}
+	}
+	return nil
+}
+
+// primaryIdentity returns identity used for new messages by default.
+func (c *Client) primaryIdentity(accountId string) storage.Identity {
+	ids := c.Identities(accountId)
+	if len(ids) == 0 {
+		return storage.Identity{}
+	}
+	return ids[0]
+}
+
+// replyIdentity selects identity to reply to msg from: one original message
+// was sent to or primary if there is no such identity.
+func (c *Client) replyIdentity(accountId string, msg *common.Msg) storage.Identity {
+	// Our own message is checked first so conversation is continued
+	// from the same address.
+	candidates := []common.Address{msg.From}
+	candidates = append(candidates, msg.To...)
+	candidates = append(candidates, msg.Cc...)
+	// Set by MTAs, contain address message was actually delivered to
+	// (useful if we are in Bcc).
+	for _, hdr := range []string{"X-Original-To", "Delivered-To"} {
+		if addr, err := mail.ParseAddress(msg.Misc.Get(hdr)); err == nil {
+			candidates = append(candidates, *addr)
+		}
+	}
+
+	for _, addr := range candidates {
+		if id := c.identity(accountId, addr.Address); id != nil {
+			return *id
+		}
+	}
+	return c.primaryIdentity(accountId)
+}
+
+// prepareOutgoing checks that message is sent from one of account's
+// identities and applies identity options. Changed copy of msg is returned.
+//
+// ErrUnknownSender is returned if From doesn't match any identity.
+func (c *Client) prepareOutgoing(accountId string, msg *common.Msg) (*common.Msg, error) {
+	if len(c.Identities(accountId)) == 0 {
+		// Nothing to check against.
+		return msg, nil
+	}
+	id := c.identity(accountId, msg.From.Address)
+	if id == nil {
+		return nil, ErrUnknownSender
+	}
+
+	res := *msg
+	if id.BccSelf {
+		present := false
+		for _, addr := range append(append(append([]common.Address{}, msg.To...), msg.Cc...), msg.Bcc...) {
+			if strings.EqualFold(addr.Address, id.Email) {
+				present = true
+				break
+			}
+		}
+		if !present {
+			res.Bcc = append(append([]common.Address{}, msg.Bcc...), common.Address{Name: id.Name, Address: id.Email})
+		}
+	}
+	return &res, nil
+}
+
+// sentDir returns directory copy of message sent from specified address
+// should be placed in.
+func (c *Client) sentDir(accountId, from string) string {
+	if id := c.identity(accountId, from); id != nil && id.SentDir != "" {
+		return id.SentDir
+	}
+	return c.account(accountId).Dirs.Sent
+}
+
+// newMsg creates empty message with From and Reply-To set according to
+// identity.
+func newMsg(id storage.Identity) *common.Msg {
+	res := &common.Msg{
+		From: common.Address{
+			Name:    id.Name,
+			Address: id.Email,
+		},
+	}
+	if id.ReplyTo != "" {
+		if addr, err := mail.ParseAddress(id.ReplyTo); err == nil {
+			res.ReplyTo = *addr
+		} else {
+			res.ReplyTo = common.Address{Address: id.ReplyTo}
+		}
+	}
+	return res
+}
+
+// signatureText returns signature of identity with separator (RFC 3676,
+// section 4.3) or empty string if there is no signature.
+func signatureText(id storage.Identity) string {
+	if id.Signature == "" {
+		return ""
+	}
+	return "\n\n-- \n" + strings.TrimRight(id.Signature, "\n") + "\n"
+}
+
+// signatureHTML is like signatureText but returns HTML. Plain text signature
+// is converted if identity has no HTML one.
+func signatureHTML(id storage.Identity) string {
+	sig := id.HTMLSignature
+	if sig == "" {
+		if id.Signature == "" {
+			return ""
+		}
+		sig = strings.Replace(html.EscapeString(strings.TrimRight(id.Signature, "\n")), "\n", "<br>\n", -1)
+	}
+	return "<br>\n<br>\n-- <br>\n" + sig
+}
+
+// Signature returns signature of identity with specified address as plain
+// text and HTML, with separator included. Empty strings are returned if
+// identity has no signature.
+func (c *Client) Signature(accountId, from string) (text, html string) {
+	id := c.identity(accountId, from)
+	if id == nil {
+		return "", ""
+	}
+	return signatureText(*id), signatureHTML(*id)
+}
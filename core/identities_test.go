@@ -0,0 +1,133 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/mailbox/proto/common"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+// setTestIdentities configures account with primary address
+// me@example.org and aliases.
+func setTestIdentities(c *Client) {
+	acc := c.Accounts[testAccount]
+	acc.SenderName = "Me"
+	acc.SenderEmail = "me@example.org"
+	acc.Dirs.Sent = "Sent"
+	acc.Identities = []storage.Identity{
+		{Email: "me@example.org", Signature: "Me\n"},
+		{Name: "Support", Email: "support@example.org", BccSelf: true, SentDir: "Support"},
+		{Email: "hidden@example.org"},
+	}
+	c.Accounts[testAccount] = acc
+}
+
+func TestReplyIdentity(t *testing.T) {
+	c := newTestClient(t, newTestBackend())
+	setTestIdentities(c)
+
+	cases := []struct {
+		name     string
+		msg      common.Msg
+		identity string
+	}{
+		{
+			"recipient",
+			common.Msg{
+				From: common.Address{Address: "alice@example.org"},
+				To:   []common.Address{{Address: "bob@example.org"}, {Address: "SUPPORT@example.org"}},
+			},
+			"support@example.org",
+		},
+		{
+			"own message",
+			common.Msg{
+				From: common.Address{Address: "support@example.org"},
+				To:   []common.Address{{Address: "me@example.org"}},
+			},
+			"support@example.org",
+		},
+		{
+			"Delivered-To",
+			common.Msg{
+				From: common.Address{Address: "alice@example.org"},
+				To:   []common.Address{{Address: "list@example.org"}},
+				Misc: common.Header{"Delivered-To": {"hidden@example.org"}},
+			},
+			"hidden@example.org",
+		},
+		{
+			"unknown",
+			common.Msg{
+				From: common.Address{Address: "alice@example.org"},
+				To:   []common.Address{{Address: "list@example.org"}},
+			},
+			"me@example.org",
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			if id := c.replyIdentity(testAccount, &cs.msg); id.Email != cs.identity {
+				t.Errorf("Wrong identity: %v (expected %v)", id.Email, cs.identity)
+			}
+		})
+	}
+}
+
+func TestComposeReplySignature(t *testing.T) {
+	c, inbox := newComposeTestClient(t)
+	setTestIdentities(c)
+	uid := addTestMsg(t, inbox, "Lunch", nil)
+
+	reply, err := c.ComposeReply(testAccount, "INBOX", uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Name of primary identity is taken from SenderName if entry in
+	// Identities doesn't set it.
+	if reply.From.Name != "Me" || reply.From.Address != "me@example.org" {
+		t.Errorf("Wrong identity used: %v", reply.From)
+	}
+	if text := string(reply.Body.Body); !strings.HasSuffix(text, "\n\n-- \nMe\n") {
+		t.Errorf("Signature is not appended: %q", text)
+	}
+}
+
+func TestPrepareOutgoing(t *testing.T) {
+	c := newTestClient(t, newTestBackend())
+	setTestIdentities(c)
+
+	_, err := c.prepareOutgoing(testAccount, &common.Msg{From: common.Address{Address: "mallory@example.org"}})
+	if err != ErrUnknownSender {
+		t.Error("Unknown sender is accepted:", err)
+	}
+
+	msg := &common.Msg{
+		From: common.Address{Address: "Support@example.org"},
+		To:   []common.Address{{Address: "alice@example.org"}},
+	}
+	res, err := c.prepareOutgoing(testAccount, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcc := addrList(res.Bcc); bcc != "support@example.org" {
+		t.Errorf("Copy is not sent to identity address: bcc %v", bcc)
+	}
+	if len(msg.Bcc) != 0 {
+		t.Error("Original message is modified")
+	}
+
+	// Address is not added again if it's already a recipient.
+	msg.Cc = []common.Address{{Address: "support@example.org"}}
+	if res, err := c.prepareOutgoing(testAccount, msg); err != nil || len(res.Bcc) != 0 {
+		t.Errorf("Address added to Bcc twice: %v, %v", addrList(res.Bcc), err)
+	}
+
+	if dir := c.sentDir(testAccount, "support@example.org"); dir != "Support" {
+		t.Errorf("Wrong directory for sent messages: %v (expected Support)", dir)
+	}
+	if dir := c.sentDir(testAccount, "hidden@example.org"); dir != "Sent" {
+		t.Errorf("Wrong directory for sent messages: %v (expected Sent)", dir)
+	}
+}
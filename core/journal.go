@@ -0,0 +1,472 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/textproto"
+	"time"
+
+	eimap "github.com/emersion/go-imap"
+	"github.com/foxcpp/mailbox/proto/common"
+	"github.com/foxcpp/mailbox/proto/imap"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+/*
+Offline operations journal.
+
+If server is not reachable (connection is lost and can't be restored after
+MaxTries attempts) mutating operations are applied to cache only and recorded
+in journal stored in account's CacheDB. While journal is not empty all new
+operations are recorded too, to preserve order.
+
+Journal is replayed once connection is restored (see session.connect) or
+account is loaded. Operations that can't be applied to server state are
+reported using FrontendHooks.ReplayConflict and dropped from journal.
+Directories affected by replayed operations are re-synchronized with server
+afterwards so optimistic changes made to cache are replaced with real state.
+*/
+
+var (
+	// Operation refers to message that was removed from server by somebody
+	// else.
+	ErrMsgGone = errors.New("replay: message no longer exists")
+
+	// Directory was recreated on server and all UIDs recorded in journal
+	// are no longer valid.
+	ErrUidValidityChanged = errors.New("replay: directory UIDVALIDITY changed")
+)
+
+// ReplayConflict describes offline operation that can't be (fully) applied
+// to server state.
+type ReplayConflict struct {
+	// Name of Client method used to perform operation ("Tag", "MoveMsgs",
+	// "CreateDir", etc).
+	Op string
+	// Directory operation applies to.
+	Dir string
+	// UIDs of messages operation was not applied to, if any.
+	Uids []uint32
+	// When operation was performed.
+	Time time.Time
+
+	Err error
+}
+
+const (
+	opTag         = "Tag"
+	opUnTag       = "UnTag"
+	opMoveMsgs    = "MoveMsgs"
+	opCopyMsgs    = "CopyMsgs"
+	opDelMsg      = "DelMsg"
+	opSaveDraft   = "SaveDraft"
+	opUpdateDraft = "UpdateDraft"
+	opCreateDir   = "CreateDir"
+	opRemoveDir   = "RemoveDir"
+	opMoveDir     = "MoveDir"
+	opRenameDir   = "RenameDir"
+)
+
+// offlineOp is stored in journal entry as arguments blob.
+type offlineOp struct {
+	Uids  []uint32 `json:",omitempty"`
+	ToDir string   `json:",omitempty"`
+	Tag   string   `json:",omitempty"`
+	// RFC 822 message for drafts.
+	Msg []byte `json:",omitempty"`
+	// Temporary UID of draft placed in cache until it's saved on server.
+	LocalUid uint32 `json:",omitempty"`
+	// UIDNEXT of target directory recorded before operation that can't be
+	// safely repeated is sent to server (see appliedBefore).
+	UidNext uint32 `json:",omitempty"`
+}
+
+// Drafts saved offline are placed in cache using temporary UIDs from the top
+// of UID range, servers assign UIDs in ascending order starting from small
+// values. Such messages are removed from cache once draft is saved on server
+// during replay.
+const minLocalUid = math.MaxUint32 - 1<<16
+
+func isLocalUid(uid uint32) bool {
+	return uid >= minLocalUid
+}
+
+// newLocalUid returns temporary UID not used in cache of directory.
+func (c *Client) newLocalUid(accountId, dir string) uint32 {
+	uids, _ := c.cache(accountId).Dir(dir).Uids()
+	next := uint32(math.MaxUint32)
+	for _, uid := range uids {
+		if isLocalUid(uid) && uid <= next {
+			next = uid - 1
+		}
+	}
+	return next
+}
+
+// cacheQueuedDraft places draft saved offline in cache using temporary UID.
+func (c *Client) cacheQueuedDraft(accountId, dir string, uid uint32, draft *common.Msg) {
+	info := imap.MessageInfo{UID: uid, CustomTags: []string{`\Draft`}, Msg: *draft}
+	if err := c.cache(accountId).Dir(dir).AddMsg(&info); err != nil {
+		c.debugLog.Printf("Failed to cache offline draft (%v, %v): %v\n", accountId, dir, err)
+		return
+	}
+	c.notifyViews(accountId, dir)
+}
+
+// PendingOps returns amount of operations performed offline and not yet
+// applied to server.
+func (c *Client) PendingOps(accountId string) (int, error) {
+	return c.cache(accountId).JournalLen()
+}
+
+func (c *Client) pendingOps(accountId string) bool {
+	count, err := c.cache(accountId).JournalLen()
+	return err == nil && count != 0
+}
+
+// runOrQueue calls f using account session (see session.go), so it's
+// repeated after reconnection if connection is lost.
+//
+// If server is not reachable or journal is not empty operation is recorded
+// in journal and true is returned. Caller should apply operation to cache in
+// this case.
+func (c *Client) runOrQueue(ctx context.Context, accountId, op, dir string, args offlineOp, f func(conn *imap.Client) error) (bool, error) {
+	if c.pendingOps(accountId) {
+		c.replayJournal(ctx, accountId)
+	}
+	// Replay may be interrupted, cancelled operation should not be queued.
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	if !c.pendingOps(accountId) {
+		err := c.session(accountId).do(ctx, f)
+		// Connection can't be re-established.
+		var accErr *AccountError
+		offline := errors.As(err, &accErr)
+		if ctxError(err) {
+			if !offline {
+				go c.resyncCancelled(accountId, op, dir, args)
+			}
+			return false, err
+		}
+		if err == nil || !(offline || connectionError(err)) {
+			return false, err
+		}
+	}
+
+	c.logger.Printf("Server is not reachable, %v (%v, %v) will be performed later.\n", op, accountId, dir)
+	return true, c.queueOp(accountId, op, dir, args)
+}
+
+func (c *Client) queueOp(accountId, op, dir string, args offlineOp) error {
+	entry := storage.JournalEntry{Op: op, Dir: dir}
+	if len(args.Uids) != 0 {
+		entry.UidValidity, _ = c.cache(accountId).Dir(dir).UidValidity()
+	}
+
+	var err error
+	entry.Args, err = json.Marshal(args)
+	if err != nil {
+		return fmt.Errorf("journal %v: %v", accountId, err)
+	}
+	if _, err := c.cache(accountId).AddJournalEntry(entry); err != nil {
+		return fmt.Errorf("journal %v: %v", accountId, err)
+	}
+	return nil
+}
+
+// replayJournal applies all pending operations to server.
+//
+// Operations are performed using account session, replay stops if
+// connection can't be re-established or when ctx is cancelled, remaining
+// operations are left in journal.
+func (c *Client) replayJournal(ctx context.Context, accountId string) {
+	// replayJournal is called after reconnection which can happen during
+	// replay.
+	if _, busy := c.replaying.LoadOrStore(accountId, true); busy {
+		return
+	}
+	defer c.replaying.Delete(accountId)
+
+	entries, err := c.cache(accountId).Journal()
+	if err != nil {
+		c.logger.Printf("Failed to read journal (%v): %v\n", accountId, err)
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	c.logger.Printf("Replaying %v operations performed offline (%v)...\n", len(entries), accountId)
+	affectedDirs := make(StrSet)
+	// Real UIDs of drafts saved offline, by temporary UID.
+	localUids := make(map[uint32]uint32)
+	dirListChanged := false
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+		var err error
+		connErr := c.session(accountId).do(ctx, func(conn *imap.Client) error {
+			err = c.replayEntry(ctx, conn, accountId, &entry, affectedDirs, localUids)
+			if err != nil && (connectionError(err) || ctxError(err)) {
+				return err
+			}
+			// Operation is rejected by server, it is reported as
+			// conflict below.
+			return nil
+		})
+		if connErr != nil {
+			break
+		}
+		if err != nil {
+			c.logger.Printf("Offline operation %v (%v, %v) failed: %v\n", entry.Op, accountId, entry.Dir, err)
+			args := offlineOp{}
+			json.Unmarshal(entry.Args, &args)
+			c.reportConflict(accountId, ReplayConflict{
+				Op:   entry.Op,
+				Dir:  entry.Dir,
+				Uids: args.Uids,
+				Time: entry.Time,
+				Err:  err,
+			})
+			affectedDirs.Add(entry.Dir)
+		}
+		switch entry.Op {
+		case opCreateDir, opRemoveDir, opMoveDir, opRenameDir:
+			dirListChanged = true
+		}
+
+		if err := c.cache(accountId).RemoveJournalEntry(entry.Id); err != nil {
+			c.logger.Printf("Failed to remove journal entry (%v): %v\n", accountId, err)
+			break
+		}
+	}
+
+	if dirListChanged {
+		if _, err := c.GetDirsContext(ctx, accountId, true); err != nil {
+			c.debugLog.Printf("Directory list reload after replay (%v) failed: %v\n", accountId, err)
+		}
+	}
+	for _, dir := range affectedDirs.List() {
+		if _, err := c.applyDirChanges(ctx, accountId, dir); err != nil {
+			c.debugLog.Printf("Resync after replay (%v, %v) failed: %v\n", accountId, dir, err)
+			continue
+		}
+		c.dirChanged(accountId, dir)
+	}
+}
+
+func (c *Client) reportConflict(accountId string, conflict ReplayConflict) {
+	if c.Hooks.ReplayConflict != nil {
+		c.Hooks.ReplayConflict(accountId, conflict)
+	}
+}
+
+// replayEntry applies single journal entry to server state.
+//
+// Entry may be replayed again if connection is lost, so changes to its
+// arguments made by appliedBefore are stored in entry.
+func (c *Client) replayEntry(ctx context.Context, conn *imap.Client, accountId string, entry *storage.JournalEntry, affectedDirs StrSet, localUids map[uint32]uint32) error {
+	args := offlineOp{}
+	if err := json.Unmarshal(entry.Args, &args); err != nil {
+		return fmt.Errorf("replay: malformed journal entry: %v", err)
+	}
+	rawDir := c.rawDirName(accountId, entry.Dir)
+
+	if entry.Op == opUpdateDraft && len(args.Uids) != 0 && isLocalUid(args.Uids[0]) {
+		// Draft saved offline is updated, replace message created by
+		// replay of SaveDraft.
+		if uid, ok := localUids[args.Uids[0]]; ok {
+			args.Uids = []uint32{uid}
+		} else {
+			args.Uids = nil
+		}
+	}
+
+	uids := args.Uids
+	if len(uids) != 0 {
+		var err error
+		uids, err = c.presentUids(ctx, conn, accountId, *entry, args.Uids)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch entry.Op {
+	case opTag, opUnTag, opMoveMsgs, opCopyMsgs, opDelMsg:
+		if len(uids) == 0 {
+			// All messages are gone, conflict is already reported.
+			return nil
+		}
+	}
+
+	affectedDirs.Add(entry.Dir)
+	switch entry.Op {
+	case opTag:
+		return conn.TagContext(ctx, rawDir, args.Tag, uids...)
+	case opUnTag:
+		return conn.UnTagContext(ctx, rawDir, args.Tag, uids...)
+	case opMoveMsgs:
+		affectedDirs.Add(args.ToDir)
+		return conn.MoveToContext(ctx, rawDir, c.rawDirName(accountId, args.ToDir), uids...)
+	case opCopyMsgs:
+		affectedDirs.Add(args.ToDir)
+		// COPY is atomic so it's enough to look for one message.
+		msgId := ""
+		for _, uid := range uids {
+			if info, err := c.cache(accountId).Dir(entry.Dir).GetMsg(uid); err == nil && info.Msg.MessageId != "" {
+				msgId = info.Msg.MessageId
+				break
+			}
+		}
+		copied, err := c.appliedBefore(ctx, conn, accountId, entry, &args, args.ToDir, msgId)
+		if err != nil || copied != 0 {
+			return err
+		}
+		return conn.CopyToContext(ctx, rawDir, c.rawDirName(accountId, args.ToDir), uids...)
+	case opDelMsg:
+		return conn.DeleteContext(ctx, rawDir, uids...)
+	case opSaveDraft, opUpdateDraft:
+		msg, err := common.ReadMsg(bytes.NewReader(args.Msg))
+		if err != nil {
+			return fmt.Errorf("replay: malformed draft: %v", err)
+		}
+		uid, err := c.appliedBefore(ctx, conn, accountId, entry, &args, entry.Dir, msg.MessageId)
+		if err != nil {
+			return err
+		}
+		switch {
+		case uid != 0:
+			// Draft is saved already, only old one may be left.
+			if entry.Op == opUpdateDraft && len(uids) != 0 {
+				err = conn.DeleteContext(ctx, rawDir, uids[0])
+			}
+		case entry.Op == opUpdateDraft && len(uids) != 0:
+			uid, err = conn.ReplaceContext(ctx, rawDir, uids[0], []string{`\Draft`}, entry.Time, msg)
+		default:
+			// Old draft is gone, save new one anyway so changes will not be
+			// lost.
+			uid, err = conn.CreateContext(ctx, rawDir, []string{`\Draft`}, entry.Time, msg)
+		}
+		if err != nil && (connectionError(err) || ctxError(err)) {
+			return err
+		}
+		if args.LocalUid != 0 {
+			// Draft is either saved or rejected (and reported as
+			// conflict), temporary copy is not needed anymore.
+			c.cache(accountId).Dir(entry.Dir).DelMsg(args.LocalUid)
+			if uid != 0 {
+				localUids[args.LocalUid] = uid
+			}
+		}
+		return err
+	case opCreateDir:
+		return conn.CreateDirContext(ctx, rawDir)
+	case opRemoveDir:
+		return conn.RemoveDirContext(ctx, rawDir)
+	case opMoveDir, opRenameDir:
+		return conn.RenameDirContext(ctx, rawDir, c.rawDirName(accountId, args.ToDir))
+	}
+	return fmt.Errorf("replay: unknown operation %v", entry.Op)
+}
+
+// appliedBefore checks whether operation that can't be safely repeated
+// (CopyMsgs, SaveDraft, UpdateDraft) was already performed by previous replay
+// attempt: server may execute command and lose connection before sending
+// response. UID of message with msgId created in dir by such attempt is
+// returned, or zero if there is none.
+//
+// Before the first attempt UIDNEXT of dir is recorded in journal entry, later
+// only messages above it are looked up. Messages without Message-Id can't be
+// found so operations on them are repeated.
+func (c *Client) appliedBefore(ctx context.Context, conn *imap.Client, accountId string, entry *storage.JournalEntry, args *offlineOp, dir, msgId string) (uint32, error) {
+	rawDir := c.rawDirName(accountId, dir)
+
+	if args.UidNext == 0 {
+		status, err := conn.StatusContext(ctx, rawDir)
+		if err != nil {
+			return 0, err
+		}
+		args.UidNext = status.UidNext
+		blob, err := json.Marshal(args)
+		if err != nil {
+			return 0, fmt.Errorf("journal %v: %v", accountId, err)
+		}
+		if err := c.cache(accountId).UpdateJournalEntry(entry.Id, blob); err != nil {
+			return 0, fmt.Errorf("journal %v: %v", accountId, err)
+		}
+		entry.Args = blob
+		return 0, nil
+	}
+	if msgId == "" {
+		return 0, nil
+	}
+
+	seqset := eimap.SeqSet{}
+	seqset.AddRange(args.UidNext, 0)
+	found, err := conn.SearchContext(ctx, rawDir, eimap.SearchCriteria{
+		Uid:    &seqset,
+		Header: textproto.MIMEHeader{"Message-Id": {"<" + msgId + ">"}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, uid := range found {
+		// N:* matches the last message even if its UID is below N.
+		if uid >= args.UidNext {
+			return uid, nil
+		}
+	}
+	return 0, nil
+}
+
+// presentUids returns UIDs of messages from journal entry that still exist on
+// server. Conflict is reported for missing ones.
+func (c *Client) presentUids(ctx context.Context, conn *imap.Client, accountId string, entry storage.JournalEntry, uids []uint32) ([]uint32, error) {
+	rawDir := c.rawDirName(accountId, entry.Dir)
+
+	status, err := conn.StatusContext(ctx, rawDir)
+	if err != nil {
+		return nil, err
+	}
+	if entry.UidValidity != 0 && status.UidValidity != entry.UidValidity {
+		return nil, ErrUidValidityChanged
+	}
+
+	seqset := eimap.SeqSet{}
+	seqset.AddNum(uids...)
+	found, err := conn.SearchContext(ctx, rawDir, eimap.SearchCriteria{Uid: &seqset})
+	if err != nil {
+		return nil, err
+	}
+	foundSet := make(map[uint32]bool, len(found))
+	for _, uid := range found {
+		foundSet[uid] = true
+	}
+
+	present := []uint32{}
+	missing := []uint32{}
+	for _, uid := range uids {
+		if foundSet[uid] {
+			present = append(present, uid)
+		} else {
+			missing = append(missing, uid)
+		}
+	}
+	if len(missing) != 0 {
+		c.reportConflict(accountId, ReplayConflict{
+			Op:   entry.Op,
+			Dir:  entry.Dir,
+			Uids: missing,
+			Time: entry.Time,
+			Err:  ErrMsgGone,
+		})
+	}
+	return present, nil
+}
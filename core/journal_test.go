@@ -0,0 +1,228 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	eimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/mailbox/proto/common"
+	"github.com/foxcpp/mailbox/proto/imap"
+)
+
+// serverMsgsCount returns amount of messages in directory of test backend.
+func serverMsgsCount(t *testing.T, be backend.Backend, dir string) uint32 {
+	t.Helper()
+	user, err := be.Login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := user.GetMailbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := mbox.Status([]eimap.StatusItem{eimap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status.Messages
+}
+
+func TestJournalOfflineDraft(t *testing.T) {
+	be := newTestBackend()
+	c := newTestClient(t, be)
+	c.Hooks.ReplayConflict = func(_ string, conflict ReplayConflict) {
+		t.Errorf("Unexpected conflict: %+v", conflict)
+	}
+	user, err := be.Login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := user.CreateMailbox("Drafts"); err != nil {
+		t.Fatal(err)
+	}
+	acc := c.Accounts[testAccount]
+	acc.Dirs.Drafts = "Drafts"
+	c.Accounts[testAccount] = acc
+	if err := c.cache(testAccount).AddDir("Drafts"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.cache(testAccount).Dir("Drafts").MarkAsValid(); err != nil {
+		t.Fatal(err)
+	}
+
+	dialer := c.serverCfg(testAccount).imap.Dialer.(*testDialer)
+	dialer.setOffline(true)
+	dialer.breakConns()
+
+	uid, err := c.SaveDraft(testAccount, &common.Msg{
+		Date:      time.Date(2018, 9, 1, 12, 0, 0, 0, time.UTC),
+		Subject:   "Offline draft",
+		MessageId: "offline@example.org",
+		Body: common.Part{
+			Type: common.ParametrizedHeader{Value: "text/plain"},
+			Body: []byte("Written on a plane."),
+		},
+	})
+	if err != nil || uid != 0 {
+		t.Fatalf("Draft is not queued: %v, %v", uid, err)
+	}
+	if pending, err := c.PendingOps(testAccount); err != nil || pending != 1 {
+		t.Fatalf("Wrong amount of pending operations: %v, %v", pending, err)
+	}
+	msgs, err := c.cache(testAccount).Dir("Drafts").ListMsgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || !isLocalUid(msgs[0].UID) || msgs[0].Msg.Subject != "Offline draft" {
+		t.Fatalf("Draft is not placed in cache: %+v", msgs)
+	}
+
+	if raceEnabled {
+		t.Skip("Saving draft on test server is reported as data race (see race_test.go)")
+	}
+
+	// Journal is replayed once connection is restored.
+	dialer.setOffline(false)
+	if err := c.session(testAccount).connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if pending, err := c.PendingOps(testAccount); err != nil || pending != 0 {
+		t.Fatalf("Journal is not replayed: %v, %v", pending, err)
+	}
+	if count := serverMsgsCount(t, be, "Drafts"); count != 1 {
+		t.Errorf("Wrong amount of drafts on server: %v", count)
+	}
+	msgs, err = c.cache(testAccount).Dir("Drafts").ListMsgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || isLocalUid(msgs[0].UID) || msgs[0].Msg.MessageId != "offline@example.org" {
+		t.Errorf("Temporary draft is not replaced with saved one: %+v", msgs)
+	}
+}
+
+func TestJournalOffline(t *testing.T) {
+	be := newTestBackend()
+	c := newTestClient(t, be)
+	c.Hooks.ReplayConflict = func(_ string, conflict ReplayConflict) {
+		t.Errorf("Unexpected conflict: %+v", conflict)
+	}
+	user, err := be.Login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := user.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"INBOX", "Archive"} {
+		if err := c.cache(testAccount).AddDir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = c.cache(testAccount).Dir("INBOX").AddMsg(&imap.MessageInfo{
+		UID: 6,
+		Msg: common.Msg{MessageId: "0000000@localhost/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialer := c.serverCfg(testAccount).imap.Dialer.(*testDialer)
+	dialer.setOffline(true)
+	dialer.breakConns()
+
+	if err := c.Tag(testAccount, "INBOX", FlaggedTag, 6); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CopyMsgs(testAccount, "INBOX", "Archive", 6); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := c.PendingOps(testAccount); err != nil || pending != 2 {
+		t.Fatalf("Wrong amount of pending operations: %v, %v", pending, err)
+	}
+	info, err := c.cache(testAccount).Dir("INBOX").GetMsg(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(info.CustomTags, " ") != eimap.FlaggedFlag {
+		t.Errorf("Tag is not applied to cache: %v", info.CustomTags)
+	}
+
+	// Journal is replayed once connection is restored.
+	dialer.setOffline(false)
+	if err := c.session(testAccount).connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if pending, err := c.PendingOps(testAccount); err != nil || pending != 0 {
+		t.Fatalf("Journal is not replayed: %v, %v", pending, err)
+	}
+	if count := serverMsgsCount(t, be, "Archive"); count != 1 {
+		t.Errorf("Wrong amount of messages in Archive: %v", count)
+	}
+	if count := serverMsgsCount(t, be, "INBOX"); count != 1 {
+		t.Errorf("Wrong amount of messages in INBOX: %v", count)
+	}
+}
+
+func TestReplayCopyApplied(t *testing.T) {
+	be := newTestBackend()
+	c := newTestClient(t, be)
+	c.Hooks.ReplayConflict = func(_ string, conflict ReplayConflict) {
+		t.Errorf("Unexpected conflict: %+v", conflict)
+	}
+	user, err := be.Login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := user.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"INBOX", "Archive"} {
+		if err := c.cache(testAccount).AddDir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Same message as one in INBOX of memory backend.
+	err = c.cache(testAccount).Dir("INBOX").AddMsg(&imap.MessageInfo{
+		UID: 6,
+		Msg: common.Msg{MessageId: "0000000@localhost/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Previous replay attempt recorded UIDNEXT of Archive and copied
+	// message but response was lost together with connection.
+	err = c.queueOp(testAccount, opCopyMsgs, "INBOX", offlineOp{Uids: []uint32{6}, ToDir: "Archive", UidNext: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqset := eimap.SeqSet{}
+	seqset.AddNum(6)
+	if err := inbox.CopyMessages(true, &seqset, "Archive"); err != nil {
+		t.Fatal(err)
+	}
+	// Copy that was not attempted yet.
+	err = c.queueOp(testAccount, opCopyMsgs, "INBOX", offlineOp{Uids: []uint32{6}, ToDir: "Archive"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.replayJournal(context.Background(), testAccount)
+
+	if pending, err := c.PendingOps(testAccount); err != nil || pending != 0 {
+		t.Fatalf("Journal is not replayed: %v, %v", pending, err)
+	}
+	if count := serverMsgsCount(t, be, "Archive"); count != 2 {
+		t.Errorf("Expected 2 copies in Archive, got %v", count)
+	}
+}
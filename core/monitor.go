@@ -0,0 +1,255 @@
+package core
+
+import (
+	"context"
+	"time"
+
+	eimap "github.com/emersion/go-imap"
+	"github.com/foxcpp/mailbox/proto/imap"
+)
+
+/*
+Directories monitoring.
+
+INBOX is always monitored by imap.Client using IDLE. Other directories listed
+in dirs.watch account option are monitored by server if it supports NOTIFY
+extension, otherwise they are polled using STATUS command every
+connection.pollinterval seconds. Directories are polled immediately if
+notifications are dropped because client is busy. When change is detected,
+directory is synchronized and NewMessage hook is called for each message
+that was not seen before.
+*/
+
+// Watched directories are still checked sometimes if NOTIFY is used because
+// notifications sent while connection is not in IDLE mode are lost.
+const notifyPollInterval = 30 * time.Minute
+
+// monitor is a state of per-account monitoring goroutine.
+type monitor struct {
+	// Receives statuses of directories changed according to server.
+	changed chan *imap.DirStatus
+	// Set (non-blocking send) when some notifications are lost,
+	// directories are polled then.
+	resync chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// dirState is a part of directory status used to detect changes.
+type dirState struct {
+	uidNext  uint32
+	messages uint32
+}
+
+// watchedDirs returns list of directories (other than INBOX) that should be
+// monitored for account.
+func (c *Client) watchedDirs(accountId string) []string {
+	res := []string{}
+	seen := make(map[string]bool)
+	add := func(dir string) {
+		if dir == "INBOX" || seen[dir] {
+			return
+		}
+		seen[dir] = true
+		res = append(res, dir)
+	}
+
+	for _, dir := range c.account(accountId).Dirs.Watch {
+		if dir != "*" {
+			add(dir)
+			continue
+		}
+		all, err := c.cache(accountId).DirList()
+		if err != nil {
+			c.logger.Printf("Failed to get directories list (%v): %v\n", accountId, err)
+			continue
+		}
+		for _, dir := range all {
+			add(dir)
+		}
+	}
+	return res
+}
+
+func (c *Client) startMonitor(accountId string) {
+	dirs := c.watchedDirs(accountId)
+	if len(dirs) == 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	mon := &monitor{
+		changed: make(chan *imap.DirStatus, 16),
+		resync:  make(chan struct{}, 1),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	c.stateLock.Lock()
+	c.monitors[accountId] = mon
+	c.stateLock.Unlock()
+	go c.monitorLoop(ctx, accountId, mon, dirs)
+}
+
+func (c *Client) stopMonitor(accountId string) {
+	c.stateLock.Lock()
+	mon := c.monitors[accountId]
+	delete(c.monitors, accountId)
+	c.stateLock.Unlock()
+	if mon == nil {
+		return
+	}
+	mon.cancel()
+	<-mon.done
+}
+
+// dirStatusChanged passes status reported by server to monitoring
+// goroutine.
+func (c *Client) dirStatusChanged(accountId string, status *imap.DirStatus) {
+	c.stateLock.RLock()
+	mon := c.monitors[accountId]
+	c.stateLock.RUnlock()
+	if mon == nil {
+		return
+	}
+	select {
+	case mon.changed <- status:
+	default:
+		// Monitor is busy, directories will be polled once it's done.
+		mon.requestResync()
+	}
+}
+
+// dirStatusLost is called when notifications about changes in watched
+// directories were lost, it requests poll of directories.
+func (c *Client) dirStatusLost(accountId string) {
+	c.stateLock.RLock()
+	mon := c.monitors[accountId]
+	c.stateLock.RUnlock()
+	if mon != nil {
+		mon.requestResync()
+	}
+}
+
+func (mon *monitor) requestResync() {
+	select {
+	case mon.resync <- struct{}{}:
+	default:
+		// Already requested.
+	}
+}
+
+func (c *Client) monitorLoop(ctx context.Context, accountId string, mon *monitor, dirs []string) {
+	defer close(mon.done)
+
+	rawDirs := make([]string, len(dirs))
+	for i, dir := range dirs {
+		rawDirs[i] = c.rawDirName(accountId, dir)
+	}
+
+	var notify bool
+	var err error
+	err = c.session(accountId).do(ctx, func(conn *imap.Client) error {
+		notify, err = conn.WatchDirsContext(ctx, rawDirs)
+		return err
+	})
+	if err != nil {
+		c.logger.Printf("Failed to enable notifications for watched directories (%v), polling them: %v\n", accountId, err)
+	}
+	if notify {
+		c.debugLog.Printf("Server supports NOTIFY, watched directories (%v) are monitored by server.\n", accountId)
+	}
+
+	known := make(map[string]dirState)
+	for {
+		c.pollDirs(ctx, accountId, rawDirs, known)
+
+		interval := time.Duration(*c.EffectiveConfig(accountId).Connection.PollInterval) * time.Second
+		if notify || interval <= 0 {
+			interval = notifyPollInterval
+		}
+		timer := time.NewTimer(interval)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				break wait
+			case status := <-mon.changed:
+				c.checkDirStatus(ctx, accountId, status, known)
+			case <-mon.resync:
+				c.debugLog.Printf("Notifications for watched directories (%v) were lost, polling them.\n", accountId)
+				c.pollDirs(ctx, accountId, rawDirs, known)
+			case <-timer.C:
+				break wait
+			}
+		}
+		timer.Stop()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// pollDirs requests statuses of directories from server and synchronizes
+// changed ones.
+func (c *Client) pollDirs(ctx context.Context, accountId string, rawDirs []string, known map[string]dirState) {
+	var statuses map[string]*imap.DirStatus
+	var err error
+	err = c.session(accountId).do(ctx, func(conn *imap.Client) error {
+		statuses, err = conn.DirsStatusContext(ctx, rawDirs)
+		return err
+	})
+	if err != nil {
+		if !ctxError(err) {
+			c.logger.Printf("Failed to check watched directories (%v): %v\n", accountId, err)
+		}
+		return
+	}
+
+	for _, status := range statuses {
+		if ctx.Err() != nil {
+			return
+		}
+		c.checkDirStatus(ctx, accountId, status, known)
+	}
+}
+
+// checkDirStatus synchronizes directory if status differs from one seen
+// last time.
+func (c *Client) checkDirStatus(ctx context.Context, accountId string, status *imap.DirStatus, known map[string]dirState) {
+	dir := c.normalizeDirName(accountId, status.Name)
+	if _, prs := status.Items[eimap.StatusUnseen]; prs {
+		c.cache(accountId).Dir(dir).SetUnreadCount(uint(status.Unseen))
+	}
+
+	state := dirState{uidNext: status.UidNext, messages: status.Messages}
+	if prev, prs := known[dir]; prs && prev == state {
+		return
+	}
+	known[dir] = state
+	c.syncWatchedDir(ctx, accountId, dir)
+}
+
+// syncWatchedDir synchronizes cached message list for directory and calls
+// NewMessage hook for messages not seen before.
+func (c *Client) syncWatchedDir(ctx context.Context, accountId, dir string) {
+	changes, err := c.applyDirChanges(ctx, accountId, dir)
+	if err != nil {
+		if !ctxError(err) {
+			c.logger.Printf("Failed to synchronize watched directory (%v, %v): %v\n", accountId, dir, err)
+		}
+		return
+	}
+
+	if !changes.Reset && len(changes.New) == 0 && len(changes.Changed) == 0 && len(changes.Vanished) == 0 {
+		return
+	}
+	c.dirChanged(accountId, dir)
+
+	// Full list is downloaded if directory was never synchronized before,
+	// messages from it are not new.
+	if changes.Reset || c.Hooks.NewMessage == nil {
+		return
+	}
+	for i := range changes.New {
+		c.Hooks.NewMessage(accountId, dir, &changes.New[i])
+	}
+}
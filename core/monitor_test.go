@@ -0,0 +1,80 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/mailbox/proto/imap"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+// startTestMonitor creates Archive directory with single message on server
+// and starts monitoring it with specified poll interval. New messages
+// reported by NewMessage hook are sent to returned channel.
+func startTestMonitor(t *testing.T, pollInterval int) (*Client, backend.Mailbox, <-chan string) {
+	be := newTestBackend()
+	user, err := be.Login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := user.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := user.GetMailbox("Archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestMsg(t, archive, "Old", nil)
+
+	c := newTestClient(t, be)
+	acc := storage.AccountCfg{}
+	acc.Dirs.Watch = []string{"Archive"}
+	c.Accounts[testAccount] = acc
+	c.GlobalCfg.Connection.PollInterval = &pollInterval
+	if err := c.cache(testAccount).AddDir("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	newMsgs := make(chan string, 16)
+	c.Hooks.NewMessage = func(accountId, dir string, msg *imap.MessageInfo) {
+		newMsgs <- dir + " " + msg.Msg.Subject
+	}
+
+	c.startMonitor(testAccount)
+	t.Cleanup(func() { c.stopMonitor(testAccount) })
+
+	// Messages found by first synchronization are not reported.
+	waitFor(t, "initial synchronization", func() bool {
+		uids, err := c.cache(testAccount).Dir("Archive").Uids()
+		return err == nil && len(uids) == 1
+	})
+	return c, archive, newMsgs
+}
+
+func expectNewMessage(t *testing.T, newMsgs <-chan string, expected string) {
+	t.Helper()
+	select {
+	case msg := <-newMsgs:
+		if msg != expected {
+			t.Errorf("Wrong new message reported: %v (expected %v)", msg, expected)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("New message is not reported")
+	}
+}
+
+func TestMonitorPolling(t *testing.T) {
+	_, archive, newMsgs := startTestMonitor(t, 1)
+
+	addTestMsg(t, archive, "New", nil)
+	expectNewMessage(t, newMsgs, "Archive New")
+}
+
+func TestMonitorResyncAfterLostStatus(t *testing.T) {
+	// Directories would be polled only once in an hour.
+	c, archive, newMsgs := startTestMonitor(t, 3600)
+
+	addTestMsg(t, archive, "New", nil)
+	c.dirStatusLost(testAccount)
+	expectNewMessage(t, newMsgs, "Archive New")
+}
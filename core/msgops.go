@@ -1,5 +1,11 @@
 package core
 
+import (
+	"context"
+
+	"github.com/foxcpp/mailbox/proto/imap"
+)
+
 // MoveMsgs moves messages from one directory to another.
 //
 // Operation can be expensive due to forced message list reload so it's recommended to call it
@@ -7,15 +13,30 @@ package core
 //
 // Invalid UIDs are ignored. Invalid account ID leads to undefined behavior (probably panic).
 // Invalid fromDir or toDir leads to error.
+//
+// If server is not reachable, messages are removed from fromDir cache and
+// operation is performed later (see journal.go).
 func (c *Client) MoveMsgs(accountId, fromDir, toDir string, uids ...uint32) error {
-	err := c.imapConns[accountId].MoveTo(c.rawDirName(accountId, fromDir), c.rawDirName(accountId, toDir), uids...)
-	if err == nil {
-		for _, uid := range uids {
-			c.caches[accountId].Dir(fromDir).DelMsg(uid)
-		}
-		c.reloadMaillist(accountId, toDir)
+	return c.MoveMsgsContext(context.Background(), accountId, fromDir, toDir, uids...)
+}
+
+// MoveMsgsContext is like MoveMsgs but can be cancelled using ctx (see context.go).
+func (c *Client) MoveMsgsContext(ctx context.Context, accountId, fromDir, toDir string, uids ...uint32) error {
+	queued, err := c.runOrQueue(ctx, accountId, opMoveMsgs, fromDir, offlineOp{Uids: uids, ToDir: toDir}, func(conn *imap.Client) error {
+		return conn.MoveToContext(ctx, c.rawDirName(accountId, fromDir), c.rawDirName(accountId, toDir), uids...)
+	})
+	if err != nil {
+		return err
 	}
-	return err
+
+	for _, uid := range uids {
+		c.cache(accountId).Dir(fromDir).DelMsg(uid)
+	}
+	c.notifyViews(accountId, fromDir)
+	if !queued {
+		c.reloadMaillist(ctx, accountId, toDir)
+	}
+	return nil
 }
 
 // CopyMsgs copies messages from one directory to another.
@@ -25,10 +46,19 @@ func (c *Client) MoveMsgs(accountId, fromDir, toDir string, uids ...uint32) erro
 //
 // Invalid UIDs are ignored. Invalid account ID leads to undefined behavior (probably panic).
 // Invalid fromDir or toDir leads to error.
+//
+// If server is not reachable, operation is performed later (see journal.go).
 func (c *Client) CopyMsgs(accountId, fromDir, toDir string, uids ...uint32) error {
-	err := c.imapConns[accountId].CopyTo(c.rawDirName(accountId, fromDir), toDir, uids...)
-	if err == nil {
-		c.reloadMaillist(accountId, toDir)
+	return c.CopyMsgsContext(context.Background(), accountId, fromDir, toDir, uids...)
+}
+
+// CopyMsgsContext is like CopyMsgs but can be cancelled using ctx (see context.go).
+func (c *Client) CopyMsgsContext(ctx context.Context, accountId, fromDir, toDir string, uids ...uint32) error {
+	queued, err := c.runOrQueue(ctx, accountId, opCopyMsgs, fromDir, offlineOp{Uids: uids, ToDir: toDir}, func(conn *imap.Client) error {
+		return conn.CopyToContext(ctx, c.rawDirName(accountId, fromDir), c.rawDirName(accountId, toDir), uids...)
+	})
+	if err == nil && !queued {
+		c.reloadMaillist(ctx, accountId, toDir)
 	}
 	return err
 }
@@ -41,16 +71,27 @@ func (c *Client) CopyMsgs(accountId, fromDir, toDir string, uids ...uint32) erro
 // Invalid UIDs are ignored. Invalid account ID leads to undefined behavior (probably panic).
 // Invalid fromDir or toDir leads to error.
 // skipTrash=true disables moveement to Trash and just removes messages in any case.
+//
+// If server is not reachable, messages are removed from cache and operation
+// is performed later (see journal.go).
 func (c *Client) DelMsg(accountId, dir string, skipTrash bool, uids ...uint32) error {
-	if dir == "Trash" || skipTrash {
-		err := c.imapConns[accountId].Delete(c.rawDirName(accountId, dir), uids...)
+	return c.DelMsgContext(context.Background(), accountId, dir, skipTrash, uids...)
+}
+
+// DelMsgContext is like DelMsg but can be cancelled using ctx (see context.go).
+func (c *Client) DelMsgContext(ctx context.Context, accountId, dir string, skipTrash bool, uids ...uint32) error {
+	if dir == c.account(accountId).Dirs.Trash || skipTrash {
+		_, err := c.runOrQueue(ctx, accountId, opDelMsg, dir, offlineOp{Uids: uids}, func(conn *imap.Client) error {
+			return conn.DeleteContext(ctx, c.rawDirName(accountId, dir), uids...)
+		})
 		if err == nil {
 			for _, uid := range uids {
-				c.caches[accountId].Dir(dir).DelMsg(uid)
+				c.cache(accountId).Dir(dir).DelMsg(uid)
 			}
+			c.notifyViews(accountId, dir)
 		}
 		return err
 	} else {
-		return c.MoveMsgs(accountId, dir, c.Accounts[accountId].Dirs.Trash, uids...)
+		return c.MoveMsgsContext(ctx, accountId, dir, c.account(accountId).Dirs.Trash, uids...)
 	}
 }
@@ -0,0 +1,78 @@
+package core
+
+import (
+	"encoding/hex"
+
+	"github.com/foxcpp/mailbox/proto/common"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+// authMethod converts authentication method name from account
+// configuration.
+func authMethod(s string) common.AuthMethod {
+	switch s {
+	case "xoauth2":
+		return common.AuthXOAuth2
+	case "oauthbearer":
+		return common.AuthOAuthBearer
+	default:
+		return common.AuthPlain
+	}
+}
+
+// tokenSource returns source of OAuth access tokens for account.
+//
+// Token source provided by frontend (FrontendHooks.TokenSource) is
+// preferred, otherwise tokens are requested using refresh token from
+// account configuration. Token endpoint is contacted using dialer (account
+// proxy) so client address is not revealed to it.
+func (c *Client) tokenSource(accountId string, dialer common.Dialer) common.TokenSource {
+	if c.Hooks.TokenSource != nil {
+		if src := c.Hooks.TokenSource(accountId); src != nil {
+			return src
+		}
+	}
+
+	oauth := c.account(accountId).Credentials.OAuth
+	refreshToken := ""
+	if oauth.RefreshToken != "" {
+		encToken, err := hex.DecodeString(oauth.RefreshToken)
+		if err != nil {
+			c.logger.Printf("Malformed refresh token for %v: %v\n", accountId, err)
+			return nil
+		}
+		tokenBytes, err := c.DecryptUsingMaster(encToken)
+		if err != nil {
+			c.logger.Printf("Failed to decrypt refresh token for %v: %v\n", accountId, err)
+			return nil
+		}
+		refreshToken = string(tokenBytes)
+	}
+
+	src := common.NewRefreshTokenSource(oauth.TokenEndpoint, oauth.ClientId, oauth.ClientSecret, refreshToken)
+	src.HTTPClient = common.HTTPClient(dialer)
+	src.OnRefresh = func(token string) {
+		c.saveRefreshToken(accountId, token)
+	}
+	return src
+}
+
+// saveRefreshToken encrypts refresh token and writes it to account
+// configuration.
+func (c *Client) saveRefreshToken(accountId, token string) {
+	c.debugLog.Println("Saving new refresh token for", accountId)
+	encToken := hex.EncodeToString(c.EncryptUsingMaster([]byte(token)))
+
+	// Update file configuration first so watcher will not consider our own
+	// change as external one.
+	fileCfg, ok := c.updateAccount(accountId, func(cfg *storage.AccountCfg) {
+		cfg.Credentials.OAuth.RefreshToken = encToken
+	})
+	if !ok {
+		// Account is unloaded, token is probably outdated anyway.
+		return
+	}
+	if err := storage.SaveAccount(accountId, fileCfg); err != nil {
+		c.logger.Printf("Failed to save refresh token for %v: %v\n", accountId, err)
+	}
+}
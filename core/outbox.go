@@ -0,0 +1,361 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/mailbox/proto/common"
+	"github.com/foxcpp/mailbox/proto/smtp"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+/*
+Outbox.
+
+Messages that can't be delivered immediately (SMTP server is not reachable
+or replied with temporary error) are stored in account's cache DB and
+delivered by background goroutine, so they survive restarts. Failed attempts
+are retried with exponential backoff (from outboxMinDelay up to
+outboxMaxDelay), reconnection to IMAP server triggers immediate attempt.
+
+Messages rejected permanently are kept in outbox until they are removed or
+retried explicitly by user (RetryOutbox).
+
+Frontend is notified about results using OutboxSent and OutboxError hooks.
+Message is copied to Sent directory only after successful delivery.
+*/
+
+const (
+	outboxMinDelay = 30 * time.Second
+	outboxMaxDelay = 1 * time.Hour
+)
+
+// OutboxMsg is a message waiting for delivery.
+type OutboxMsg struct {
+	Id  int64
+	Msg *common.Msg
+
+	// When message was queued.
+	Queued   time.Time
+	Attempts int
+	// Zero if message will not be delivered automatically.
+	NextAttempt time.Time
+	// Error from last delivery attempt, empty if there was none.
+	LastError string
+	// UID of copy in drafts directory, non-zero for scheduled messages.
+	DraftUid uint32
+}
+
+// outbox is a state of per-account delivery goroutine.
+type outbox struct {
+	kick   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// Held while message is delivered so it can't be removed concurrently.
+	lock sync.Mutex
+}
+
+// QueueMessage adds message to outbox, it will be delivered in background.
+// Id of outbox entry is returned. Sender is checked like in SendMessage.
+func (c *Client) QueueMessage(accountId string, msg *common.Msg) (int64, error) {
+	msg, err := c.prepareOutgoing(accountId, msg)
+	if err != nil {
+		return 0, err
+	}
+	return c.queueMessage(accountId, msg, storage.OutboxEntry{NextAttempt: time.Now()})
+}
+
+// queueMessage adds message to outbox, entry contains initial values of
+// other fields.
+func (c *Client) queueMessage(accountId string, msg *common.Msg, entry storage.OutboxEntry) (int64, error) {
+	var buf bytes.Buffer
+	if err := msg.Write(&buf); err != nil {
+		return 0, err
+	}
+	entry.Msg = buf.Bytes()
+	id, err := c.cache(accountId).AddOutboxEntry(entry)
+	if err != nil {
+		return 0, err
+	}
+	c.kickOutbox(accountId)
+	return id, nil
+}
+
+// Outbox returns list of messages waiting for delivery.
+func (c *Client) Outbox(accountId string) ([]OutboxMsg, error) {
+	entries, err := c.cache(accountId).Outbox()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]OutboxMsg, 0, len(entries))
+	for _, entry := range entries {
+		msg, err := common.ReadMsg(bytes.NewReader(entry.Msg))
+		if err != nil {
+			c.logger.Printf("Malformed message in outbox (%v, %v): %v\n", accountId, entry.Id, err)
+			continue
+		}
+		res = append(res, OutboxMsg{
+			Id:          entry.Id,
+			Msg:         msg,
+			Queued:      entry.Time,
+			Attempts:    entry.Attempts,
+			NextAttempt: entry.NextAttempt,
+			LastError:   entry.LastError,
+			DraftUid:    entry.DraftUid,
+		})
+	}
+	return res, nil
+}
+
+// RetryOutbox schedules immediate delivery attempt for outbox entry,
+// including ones rejected permanently.
+func (c *Client) RetryOutbox(accountId string, id int64) error {
+	unlock := c.lockOutbox(accountId)
+	defer unlock()
+
+	entry, err := c.outboxEntry(accountId, id)
+	if err != nil {
+		return err
+	}
+	entry.NextAttempt = time.Now()
+	if err := c.cache(accountId).UpdateOutboxEntry(*entry); err != nil {
+		return err
+	}
+	c.kickOutbox(accountId)
+	return nil
+}
+
+// RemoveFromOutbox removes message from outbox without delivering it. This
+// is also used to cancel scheduled messages (see schedule.go), their
+// copies in drafts directory are removed too.
+//
+// Error is returned if message is already delivered.
+func (c *Client) RemoveFromOutbox(accountId string, id int64) error {
+	return c.RemoveFromOutboxContext(context.Background(), accountId, id)
+}
+
+// RemoveFromOutboxContext is like RemoveFromOutbox but can be cancelled using ctx (see context.go).
+func (c *Client) RemoveFromOutboxContext(ctx context.Context, accountId string, id int64) error {
+	unlock := c.lockOutbox(accountId)
+	defer unlock()
+
+	entry, err := c.outboxEntry(accountId, id)
+	if err != nil {
+		return err
+	}
+	if err := c.cache(accountId).RemoveOutboxEntry(id); err != nil {
+		return err
+	}
+	if entry.DraftUid != 0 {
+		return c.DelMsgContext(ctx, accountId, c.account(accountId).Dirs.Drafts, true, entry.DraftUid)
+	}
+	return nil
+}
+
+// lockOutbox prevents delivery of messages from account's outbox until
+// returned function is called.
+func (c *Client) lockOutbox(accountId string) (unlock func()) {
+	c.stateLock.RLock()
+	box := c.outboxes[accountId]
+	c.stateLock.RUnlock()
+	if box == nil {
+		return func() {}
+	}
+	box.lock.Lock()
+	return box.lock.Unlock
+}
+
+// outboxEntry is like CacheDB.OutboxEntry but returns meaningful error if
+// there is no such entry.
+func (c *Client) outboxEntry(accountId string, id int64) (*storage.OutboxEntry, error) {
+	entry, err := c.cache(accountId).OutboxEntry(id)
+	if err == storage.ErrNullValue {
+		return nil, errors.New("outbox: message is already sent")
+	}
+	return entry, err
+}
+
+// kickOutbox wakes up delivery goroutine for account.
+func (c *Client) kickOutbox(accountId string) {
+	c.stateLock.RLock()
+	box := c.outboxes[accountId]
+	c.stateLock.RUnlock()
+	if box == nil {
+		return
+	}
+	select {
+	case box.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) startOutbox(accountId string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	box := &outbox{
+		kick:   make(chan struct{}, 1),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	c.stateLock.Lock()
+	c.outboxes[accountId] = box
+	c.stateLock.Unlock()
+	go c.outboxLoop(ctx, accountId, box)
+}
+
+func (c *Client) stopOutbox(accountId string) {
+	c.stateLock.Lock()
+	box := c.outboxes[accountId]
+	delete(c.outboxes, accountId)
+	c.stateLock.Unlock()
+	if box == nil {
+		return
+	}
+	box.cancel()
+	<-box.done
+}
+
+func (c *Client) outboxLoop(ctx context.Context, accountId string, box *outbox) {
+	defer close(box.done)
+	for {
+		next := c.flushOutbox(ctx, accountId, box)
+
+		var timer *time.Timer
+		var timerCh <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			timerCh = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-box.kick:
+		case <-timerCh:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// flushOutbox attempts to deliver all due messages and returns time of the
+// next scheduled attempt (zero if there is none).
+func (c *Client) flushOutbox(ctx context.Context, accountId string, box *outbox) time.Time {
+	entries, err := c.cache(accountId).Outbox()
+	if err != nil {
+		c.logger.Printf("Failed to read outbox (%v): %v\n", accountId, err)
+		return time.Time{}
+	}
+
+	var next time.Time
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return time.Time{}
+		}
+		if entry.NextAttempt.IsZero() {
+			continue
+		}
+		if entry.NextAttempt.After(time.Now()) {
+			if next.IsZero() || entry.NextAttempt.Before(next) {
+				next = entry.NextAttempt
+			}
+			continue
+		}
+
+		retryAt := c.deliverQueued(ctx, accountId, box, entry.Id)
+		if !retryAt.IsZero() && (next.IsZero() || retryAt.Before(next)) {
+			next = retryAt
+		}
+	}
+	return next
+}
+
+// deliverQueued performs delivery attempt for outbox entry and returns time
+// of the next attempt if it failed.
+func (c *Client) deliverQueued(ctx context.Context, accountId string, box *outbox, id int64) time.Time {
+	box.lock.Lock()
+	defer box.lock.Unlock()
+
+	// Re-read entry, it may be removed or changed while we were busy with
+	// previous ones.
+	entry, err := c.cache(accountId).OutboxEntry(id)
+	if err != nil {
+		return time.Time{}
+	}
+	if entry.NextAttempt.IsZero() || entry.NextAttempt.After(time.Now()) {
+		return entry.NextAttempt
+	}
+
+	msg, err := common.ReadMsg(bytes.NewReader(entry.Msg))
+	if err != nil {
+		c.logger.Printf("Malformed message in outbox (%v, %v): %v\n", accountId, id, err)
+		entry.NextAttempt = time.Time{}
+		entry.LastError = err.Error()
+		c.cache(accountId).UpdateOutboxEntry(*entry)
+		return time.Time{}
+	}
+
+	c.debugLog.Printf("Delivering message from outbox (%v, %v), attempt %v...\n", accountId, id, entry.Attempts+1)
+	sendErr := c.deliver(ctx, accountId, msg)
+	if sendErr != nil && ctxError(sendErr) {
+		return time.Time{}
+	}
+	if rcptErr, ok := sendErr.(smtp.RejectedRcptsError); sendErr == nil || (ok && rcptErr.Delivered) {
+		if err := c.cache(accountId).RemoveOutboxEntry(id); err != nil {
+			c.logger.Printf("Failed to remove delivered message from outbox (%v, %v): %v\n", accountId, id, err)
+		}
+		if entry.DraftUid != 0 {
+			if err := c.DelMsgContext(ctx, accountId, c.account(accountId).Dirs.Drafts, true, entry.DraftUid); err != nil {
+				c.logger.Printf("Failed to remove draft of sent message (%v, %v): %v\n", accountId, entry.DraftUid, err)
+			}
+		}
+		uid := c.copyToSent(ctx, accountId, msg)
+		if sendErr != nil {
+			c.logger.Println("Some recipients were rejected:", sendErr)
+		}
+		if c.Hooks.OutboxSent != nil {
+			c.Hooks.OutboxSent(accountId, id, uid)
+		}
+		return time.Time{}
+	}
+
+	entry.Attempts++
+	entry.LastError = sendErr.Error()
+	if retryableSendError(sendErr) {
+		entry.NextAttempt = time.Now().Add(outboxDelay(entry.Attempts))
+	} else {
+		entry.NextAttempt = time.Time{}
+	}
+	c.logger.Printf("Delivery of message from outbox (%v, %v) failed: %v\n", accountId, id, sendErr)
+	if err := c.cache(accountId).UpdateOutboxEntry(*entry); err != nil {
+		c.logger.Printf("Failed to update outbox entry (%v, %v): %v\n", accountId, id, err)
+	}
+	if c.Hooks.OutboxError != nil {
+		c.Hooks.OutboxError(accountId, id, sendErr, entry.NextAttempt)
+	}
+	return entry.NextAttempt
+}
+
+// outboxDelay returns delay before next delivery attempt after specified
+// amount of failed ones.
+func outboxDelay(attempts int) time.Duration {
+	delay := outboxMinDelay
+	for i := 1; i < attempts && delay < outboxMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > outboxMaxDelay {
+		return outboxMaxDelay
+	}
+	return delay
+}
+
+// retryableSendError reports whether delivery that failed with err may
+// succeed later.
+func retryableSendError(err error) bool {
+	return connectionError(err) || smtp.IsTemporary(err)
+}
@@ -0,0 +1,163 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type outboxResult struct {
+	id          int64
+	err         error
+	nextAttempt time.Time
+}
+
+// outboxHooks sets OutboxSent and OutboxError hooks that send results to
+// returned channel.
+func outboxHooks(c *Client) <-chan outboxResult {
+	results := make(chan outboxResult, 10)
+	c.Hooks.OutboxSent = func(accountId string, id int64, uid uint32) {
+		results <- outboxResult{id: id}
+	}
+	c.Hooks.OutboxError = func(accountId string, id int64, err error, nextAttempt time.Time) {
+		results <- outboxResult{id, err, nextAttempt}
+	}
+	return results
+}
+
+func waitOutboxResult(t *testing.T, results <-chan outboxResult, id int64) outboxResult {
+	t.Helper()
+	select {
+	case res := <-results:
+		if res.id != id {
+			t.Fatalf("Result reported for wrong entry: %v (expected %v)", res.id, id)
+		}
+		return res
+	case <-time.After(10 * time.Second):
+		t.Fatal("Delivery result is not reported")
+	}
+	return outboxResult{}
+}
+
+func TestOutboxQueuedBeforeStart(t *testing.T) {
+	c := newTestClient(t, newTestBackend())
+	results := outboxHooks(c)
+
+	// Message stays in cache DB until outbox is started (e.g. after
+	// restart).
+	msg := undoTestMsg
+	id, err := c.QueueMessage(testAccount, &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outbox, err := c.Outbox(testAccount); err != nil || len(outbox) != 1 || outbox[0].Id != id {
+		t.Fatal("Message is not queued:", outbox, err)
+	}
+
+	sent := startTestOutbox(t, c)
+	select {
+	case <-sent:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Queued message is not delivered")
+	}
+	if res := waitOutboxResult(t, results, id); res.err != nil {
+		t.Fatal("Delivery error reported:", res.err)
+	}
+	if outbox, err := c.Outbox(testAccount); err != nil || len(outbox) != 0 {
+		t.Fatal("Message is not removed from outbox:", outbox, err)
+	}
+}
+
+func TestOutboxRetryUnreachable(t *testing.T) {
+	c := newTestClient(t, newTestBackend())
+	results := outboxHooks(c)
+	be := &smtpTestBackend{sent: make(chan []byte, 10)}
+	d := &testDialer{}
+	d.setOffline(true)
+	startTestOutboxWith(t, c, be, d)
+
+	msg := undoTestMsg
+	id, err := c.QueueMessage(testAccount, &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := waitOutboxResult(t, results, id)
+	if res.err == nil {
+		t.Fatal("Delivery succeeded while server is unreachable")
+	}
+	if delay := time.Until(res.nextAttempt); delay <= 0 || delay > outboxMinDelay {
+		t.Errorf("Wrong delay before next attempt: %v", delay)
+	}
+	outbox, err := c.Outbox(testAccount)
+	if err != nil || len(outbox) != 1 {
+		t.Fatal("Message is not kept in outbox:", outbox, err)
+	}
+	if outbox[0].Attempts != 1 || outbox[0].LastError == "" {
+		t.Errorf("Failed attempt is not recorded: %+v", outbox[0])
+	}
+
+	d.setOffline(false)
+	if err := c.RetryOutbox(testAccount, id); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-be.sent:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Message is not delivered after retry")
+	}
+	if res := waitOutboxResult(t, results, id); res.err != nil {
+		t.Fatal("Delivery error reported:", res.err)
+	}
+}
+
+func TestOutboxPermanentError(t *testing.T) {
+	c := newTestClient(t, newTestBackend())
+	results := outboxHooks(c)
+	be := &smtpTestBackend{sent: make(chan []byte, 10)}
+	be.setReject(errors.New("sender is not allowed"))
+	startTestOutboxWith(t, c, be, &testDialer{})
+
+	msg := undoTestMsg
+	id, err := c.QueueMessage(testAccount, &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := waitOutboxResult(t, results, id)
+	if res.err == nil {
+		t.Fatal("Delivery succeeded despite rejection")
+	}
+	if !res.nextAttempt.IsZero() {
+		t.Error("Delivery is retried after permanent error at", res.nextAttempt)
+	}
+	outbox, err := c.Outbox(testAccount)
+	if err != nil || len(outbox) != 1 || !outbox[0].NextAttempt.IsZero() {
+		t.Fatal("Rejected message is not kept in outbox:", outbox, err)
+	}
+
+	// Explicit retry ignores previous error.
+	be.setReject(nil)
+	if err := c.RetryOutbox(testAccount, id); err != nil {
+		t.Fatal(err)
+	}
+	if res := waitOutboxResult(t, results, id); res.err != nil {
+		t.Fatal("Delivery error reported:", res.err)
+	}
+	<-be.sent
+}
+
+func TestOutboxDelay(t *testing.T) {
+	cases := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, outboxMinDelay},
+		{2, 2 * outboxMinDelay},
+		{4, 8 * outboxMinDelay},
+		{100, outboxMaxDelay},
+	}
+	for _, c := range cases {
+		if delay := outboxDelay(c.attempts); delay != c.delay {
+			t.Errorf("Wrong delay after %v attempts: %v (expected %v)", c.attempts, delay, c.delay)
+		}
+	}
+}
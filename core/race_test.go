@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package core
+
+// go-imap server writes continuation requests from separate goroutine without
+// synchronization, so APPEND to test server is reported as data race.
+const raceEnabled = true
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/foxcpp/mailbox/proto/common"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+/*
+Scheduled sending.
+
+Scheduled messages are outbox entries with delivery time in the future (see
+outbox.go), so they persist across restarts and can be listed using Outbox.
+Copy of scheduled message is saved in drafts directory so it's visible on
+other devices, it is removed after delivery or cancellation
+(RemoveFromOutbox).
+
+SendUndoable is a short-term variant of scheduling: message is held in
+outbox for Sending.UndoDelay seconds without saving draft, so user can
+cancel it using RemoveFromOutbox.
+*/
+
+// ScheduleMessage places message in outbox to be delivered at specified time
+// and saves its copy in drafts directory. Id of outbox entry is returned.
+// Sender is checked like in SendMessage.
+//
+// If server is not reachable, draft will be saved later (see journal.go)
+// but it will not be removed automatically after delivery.
+func (c *Client) ScheduleMessage(accountId string, msg *common.Msg, at time.Time) (int64, error) {
+	return c.ScheduleMessageContext(context.Background(), accountId, msg, at)
+}
+
+// ScheduleMessageContext is like ScheduleMessage but can be cancelled using ctx (see context.go).
+func (c *Client) ScheduleMessageContext(ctx context.Context, accountId string, msg *common.Msg, at time.Time) (int64, error) {
+	if at.IsZero() {
+		return 0, errors.New("schedule: zero delivery time")
+	}
+	msg, err := c.prepareOutgoing(accountId, msg)
+	if err != nil {
+		return 0, err
+	}
+
+	draftUid, err := c.SaveDraftContext(ctx, accountId, msg)
+	if err != nil {
+		return 0, err
+	}
+	id, err := c.queueMessage(accountId, msg, storage.OutboxEntry{NextAttempt: at, DraftUid: draftUid})
+	if err != nil {
+		if draftUid != 0 {
+			c.DelMsgContext(ctx, accountId, c.account(accountId).Dirs.Drafts, true, draftUid)
+		}
+		return 0, err
+	}
+	return id, nil
+}
+
+// SendUndoable places message in outbox to be delivered after undo delay
+// (Sending.UndoDelay in configuration), so sending can be cancelled using
+// RemoveFromOutbox. Id of outbox entry is returned.
+//
+// Result of delivery is reported using OutboxSent and OutboxError hooks.
+func (c *Client) SendUndoable(accountId string, msg *common.Msg) (int64, error) {
+	msg, err := c.prepareOutgoing(accountId, msg)
+	if err != nil {
+		return 0, err
+	}
+	// UndoDelay is nil if configuration is not loaded using LoadGlobal,
+	// message is sent immediately then.
+	delay := time.Duration(0)
+	if undoDelay := c.EffectiveConfig(accountId).Sending.UndoDelay; undoDelay != nil {
+		delay = time.Duration(*undoDelay) * time.Second
+	}
+	return c.queueMessage(accountId, msg, storage.OutboxEntry{NextAttempt: time.Now().Add(delay)})
+}
+
+// UpdateScheduled replaces contents and delivery time of message in outbox.
+// Copy in drafts directory is replaced too.
+//
+// Error is returned if message is already delivered.
+func (c *Client) UpdateScheduled(accountId string, id int64, msg *common.Msg, at time.Time) error {
+	return c.UpdateScheduledContext(context.Background(), accountId, id, msg, at)
+}
+
+// UpdateScheduledContext is like UpdateScheduled but can be cancelled using ctx (see context.go).
+func (c *Client) UpdateScheduledContext(ctx context.Context, accountId string, id int64, msg *common.Msg, at time.Time) error {
+	if at.IsZero() {
+		return errors.New("schedule: zero delivery time")
+	}
+	msg, err := c.prepareOutgoing(accountId, msg)
+	if err != nil {
+		return err
+	}
+
+	unlock := c.lockOutbox(accountId)
+	defer unlock()
+
+	entry, err := c.outboxEntry(accountId, id)
+	if err != nil {
+		return err
+	}
+
+	buf := bytes.Buffer{}
+	if err := msg.Write(&buf); err != nil {
+		return err
+	}
+	if entry.DraftUid != 0 {
+		entry.DraftUid, err = c.UpdateDraftContext(ctx, accountId, entry.DraftUid, msg)
+		if err != nil {
+			return err
+		}
+	}
+	entry.Msg = buf.Bytes()
+	entry.NextAttempt = at
+	if err := c.cache(accountId).UpdateOutboxEntry(*entry); err != nil {
+		return err
+	}
+	c.kickOutbox(accountId)
+	return nil
+}
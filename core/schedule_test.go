@@ -0,0 +1,184 @@
+package core
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	smtp "github.com/emersion/go-smtp"
+	"github.com/foxcpp/mailbox/proto/common"
+)
+
+// smtpTestBackend accepts messages from anonymous users and sends their
+// contents to channel.
+type smtpTestBackend struct {
+	sent chan []byte
+
+	lock sync.Mutex
+	// If not nil, MAIL command is rejected with it (code 502).
+	rejectErr error
+}
+
+func (be *smtpTestBackend) Login(username, password string) (smtp.User, error) {
+	return nil, smtp.ErrAuthUnsupported
+}
+
+func (be *smtpTestBackend) AnonymousLogin() (smtp.User, error) {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+	if be.rejectErr != nil {
+		return nil, be.rejectErr
+	}
+	return be, nil
+}
+
+func (be *smtpTestBackend) setReject(err error) {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+	be.rejectErr = err
+}
+
+func (be *smtpTestBackend) Send(from string, to []string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	be.sent <- data
+	return nil
+}
+
+func (be *smtpTestBackend) Logout() error {
+	return nil
+}
+
+// startTestOutbox configures account of test client to use local SMTP
+// server and starts outbox. Channel that receives delivered messages is
+// returned. Configuration must not be changed after this call.
+func startTestOutbox(t *testing.T, c *Client) <-chan []byte {
+	be := &smtpTestBackend{sent: make(chan []byte, 10)}
+	startTestOutboxWith(t, c, be, &testDialer{})
+	return be.sent
+}
+
+// startTestOutboxWith is like startTestOutbox but SMTP server uses
+// specified backend and connections to it are made using d.
+func startTestOutboxWith(t *testing.T, c *Client, be *smtpTestBackend, d *testDialer) {
+	srv := smtp.NewServer(be)
+	srv.Domain = "localhost"
+	srv.AllowInsecureAuth = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	// Server.Close races with Serve in this version of go-smtp.
+	t.Cleanup(func() { l.Close() })
+
+	copyToSent := false
+	acc := c.Accounts[testAccount]
+	acc.CopyToSent = &copyToSent
+	c.Accounts[testAccount] = acc
+	cfg := c.serverCfgs[testAccount]
+	cfg.smtp = common.ServConfig{
+		Host:     "127.0.0.1",
+		Port:     uint16(l.Addr().(*net.TCPAddr).Port),
+		ConnType: common.Plaintext,
+		Dialer:   d,
+	}
+	c.serverCfgs[testAccount] = cfg
+
+	c.startOutbox(testAccount)
+	t.Cleanup(func() { c.stopOutbox(testAccount) })
+}
+
+var undoTestMsg = common.Msg{
+	From: common.Address{Address: "me@example.org"},
+	To:   []common.Address{{Address: "a@example.org"}},
+	Body: common.Part{Body: []byte("Hello!")},
+}
+
+func TestSendUndoableCancel(t *testing.T) {
+	c := newTestClient(t, newTestBackend())
+	delay := 60
+	c.GlobalCfg.Sending.UndoDelay = &delay
+	sent := startTestOutbox(t, c)
+
+	msg := undoTestMsg
+	id, err := c.SendUndoable(testAccount, &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox, err := c.Outbox(testAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outbox) != 1 || time.Until(outbox[0].NextAttempt) < 50*time.Second {
+		t.Fatal("Message is not held for undo delay:", outbox)
+	}
+
+	if err := c.RemoveFromOutbox(testAccount, id); err != nil {
+		t.Fatal("Undo failed:", err)
+	}
+	if outbox, err := c.Outbox(testAccount); err != nil || len(outbox) != 0 {
+		t.Fatal("Message is not removed from outbox:", outbox, err)
+	}
+
+	// Outbox goroutine is woken up by SendUndoable, it must not deliver
+	// message that is not due yet.
+	select {
+	case <-sent:
+		t.Fatal("Cancelled message is delivered")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestSendUndoableDelivered(t *testing.T) {
+	c := newTestClient(t, newTestBackend())
+	delay := 2
+	c.GlobalCfg.Sending.UndoDelay = &delay
+	sent := startTestOutbox(t, c)
+
+	msg := undoTestMsg
+	start := time.Now()
+	id, err := c.SendUndoable(testAccount, &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sent:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Message is not delivered after undo delay")
+	}
+	// Delivery time is stored with second precision.
+	if time.Since(start) < time.Second {
+		t.Error("Message is delivered before undo delay")
+	}
+
+	waitFor(t, "removal from outbox", func() bool {
+		outbox, err := c.Outbox(testAccount)
+		return err == nil && len(outbox) == 0
+	})
+	if err := c.RemoveFromOutbox(testAccount, id); err == nil {
+		t.Error("No error for undo after delivery")
+	}
+}
+
+func TestSendUndoableDefaultDelay(t *testing.T) {
+	// Configuration is not loaded using LoadGlobal so UndoDelay is not
+	// set, message is delivered immediately.
+	c := newTestClient(t, newTestBackend())
+	sent := startTestOutbox(t, c)
+
+	msg := undoTestMsg
+	if _, err := c.SendUndoable(testAccount, &msg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sent:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Message is not delivered")
+	}
+}
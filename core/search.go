@@ -1,10 +1,33 @@
 package core
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/textproto"
 	"time"
 
 	eimap "github.com/emersion/go-imap"
+	"github.com/foxcpp/mailbox/proto/imap"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+// SearchMode selects where Search looks for messages.
+type SearchMode int
+
+const (
+	// Search on server only. This is default.
+	SearchServer SearchMode = iota
+	// Search in local cache using full-text index. Works offline but only
+	// cached messages can be found and only cached text is searched (see
+	// DownloadOfflineDirs). Text is matched by word prefixes, not
+	// substrings. Search by Text requires SQLite with FTS5 (build with
+	// sqlite_fts5 tag), storage.ErrNoFTS is returned otherwise.
+	SearchLocal
+	// Search in local cache and on server, results are merged. If server is
+	// not reachable - only local results are returned, if local search is
+	// not available (no FTS5) - only server results are returned.
+	SearchMerged
 )
 
 // To match criteria message should match each field
@@ -23,6 +46,11 @@ type SearchCriteria struct {
 	Text string
 	// Message in any of listed directories. Defaults to full search.
 	Dirs []string
+
+	Mode SearchMode
+	// Maximum amount of local results, 0 means no limit. Server results are
+	// not limited.
+	Limit int
 }
 
 func (sc SearchCriteria) toGoImap() eimap.SearchCriteria {
@@ -53,15 +81,96 @@ func (sc SearchCriteria) toGoImap() eimap.SearchCriteria {
 type SearchResult struct {
 	Dir string
 	Uid uint32
+
+	// Relevance of local match (lower is better) and fragment of matched
+	// text with matches enclosed in [ and ]. Both are present only for
+	// messages found in local cache using Text.
+	Rank    float64
+	Snippet string
 }
 
 // Search for messages in directory matching specific criteria.
+//
+// Local results are ordered by relevance, server results follow them in
+// directory order.
 func (c *Client) Search(accountId string, criteria SearchCriteria) ([]SearchResult, error) {
+	return c.SearchContext(context.Background(), accountId, criteria)
+}
+
+// SearchContext is like Search but can be cancelled using ctx (see context.go).
+func (c *Client) SearchContext(ctx context.Context, accountId string, criteria SearchCriteria) ([]SearchResult, error) {
+	switch criteria.Mode {
+	case SearchLocal:
+		return c.searchLocal(accountId, criteria)
+	case SearchMerged:
+		local, err := c.searchLocal(accountId, criteria)
+		if errors.Is(err, storage.ErrNoFTS) {
+			c.logger.Printf("Local search (%v) is not available, returning only server results: %v\n", accountId, err)
+			return c.searchServer(ctx, accountId, criteria)
+		}
+		if err != nil {
+			return nil, err
+		}
+		remote, err := c.searchServer(ctx, accountId, criteria)
+		if err != nil {
+			if ctxError(err) {
+				return nil, err
+			}
+			if _, offline := err.(*AccountError); offline || connectionError(err) {
+				c.logger.Printf("Server search (%v) failed, returning only local results: %v\n", accountId, err)
+				return local, nil
+			}
+			return nil, err
+		}
+		return mergeResults(local, remote), nil
+	}
+	return c.searchServer(ctx, accountId, criteria)
+}
+
+func (c *Client) searchLocal(accountId string, criteria SearchCriteria) ([]SearchResult, error) {
+	hits, err := c.cache(accountId).Search(storage.SearchQuery{
+		Text:   criteria.Text,
+		From:   criteria.From,
+		Before: criteria.Before,
+		After:  criteria.After,
+		Dirs:   criteria.Dirs,
+		Limit:  criteria.Limit,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("search %v: %w", accountId, err)
+	}
+
+	res := make([]SearchResult, len(hits))
+	for i, hit := range hits {
+		res[i] = SearchResult{hit.Dir, hit.Uid, hit.Rank, hit.Snippet}
+	}
+	return res, nil
+}
+
+// mergeResults appends server results not found locally to local results.
+func mergeResults(local, remote []SearchResult) []SearchResult {
+	type key struct {
+		dir string
+		uid uint32
+	}
+	seen := make(map[key]bool, len(local))
+	for _, res := range local {
+		seen[key{res.Dir, res.Uid}] = true
+	}
+	for _, res := range remote {
+		if !seen[key{res.Dir, res.Uid}] {
+			local = append(local, res)
+		}
+	}
+	return local
+}
+
+func (c *Client) searchServer(ctx context.Context, accountId string, criteria SearchCriteria) ([]SearchResult, error) {
 	// IMAP supports only per-dir searches, so we emulate multi-dir search by
 	// searching in each directory and joining results together.
 	dirsToCheck := criteria.Dirs
 	if dirsToCheck == nil {
-		allDirs, err := c.GetDirs(accountId, false)
+		allDirs, err := c.GetDirsContext(ctx, accountId, false)
 		if err != nil {
 			return nil, err
 		}
@@ -71,22 +180,20 @@ func (c *Client) Search(accountId string, criteria SearchCriteria) ([]SearchResu
 	var res []SearchResult
 
 	for _, dir := range dirsToCheck {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		var matches []uint32
 		var err error
-		for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-			matches, err = c.imapConns[accountId].Search(c.rawDirName(accountId, dir), criteria.toGoImap())
-			if err == nil || !connectionError(err) {
-				break
-			}
-			if err := c.connectToServer(accountId); err != nil {
-				return nil, err
-			}
-		}
+		err = c.session(accountId).do(ctx, func(conn *imap.Client) error {
+			matches, err = conn.SearchContext(ctx, c.rawDirName(accountId, dir), criteria.toGoImap())
+			return err
+		})
 		if err != nil {
 			return nil, err
 		}
 		for _, match := range matches {
-			res = append(res, SearchResult{dir, match})
+			res = append(res, SearchResult{Dir: dir, Uid: match})
 		}
 	}
 	return res, nil
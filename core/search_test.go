@@ -0,0 +1,352 @@
+package core
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	eimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/foxcpp/mailbox/proto/common"
+	"github.com/foxcpp/mailbox/proto/imap"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+const testAccount = "test"
+
+// testDialer makes direct connections and can break them to simulate
+// connection loss.
+type testDialer struct {
+	lock    sync.Mutex
+	conns   []*testConn
+	offline bool
+}
+
+func (d *testDialer) Dial(network, addr string) (net.Conn, error) {
+	d.lock.Lock()
+	offline := d.offline
+	d.lock.Unlock()
+	if offline {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	tc := &testConn{Conn: conn}
+	d.conns = append(d.conns, tc)
+	return tc, nil
+}
+
+// breakConns makes all connections made so far fail writes. Connections
+// are not closed so loss is detected only by operations using them, not
+// by pool in background.
+func (d *testDialer) breakConns() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, conn := range d.conns {
+		conn.lock.Lock()
+		conn.broken = true
+		conn.lock.Unlock()
+	}
+	d.conns = nil
+}
+
+// setOffline makes new connections fail (or succeed again).
+func (d *testDialer) setOffline(offline bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.offline = offline
+}
+
+type testConn struct {
+	net.Conn
+
+	lock   sync.Mutex
+	broken bool
+}
+
+func (c *testConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	broken := c.broken
+	c.lock.Unlock()
+	if broken {
+		return 0, &net.OpError{Op: "write", Net: "tcp", Err: syscall.EPIPE}
+	}
+	return c.Conn.Write(b)
+}
+
+// newTestBackend returns memory backend that can be used by several
+// connections (see proto/imap/pool.go) and tests at the same time, memory
+// backend itself is not safe for concurrent use.
+func newTestBackend() backend.Backend {
+	return lockedBackend{&sync.Mutex{}, memory.New()}
+}
+
+type lockedBackend struct {
+	lock *sync.Mutex
+	be   backend.Backend
+}
+
+func (b lockedBackend) Login(username, password string) (backend.User, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	u, err := b.be.Login(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return lockedUser{b.lock, u}, nil
+}
+
+type lockedUser struct {
+	lock *sync.Mutex
+	backend.User
+}
+
+func (u lockedUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	mboxes, err := u.User.ListMailboxes(subscribed)
+	for i, mbox := range mboxes {
+		mboxes[i] = lockedMailbox{u.lock, mbox}
+	}
+	return mboxes, err
+}
+
+func (u lockedUser) GetMailbox(name string) (backend.Mailbox, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return lockedMailbox{u.lock, mbox}, nil
+}
+
+func (u lockedUser) CreateMailbox(name string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.User.CreateMailbox(name)
+}
+
+func (u lockedUser) DeleteMailbox(name string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.User.DeleteMailbox(name)
+}
+
+func (u lockedUser) RenameMailbox(existingName, newName string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.User.RenameMailbox(existingName, newName)
+}
+
+type lockedMailbox struct {
+	lock *sync.Mutex
+	backend.Mailbox
+}
+
+func (m lockedMailbox) Name() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.Mailbox.Name()
+}
+
+func (m lockedMailbox) Info() (*eimap.MailboxInfo, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.Mailbox.Info()
+}
+
+func (m lockedMailbox) Status(items []eimap.StatusItem) (*eimap.MailboxStatus, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.Mailbox.Status(items)
+}
+
+func (m lockedMailbox) SetSubscribed(subscribed bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.Mailbox.SetSubscribed(subscribed)
+}
+
+func (m lockedMailbox) ListMessages(uid bool, seqset *eimap.SeqSet, items []eimap.FetchItem, ch chan<- *eimap.Message) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.Mailbox.ListMessages(uid, seqset, items, ch)
+}
+
+func (m lockedMailbox) SearchMessages(uid bool, criteria *eimap.SearchCriteria) ([]uint32, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.Mailbox.SearchMessages(uid, criteria)
+}
+
+func (m lockedMailbox) CreateMessage(flags []string, date time.Time, body eimap.Literal) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.Mailbox.CreateMessage(flags, date, body)
+}
+
+func (m lockedMailbox) UpdateMessagesFlags(uid bool, seqset *eimap.SeqSet, op eimap.FlagsOp, flags []string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.Mailbox.UpdateMessagesFlags(uid, seqset, op, flags)
+}
+
+func (m lockedMailbox) CopyMessages(uid bool, seqset *eimap.SeqSet, dest string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.Mailbox.CopyMessages(uid, seqset, dest)
+}
+
+func (m lockedMailbox) Expunge() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.Mailbox.Expunge()
+}
+
+// newTestClient returns Client with single account connected to server with
+// specified backend (see newTestBackend, user "username", password
+// "password") using testDialer. Account cache is stored in temporary
+// directory.
+func newTestClient(t *testing.T, be backend.Backend) *Client {
+	srv := server.New(be)
+	srv.AllowInsecureAuth = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	cfg := common.ServConfig{
+		Host:     "127.0.0.1",
+		Port:     uint16(l.Addr().(*net.TCPAddr).Port),
+		ConnType: common.Plaintext,
+		Dialer:   &testDialer{},
+		User:     "username",
+		Pass:     "password",
+	}
+	conn, err := imap.Connect(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Logger = *log.New(ioutil.Discard, "", 0)
+	if err := conn.Auth(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := storage.OpenCacheDB(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cache.Close() })
+
+	maxTries := 1
+	c := &Client{
+		Accounts:     map[string]storage.AccountCfg{testAccount: {}},
+		GlobalCfg:    storage.GlobalCfg{},
+		fileCfgs:     map[string]storage.AccountCfg{testAccount: {}},
+		caches:       map[string]*storage.CacheDB{testAccount: cache},
+		serverCfgs:   map[string]serverConfig{testAccount: {imap: cfg}},
+		imapConns:    map[string]*imap.Client{testAccount: conn},
+		sessions:     make(map[string]*session),
+		outboxes:     make(map[string]*outbox),
+		monitors:     make(map[string]*monitor),
+		prefetchDirs: make(map[string][]string),
+		logger:       log.New(ioutil.Discard, "", 0),
+		debugLog:     log.New(ioutil.Discard, "", 0),
+	}
+	c.GlobalCfg.Connection.MaxTries = &maxTries
+	c.sessions[testAccount] = newSession(c, testAccount)
+	c.imapDirSep.Store(testAccount, ".")
+	return c
+}
+
+func TestSearch(t *testing.T) {
+	c := newTestClient(t, newTestBackend())
+
+	// Same message as one in INBOX of memory backend.
+	if err := c.cache(testAccount).AddDir("INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	err := c.cache(testAccount).Dir("INBOX").AddMsg(&imap.MessageInfo{
+		UID: 6,
+		Msg: common.Msg{
+			Date:    time.Date(2018, 9, 1, 12, 0, 0, 0, time.UTC),
+			Subject: "A little message, just for you",
+			From:    common.Address{Address: "contact@example.org"},
+			Body: common.Part{
+				Type: common.ParametrizedHeader{Value: "text/plain"},
+				Path: "1",
+				Body: []byte("Hi there :)"),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	criteria := SearchCriteria{Text: "little", Dirs: []string{"INBOX"}}
+
+	criteria.Mode = SearchServer
+	res, err := c.Search(testAccount, criteria)
+	if err != nil {
+		t.Fatal("SearchServer:", err)
+	}
+	if len(res) != 1 || res[0].Dir != "INBOX" || res[0].Uid != 6 {
+		t.Errorf("SearchServer: wrong results: %+v", res)
+	}
+
+	criteria.Mode = SearchLocal
+	res, err = c.Search(testAccount, criteria)
+	noFTS := errors.Is(err, storage.ErrNoFTS)
+	if err != nil && !noFTS {
+		t.Fatal("SearchLocal:", err)
+	}
+	if !noFTS && (len(res) != 1 || res[0].Uid != 6 || res[0].Snippet == "") {
+		t.Errorf("SearchLocal: wrong results: %+v", res)
+	}
+
+	// Falls back to server search if there is no index.
+	criteria.Mode = SearchMerged
+	res, err = c.Search(testAccount, criteria)
+	if err != nil {
+		t.Fatal("SearchMerged:", err)
+	}
+	if len(res) != 1 || res[0].Dir != "INBOX" || res[0].Uid != 6 {
+		t.Errorf("SearchMerged: wrong results: %+v", res)
+	}
+	if !noFTS && res[0].Snippet == "" {
+		t.Errorf("SearchMerged: local result is not preferred: %+v", res)
+	}
+}
+
+func TestMergeResults(t *testing.T) {
+	local := []SearchResult{{Dir: "INBOX", Uid: 2, Rank: -1, Snippet: "[a]"}}
+	remote := []SearchResult{{Dir: "INBOX", Uid: 1}, {Dir: "INBOX", Uid: 2}, {Dir: "Sent", Uid: 2}}
+
+	res := mergeResults(local, remote)
+	expected := []SearchResult{local[0], remote[0], remote[2]}
+	if len(res) != len(expected) {
+		t.Fatalf("Wrong amount of results: %+v", res)
+	}
+	for i := range expected {
+		if res[i] != expected[i] {
+			t.Errorf("Wrong result %v: %+v (expected %+v)", i, res[i], expected[i])
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package core
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/mailbox/proto/imap"
+)
+
+/*
+Account sessions.
+
+Each account has a session that tracks state of connection to IMAP server
+and performs operations using it (see session.do). Operation failed because
+of connection loss is repeated after reconnection, up to connection.maxtries
+times. Reconnection attempts after the first one are delayed exponentially
+with random jitter, so unreachable server is not flooded with attempts.
+
+Reconnection is serialized: if connection is lost by several goroutines at
+the same time, only one of them reconnects and others wait for result.
+State changes are reported using FrontendHooks.ConnState.
+
+Once connection is re-established, changes made while it was lost are
+applied (journal replay, see journal.go) and picked up (see
+connectionRestored). This is done after reconnection completes, so replay
+uses session.do like any other operation.
+*/
+
+// ConnState is a state of connection to IMAP server of account.
+type ConnState int
+
+const (
+	// Connection is lost, it will be re-established when needed.
+	Disconnected ConnState = iota
+	// Connection is being (re-)established.
+	Connecting
+	// Connection is established and authenticated.
+	Authenticated
+	// Last connection attempt failed.
+	Failed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case Disconnected:
+		return "disconnected"
+	case Connecting:
+		return "connecting"
+	case Authenticated:
+		return "authenticated"
+	case Failed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+const (
+	retryMinDelay = 1 * time.Second
+	retryMaxDelay = 30 * time.Second
+)
+
+type session struct {
+	c         *Client
+	accountId string
+
+	lock  sync.Mutex
+	state ConnState
+	// Incremented each time connection is re-established, so goroutines
+	// that lost the same connection reconnect only once.
+	generation int
+	// Closed when reconnection in progress completes, nil if there is no
+	// one.
+	reconnecting chan struct{}
+	// Result of last reconnection.
+	lastErr *AccountError
+}
+
+func newSession(c *Client, accountId string) *session {
+	return &session{
+		c:         c,
+		accountId: accountId,
+		state:     Disconnected,
+	}
+}
+
+// ConnState returns state of connection to IMAP server of account.
+// Disconnected is returned for accounts that are not loaded.
+func (c *Client) ConnState(accountId string) ConnState {
+	s := c.session(accountId)
+	if s == nil {
+		// Unknown or unloaded account.
+		return Disconnected
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state
+}
+
+// setState changes state and notifies frontend about change. err is a
+// cause of Failed state.
+func (s *session) setState(state ConnState, err error) {
+	s.lock.Lock()
+	changed := s.state != state
+	s.state = state
+	s.lock.Unlock()
+
+	if changed && s.c.Hooks.ConnState != nil {
+		s.c.Hooks.ConnState(s.accountId, state, err)
+	}
+}
+
+// do calls f with connection to IMAP server, repeating it after
+// reconnection if it failed because of connection loss.
+//
+// *AccountError is returned if connection can't be re-established.
+func (s *session) do(ctx context.Context, f func(conn *imap.Client) error) error {
+	var err error
+	for i := 0; i < s.c.maxTries(s.accountId); i++ {
+		s.lock.Lock()
+		generation := s.generation
+		s.lock.Unlock()
+
+		err = f(s.c.imapConn(s.accountId))
+		if err == nil || !connectionError(err) {
+			return err
+		}
+		s.c.debugLog.Printf("Connection lost (%v): %v\n", s.accountId, err)
+		if connErr := s.reconnect(ctx, generation, i); connErr != nil {
+			return connErr
+		}
+	}
+	return err
+}
+
+// reconnect re-establishes connection after attempt-th try of operation
+// (counting from zero) failed because connection of specified generation
+// was lost. Nothing is done if connection was already re-established since
+// then.
+func (s *session) reconnect(ctx context.Context, generation, attempt int) *AccountError {
+	s.lock.Lock()
+	lost := s.generation == generation && s.reconnecting == nil
+	s.lock.Unlock()
+	if lost {
+		s.setState(Disconnected, nil)
+	}
+
+	if attempt != 0 {
+		select {
+		case <-time.After(jitter(retryDelay(attempt))):
+		case <-ctx.Done():
+			return &AccountError{s.accountId, ctx.Err()}
+		}
+	}
+
+	s.lock.Lock()
+	current := s.generation != generation
+	s.lock.Unlock()
+	if current {
+		return nil
+	}
+	return s.connect(ctx)
+}
+
+// connect establishes connection to server. If connection is already being
+// established by other goroutine, it waits for result instead.
+func (s *session) connect(ctx context.Context) *AccountError {
+	for {
+		s.lock.Lock()
+		wait := s.reconnecting
+		if wait == nil {
+			s.reconnecting = make(chan struct{})
+			s.lock.Unlock()
+			break
+		}
+		s.lock.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return &AccountError{s.accountId, ctx.Err()}
+		}
+		s.lock.Lock()
+		err := s.lastErr
+		s.lock.Unlock()
+		// Attempt cancelled by other goroutine says nothing about server
+		// availability.
+		if err == nil || !ctxError(err) {
+			return err
+		}
+	}
+
+	s.setState(Connecting, nil)
+	restored := s.c.imapConn(s.accountId) != nil
+	err := s.c.connectToServer(ctx, s.accountId)
+
+	s.lock.Lock()
+	if err == nil {
+		s.generation++
+	}
+	s.lastErr = err
+	close(s.reconnecting)
+	s.reconnecting = nil
+	s.lock.Unlock()
+
+	switch {
+	case err == nil:
+		s.setState(Authenticated, nil)
+		if restored {
+			// Other goroutines may use connection already, journal replay
+			// makes sure new operations are not applied before offline ones.
+			s.c.connectionRestored(ctx, s.accountId)
+		}
+	case ctxError(err):
+		s.setState(Disconnected, nil)
+	default:
+		s.setState(Failed, err)
+	}
+	return err
+}
+
+// retryDelay returns delay before reconnection after specified amount of
+// failed tries.
+func retryDelay(attempt int) time.Duration {
+	delay := retryMinDelay
+	for i := 1; i < attempt && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		return retryMaxDelay
+	}
+	return delay
+}
+
+// jitter returns random duration between delay/2 and delay*3/2.
+func jitter(delay time.Duration) time.Duration {
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)))
+}
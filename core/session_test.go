@@ -0,0 +1,81 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	eimap "github.com/emersion/go-imap"
+)
+
+func TestConnStateUnknownAccount(t *testing.T) {
+	c := newTestClient(t, newTestBackend())
+	if state := c.ConnState("missing"); state != Disconnected {
+		t.Errorf("Wrong state of unknown account: %v", state)
+	}
+}
+
+func TestReplayReconnect(t *testing.T) {
+	be := newTestBackend()
+	c := newTestClient(t, be)
+	states := make(chan ConnState, 16)
+	c.Hooks.ConnState = func(_ string, state ConnState, _ error) {
+		states <- state
+	}
+	c.Hooks.ReplayConflict = func(_ string, conflict ReplayConflict) {
+		t.Errorf("Unexpected conflict: %+v", conflict)
+	}
+	if err := c.cache(testAccount).AddDir("INBOX"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Message 6 is in INBOX of memory backend.
+	err := c.queueOp(testAccount, opTag, "INBOX", offlineOp{Uids: []uint32{6}, Tag: string(FlaggedTag)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Connection is lost so operation is repeated by session after
+	// reconnection.
+	maxTries := 2
+	c.GlobalCfg.Connection.MaxTries = &maxTries
+	c.serverCfg(testAccount).imap.Dialer.(*testDialer).breakConns()
+
+	c.replayJournal(context.Background(), testAccount)
+
+	if pending, err := c.PendingOps(testAccount); err != nil || pending != 0 {
+		t.Fatalf("Journal is not replayed: %v, %v", pending, err)
+	}
+	for _, expected := range []ConnState{Connecting, Authenticated} {
+		select {
+		case state := <-states:
+			if state != expected {
+				t.Fatalf("Wrong state reported: %v (expected %v)", state, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Reconnection is not performed by session, %v is not reported", expected)
+		}
+	}
+
+	user, err := be.Login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqset := eimap.SeqSet{}
+	seqset.AddNum(6)
+	msgs := make(chan *eimap.Message, 1)
+	if err := inbox.ListMessages(true, &seqset, []eimap.FetchItem{eimap.FetchFlags}, msgs); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-msgs
+	flagged := false
+	for _, flag := range msg.Flags {
+		flagged = flagged || flag == eimap.FlaggedFlag
+	}
+	if !flagged {
+		t.Errorf("Operation is not applied: %v", msg.Flags)
+	}
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"context"
+	"strings"
+
+	"github.com/foxcpp/mailbox/proto/imap"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+// specialDir describes special directory from AccountCfg.Dirs.
+type specialDir struct {
+	field    func(cfg *storage.AccountCfg) *string
+	use      string
+	fallback string
+	// Create directory if it doesn't exists. Directories not created are
+	// left unset.
+	create bool
+}
+
+var specialDirs = []specialDir{
+	{func(cfg *storage.AccountCfg) *string { return &cfg.Dirs.Drafts }, imap.SpecialDrafts, "Drafts", true},
+	{func(cfg *storage.AccountCfg) *string { return &cfg.Dirs.Sent }, imap.SpecialSent, "Sent", true},
+	{func(cfg *storage.AccountCfg) *string { return &cfg.Dirs.Trash }, imap.SpecialTrash, "Trash", true},
+	{func(cfg *storage.AccountCfg) *string { return &cfg.Dirs.Junk }, imap.SpecialJunk, "Junk", false},
+	{func(cfg *storage.AccountCfg) *string { return &cfg.Dirs.Archive }, imap.SpecialArchive, "Archive", false},
+}
+
+// setSpecialUseDirs fills special directories not set in account
+// configuration using special-use attributes (RFC 6154) reported by server.
+//
+// If server doesn't marks any directory for some purpose - directory with
+// conventional name ("Sent", "Trash", etc) is used. Drafts, Sent and Trash
+// directories are created if they don't exist.
+//
+// Only effective configuration is changed, detected directories are not
+// saved to account configuration file.
+func (c *Client) setSpecialUseDirs(ctx context.Context, accountId string) {
+	conf := c.account(accountId)
+	// Detected names, by index in specialDirs.
+	found := make([]string, len(specialDirs))
+	defer func() {
+		// Configuration may be changed while server is queried, only
+		// directories that are still unset are filled.
+		c.updateEffectiveAccount(accountId, func(cfg *storage.AccountCfg) {
+			for i, dir := range specialDirs {
+				if field := dir.field(cfg); *field == "" {
+					*field = found[i]
+				}
+			}
+		})
+		conf := c.account(accountId)
+		c.debugLog.Printf("Special directories for %v: drafts=%v, sent=%v, trash=%v, junk=%v, archive=%v\n",
+			accountId, conf.Dirs.Drafts, conf.Dirs.Sent, conf.Dirs.Trash, conf.Dirs.Junk, conf.Dirs.Archive)
+	}()
+
+	missing := false
+	for _, dir := range specialDirs {
+		if *dir.field(&conf) == "" {
+			missing = true
+		}
+	}
+	if !missing {
+		return
+	}
+
+	var separator string
+	var infos []imap.DirInfo
+	var err error
+	err = c.session(accountId).do(ctx, func(conn *imap.Client) error {
+		separator, infos, err = conn.DirListContext(ctx)
+		return err
+	})
+	if err != nil {
+		c.logger.Printf("Failed to detect special directories (%v), using default names: %v\n", accountId, err)
+		for i, dir := range specialDirs {
+			if *dir.field(&conf) == "" && dir.create {
+				found[i] = dir.fallback
+			}
+		}
+		return
+	}
+	c.imapDirSep.Store(accountId, separator)
+
+	byUse := make(map[string]string)
+	byName := make(map[string]string)
+	for _, info := range infos {
+		name := c.normalizeDirName(accountId, info.Name)
+		byName[strings.ToLower(name)] = name
+		for _, attr := range info.Attrs {
+			use := imap.CanonicalSpecialUse(attr)
+			if _, prs := byUse[use]; !prs && use != "" {
+				byUse[use] = name
+			}
+		}
+	}
+
+	for i, dir := range specialDirs {
+		if *dir.field(&conf) != "" {
+			continue
+		}
+		if name, prs := byUse[dir.use]; prs {
+			found[i] = name
+			continue
+		}
+		if name, prs := byName[strings.ToLower(dir.fallback)]; prs {
+			found[i] = name
+			continue
+		}
+		if !dir.create {
+			continue
+		}
+
+		found[i] = dir.fallback
+		c.logger.Printf("Creating %v directory (%v)...\n", dir.fallback, accountId)
+		err := c.session(accountId).do(ctx, func(conn *imap.Client) error {
+			return conn.CreateSpecialDirContext(ctx, c.rawDirName(accountId, dir.fallback), dir.use)
+		})
+		if err != nil {
+			c.logger.Printf("Failed to create %v directory (%v): %v\n", dir.fallback, accountId, err)
+			continue
+		}
+		c.cache(accountId).AddDir(dir.fallback)
+	}
+}
@@ -0,0 +1,96 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	eimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// specialUseBackend reports attributes for directories of wrapped backend
+// in LIST responses.
+type specialUseBackend struct {
+	backend.Backend
+	attrs map[string]string
+}
+
+func (b specialUseBackend) Login(username, password string) (backend.User, error) {
+	u, err := b.Backend.Login(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return specialUseUser{u, b.attrs}, nil
+}
+
+type specialUseUser struct {
+	backend.User
+	attrs map[string]string
+}
+
+func (u specialUseUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	mboxes, err := u.User.ListMailboxes(subscribed)
+	for i, mbox := range mboxes {
+		mboxes[i] = specialUseMailbox{mbox, u.attrs[mbox.Name()]}
+	}
+	return mboxes, err
+}
+
+type specialUseMailbox struct {
+	backend.Mailbox
+	attr string
+}
+
+func (m specialUseMailbox) Info() (*eimap.MailboxInfo, error) {
+	info, err := m.Mailbox.Info()
+	if err == nil && m.attr != "" {
+		info.Attributes = append(info.Attributes, m.attr)
+	}
+	return info, err
+}
+
+func TestSpecialUseDirs(t *testing.T) {
+	be := specialUseBackend{newTestBackend(), map[string]string{
+		// Attributes are case-insensitive.
+		"Sent Items": `\sent`,
+		"Spam":       `\Junk`,
+	}}
+	user, err := be.Login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Sent Items", "Spam", "Trash"} {
+		if err := user.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := newTestClient(t, be)
+	acc := c.Accounts[testAccount]
+	acc.Dirs.Archive = "Old"
+	c.Accounts[testAccount] = acc
+
+	c.setSpecialUseDirs(context.Background(), testAccount)
+
+	dirs := c.account(testAccount).Dirs
+	if dirs.Sent != "Sent Items" || dirs.Junk != "Spam" {
+		t.Errorf("Special-use directories are not detected: sent %q, junk %q", dirs.Sent, dirs.Junk)
+	}
+	if dirs.Trash != "Trash" {
+		t.Errorf("Directory with conventional name is not used: %q", dirs.Trash)
+	}
+	if dirs.Archive != "Old" {
+		t.Errorf("Configured directory is replaced: %q", dirs.Archive)
+	}
+	if dirs.Drafts != "Drafts" {
+		t.Errorf("Missing Drafts directory is not set: %q", dirs.Drafts)
+	}
+	if _, err := user.GetMailbox("Drafts"); err != nil {
+		t.Errorf("Missing Drafts directory is not created: %v", err)
+	}
+
+	// Detected directories are not written to configuration file.
+	if fileCfg, _ := c.fileCfg(testAccount); fileCfg.Dirs.Sent != "" {
+		t.Errorf("Detected directory is saved to file configuration: %q", fileCfg.Dirs.Sent)
+	}
+}
@@ -3,6 +3,8 @@
 package core
 
 import (
+	"context"
+	"crypto/x509"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -11,10 +13,12 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	eimap "github.com/emersion/go-imap"
 	"github.com/foxcpp/mailbox/proto/common"
 	"github.com/foxcpp/mailbox/proto/imap"
+	"github.com/foxcpp/mailbox/proto/smtp"
 	"github.com/foxcpp/mailbox/storage"
 )
 
@@ -39,6 +43,42 @@ type FrontendHooks struct {
 
 	// Called when new message received.
 	NewMessage func(string, string, *imap.MessageInfo)
+
+	// Called when operation performed while server was not reachable can't
+	// be applied to server state. First argument is account ID.
+	ReplayConflict func(string, ReplayConflict)
+
+	// Called when configuration file changed on disk can't be applied.
+	// First argument is account ID or empty string for global.yml.
+	ConfigReloadError func(string, error)
+
+	// Called to get OAuth access tokens source for account (first
+	// argument) that uses OAuth authentication. If nil or returns nil,
+	// refresh token from account configuration is used.
+	TokenSource func(string) common.TokenSource
+
+	// Called when server certificate doesn't match pinned one. Arguments
+	// are account ID, server host name and new certificate. If true is
+	// returned, certificate is accepted and pinned.
+	CertChanged func(string, string, *x509.Certificate) bool
+
+	// Called when message from outbox is delivered. Arguments are account
+	// ID, outbox entry ID and UID of copy in Sent directory (zero if none).
+	OutboxSent func(string, int64, uint32)
+
+	// Called when delivery of message from outbox failed. Arguments are
+	// account ID, outbox entry ID, error and time of next attempt (zero if
+	// message will not be delivered without RetryOutbox call).
+	OutboxError func(string, int64, error, time.Time)
+
+	// Called when contents of virtual view changed (see views.go).
+	// Frontend should re-request it using GetView.
+	ViewChanged func(View)
+
+	// Called when state of connection to IMAP server changes (see
+	// session.go). Arguments are account ID, new state and error that
+	// caused Failed state (nil for other states).
+	ConnState func(string, ConnState, error)
 }
 
 type Client struct {
@@ -46,23 +86,45 @@ type Client struct {
 	Hooks           FrontendHooks
 
 	masterKey []byte
+
+	// Protects Accounts, GlobalCfg and per-account maps below, see
+	// state.go. Frontend should use EffectiveConfig and Identities instead
+	// of reading Accounts and GlobalCfg directly.
+	stateLock sync.RWMutex
+
 	Accounts  map[string]storage.AccountCfg
 	GlobalCfg storage.GlobalCfg
 
+	// Account configuration as passed to LoadAccount, without values
+	// detected automatically.
+	fileCfgs map[string]storage.AccountCfg
+
 	caches map[string]*storage.CacheDB
 
-	serverCfgs map[string]struct {
-		imap, smtp common.ServConfig
-	}
+	serverCfgs map[string]serverConfig
 
 	imapConns map[string]*imap.Client
 
+	// Connection state and retry logic, see session.go.
+	sessions map[string]*session
+
+	// Delivery goroutines for outbox, see outbox.go.
+	outboxes map[string]*outbox
+
+	// Goroutines monitoring watched directories, see monitor.go.
+	monitors map[string]*monitor
+
 	// Per-account list of directories message list for which is downloaded early (during Launch).
 	// Currently this is only INBOX.
 	prefetchDirs map[string][]string
 
 	imapDirSep sync.Map
 
+	// Accounts for which journal replay is in progress.
+	replaying sync.Map
+
+	cfgWatcher *storage.ConfigWatcher
+
 	logger, debugLog *log.Logger
 	logFile          *os.File
 }
@@ -76,6 +138,10 @@ func (e AccountError) Error() string {
 	return fmt.Sprintf("accountErr %v: %v", e.AccountId, e.Err)
 }
 
+func (e AccountError) Unwrap() error {
+	return e.Err
+}
+
 // Launch reads client configuration and connects to servers.
 //
 // hooks argument provides set of callbacks to call on various events. All functions must be provided.
@@ -120,14 +186,16 @@ func Launch(hooks FrontendHooks, userLogOut io.Writer) (*Client, error) {
 		return nil, errors.New("launch: failed to prepare master key")
 	}
 
-	res.serverCfgs = make(map[string]struct {
-		imap, smtp common.ServConfig
-	})
+	res.serverCfgs = make(map[string]serverConfig)
 
 	res.Accounts = make(map[string]storage.AccountCfg)
+	res.fileCfgs = make(map[string]storage.AccountCfg)
 	res.caches = make(map[string]*storage.CacheDB)
 	res.imapConns = make(map[string]*imap.Client)
+	res.sessions = make(map[string]*session)
 	res.prefetchDirs = make(map[string][]string)
+	res.outboxes = make(map[string]*outbox)
+	res.monitors = make(map[string]*monitor)
 
 	for name, info := range accounts {
 		res.debugLog.Println("Setting up account", name+"...")
@@ -140,17 +208,22 @@ func Launch(hooks FrontendHooks, userLogOut io.Writer) (*Client, error) {
 	// Save new config, in case something changed something.
 	storage.SaveGlobal(&res.GlobalCfg)
 
+	res.watchConfig()
+
 	return res, nil
 }
 
 func (c *Client) Stop() {
-	for name := range c.Accounts {
+	if c.cfgWatcher != nil {
+		c.cfgWatcher.Close()
+	}
+	for _, name := range c.accountIds() {
 		c.UnloadAccount(name)
 	}
 	c.logFile.Close()
 }
 
-func (c *Client) prepareServerConfig(accountId string) {
+func (c *Client) prepareServerConfig(accountId string) error {
 	connTypeConv := func(s string) common.ConnType {
 		if s == "tls" {
 			return common.TLS
@@ -158,14 +231,44 @@ func (c *Client) prepareServerConfig(accountId string) {
 		if s == "starttls" {
 			return common.STARTTLS
 		}
+		if s == "none" {
+			return common.Plaintext
+		}
 		// Config reader checks validity, so this should not really happen
 		return common.STARTTLS
 	}
 
-	info := c.Accounts[accountId]
+	info := c.account(accountId)
+
+	if info.Server.Imap.Encryption == "none" || info.Server.Smtp.Encryption == "none" {
+		c.logger.Printf("WARNING: Encryption is disabled for %v, credentials and messages are sent in plain text.\n", accountId)
+	}
+	imapTLS, err := c.tlsPolicy(accountId, "imap", info.Server.Imap.TLS)
+	if err != nil {
+		return err
+	}
+	smtpTLS, err := c.tlsPolicy(accountId, "smtp", info.Server.Smtp.TLS)
+	if err != nil {
+		return err
+	}
+
+	var dialer common.Dialer
+	if proxy := c.EffectiveConfig(accountId).Connection.Proxy; proxy != "" && proxy != "none" {
+		dialer, err = common.NewProxyDialer(proxy)
+		if err != nil {
+			return err
+		}
+		c.debugLog.Println("Using proxy for", accountId)
+	}
+
+	method := authMethod(info.Credentials.Auth)
+	var token common.TokenSource
+	if method != common.AuthPlain {
+		token = c.tokenSource(accountId, dialer)
+	}
 
 	pass := ""
-	if len(info.Credentials.Pass) != 0 {
+	if method == common.AuthPlain && len(info.Credentials.Pass) != 0 {
 		encPass, err := hex.DecodeString(info.Credentials.Pass)
 		if err != nil {
 			pass = ""
@@ -177,61 +280,89 @@ func (c *Client) prepareServerConfig(accountId string) {
 			pass = string(passBytes)
 		}
 	}
-	if pass == "" && c.Hooks.PasswordPrompt != nil {
+	if method == common.AuthPlain && pass == "" && c.Hooks.PasswordPrompt != nil {
 		pass = c.Hooks.PasswordPrompt("Enter password for " + info.SenderEmail + ":")
 	}
 
-	c.serverCfgs[accountId] = struct{ imap, smtp common.ServConfig }{
+	cfg := serverConfig{
 		imap: common.ServConfig{
-			Host:     info.Server.Imap.Host,
-			Port:     info.Server.Imap.Port,
-			ConnType: connTypeConv(info.Server.Imap.Encryption),
-			User:     info.Credentials.User,
-			Pass:     pass,
+			Host:       info.Server.Imap.Host,
+			Port:       info.Server.Imap.Port,
+			ConnType:   connTypeConv(info.Server.Imap.Encryption),
+			TLS:        imapTLS,
+			Dialer:     dialer,
+			User:       info.Credentials.User,
+			Pass:       pass,
+			AuthMethod: method,
+			Token:      token,
+
+			Mechanisms:          info.Credentials.Mechanisms,
+			ForbiddenMechanisms: info.Credentials.ForbidMechanisms,
 		},
 		smtp: common.ServConfig{
-			Host:     info.Server.Smtp.Host,
-			Port:     info.Server.Smtp.Port,
-			ConnType: connTypeConv(info.Server.Smtp.Encryption),
-			User:     info.Credentials.User,
-			Pass:     pass,
+			Host:       info.Server.Smtp.Host,
+			Port:       info.Server.Smtp.Port,
+			ConnType:   connTypeConv(info.Server.Smtp.Encryption),
+			TLS:        smtpTLS,
+			Dialer:     dialer,
+			User:       info.Credentials.User,
+			Pass:       pass,
+			AuthMethod: method,
+			Token:      token,
+
+			Mechanisms:          info.Credentials.Mechanisms,
+			ForbiddenMechanisms: info.Credentials.ForbidMechanisms,
 		},
 	}
 
+	c.stateLock.Lock()
+	c.serverCfgs[accountId] = cfg
 	c.prefetchDirs[accountId] = []string{"INBOX"}
+	c.stateLock.Unlock()
+	return nil
 }
 
-func (c *Client) connectToServer(accountId string) *AccountError {
-	var err error
+func (c *Client) connectToServer(ctx context.Context, accountId string) *AccountError {
+	if err := ctx.Err(); err != nil {
+		return &AccountError{accountId, err}
+	}
+	cfg := c.serverCfg(accountId).imap
 
-	if c.imapConns[accountId] != nil {
-		if err := c.imapConns[accountId].Reconnect(); err != nil {
+	if conn := c.imapConn(accountId); conn != nil {
+		if err := conn.ReconnectContext(ctx); err != nil {
 			return &AccountError{accountId, err}
 		}
-		if err := c.imapConns[accountId].Auth(c.serverCfgs[accountId].imap); err != nil {
+		if err := conn.AuthContext(ctx, cfg); err != nil {
 			return &AccountError{accountId, err}
 		}
 		return nil
 	}
 
-	c.logger.Printf("Connecting to IMAP server (%v:%v)...\n",
-		c.serverCfgs[accountId].imap.Host,
-		c.serverCfgs[accountId].imap.Port)
-	c.imapConns[accountId], err = imap.Connect(c.serverCfgs[accountId].imap)
+	c.logger.Printf("Connecting to IMAP server (%v:%v)...\n", cfg.Host, cfg.Port)
+	conn, err := imap.ConnectContext(ctx, cfg)
 	if err != nil {
 		c.logger.Println("Connection failed:", err)
 		return &AccountError{accountId, err}
 	}
+	// Set before authentication so updates received right after it are not
+	// lost.
+	conn.SetCallbacks(c.makeUpdateCallbacks(accountId))
+	conn.Logger = *log.New(c.logFile, "imap["+accountId+",debug] ", log.LstdFlags)
+	conn.SetPoolSize(*c.EffectiveConfig(accountId).Connection.PoolSize)
+	c.stateLock.Lock()
+	c.imapConns[accountId] = conn
+	c.stateLock.Unlock()
+
 	c.logger.Println("Authenticating to IMAP server...")
-	err = c.imapConns[accountId].Auth(c.serverCfgs[accountId].imap)
-	if err != nil {
-		c.logger.Println("Authentication failed:", err)
+	if err := conn.AuthContext(ctx, cfg); err != nil {
+		if errors.Is(err, imap.ErrAuthFailed) {
+			c.logger.Println("Server rejected credentials:", err)
+		} else {
+			c.logger.Println("Authentication failed:", err)
+		}
 		return &AccountError{accountId, err}
 	}
 
-	c.imapConns[accountId].Callbacks = c.makeUpdateCallbacks(accountId)
-	c.imapConns[accountId].Logger = *log.New(c.logFile, "imap["+accountId+",debug] ", log.LstdFlags)
-
 	return nil
 }
 
@@ -243,7 +374,79 @@ func (c *Client) dirSep(accountId string) string {
 	return val.(string)
 }
 
+// makeUpdateCallbacks returns callbacks for unsolicited updates from IMAP
+// server.
+//
+// Callbacks are called by update dispatcher of imap.Client, updates from
+// all connections wait for it, so handlers that make requests using the
+// same client would deadlock once buffer of updates is full. Handlers are
+// run in order by separate goroutine instead (see updateQueue).
 func (c *Client) makeUpdateCallbacks(accountId string) *imap.UpdateCallbacks {
+	q := &updateQueue{}
+	handlers := c.updateHandlers(accountId)
+	return &imap.UpdateCallbacks{
+		NewMessage: func(dir string, seqnum uint32) {
+			q.push(func() { handlers.NewMessage(dir, seqnum) })
+		},
+		MessageRemoved: func(dir string, uid uint32) {
+			q.push(func() { handlers.MessageRemoved(dir, uid) })
+		},
+		MessageUpdate: func(dir string, info *eimap.Message) {
+			q.push(func() { handlers.MessageUpdate(dir, info) })
+		},
+		MboxUpdate: func(status *eimap.MailboxStatus) {
+			q.push(func() { handlers.MboxUpdate(status) })
+		},
+		DirStatus: func(status *imap.DirStatus) {
+			q.push(func() { handlers.DirStatus(status) })
+		},
+		DirStatusLost: func() {
+			q.push(handlers.DirStatusLost)
+		},
+	}
+}
+
+// updateQueue runs functions in order on separate goroutine. Goroutine is
+// started when the first function is added and exits once queue is empty.
+type updateQueue struct {
+	lock    sync.Mutex
+	pending []func()
+	running bool
+}
+
+func (q *updateQueue) push(f func()) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.pending = append(q.pending, f)
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+}
+
+func (q *updateQueue) run() {
+	for {
+		q.lock.Lock()
+		if len(q.pending) == 0 {
+			q.running = false
+			q.lock.Unlock()
+			return
+		}
+		f := q.pending[0]
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+		q.lock.Unlock()
+
+		f()
+	}
+}
+
+// updateHandlers returns handlers of unsolicited updates, they make
+// requests to server and must not be called by update dispatcher directly
+// (see makeUpdateCallbacks).
+func (c *Client) updateHandlers(accountId string) *imap.UpdateCallbacks {
+	// Updates are processed in background and never cancelled.
+	ctx := context.Background()
 	return &imap.UpdateCallbacks{
 		NewMessage: func(dir string, seqnum uint32) {
 			c.logger.Printf("New message for account %v in dir %v.\n", accountId, dir)
@@ -254,142 +457,150 @@ func (c *Client) makeUpdateCallbacks(accountId string) *imap.UpdateCallbacks {
 
 			// TODO: Measure performance impact of this extract resolve request
 			// and consider exposing seqnum-based operations in imap.Client.
-			uid, err := c.resolveUid(accountId, dir, seqnum)
+			uid, err := c.resolveUid(ctx, accountId, dir, seqnum)
 			if err != nil {
 				c.debugLog.Println("Alert: Reloading message list: failed to download message:", err)
-				c.reloadMaillist(accountId, dir)
+				c.reloadMaillist(ctx, accountId, dir)
 				return
 			}
 
-			count := c.caches[accountId].Dir(dir).MsgsCount()
+			if _, err := c.cache(accountId).Dir(dir).GetMsg(uid); err == nil {
+				// Already added by directories monitor (see monitor.go).
+				return
+			}
+
+			count := c.cache(accountId).Dir(dir).MsgsCount()
 
 			if seqnum != uint32(count+1) {
 				c.debugLog.Println("Alert: Reloading message list: sequence numbers de-synced.")
-				c.reloadMaillist(accountId, dir)
+				c.reloadMaillist(ctx, accountId, dir)
 				return
 			}
 			// If this thing really should go to the end of slice...
 
 			var msg *imap.MessageInfo
-			for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-				msg, err = c.imapConns[accountId].FetchPartialMail(rawDir, uid, imap.TextOnly)
-				if err == nil || !connectionError(err) {
-					break
-				}
-				err = c.connectToServer(accountId)
-			}
+			err = c.session(accountId).do(ctx, func(conn *imap.Client) error {
+				msg, err = conn.FetchPartialMailContext(ctx, rawDir, uid, imap.TextOnly)
+				return err
+			})
 			if err != nil {
 				c.debugLog.Println("Alert: Reloading message list: failed to download message:", err)
-				c.reloadMaillist(accountId, dir)
+				c.reloadMaillist(ctx, accountId, dir)
 				return
 			}
 
-			if err := c.caches[accountId].Dir(dir).AddMsg(msg); err != nil {
+			if err := c.cache(accountId).Dir(dir).AddMsg(msg); err != nil {
 				c.debugLog.Println("Cache AddMsg:", err)
 			}
 
-			if c.Hooks.ResetDir != nil {
-				c.Hooks.ResetDir(accountId, dir)
+			c.dirChanged(accountId, dir)
+			if c.Hooks.NewMessage != nil {
+				c.Hooks.NewMessage(accountId, dir, msg)
 			}
 		},
-		MessageRemoved: func(dir string, seqnum uint32) {
+		MessageRemoved: func(dir string, uid uint32) {
 			c.logger.Printf("Message removed from dir %v on account %v.\n", dir, accountId)
-			c.debugLog.Printf("Message removed from dir %v on account %v, sequence number: %v.\n", dir, accountId, seqnum)
+			c.debugLog.Printf("Message removed from dir %v on account %v, UID: %v.\n", dir, accountId, uid)
 
 			dir = c.normalizeDirName(accountId, dir)
 
-			count := c.caches[accountId].Dir(dir).MsgsCount()
-
-			if uint32(count) < seqnum {
-				c.debugLog.Println("Alert: Reloading message list: sequence number is out of range.")
-				c.reloadMaillist(accountId, dir)
+			if uid == 0 {
+				c.debugLog.Println("Alert: Reloading message list: UID of removed message is unknown.")
+				c.reloadMaillist(ctx, accountId, dir)
 				return
 			}
-			// Look-up UID to remove in cache.
-			uid, err := c.caches[accountId].Dir(dir).ResolveUid(seqnum)
-			if err != nil {
-				c.debugLog.Println("Alert: Reloading message list: failed to resolve UID for removed message.")
-				c.reloadMaillist(accountId, dir)
-			}
-			if err := c.caches[accountId].Dir(dir).DelMsg(uid); err != nil {
+			if err := c.cache(accountId).Dir(dir).DelMsg(uid); err != nil {
 				c.debugLog.Println("Cache DelMsg:", err)
 			}
 
-			if c.Hooks.ResetDir != nil {
-				c.Hooks.ResetDir(accountId, dir)
-			}
+			c.dirChanged(accountId, dir)
 		},
 		MessageUpdate: func(dir string, info *eimap.Message) {
 			// Basically, this is only Flags change.
 			if info.Uid != 0 && info.Flags != nil {
-				c.caches[accountId].Dir(c.normalizeDirName(accountId, dir)).ReplaceTagList(info.Uid, info.Flags)
+				dir = c.normalizeDirName(accountId, dir)
+				c.cache(accountId).Dir(dir).ReplaceTagList(info.Uid, info.Flags)
+				c.notifyViews(accountId, dir)
 			}
 		},
 		MboxUpdate: func(status *eimap.MailboxStatus) {
 			dir := c.normalizeDirName(accountId, status.Name)
 
-			uidv, err := c.caches[accountId].Dir(dir).UidValidity()
+			uidv, err := c.cache(accountId).Dir(dir).UidValidity()
 			if err != nil {
 				return
 			}
-			if uidv != status.UidValidity {
+			// Zero if update is received while directory is being selected.
+			if status.UidValidity != 0 && uidv != status.UidValidity {
 				c.debugLog.Println("UIDVALIDITY changed for dir", status.Name)
-				c.reloadMaillist(accountId, status.Name)
-				c.caches[accountId].Dir(dir).SetUidValidity(uidv)
+				c.reloadMaillist(ctx, accountId, dir)
 			}
-			c.caches[accountId].Dir(dir).SetUnreadCount(uint(status.Unseen))
+			c.cache(accountId).Dir(dir).SetUnreadCount(uint(status.Unseen))
+		},
+		DirStatus: func(status *imap.DirStatus) {
+			c.debugLog.Printf("Server reported changes in dir %v on account %v.\n", status.Name, accountId)
+			c.dirStatusChanged(accountId, status)
+		},
+		DirStatusLost: func() {
+			c.dirStatusLost(accountId)
 		},
 	}
 }
 
 // prefetchData is called for early data population shortly after
 // account loading.
-func (c *Client) prefetchData(accountId string) error {
-	_, err := c.GetDirs(accountId, true)
+func (c *Client) prefetchData(ctx context.Context, accountId string) error {
+	_, err := c.GetDirsContext(ctx, accountId, true)
 	if err != nil {
 		return err
 	}
 
-	for _, dir := range c.prefetchDirs[accountId] {
-		var status *imap.DirStatus
-		var err error
-		for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-			status, err = c.imapConns[accountId].Status(c.rawDirName(accountId, dir))
-			if err == nil || !connectionError(err) {
-				break
-			}
-			if err := c.connectToServer(accountId); err != nil {
-				return err
-			}
-		}
-		if err != nil {
+	for _, dir := range c.prefetchDirList(accountId) {
+		if err := c.syncMaillist(ctx, accountId, dir); err != nil {
 			return err
 		}
-
-		cacheVal, err := c.caches[accountId].Dir(dir).UidValidity()
-		if cacheVal != status.UidValidity || err == storage.ErrNullValue {
-			if cacheVal != status.UidValidity {
-				c.debugLog.Println("UIDVALIDITY changed")
-			}
-			c.caches[accountId].Dir(dir).InvalidateMsglist()
-			c.caches[accountId].Dir(dir).SetUidValidity(status.UidValidity)
-		}
-
-		c.getMsgsList(accountId, dir, true)
 	}
 
-	return err
+	return nil
 }
 
-func (c *Client) reloadMaillist(accountId string, dir string) {
-	c.getMsgsList(accountId, dir, true)
+// connectionRestored is called after connection to server is re-established
+// to apply changes made while it was lost, in both directions.
+func (c *Client) connectionRestored(ctx context.Context, accountId string) {
+	c.replayJournal(ctx, accountId)
+	c.resyncPrefetchDirs(ctx, accountId)
+	// Network is likely available again.
+	c.kickOutbox(accountId)
+}
 
-	if c.Hooks.ResetDir != nil {
-		c.Hooks.ResetDir(accountId, dir)
+// resyncPrefetchDirs is called after reconnection to pick up changes made
+// while connection was lost. Errors are only logged, directories are
+// synchronized again when they are used.
+func (c *Client) resyncPrefetchDirs(ctx context.Context, accountId string) {
+	for _, dir := range c.prefetchDirList(accountId) {
+		if _, err := c.applyDirChanges(ctx, accountId, dir); err != nil {
+			c.debugLog.Printf("Resync after reconnect (%v, %v) failed: %v\n", accountId, dir, err)
+			continue
+		}
+		c.dirChanged(accountId, dir)
 	}
 }
 
+func (c *Client) reloadMaillist(ctx context.Context, accountId string, dir string) {
+	c.getMsgsList(ctx, accountId, dir, true)
+
+	c.dirChanged(accountId, dir)
+}
+
 // Returns true if passed error is caused by server connection loss and request should be retries.
 func connectionError(err error) bool {
-	return err.Error() == "imap: connection closed" || err.Error() == "short write"
+	if ctxError(err) {
+		// Cancelled operations should not be retried.
+		return false
+	}
+	if errors.Is(err, imap.ErrConnection) || errors.Is(err, smtp.ErrConnection) {
+		return true
+	}
+	// Errors not passed through proto packages, such as OAuth token requests.
+	return common.IsConnLoss(err)
 }
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	eimap "github.com/emersion/go-imap"
+)
+
+func TestUpdateCallbacksDontBlock(t *testing.T) {
+	be := newTestBackend()
+	c := newTestClient(t, be)
+	if err := c.cache(testAccount).AddDir("INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	callbacks := c.makeUpdateCallbacks(testAccount)
+
+	// Server doesn't respond while backend is locked, so handlers can't
+	// complete.
+	lock := be.(lockedBackend).lock
+	lock.Lock()
+	done := make(chan struct{})
+	go func() {
+		callbacks.NewMessage("INBOX", 1)
+		callbacks.MessageUpdate("INBOX", &eimap.Message{Uid: 6, Flags: []string{eimap.SeenFlag, eimap.AnsweredFlag}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		lock.Unlock()
+		t.Fatal("Callbacks wait for requests to server")
+	}
+	lock.Unlock()
+
+	// Updates are still applied in order they were received.
+	waitFor(t, "flags update", func() bool {
+		msg, err := c.cache(testAccount).Dir("INBOX").GetMsg(6)
+		return err == nil && msg.Answered
+	})
+}
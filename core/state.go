@@ -0,0 +1,131 @@
+package core
+
+import (
+	"github.com/foxcpp/mailbox/proto/common"
+	"github.com/foxcpp/mailbox/proto/imap"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+/*
+Client state.
+
+Configuration and per-account objects (caches, connections, sessions) are
+replaced by configuration watcher (see watch.go) and LoadAccount /
+UnloadAccount while they are used by frontend calls and background
+goroutines, so they are accessed only with Client.stateLock held. Functions
+below should be used to get single values. Lock is held only while maps are
+accessed, never during network operations.
+
+Objects for unloaded accounts are nil, operations on them fail or panic
+like before account was loaded.
+*/
+
+// serverConfig is a configuration of account servers prepared by
+// prepareServerConfig.
+type serverConfig struct {
+	imap, smtp common.ServConfig
+}
+
+func (c *Client) account(accountId string) storage.AccountCfg {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.Accounts[accountId]
+}
+
+// fileCfg returns configuration of account as passed to LoadAccount
+// and true if account is loaded.
+func (c *Client) fileCfg(accountId string) (storage.AccountCfg, bool) {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	cfg, ok := c.fileCfgs[accountId]
+	return cfg, ok
+}
+
+// accountIds returns names of loaded accounts.
+func (c *Client) accountIds() []string {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	res := make([]string, 0, len(c.Accounts))
+	for name := range c.Accounts {
+		res = append(res, name)
+	}
+	return res
+}
+
+// updateEffectiveAccount applies change to effective configuration of loaded
+// account, file configuration is left as is. Nothing is done if account is
+// not loaded.
+func (c *Client) updateEffectiveAccount(accountId string, change func(cfg *storage.AccountCfg)) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	cfg, ok := c.Accounts[accountId]
+	if !ok {
+		return
+	}
+	change(&cfg)
+	c.Accounts[accountId] = cfg
+}
+
+// updateAccount applies change to both effective and file configuration of
+// loaded account. Changed file configuration is returned so it can be
+// saved, false is returned if account is not loaded.
+func (c *Client) updateAccount(accountId string, change func(cfg *storage.AccountCfg)) (storage.AccountCfg, bool) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	cfg, ok := c.Accounts[accountId]
+	if !ok {
+		return storage.AccountCfg{}, false
+	}
+	change(&cfg)
+	c.Accounts[accountId] = cfg
+
+	fileCfg := c.fileCfgs[accountId]
+	change(&fileCfg)
+	c.fileCfgs[accountId] = fileCfg
+	return fileCfg, true
+}
+
+func (c *Client) globalCfg() storage.GlobalCfg {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.GlobalCfg
+}
+
+// updateGlobalCfg applies change to global configuration and returns
+// changed configuration.
+func (c *Client) updateGlobalCfg(change func(cfg *storage.GlobalCfg)) storage.GlobalCfg {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	change(&c.GlobalCfg)
+	return c.GlobalCfg
+}
+
+func (c *Client) cache(accountId string) *storage.CacheDB {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.caches[accountId]
+}
+
+func (c *Client) serverCfg(accountId string) serverConfig {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.serverCfgs[accountId]
+}
+
+func (c *Client) imapConn(accountId string) *imap.Client {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.imapConns[accountId]
+}
+
+func (c *Client) session(accountId string) *session {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.sessions[accountId]
+}
+
+func (c *Client) prefetchDirList(accountId string) []string {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.prefetchDirs[accountId]
+}
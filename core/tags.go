@@ -1,50 +1,63 @@
 package core
 
+import (
+	"context"
+
+	"github.com/foxcpp/mailbox/proto/imap"
+)
+
 type Tag string
 
 const (
 	ReadenTag   Tag = `\Seen`
 	AnsweredTag Tag = `\Answered`
+	FlaggedTag  Tag = `\Flagged`
 )
 
+// Tag adds tag to messages.
+//
+// If server is not reachable, operation is applied to cache and performed
+// later (see journal.go).
 func (c *Client) Tag(accountId, dir string, tag Tag, uids ...uint32) error {
-	var err error
-	for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-		err = c.imapConns[accountId].Tag(c.rawDirName(accountId, dir), string(tag), uids...)
-		if err == nil || !connectionError(err) {
-			break
-		}
-		if err := c.connectToServer(accountId); err != nil {
-			return err
-		}
-	}
+	return c.TagContext(context.Background(), accountId, dir, tag, uids...)
+}
+
+// TagContext is like Tag but can be cancelled using ctx (see context.go).
+func (c *Client) TagContext(ctx context.Context, accountId, dir string, tag Tag, uids ...uint32) error {
+	_, err := c.runOrQueue(ctx, accountId, opTag, dir, offlineOp{Uids: uids, Tag: string(tag)}, func(conn *imap.Client) error {
+		return conn.TagContext(ctx, c.rawDirName(accountId, dir), string(tag), uids...)
+	})
 	if err != nil {
 		return err
 	}
 
 	for _, uid := range uids {
-		c.caches[accountId].Dir(dir).AddTag(uid, string(tag))
+		c.cache(accountId).Dir(dir).AddTag(uid, string(tag))
 	}
+	c.notifyViews(accountId, dir)
 	return nil
 }
 
+// UnTag removes tag from messages.
+//
+// If server is not reachable, operation is applied to cache and performed
+// later (see journal.go).
 func (c *Client) UnTag(accountId, dir string, tag Tag, uids ...uint32) error {
-	var err error
-	for i := 0; i < *c.GlobalCfg.Connection.MaxTries; i++ {
-		err = c.imapConns[accountId].UnTag(c.rawDirName(accountId, dir), string(tag), uids...)
-		if err == nil || !connectionError(err) {
-			break
-		}
-		if err := c.connectToServer(accountId); err != nil {
-			return err
-		}
-	}
+	return c.UnTagContext(context.Background(), accountId, dir, tag, uids...)
+}
+
+// UnTagContext is like UnTag but can be cancelled using ctx (see context.go).
+func (c *Client) UnTagContext(ctx context.Context, accountId, dir string, tag Tag, uids ...uint32) error {
+	_, err := c.runOrQueue(ctx, accountId, opUnTag, dir, offlineOp{Uids: uids, Tag: string(tag)}, func(conn *imap.Client) error {
+		return conn.UnTagContext(ctx, c.rawDirName(accountId, dir), string(tag), uids...)
+	})
 	if err != nil {
 		return err
 	}
 
 	for _, uid := range uids {
-		c.caches[accountId].Dir(dir).RemTag(uid, string(tag))
+		c.cache(accountId).Dir(dir).RemTag(uid, string(tag))
 	}
+	c.notifyViews(accountId, dir)
 	return nil
 }
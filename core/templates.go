@@ -0,0 +1,216 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/foxcpp/mailbox/proto/common"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+/*
+Templates.
+
+Templates are stored in TemplatesDir (see storage/templates.go) and managed
+using storage.LoadTemplate, SaveTemplate and DeleteTemplate. Subject and
+bodies use text/template syntax (html/template for HTML body, so values are
+escaped), fields of TemplateData are available, for example:
+
+	Hello {{.RecipientName}},
+
+	On {{.OrigDate.Format "2 Jan 2006"}} you wrote:
+	{{.Quoted}}
+
+Signature of identity message is sent from is appended to bodies
+automatically.
+*/
+
+// TemplateData contains values available in templates.
+type TemplateData struct {
+	// First recipient of rendered message.
+	RecipientName  string
+	RecipientEmail string
+
+	SenderName  string
+	SenderEmail string
+
+	// Values from original message if template is rendered as reply,
+	// zero otherwise.
+	OrigSubject string
+	OrigFrom    common.Address
+	OrigDate    time.Time
+	// Text of original message with each line prefixed with "> ".
+	Quoted string
+}
+
+// RenderTemplate creates message from template.
+//
+// If orig is not nil, message is rendered as reply to it (it can be
+// obtained using GetMsgText): reply headers are set, identity is selected
+// like for ComposeReply and original author is used as recipient if
+// template has no default ones.
+//
+// Returned message is not saved anywhere, like one returned by
+// ComposeReply.
+func (c *Client) RenderTemplate(accountId, name string, orig *common.Msg) (*common.Msg, error) {
+	tmpl, err := storage.LoadTemplate(name)
+	if err != nil {
+		return nil, err
+	}
+
+	id := c.primaryIdentity(accountId)
+	if orig != nil {
+		id = c.replyIdentity(accountId, orig)
+	}
+	res := newMsg(id)
+	data := TemplateData{SenderName: id.Name, SenderEmail: id.Email}
+
+	if res.To, err = parseAddrs(tmpl.To); err != nil {
+		return nil, renderError(name, err)
+	}
+	if res.Cc, err = parseAddrs(tmpl.Cc); err != nil {
+		return nil, renderError(name, err)
+	}
+	if res.Bcc, err = parseAddrs(tmpl.Bcc); err != nil {
+		return nil, renderError(name, err)
+	}
+
+	subject := tmpl.Subject
+	if orig != nil {
+		res.InReplyTo = orig.MessageId
+		res.References = replyReferences(orig)
+		if len(res.To) == 0 {
+			res.To = filterAddrs(replyAuthor(orig), c.ownAddresses(accountId), nil)
+		}
+		if subject == "" {
+			subject = prefixSubject("Re: ", orig.Subject, "re:")
+		}
+
+		data.OrigSubject = orig.Subject
+		data.OrigFrom = orig.From
+		data.OrigDate = orig.Date
+		data.Quoted = strings.TrimRight(quoteText(bodyText(&orig.Body)), "\n")
+	}
+	if len(res.To) != 0 {
+		data.RecipientName = res.To[0].Name
+		data.RecipientEmail = res.To[0].Address
+	}
+
+	if res.Subject, err = execText(name, subject, data); err != nil {
+		return nil, err
+	}
+	text, err := execText(name, tmpl.Text, data)
+	if err != nil {
+		return nil, err
+	}
+	body := textPart(text + signatureText(id))
+	if tmpl.HTML != "" {
+		html, err := execHTML(name, tmpl.HTML, data)
+		if err != nil {
+			return nil, err
+		}
+		body = common.Part{
+			Type: common.ParametrizedHeader{Value: "multipart/alternative"},
+			Children: []common.Part{
+				body,
+				{
+					Type: common.ParametrizedHeader{
+						Value:  "text/html",
+						Params: map[string]string{"charset": "utf-8"},
+					},
+					Body: []byte(html + signatureHTML(id)),
+				},
+			},
+		}
+	}
+
+	if len(tmpl.Attachments) == 0 {
+		res.Body = body
+		res.Body.AssignPaths()
+		return res, nil
+	}
+	res.Body = common.Part{
+		Type:     common.ParametrizedHeader{Value: "multipart/mixed"},
+		Children: []common.Part{body},
+	}
+	for _, path := range tmpl.Attachments {
+		part, err := attachmentPart(path)
+		if err != nil {
+			return nil, renderError(name, err)
+		}
+		res.Body.Children = append(res.Body.Children, part)
+	}
+	res.Body.AssignPaths()
+	return res, nil
+}
+
+func renderError(name string, err error) error {
+	return fmt.Errorf("rendertemplate %v: %v", name, err)
+}
+
+func execText(name, text string, data TemplateData) (string, error) {
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", renderError(name, err)
+	}
+	buf := bytes.Buffer{}
+	if err := t.Execute(&buf, data); err != nil {
+		return "", renderError(name, err)
+	}
+	return buf.String(), nil
+}
+
+func execHTML(name, text string, data TemplateData) (string, error) {
+	t, err := htmltemplate.New(name).Parse(text)
+	if err != nil {
+		return "", renderError(name, err)
+	}
+	buf := bytes.Buffer{}
+	if err := t.Execute(&buf, data); err != nil {
+		return "", renderError(name, err)
+	}
+	return buf.String(), nil
+}
+
+func parseAddrs(list []string) ([]common.Address, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	return common.ConvertAddrList(mail.ParseAddressList(strings.Join(list, ", ")))
+}
+
+// attachmentPart reads file and creates attachment part for it.
+func attachmentPart(path string) (common.Part, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(storage.TemplatesDir(), path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return common.Part{}, err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	typ, err := common.ParseParamHdr(contentType)
+	if err != nil {
+		typ = common.ParametrizedHeader{Value: "application/octet-stream"}
+	}
+	return common.Part{
+		Type: typ,
+		Disposition: common.ParametrizedHeader{
+			Value:  "attachment",
+			Params: map[string]string{"filename": filepath.Base(path)},
+		},
+		Body: data,
+	}, nil
+}
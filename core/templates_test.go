@@ -0,0 +1,142 @@
+package core
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/mailbox/proto/common"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	t.Setenv("MAILBOX_HOME", t.TempDir())
+	c := newTestClient(t, newTestBackend())
+	setTestIdentities(c)
+
+	err := storage.SaveTemplate("welcome", storage.Template{
+		Subject:     "Welcome, {{.RecipientName}}",
+		To:          []string{"Alice <alice@example.org>"},
+		Text:        "Hello {{.RecipientName}} <{{.RecipientEmail}}>,\nregards, {{.SenderName}}",
+		HTML:        "<p>Hello {{.RecipientName}} &amp; {{.SenderEmail}}</p>",
+		Attachments: []string{"terms.txt"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(storage.TemplatesDir(), "terms.txt"), []byte("Terms"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := c.RenderTemplate(testAccount, "welcome", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.From.Address != "me@example.org" {
+		t.Errorf("Wrong identity used: %v", msg.From)
+	}
+	if msg.Subject != "Welcome, Alice" || addrList(msg.To) != "alice@example.org" {
+		t.Errorf("Wrong subject or recipients: %q, %v", msg.Subject, addrList(msg.To))
+	}
+
+	if msg.Body.Type.Value != "multipart/mixed" || len(msg.Body.Children) != 2 {
+		t.Fatalf("Wrong message structure: %+v", msg.Body)
+	}
+	alt := msg.Body.Children[0]
+	if alt.Type.Value != "multipart/alternative" || len(alt.Children) != 2 {
+		t.Fatalf("Wrong body structure: %+v", alt)
+	}
+	if text := string(alt.Children[0].Body); text != "Hello Alice <alice@example.org>,\nregards, Me\n\n-- \nMe\n" {
+		t.Errorf("Wrong text body: %q", text)
+	}
+	if html := string(alt.Children[1].Body); html != "<p>Hello Alice &amp; me@example.org</p><br>\n<br>\n-- <br>\nMe" {
+		t.Errorf("Wrong HTML body: %q", html)
+	}
+	attachment := msg.Body.Children[1]
+	if string(attachment.Body) != "Terms" || attachment.Disposition.Params["filename"] != "terms.txt" || attachment.Type.Value != "text/plain" {
+		t.Errorf("Wrong attachment: %+v", attachment)
+	}
+}
+
+func TestRenderTemplateReply(t *testing.T) {
+	t.Setenv("MAILBOX_HOME", t.TempDir())
+	c := newTestClient(t, newTestBackend())
+	setTestIdentities(c)
+
+	err := storage.SaveTemplate("ack", storage.Template{
+		Text: "{{.OrigFrom.Name}} wrote on {{.OrigDate.Format \"2 Jan 2006\"}}:\n{{.Quoted}}\nReceived.",
+		HTML: "<p>Re: {{.OrigSubject}}</p>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig := &common.Msg{
+		Date:      time.Date(2018, 9, 1, 12, 0, 0, 0, time.UTC),
+		Subject:   "<b>Help</b>",
+		From:      common.Address{Name: "Alice", Address: "alice@example.org"},
+		To:        []common.Address{{Address: "support@example.org"}},
+		MessageId: "1234@example.org",
+		Body:      textPart("Printer\nis broken\n"),
+	}
+	msg, err := c.RenderTemplate(testAccount, "ack", orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.From.Address != "support@example.org" {
+		t.Errorf("Wrong identity used: %v", msg.From)
+	}
+	if msg.Subject != "Re: <b>Help</b>" || addrList(msg.To) != "alice@example.org" || msg.InReplyTo != "1234@example.org" {
+		t.Errorf("Wrong reply headers: %q, %v, %q", msg.Subject, addrList(msg.To), msg.InReplyTo)
+	}
+	if len(msg.Body.Children) != 2 {
+		t.Fatalf("Wrong body structure: %+v", msg.Body)
+	}
+	// Support identity has no signature.
+	if text := string(msg.Body.Children[0].Body); text != "Alice wrote on 1 Sep 2018:\n> Printer\n> is broken\nReceived." {
+		t.Errorf("Wrong text body: %q", text)
+	}
+	if html := string(msg.Body.Children[1].Body); html != "<p>Re: &lt;b&gt;Help&lt;/b&gt;</p>" {
+		t.Errorf("Values are not escaped in HTML body: %q", html)
+	}
+}
+
+func TestRenderTemplateErrors(t *testing.T) {
+	t.Setenv("MAILBOX_HOME", t.TempDir())
+	c := newTestClient(t, newTestBackend())
+
+	if _, err := c.RenderTemplate(testAccount, "missing", nil); err == nil {
+		t.Error("No error for missing template")
+	}
+
+	cases := map[string]storage.Template{
+		"syntax":     {Text: "{{.RecipientName"},
+		"field":      {Subject: "{{.Unknown}}"},
+		"recipient":  {To: []string{"<<broken"}},
+		"attachment": {Attachments: []string{"missing.pdf"}},
+	}
+	for name, tmpl := range cases {
+		if err := storage.SaveTemplate(name, tmpl); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.RenderTemplate(testAccount, name, nil); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("%v: wrong error: %v", name, err)
+		}
+	}
+}
+
+func TestSignatureHTML(t *testing.T) {
+	id := storage.Identity{Signature: "Alice <alice@example.org>\nExample & Co\n"}
+	if sig := signatureHTML(id); sig != "<br>\n<br>\n-- <br>\nAlice &lt;alice@example.org&gt;<br>\nExample &amp; Co" {
+		t.Errorf("Plain text signature is not converted: %q", sig)
+	}
+	id.HTMLSignature = "<b>Alice</b>"
+	if sig := signatureHTML(id); sig != "<br>\n<br>\n-- <br>\n<b>Alice</b>" {
+		t.Errorf("HTML signature is not used: %q", sig)
+	}
+	if sig := signatureHTML(storage.Identity{}); sig != "" {
+		t.Errorf("Signature returned for identity without one: %q", sig)
+	}
+}
@@ -0,0 +1,468 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/mailbox/proto/imap"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+/*
+Message threading.
+
+Threads are built from Message-Id, References and In-Reply-To headers using
+algorithm described by Jamie Zawinski (https://www.jwz.org/doc/threading.html),
+messages without references are additionally grouped by subject.
+
+Threads are computed for all cached messages of account at once so replies
+stored in other directories (i.e. Sent) are included. Thread of each message
+(Message-Id of thread root) is stored in cache and recomputed only when new
+messages are added.
+
+If AccountCfg.ServerThreading is set and server supports THREAD=REFERENCES
+extension (RFC 5256), threads are built by server instead. Such threads
+include only messages from requested directory.
+*/
+
+// Thread is a node of conversation tree.
+type Thread struct {
+	// Empty if message is referenced by other messages but not available
+	// (not cached, removed, etc). Such nodes always have children.
+	Dir       string
+	Uid       uint32
+	MessageId string
+	Subject   string
+	Date      time.Time
+
+	// Replies, ordered by date.
+	Children []*Thread
+}
+
+// GetThreads returns conversation trees for messages in specified
+// directory. Trees include messages from other directories if they belong to
+// the same thread. Threads are ordered by date of first message.
+//
+// Only cached messages are considered, directory message list is downloaded
+// if it is not cached yet.
+func (c *Client) GetThreads(accountId, dirName string) ([]*Thread, error) {
+	return c.GetThreadsContext(context.Background(), accountId, dirName)
+}
+
+// GetThreadsContext is like GetThreads but can be cancelled using ctx (see context.go).
+func (c *Client) GetThreadsContext(ctx context.Context, accountId, dirName string) ([]*Thread, error) {
+	if _, err := c.GetMsgsListContext(ctx, accountId, dirName); err != nil {
+		return nil, err
+	}
+
+	if c.account(accountId).ServerThreading {
+		threads, err := c.serverThreads(ctx, accountId, dirName)
+		if err == nil || ctxError(err) {
+			return threads, err
+		}
+		c.debugLog.Printf("Server-side threading (%v, %v) failed, using local: %v\n", accountId, dirName, err)
+	}
+
+	// Replies are usually stored in Sent directory, make sure we know about
+	// them.
+	if sent := c.account(accountId).Dirs.Sent; sent != dirName {
+		if _, err := c.GetMsgsListContext(ctx, accountId, sent); err != nil {
+			c.debugLog.Printf("Failed to get messages list for %v (%v): %v\n", sent, accountId, err)
+		}
+	}
+
+	cache := c.cache(accountId)
+	outdated, err := cache.ThreadsNeedUpdate()
+	if err != nil {
+		return nil, fmt.Errorf("threads %v, %v: %v", accountId, dirName, err)
+	}
+
+	var msgs []storage.ThreadMsg
+	if outdated {
+		msgs, err = cache.ThreadMsgs()
+	} else {
+		msgs, err = cache.Dir(dirName).ThreadMsgs()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("threads %v, %v: %v", accountId, dirName, err)
+	}
+
+	roots := buildThreads(msgs)
+	if outdated {
+		c.debugLog.Printf("Recomputed threads for %v messages (%v)\n", len(msgs), accountId)
+		if err := cache.SetThreadIds(threadIds(roots)); err != nil {
+			return nil, fmt.Errorf("threads %v, %v: %v", accountId, dirName, err)
+		}
+	}
+
+	res := []*Thread{}
+	for _, root := range roots {
+		if root.containsDir(dirName) {
+			res = append(res, root.toThread())
+		}
+	}
+	return res, nil
+}
+
+func (c *Client) serverThreads(ctx context.Context, accountId, dirName string) ([]*Thread, error) {
+	var nodes []*imap.ThreadNode
+	var err error
+	err = c.session(accountId).do(ctx, func(conn *imap.Client) error {
+		supported, err := conn.SupportsThreading()
+		if err != nil {
+			return err
+		}
+		if !supported {
+			return fmt.Errorf("server doesn't supports THREAD=REFERENCES")
+		}
+		nodes, err = conn.ThreadsContext(ctx, c.rawDirName(accountId, dirName))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := c.cache(accountId).Dir(dirName).ListMsgs()
+	if err != nil {
+		return nil, err
+	}
+	byUid := make(map[uint32]*imap.MessageInfo, len(list))
+	for i := range list {
+		byUid[list[i].UID] = &list[i]
+	}
+
+	var convert func(node *imap.ThreadNode) *Thread
+	convert = func(node *imap.ThreadNode) *Thread {
+		res := &Thread{}
+		if info := byUid[node.UID]; info != nil {
+			res.Dir = dirName
+			res.Uid = info.UID
+			res.MessageId = info.Msg.MessageId
+			res.Subject = info.Msg.Subject
+			res.Date = info.Msg.Date
+		}
+		for _, child := range node.Children {
+			res.Children = append(res.Children, convert(child))
+		}
+		return res
+	}
+
+	res := make([]*Thread, len(nodes))
+	for i, node := range nodes {
+		res[i] = convert(node)
+	}
+	return res, nil
+}
+
+// container is a node of thread tree used during threading. Message is nil
+// for referenced but missing messages.
+type container struct {
+	id       string
+	msg      *storage.ThreadMsg
+	parent   *container
+	children []*container
+}
+
+func (c *container) addChild(child *container) {
+	if child.parent != nil {
+		child.parent.removeChild(child)
+	}
+	child.parent = c
+	c.children = append(c.children, child)
+}
+
+func (c *container) removeChild(child *container) {
+	for i, ch := range c.children {
+		if ch == child {
+			c.children = append(c.children[:i], c.children[i+1:]...)
+			break
+		}
+	}
+	child.parent = nil
+}
+
+// hasDescendant checks whether other is c or is reachable from c.
+func (c *container) hasDescendant(other *container) bool {
+	for ; other != nil; other = other.parent {
+		if other == c {
+			return true
+		}
+	}
+	return false
+}
+
+// date returns date of message or earliest date of replies for empty
+// containers.
+func (c *container) date() time.Time {
+	if c.msg != nil {
+		return c.msg.Date
+	}
+	res := time.Time{}
+	for _, child := range c.children {
+		if d := child.date(); res.IsZero() || d.Before(res) {
+			res = d
+		}
+	}
+	return res
+}
+
+func (c *container) subject() string {
+	if c.msg != nil {
+		return c.msg.Subject
+	}
+	for _, child := range c.children {
+		if child.msg != nil {
+			return child.msg.Subject
+		}
+	}
+	return ""
+}
+
+func (c *container) containsDir(dir string) bool {
+	if c.msg != nil && c.msg.Dir == dir {
+		return true
+	}
+	for _, child := range c.children {
+		if child.containsDir(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *container) toThread() *Thread {
+	res := &Thread{Children: make([]*Thread, len(c.children))}
+	if c.msg != nil {
+		res.Dir = c.msg.Dir
+		res.Uid = c.msg.Uid
+		res.MessageId = c.msg.MessageId
+		res.Subject = c.msg.Subject
+		res.Date = c.msg.Date
+	}
+	for i, child := range c.children {
+		res.Children[i] = child.toThread()
+	}
+	return res
+}
+
+func sortContainers(list []*container) {
+	sort.SliceStable(list, func(i, j int) bool {
+		di, dj := list[i].date(), list[j].date()
+		if di.Equal(dj) {
+			return list[i].id < list[j].id
+		}
+		return di.Before(dj)
+	})
+	for _, c := range list {
+		sortContainers(c.children)
+	}
+}
+
+// buildThreads groups messages into threads and returns list of thread
+// roots ordered by date.
+func buildThreads(msgs []storage.ThreadMsg) []*container {
+	idTable := make(map[string]*container, len(msgs))
+	get := func(id string) *container {
+		c := idTable[id]
+		if c == nil {
+			c = &container{id: id}
+			idTable[id] = c
+		}
+		return c
+	}
+
+	for i := range msgs {
+		msg := &msgs[i]
+
+		id := msg.MessageId
+		if id == "" || idTable[id] != nil && idTable[id].msg != nil {
+			// No Message-Id or same message is stored in several
+			// directories, treat them as different messages.
+			id = fmt.Sprintf("%v/%v/%v", msg.Dir, msg.Uid, msg.MessageId)
+		}
+		cont := get(id)
+		cont.msg = msg
+
+		refs := msg.References
+		if len(refs) == 0 && msg.InReplyTo != "" {
+			refs = []string{msg.InReplyTo}
+		}
+
+		// Link referenced messages together, keeping existing links.
+		var prev *container
+		for _, ref := range refs {
+			refCont := get(ref)
+			if prev != nil && refCont.parent == nil && !refCont.hasDescendant(prev) {
+				prev.addChild(refCont)
+			}
+			prev = refCont
+		}
+
+		// Last reference is a parent of message.
+		if prev != nil && cont.hasDescendant(prev) {
+			prev = nil
+		}
+		if prev != nil {
+			prev.addChild(cont)
+		} else if cont.parent != nil {
+			cont.parent.removeChild(cont)
+		}
+	}
+
+	roots := []*container{}
+	for _, c := range idTable {
+		if c.parent == nil {
+			roots = append(roots, c)
+		}
+	}
+	roots = pruneEmpty(nil, roots)
+	sortContainers(roots)
+	roots = groupBySubject(roots)
+	sortContainers(roots)
+	return roots
+}
+
+// pruneEmpty removes empty containers without children and replaces empty
+// containers with their children if it doesn't make them roots (unless there
+// is only one child).
+func pruneEmpty(parent *container, list []*container) []*container {
+	res := make([]*container, 0, len(list))
+	for _, c := range list {
+		c.children = pruneEmpty(c, c.children)
+		if c.msg == nil {
+			if len(c.children) == 0 {
+				continue
+			}
+			if parent != nil || len(c.children) == 1 {
+				for _, child := range c.children {
+					child.parent = parent
+					res = append(res, child)
+				}
+				continue
+			}
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+var subjectPrefixes = []string{"re:", "fwd:", "fw:", "aw:"}
+
+// normalizeSubject strips reply and forward prefixes from subject.
+func normalizeSubject(subject string) (normalized string, reply bool) {
+	s := strings.ToLower(strings.TrimSpace(subject))
+	for {
+		stripped := false
+		for _, prefix := range subjectPrefixes {
+			if strings.HasPrefix(s, prefix) {
+				s = strings.TrimSpace(s[len(prefix):])
+				stripped = true
+				reply = true
+			}
+		}
+		if !stripped {
+			return s, reply
+		}
+	}
+}
+
+// groupBySubject merges threads with same subject, roots list should be
+// ordered by date.
+func groupBySubject(roots []*container) []*container {
+	table := make(map[string]*container)
+	for _, root := range roots {
+		subj, reply := normalizeSubject(root.subject())
+		if subj == "" {
+			continue
+		}
+		old := table[subj]
+		if old == nil {
+			table[subj] = root
+			continue
+		}
+		// Prefer empty containers and non-replies.
+		if root.msg == nil && old.msg != nil {
+			table[subj] = root
+			continue
+		}
+		if old.msg != nil && root.msg != nil && !reply {
+			if _, oldReply := normalizeSubject(old.msg.Subject); oldReply {
+				table[subj] = root
+			}
+		}
+	}
+
+	res := make([]*container, 0, len(roots))
+	merged := make(map[*container]*container)
+	for _, root := range roots {
+		if root.parent != nil {
+			// Already attached to thread processed before.
+			continue
+		}
+		subj, reply := normalizeSubject(root.subject())
+		other := table[subj]
+		if subj == "" || other == nil || other == root {
+			res = append(res, root)
+			continue
+		}
+		if replacement := merged[other]; replacement != nil {
+			other = replacement
+		}
+
+		_, otherReply := normalizeSubject(other.subject())
+		switch {
+		case root.msg == nil && other.msg == nil:
+			for len(root.children) != 0 {
+				other.addChild(root.children[0])
+			}
+		case other.msg == nil:
+			other.addChild(root)
+		case root.msg == nil:
+			root.addChild(other)
+			res = replaceRoot(res, other, root)
+			merged[table[subj]] = root
+		case !otherReply && reply:
+			other.addChild(root)
+		default:
+			dummy := &container{id: other.id}
+			dummy.addChild(other)
+			dummy.addChild(root)
+			res = replaceRoot(res, other, dummy)
+			merged[table[subj]] = dummy
+		}
+	}
+	return res
+}
+
+// replaceRoot replaces old with new in list or appends new if old is not
+// there yet.
+func replaceRoot(list []*container, old, new *container) []*container {
+	for i, c := range list {
+		if c == old {
+			list[i] = new
+			return list
+		}
+	}
+	return append(list, new)
+}
+
+// threadIds returns thread ID (ID of root container) for each message.
+func threadIds(roots []*container) map[storage.MsgKey]string {
+	res := make(map[storage.MsgKey]string)
+	var walk func(id string, c *container)
+	walk = func(id string, c *container) {
+		if c.msg != nil {
+			res[storage.MsgKey{Dir: c.msg.Dir, Uid: c.msg.Uid}] = id
+		}
+		for _, child := range c.children {
+			walk(id, child)
+		}
+	}
+	for _, root := range roots {
+		walk(root.id, root)
+	}
+	return res
+}
@@ -0,0 +1,204 @@
+package core
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/mailbox/storage"
+)
+
+// threadMsg returns message in INBOX sent on specified day of month.
+func threadMsg(uid uint32, id, subject string, day int, refs ...string) storage.ThreadMsg {
+	return storage.ThreadMsg{
+		Dir:        "INBOX",
+		Uid:        uid,
+		MessageId:  id,
+		References: refs,
+		Subject:    subject,
+		Date:       time.Date(2018, 9, day, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+// dumpThreads formats threads as list of UIDs with replies in parentheses,
+// * is used for empty containers: "1(2 3(4)) *(5 6)".
+func dumpThreads(list []*container) string {
+	res := make([]string, len(list))
+	for i, c := range list {
+		if c.msg == nil {
+			res[i] = "*"
+		} else {
+			res[i] = strconv.Itoa(int(c.msg.Uid))
+		}
+		if len(c.children) != 0 {
+			res[i] += "(" + dumpThreads(c.children) + ")"
+		}
+	}
+	return strings.Join(res, " ")
+}
+
+func TestBuildThreads(t *testing.T) {
+	cases := []struct {
+		name     string
+		msgs     []storage.ThreadMsg
+		expected string
+	}{
+		{
+			"references chain",
+			[]storage.ThreadMsg{
+				threadMsg(3, "c", "Re: Re: Hello", 3, "a", "b"),
+				threadMsg(1, "a", "Hello", 1),
+				threadMsg(2, "b", "Re: Hello", 2, "a"),
+			},
+			"1(2(3))",
+		},
+		{
+			"in-reply-to",
+			[]storage.ThreadMsg{
+				threadMsg(1, "a", "Hello", 1),
+				func() storage.ThreadMsg {
+					msg := threadMsg(2, "b", "Re: Hello", 2)
+					msg.InReplyTo = "a"
+					return msg
+				}(),
+			},
+			"1(2)",
+		},
+		{
+			"references preferred over in-reply-to",
+			[]storage.ThreadMsg{
+				threadMsg(1, "a", "Hello", 1),
+				func() storage.ThreadMsg {
+					msg := threadMsg(2, "b", "Re: Hello", 2, "a")
+					msg.InReplyTo = "x"
+					return msg
+				}(),
+			},
+			"1(2)",
+		},
+		{
+			"missing parent",
+			[]storage.ThreadMsg{
+				threadMsg(1, "b", "Re: Hello", 1, "a"),
+				threadMsg(2, "c", "Re: Hello", 2, "a"),
+			},
+			"*(1 2)",
+		},
+		{
+			"missing parent of single message",
+			[]storage.ThreadMsg{threadMsg(1, "b", "Re: Hello", 1, "a")},
+			"1",
+		},
+		{
+			"missing message in the middle",
+			[]storage.ThreadMsg{
+				threadMsg(1, "a", "Hello", 1),
+				threadMsg(3, "c", "Re: Re: Hello", 3, "a", "b"),
+			},
+			"1(3)",
+		},
+		{
+			// Link that creates loop is ignored.
+			"reference loop",
+			[]storage.ThreadMsg{
+				threadMsg(1, "a", "Hello", 1, "b"),
+				threadMsg(2, "b", "Re: Hello", 2, "a"),
+			},
+			"2(1)",
+		},
+		{
+			"replies grouped by subject",
+			[]storage.ThreadMsg{
+				threadMsg(1, "a", "Meeting", 1),
+				threadMsg(2, "b", "Re: Meeting", 2),
+				threadMsg(3, "c", "Fwd: meeting", 3),
+				threadMsg(4, "d", "RE: Re: Meeting", 4),
+			},
+			"1(2 3 4)",
+		},
+		{
+			"reply received before original",
+			[]storage.ThreadMsg{
+				threadMsg(1, "b", "Re: Meeting", 1),
+				threadMsg(2, "a", "Meeting", 2),
+			},
+			"2(1)",
+		},
+		{
+			"threads with missing parents grouped by subject",
+			[]storage.ThreadMsg{
+				threadMsg(1, "b", "Re: Topic", 1, "x"),
+				threadMsg(2, "c", "Re: Topic", 2, "y"),
+				threadMsg(3, "d", "Re: Topic", 3, "y"),
+			},
+			"*(1 2 3)",
+		},
+		{
+			"same subject without prefixes",
+			[]storage.ThreadMsg{
+				threadMsg(1, "a", "Lunch", 1),
+				threadMsg(2, "b", "Lunch", 2),
+			},
+			"*(1 2)",
+		},
+		{
+			"different subjects",
+			[]storage.ThreadMsg{
+				threadMsg(2, "b", "Re: Dinner", 2),
+				threadMsg(1, "a", "Lunch", 1),
+			},
+			"1 2",
+		},
+		{
+			"empty subjects are not grouped",
+			[]storage.ThreadMsg{
+				threadMsg(1, "a", "", 1),
+				threadMsg(2, "b", "Re:", 2),
+			},
+			"1 2",
+		},
+		{
+			"same message in several directories",
+			[]storage.ThreadMsg{
+				threadMsg(1, "a", "Hello", 1),
+				func() storage.ThreadMsg {
+					msg := threadMsg(1, "a", "Hello", 1)
+					msg.Dir = "Archive"
+					return msg
+				}(),
+			},
+			"*(1 1)",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if res := dumpThreads(buildThreads(c.msgs)); res != c.expected {
+				t.Errorf("Wrong threads: %v (expected %v)", res, c.expected)
+			}
+		})
+	}
+}
+
+func TestNormalizeSubject(t *testing.T) {
+	cases := []struct {
+		subject    string
+		normalized string
+		reply      bool
+	}{
+		{"Hello", "hello", false},
+		{"Re: Hello", "hello", true},
+		{"RE:Hello", "hello", true},
+		{"Fwd: Re: Hello ", "hello", true},
+		{"FW: AW: Hello", "hello", true},
+		{"Re: Re:", "", true},
+		{"Reply", "reply", false},
+	}
+	for _, c := range cases {
+		normalized, reply := normalizeSubject(c.subject)
+		if normalized != c.normalized || reply != c.reply {
+			t.Errorf("%q: got %q, %v (expected %q, %v)", c.subject, normalized, reply, c.normalized, c.reply)
+		}
+	}
+}
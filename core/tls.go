@@ -0,0 +1,72 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/foxcpp/mailbox/proto/common"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+// tlsPolicy creates TLS policy for account server from configuration. server
+// is either "imap" or "smtp".
+func (c *Client) tlsPolicy(accountId, server string, conf storage.TLSCfg) (*common.TLSPolicy, error) {
+	res := common.NewTLSPolicy(conf.Pins)
+	res.TrustOnFirstUse = conf.TOFU
+
+	if conf.CAFile != "" {
+		pem, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls policy %v, %v: %v", accountId, server, err)
+		}
+		res.RootCAs = x509.NewCertPool()
+		if !res.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls policy %v, %v: no certificates found in %v", accountId, server, conf.CAFile)
+		}
+	}
+
+	if conf.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.ClientCert, conf.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("tls policy %v, %v: %v", accountId, server, err)
+		}
+		res.ClientCert = &cert
+	}
+
+	res.CertChanged = func(host string, cert *x509.Certificate) bool {
+		c.logger.Printf("Server certificate changed for %v (%v), new fingerprint: %v\n", accountId, host, common.CertFingerprint(cert))
+		if c.Hooks.CertChanged == nil {
+			return false
+		}
+		return c.Hooks.CertChanged(accountId, host, cert)
+	}
+	res.PinsChanged = func(pins []string) {
+		c.saveTLSPins(accountId, server, pins)
+	}
+	return res, nil
+}
+
+// saveTLSPins writes list of pinned certificates to account configuration.
+func (c *Client) saveTLSPins(accountId, server string, pins []string) {
+	c.debugLog.Printf("Saving pinned certificates for %v (%v): %v\n", accountId, server, pins)
+
+	setPins := func(cfg *storage.AccountCfg) {
+		if server == "imap" {
+			cfg.Server.Imap.TLS.Pins = pins
+		} else {
+			cfg.Server.Smtp.TLS.Pins = pins
+		}
+	}
+
+	// Update file configuration first so watcher will not consider our own
+	// change as external one.
+	fileCfg, ok := c.updateAccount(accountId, setPins)
+	if !ok {
+		return
+	}
+	if err := storage.SaveAccount(accountId, fileCfg); err != nil {
+		c.logger.Printf("Failed to save pinned certificates for %v: %v\n", accountId, err)
+	}
+}
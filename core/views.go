@@ -0,0 +1,134 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/foxcpp/mailbox/proto/imap"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+/*
+Virtual views.
+
+Views aggregate messages from all loaded accounts. They are computed from
+cache, so only messages from directories message list of which was
+downloaded (INBOX is always downloaded, see also GetMsgsList and
+DownloadOfflineDirs) are included.
+
+ViewChanged hook is called when cache of directory included in view is
+changed by server updates or by Client methods.
+*/
+
+// View is a virtual directory aggregating messages from all accounts.
+type View int
+
+const (
+	// Messages from INBOX of each account.
+	ViewAllInboxes View = iota
+	// Messages without \Seen flag.
+	ViewUnread
+	// Messages with \Flagged flag.
+	ViewFlagged
+	// Messages sent today (in local time zone).
+	ViewToday
+)
+
+// ViewMsg is a message from view together with its real location.
+type ViewMsg struct {
+	AccountId string
+	Dir       string
+	imap.MessageInfo
+}
+
+// GetView returns messages from view, newest first.
+//
+// Views other than ViewAllInboxes don't include messages from Trash and Junk
+// directories.
+func (c *Client) GetView(view View) ([]ViewMsg, error) {
+	res := []ViewMsg{}
+	for _, accountId := range c.accountIds() {
+		cache := c.cache(accountId)
+		if cache == nil {
+			// Unloaded concurrently.
+			continue
+		}
+		filter, err := c.viewFilter(accountId, view)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := cache.FilterMsgs(filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			msg, err := cache.Dir(key.Dir).GetMsg(key.Uid)
+			if err != nil {
+				// Removed concurrently.
+				continue
+			}
+			res = append(res, ViewMsg{AccountId: accountId, Dir: key.Dir, MessageInfo: *msg})
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Msg.Date.After(res[j].Msg.Date)
+	})
+	return res, nil
+}
+
+func (c *Client) viewFilter(accountId string, view View) (storage.MsgFilter, error) {
+	switch view {
+	case ViewAllInboxes:
+		return storage.MsgFilter{Dirs: []string{"INBOX"}}, nil
+	case ViewUnread:
+		return storage.MsgFilter{ExcludeDirs: c.viewExcludedDirs(accountId), NoTag: string(ReadenTag)}, nil
+	case ViewFlagged:
+		return storage.MsgFilter{ExcludeDirs: c.viewExcludedDirs(accountId), Tag: string(FlaggedTag)}, nil
+	case ViewToday:
+		now := time.Now()
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+		return storage.MsgFilter{ExcludeDirs: c.viewExcludedDirs(accountId), Since: midnight}, nil
+	}
+	return storage.MsgFilter{}, fmt.Errorf("getview: unknown view %v", int(view))
+}
+
+// viewExcludedDirs returns list of directories messages from which should
+// not be included in views.
+func (c *Client) viewExcludedDirs(accountId string) []string {
+	res := []string{}
+	for _, dir := range []string{c.account(accountId).Dirs.Trash, c.account(accountId).Dirs.Junk} {
+		if dir != "" {
+			res = append(res, dir)
+		}
+	}
+	return res
+}
+
+// notifyViews calls ViewChanged hook for views that can include messages
+// from directory.
+func (c *Client) notifyViews(accountId, dir string) {
+	if c.Hooks.ViewChanged == nil {
+		return
+	}
+	if dir == "INBOX" {
+		c.Hooks.ViewChanged(ViewAllInboxes)
+	}
+	for _, excluded := range c.viewExcludedDirs(accountId) {
+		if dir == excluded {
+			return
+		}
+	}
+	c.Hooks.ViewChanged(ViewUnread)
+	c.Hooks.ViewChanged(ViewFlagged)
+	c.Hooks.ViewChanged(ViewToday)
+}
+
+// dirChanged notifies frontend that cached contents of directory changed.
+func (c *Client) dirChanged(accountId, dir string) {
+	if c.Hooks.ResetDir != nil {
+		c.Hooks.ResetDir(accountId, dir)
+	}
+	c.notifyViews(accountId, dir)
+}
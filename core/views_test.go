@@ -0,0 +1,72 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/foxcpp/mailbox/proto/common"
+	"github.com/foxcpp/mailbox/proto/imap"
+	"github.com/foxcpp/mailbox/storage"
+)
+
+func TestGetView(t *testing.T) {
+	c := newTestClient(t, newTestBackend())
+	cfg := storage.AccountCfg{}
+	cfg.Dirs.Trash = "Trash"
+	c.Accounts[testAccount] = cfg
+
+	now := time.Now()
+	msgs := []struct {
+		dir string
+		msg imap.MessageInfo
+	}{
+		{"INBOX", imap.MessageInfo{UID: 1, Msg: common.Msg{Date: now.Add(-48 * time.Hour)}}},
+		{"INBOX", imap.MessageInfo{UID: 2, Readen: true, CustomTags: []string{string(FlaggedTag)}, Msg: common.Msg{Date: now}}},
+		{"Archive", imap.MessageInfo{UID: 3, Msg: common.Msg{Date: now.Add(-time.Minute)}}},
+		{"Trash", imap.MessageInfo{UID: 4, Msg: common.Msg{Date: now}}},
+	}
+	for _, dir := range []string{"INBOX", "Archive", "Trash"} {
+		if err := c.cache(testAccount).AddDir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, m := range msgs {
+		msg := m.msg
+		if err := c.cache(testAccount).Dir(m.dir).AddMsg(&msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		view     View
+		expected []uint32
+	}{
+		{ViewAllInboxes, []uint32{2, 1}},
+		{ViewUnread, []uint32{3, 1}},
+		{ViewFlagged, []uint32{2}},
+	}
+	for _, cs := range cases {
+		res, err := c.GetView(cs.view)
+		if err != nil {
+			t.Fatalf("View %v: %v", cs.view, err)
+		}
+		uids := []uint32{}
+		for _, msg := range res {
+			uids = append(uids, msg.UID)
+		}
+		if len(uids) != len(cs.expected) {
+			t.Errorf("View %v: got %v (expected %v)", cs.view, uids, cs.expected)
+			continue
+		}
+		for i := range uids {
+			if uids[i] != cs.expected[i] {
+				t.Errorf("View %v: got %v (expected %v)", cs.view, uids, cs.expected)
+				break
+			}
+		}
+	}
+
+	if _, err := c.GetView(View(42)); err == nil {
+		t.Error("No error for unknown view")
+	}
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/foxcpp/mailbox/storage"
+)
+
+// Changes to configuration files are applied only after there were no other
+// changes during this interval.
+const configReloadDelay = 500 * time.Millisecond
+
+// watchConfig starts applying changes made to configuration files while
+// client is running.
+//
+// Account files are reloaded as a whole: added accounts are loaded, removed
+// are unloaded, changed are unloaded and loaded again. Changes that can't be
+// applied to running client (encryption settings) are ignored until
+// restart.
+func (c *Client) watchConfig() {
+	w, err := storage.WatchConfig(configReloadDelay)
+	if err != nil {
+		c.logger.Println("Failed to start configuration watcher, changes will be applied only after restart:", err)
+		return
+	}
+	c.cfgWatcher = w
+
+	go func() {
+		for changes := range w.Changes {
+			for _, change := range changes {
+				c.applyConfigChange(change)
+			}
+		}
+	}()
+}
+
+func (c *Client) applyConfigChange(change storage.ConfigChange) {
+	if change.Account == "" {
+		c.reloadGlobal()
+		return
+	}
+	name := change.Account
+	fileCfg, loaded := c.fileCfg(name)
+
+	if change.Removed {
+		if loaded {
+			c.logger.Printf("Configuration file for %v removed, unloading account...\n", name)
+			c.UnloadAccount(name)
+		}
+		return
+	}
+
+	conf, err := storage.LoadAccount(name)
+	if err != nil {
+		c.logger.Printf("Failed to reload configuration for %v: %v\n", name, err)
+		c.reportReloadError(name, err)
+		return
+	}
+	if loaded {
+		if reflect.DeepEqual(*conf, fileCfg) {
+			// Probably written by us.
+			return
+		}
+		c.logger.Printf("Configuration for %v changed, reloading account...\n", name)
+		c.UnloadAccount(name)
+	} else {
+		c.logger.Printf("New account %v found, loading...\n", name)
+	}
+
+	if err := c.LoadAccount(name, *conf); err != nil {
+		c.logger.Printf("Failed to load account %v: %v\n", name, err.Err)
+		c.reportReloadError(name, err)
+		return
+	}
+	if c.Hooks.Reset != nil {
+		c.Hooks.Reset(name)
+	}
+}
+
+func (c *Client) reloadGlobal() {
+	conf, err := storage.LoadGlobal()
+	if err != nil {
+		c.logger.Println("Failed to reload global configuration:", err)
+		c.reportReloadError("", err)
+		return
+	}
+
+	changed := false
+	c.updateGlobalCfg(func(cfg *storage.GlobalCfg) {
+		if !reflect.DeepEqual(conf.Encryption, cfg.Encryption) {
+			c.logger.Println("Encryption settings changed, restart is required to apply them.")
+			conf.Encryption = cfg.Encryption
+		}
+		if !reflect.DeepEqual(*conf, *cfg) {
+			*cfg = *conf
+			changed = true
+		}
+	})
+	if changed {
+		c.logger.Println("Global configuration changed, reloaded.")
+		for _, accountId := range c.accountIds() {
+			if conn := c.imapConn(accountId); conn != nil {
+				conn.SetPoolSize(*c.EffectiveConfig(accountId).Connection.PoolSize)
+			}
+		}
+	}
+}
+
+func (c *Client) reportReloadError(accountId string, err error) {
+	if c.Hooks.ConfigReloadError != nil {
+		c.Hooks.ConfigReloadError(accountId, err)
+	}
+}
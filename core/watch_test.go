@@ -0,0 +1,114 @@
+package core
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/mailbox/storage"
+)
+
+// waitFor calls cond until it returns true and fails test if it doesn't
+// happen in reasonable time.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	t.Setenv("MAILBOX_HOME", t.TempDir())
+	c := newTestClient(t, newTestBackend())
+	globalCfg, err := storage.LoadGlobal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.GlobalCfg = *globalCfg
+
+	imapCfg := c.serverCfg(testAccount).imap
+	c.Hooks.PasswordPrompt = func(string) string { return imapCfg.Pass }
+	resets := make(chan string, 16)
+	c.Hooks.Reset = func(accountId string) { resets <- accountId }
+
+	c.watchConfig()
+	if c.cfgWatcher == nil {
+		t.Fatal("Watcher is not started")
+	}
+	defer c.cfgWatcher.Close()
+
+	// Frontend calls made while configuration is reloaded.
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.EffectiveConfig("second")
+			c.Identities("second")
+			c.ConnState(testAccount)
+			// Result is not checked: cache of new account is locked by
+			// SQLite while it's being filled by prefetch.
+			c.GetView(ViewAllInboxes)
+		}
+	}()
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	acc := storage.AccountCfg{SenderEmail: "second@example.org"}
+	acc.Server.Imap.Host = imapCfg.Host
+	acc.Server.Imap.Port = imapCfg.Port
+	acc.Server.Imap.Encryption = "none"
+	acc.Server.Smtp.Encryption = "none"
+	acc.Credentials.User = imapCfg.User
+	if err := storage.SaveAccount("second", acc); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case accountId := <-resets:
+		if accountId != "second" {
+			t.Errorf("Reset called for wrong account: %v", accountId)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("New account is not loaded")
+	}
+	if state := c.ConnState("second"); state != Authenticated {
+		t.Errorf("New account is not connected: %v", state)
+	}
+	if ids := c.Identities("second"); len(ids) != 1 || ids[0].Email != "second@example.org" {
+		t.Errorf("Wrong configuration of new account: %+v", ids)
+	}
+
+	maxTries := 3
+	globalCfg.Connection.MaxTries = &maxTries
+	if err := storage.SaveGlobal(globalCfg); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "global configuration reload", func() bool {
+		return *c.EffectiveConfig(testAccount).Connection.MaxTries == 3
+	})
+
+	if err := storage.DeleteAccount("second"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "account unloading", func() bool {
+		_, loaded := c.fileCfg("second")
+		return !loaded
+	})
+	select {
+	case accountId := <-resets:
+		t.Errorf("Unexpected reset of %v", accountId)
+	default:
+	}
+}
@@ -12,6 +12,6 @@ require (
 	github.com/foxcpp/go-sysid v0.0.0-20180908210514-6093cb27f162
 	github.com/mattn/go-sqlite3 v1.9.0
 	golang.org/x/crypto v0.0.0-20180904163835-0709b304e793
-	golang.org/x/text v0.3.0 // indirect
+	golang.org/x/text v0.3.0
 	gopkg.in/yaml.v2 v2.2.1
 )
@@ -0,0 +1,339 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Dialer establishes network connections to servers.
+//
+// *net.Dialer satisfies this interface.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// ContextDialer is implemented by dialers that can be cancelled using
+// context, it is preferred over Dialer if available.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Dial connects to server using conf.Dialer or directly if it is nil.
+func (conf ServConfig) Dial() (net.Conn, error) {
+	return conf.DialContext(context.Background())
+}
+
+// DialContext is like Dial but aborts connection attempt when ctx is
+// cancelled.
+func (conf ServConfig) DialContext(ctx context.Context) (net.Conn, error) {
+	return DialContext(ctx, conf.Dialer, "tcp", net.JoinHostPort(conf.Host, strconv.Itoa(int(conf.Port))))
+}
+
+// DialContext connects to addr using d or directly if d is nil.
+func DialContext(ctx context.Context, d Dialer, network, addr string) (net.Conn, error) {
+	switch d := d.(type) {
+	case nil:
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	case ContextDialer:
+		return d.DialContext(ctx, network, addr)
+	default:
+		return d.Dial(network, addr)
+	}
+}
+
+// HTTPClient returns HTTP client that makes connections using d or directly
+// if d is nil. Proxy settings from environment are ignored, so requests go
+// the same way as connections to mail servers.
+func HTTPClient(d Dialer) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return DialContext(ctx, d, network, addr)
+	}
+	return &http.Client{Transport: transport}
+}
+
+// WatchConn closes conn if ctx is cancelled or its deadline expires before
+// returned function is called.
+//
+// This allows to abort blocking I/O performed by libraries that don't
+// support contexts. Connection can't be used after cancellation.
+func WatchConn(ctx context.Context, conn io.Closer) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	stopCh := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stopCh:
+		}
+	}()
+	return func() {
+		close(stopCh)
+		<-finished
+	}
+}
+
+// TorProxy is an address of SOCKS proxy of locally running Tor.
+const TorProxy = "socks5h://127.0.0.1:9050"
+
+// NewProxyDialer creates dialer that connects through proxy specified by URL.
+//
+// Supported schemes are socks5 (host names are resolved locally), socks5h
+// (host names are resolved by proxy) and http (HTTP CONNECT method).
+// Credentials can be specified in URL. "tor" is accepted as shorthand for
+// TorProxy.
+func NewProxyDialer(proxyURL string) (Dialer, error) {
+	if proxyURL == "tor" {
+		proxyURL = TorProxy
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %v", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy: no address in %v", proxyURL)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		res := &socks5Dialer{proxy: u.Host, remoteDNS: u.Scheme == "socks5h"}
+		if u.User != nil {
+			res.user = u.User.Username()
+			res.pass, _ = u.User.Password()
+		}
+		return res, nil
+	case "http":
+		return &connectDialer{proxy: u.Host, user: u.User}, nil
+	default:
+		return nil, fmt.Errorf("proxy: unsupported scheme: %v", u.Scheme)
+	}
+}
+
+// socks5Dialer implements SOCKS5 client (RFC 1928) with username/password
+// authentication (RFC 1929).
+type socks5Dialer struct {
+	proxy      string
+	user, pass string
+	remoteDNS  bool
+}
+
+func (d *socks5Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: invalid port: %v", portStr)
+	}
+	if !d.remoteDNS && net.ParseIP(host) == nil {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		host = ips[0].IP.String()
+	}
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, d.proxy)
+	if err != nil {
+		return nil, err
+	}
+	stop := WatchConn(ctx, conn)
+	err = d.handshake(conn, host, port)
+	stop()
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("socks5: %v", err)
+	}
+	return conn, nil
+}
+
+var socks5Errors = []string{
+	"",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+func (d *socks5Dialer) handshake(conn net.Conn, host string, port int) error {
+	methods := []byte{0x00} // No authentication.
+	if d.user != "" {
+		methods = append(methods, 0x02) // Username/password.
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != 0x05 {
+		return fmt.Errorf("unexpected protocol version: %v", resp[0])
+	}
+	switch resp[1] {
+	case 0x00:
+	case 0x02:
+		if len(d.user) > 255 || len(d.pass) > 255 {
+			return errors.New("too long username or password")
+		}
+		req := []byte{0x01, byte(len(d.user))}
+		req = append(req, d.user...)
+		req = append(req, byte(len(d.pass)))
+		req = append(req, d.pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if resp[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	default:
+		return errors.New("no acceptable authentication methods")
+	}
+
+	req := []byte{0x05, 0x01 /* CONNECT */, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, 0x01)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, 0x04)
+			req = append(req, ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("too long host name")
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// VER, REP, RSV, ATYP
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		if int(reply[1]) < len(socks5Errors) {
+			return errors.New(socks5Errors[reply[1]])
+		}
+		return fmt.Errorf("unknown error code: %v", reply[1])
+	}
+
+	// Skip bound address, we don't need it.
+	addrLen := 0
+	switch reply[3] {
+	case 0x01:
+		addrLen = net.IPv4len
+	case 0x04:
+		addrLen = net.IPv6len
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		addrLen = int(l[0])
+	default:
+		return fmt.Errorf("unknown address type: %v", reply[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+// connectDialer connects using HTTP CONNECT method (RFC 7231, section
+// 4.3.6).
+type connectDialer struct {
+	proxy string
+	user  *url.Userinfo
+}
+
+func (d *connectDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, d.proxy)
+	if err != nil {
+		return nil, err
+	}
+	stop := WatchConn(ctx, conn)
+	defer stop()
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.user != nil {
+		pass, _ := d.user.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(d.user.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("http proxy: %v", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("http proxy: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy: %v", resp.Status)
+	}
+	// Server greeting may be already buffered.
+	return &bufferedConn{conn, br}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,189 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// greetingServer accepts connections and sends greeting to each.
+func greetingServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "* OK hello\r\n")
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+// fakeSOCKS5 is a SOCKS5 proxy that requires authentication and connects
+// to target regardless of requested address.
+func fakeSOCKS5(t *testing.T, target string, requested chan<- string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 512)
+		io.ReadFull(conn, buf[:2])
+		io.ReadFull(conn, buf[:buf[1]])
+		conn.Write([]byte{0x05, 0x02})
+
+		io.ReadFull(conn, buf[:2])
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(conn, pass)
+		if string(user) != "user" || string(pass) != "pass" {
+			conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+
+		io.ReadFull(conn, buf[:4])
+		if buf[3] != 0x03 {
+			requested <- "not a domain name"
+			return
+		}
+		io.ReadFull(conn, buf[:1])
+		host := make([]byte, buf[0])
+		io.ReadFull(conn, host)
+		io.ReadFull(conn, buf[:2])
+		requested <- string(host)
+
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+		io.Copy(conn, upstream)
+	}()
+	return l
+}
+
+func checkGreeting(t *testing.T, conn net.Conn) {
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal("Read:", err)
+	}
+	if line != "* OK hello\r\n" {
+		t.Errorf("Wrong greeting: %q", line)
+	}
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	target := greetingServer(t)
+	defer target.Close()
+	requested := make(chan string, 1)
+	proxy := fakeSOCKS5(t, target.Addr().String(), requested)
+	defer proxy.Close()
+
+	d, err := NewProxyDialer("socks5h://user:pass@" + proxy.Addr().String())
+	if err != nil {
+		t.Fatal("NewProxyDialer:", err)
+	}
+	conn, err := ServConfig{Host: "imap.example.org", Port: 993, Dialer: d}.Dial()
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer conn.Close()
+	if host := <-requested; host != "imap.example.org" {
+		t.Errorf("Host name not passed to proxy: %v", host)
+	}
+	checkGreeting(t, conn)
+}
+
+func TestConnectDialer(t *testing.T) {
+	target := greetingServer(t)
+	defer target.Close()
+	_, targetPort, _ := net.SplitHostPort(target.Addr().String())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" || r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		io.Copy(conn, upstream)
+	}))
+
+	port, _ := strconv.Atoi(targetPort)
+	conf := ServConfig{Host: "127.0.0.1", Port: uint16(port)}
+
+	conf.Dialer, _ = NewProxyDialer("http://" + l.Addr().String())
+	if _, err := conf.Dial(); err == nil {
+		t.Error("No error without credentials")
+	}
+
+	conf.Dialer, _ = NewProxyDialer("http://user:pass@" + l.Addr().String())
+	conn, err := conf.Dial()
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer conn.Close()
+	checkGreeting(t, conn)
+}
+
+func TestDialContextCancel(t *testing.T) {
+	// Proxy that accepts connections but never replies.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	d, err := NewProxyDialer("socks5h://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	conf := ServConfig{Host: "example.org", Port: 143, Dialer: d}
+	if _, err := conf.DialContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Expected DeadlineExceeded, got", err)
+	}
+}
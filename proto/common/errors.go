@@ -0,0 +1,99 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+var (
+	// ErrConnection is matched (using errors.Is) by errors caused by loss
+	// of server connection. Such operations may succeed after reconnection.
+	ErrConnection = errors.New("connection lost")
+
+	// ErrAuthFailed is matched (using errors.Is) by errors caused by
+	// rejected credentials.
+	ErrAuthFailed = errors.New("authentication failed")
+)
+
+// ConnError wraps error caused by loss of server connection.
+type ConnError struct {
+	Err error
+}
+
+func (e *ConnError) Error() string {
+	return "connection lost: " + e.Err.Error()
+}
+
+func (e *ConnError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ConnError) Is(target error) bool {
+	return target == ErrConnection
+}
+
+// AuthError wraps server response rejecting credentials.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return "authentication failed: " + e.Err.Error()
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+func (e *AuthError) Is(target error) bool {
+	return target == ErrAuthFailed
+}
+
+// IsConnLoss reports whether err is caused by loss of server connection:
+// network errors (including timeouts and connection resets), TLS record
+// errors and unexpected end of stream.
+//
+// Cancelled contexts are never reported as connection loss even if
+// connection was closed because of cancellation.
+func IsConnLoss(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, ErrConnection) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &recordErr) {
+		return true
+	}
+	for _, target := range []error{
+		io.EOF, io.ErrUnexpectedEOF, io.ErrClosedPipe, io.ErrShortWrite,
+		net.ErrClosed, syscall.ECONNRESET, syscall.ECONNABORTED, syscall.EPIPE,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// WrapConnError wraps err using ConnError if it's caused by loss of server
+// connection (see IsConnLoss), other errors are returned as is.
+func WrapConnError(err error) error {
+	if !IsConnLoss(err) || errors.Is(err, ErrConnection) {
+		return err
+	}
+	return &ConnError{err}
+}
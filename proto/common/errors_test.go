@@ -0,0 +1,41 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestIsConnLoss(t *testing.T) {
+	cases := []struct {
+		err  error
+		loss bool
+	}{
+		{nil, false},
+		{io.EOF, true},
+		{io.ErrUnexpectedEOF, true},
+		{fmt.Errorf("read: %w", io.EOF), true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, true},
+		{&ConnError{errors.New("imap: connection closed")}, true},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("NO Mailbox doesn't exist"), false},
+		{&AuthError{errors.New("invalid credentials")}, false},
+	}
+	for _, c := range cases {
+		if loss := IsConnLoss(c.err); loss != c.loss {
+			t.Errorf("IsConnLoss(%v) = %v, expected %v", c.err, loss, c.loss)
+		}
+	}
+
+	wrapped := WrapConnError(io.EOF)
+	if !errors.Is(wrapped, ErrConnection) || !errors.Is(wrapped, io.EOF) {
+		t.Errorf("Wrapped error doesn't match ErrConnection and original error: %v", wrapped)
+	}
+	if err := WrapConnError(context.Canceled); err != context.Canceled {
+		t.Errorf("Context error is wrapped: %v", err)
+	}
+}
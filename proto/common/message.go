@@ -19,6 +19,10 @@ type ParametrizedHeader struct {
 type Header = message.Header
 type Address = mail.Address
 
+// Part is a node of message MIME tree.
+//
+// multipart/* parts have no body, only Children. All other parts are leafs
+// and have no Children.
 type Part struct {
 	Type        ParametrizedHeader
 	Disposition ParametrizedHeader
@@ -26,6 +30,11 @@ type Part struct {
 	Size uint32
 	Misc Header
 
+	// IMAP section path of this part, like "1.2.3". Root part of multipart
+	// message has empty path, root part of non-multipart message is "1".
+	Path     string
+	Children []Part
+
 	// Note, can be null, use CacheDB to request cached bodies for parts.
 	Body []byte
 }
@@ -33,17 +42,25 @@ type Part struct {
 // Msg struct represents a parsed E-Mail message.
 //
 // RFC 822-style headers are splitten into corresponding fields, remaining ones
-// left in Miscfield. Multi-part MIME messages are automatically
-// splitten into parts and decoded. Non-multipart bodies are represented as a
-// body with single part. Headers are left empty if missing or invalid.
+// left in Misc field. Multi-part MIME messages are automatically
+// splitten into tree of parts and decoded. Non-multipart bodies are represented as a
+// single root part without children. Headers are left empty if missing or invalid.
 type Msg struct {
 	Date          time.Time
 	Subject       string
 	From, ReplyTo Address
 	To, Cc, Bcc   []Address
-	Misc          Header
 
-	Parts []Part
+	// Message IDs are stored without angle brackets.
+	MessageId  string
+	InReplyTo  string
+	References []string
+
+	Misc Header
+
+	// Root of MIME tree. Zero value if message body structure is unknown
+	// (i.e. only envelope was downloaded).
+	Body Part
 }
 
 func (ph ParametrizedHeader) String() string {
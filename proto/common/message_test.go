@@ -1,8 +1,8 @@
 package common
 
 import (
+	"bytes"
 	"fmt"
-	"net/mail"
 	"strings"
 	"testing"
 	"time"
@@ -19,9 +19,10 @@ Other headers:
 Parts:
 `, msg.Date, msg.Subject, msg.To, msg.From, msg.ReplyTo, msg.Cc, msg.Bcc, msg.Misc)
 
-	for i, part := range msg.Parts {
-		res += fmt.Sprintf("%v: Len.: %v  Type: %v  %v\n", i, len(part.Body), part.Type.T, part.Misc)
-	}
+	msg.Body.Walk(func(part *Part) error {
+		res += fmt.Sprintf("%v: Len.: %v  Type: %v  %v\n", part.Path, len(part.Body), part.Type, part.Misc)
+		return nil
+	})
 
 	return res
 }
@@ -60,21 +61,21 @@ X-CustomHeader: foo
 Test! Test! Test! Test! ` + "\u5730\u9F20"
 	simple7bitParsed = Msg{
 		Date:    time.Date(2018, time.May, 8, 20, 48, 21, 0, time.UTC),
-		To:      []mail.Address{mail.Address{"", "test@test"}},
+		To:      []Address{{Name: "", Address: "test@test"}},
 		Subject: "test",
-		From:    mail.Address{"test", "test@test"},
-		ReplyTo: mail.Address{},
-		Cc:      []mail.Address{mail.Address{"foo", "foo@foo"}, mail.Address{"bar", "bar@bar"}},
-		Bcc:     []mail.Address{},
-		Misc: mail.Header{
+		From:    Address{Name: "test", Address: "test@test"},
+		ReplyTo: Address{},
+		Cc:      []Address{{Name: "foo", Address: "foo@foo"}, {Name: "bar", Address: "bar@bar"}},
+		Bcc:     []Address{},
+		Misc: Header{
 			"X-Customheader": []string{"foo"},
 		},
-		Parts: []Part{
-			BodyType: Part{
-				ParametrizedHeader{"text/plain", map[string]string{"charset": "utf-8"}},
-				mail.Header{},
-				[]byte("Test! Test! Test! Test! \u5730\u9F20"),
-			},
+		Body: Part{
+			Type: ParametrizedHeader{Value: "text/plain", Params: map[string]string{"charset": "utf-8"}},
+			Size: 30,
+			Misc: nil,
+			Path: "1",
+			Body: []byte("Test! Test! Test! Test! \u5730\u9F20"),
 		},
 	}
 
@@ -93,6 +94,31 @@ VGVzdCEgVGVzdCEgVGVzdCEgVGVzdCEg5Zyw6byg`
 	simpleBase64Parsed = simple7bitParsed
 
 	simpleQuotedPrintedParsed = simple7bitParsed
+
+	nestedMultipartRaw = "From: test <test@test>\r\n" +
+		"To: test@test\r\n" +
+		"Subject: nested\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=inner\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"Plain text\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<b>HTML</b>\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=test.bin\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"AAECAw==\r\n" +
+		"--outer--\r\n"
 )
 
 func TestReadMsg(t *testing.T) {
@@ -103,4 +129,98 @@ func TestReadMsg(t *testing.T) {
 	t.Run("simple/7bit", checkEqual(simple7bitRaw, &simple7bitParsed))
 	t.Run("simple/base64", checkEqual(simple7bitRaw, &simple7bitParsed))
 	//t.Run("simple/quoted-printed", checkEqual(simpleQuotedPrintedRaw, &simpleQuotedPrintedParsed))
+	t.Run("multipart/nested", func(t *testing.T) {
+		msg, err := ReadMsg(strings.NewReader(nestedMultipartRaw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkNestedTree(t, msg)
+	})
+}
+
+func checkNestedTree(t *testing.T, msg *Msg) {
+	if msg.Body.Type.Value != "multipart/mixed" || msg.Body.Path != "" {
+		t.Fatalf("Wrong root part: %v %q", msg.Body.Type.Value, msg.Body.Path)
+	}
+
+	expected := []struct {
+		path, typ, body string
+	}{
+		{"1.1", "text/plain", "Plain text"},
+		{"1.2", "text/html", "<b>HTML</b>"},
+		{"2", "application/octet-stream", "\x00\x01\x02\x03"},
+	}
+	leaves := msg.Body.Leaves()
+	if len(leaves) != len(expected) {
+		t.Fatalf("Wrong leaves count: %v\n%v", len(leaves), prettyPrint(msg))
+	}
+	for i, e := range expected {
+		if leaves[i].Path != e.path || leaves[i].Type.Value != e.typ || string(leaves[i].Body) != e.body {
+			t.Errorf("Part %v mismatch: got %q %v %q", i, leaves[i].Path, leaves[i].Type.Value, leaves[i].Body)
+		}
+	}
+
+	if alt := msg.Body.Find("1"); alt == nil || alt.Type.Value != "multipart/alternative" {
+		t.Errorf("Missing multipart/alternative part")
+	}
+	if att := msg.Body.Find("2"); att == nil || att.Disposition.Params["filename"] != "test.bin" {
+		t.Errorf("Attachment disposition lost")
+	}
+}
+
+func TestNestedMultipart(t *testing.T) {
+	msg, err := ReadMsg(strings.NewReader(nestedMultipartRaw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNestedTree(t, msg)
+
+	// Written message should be parsed into same tree.
+	buf := bytes.Buffer{}
+	if err := msg.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	reparsed, err := ReadMsg(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNestedTree(t, reparsed)
+}
+
+func TestBuildPartTree(t *testing.T) {
+	msg, err := ReadMsg(strings.NewReader(nestedMultipartRaw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flatten tree in reverse order, as it may be returned from DB.
+	flat := []Part{}
+	msg.Body.Walk(func(p *Part) error {
+		cpy := *p
+		cpy.Children = nil
+		flat = append([]Part{cpy}, flat...)
+		return nil
+	})
+
+	msg.Body = BuildPartTree(flat)
+	checkNestedTree(t, msg)
+}
+
+func TestParseMsgIdList(t *testing.T) {
+	cases := []struct {
+		in  string
+		out []string
+	}{
+		{"<a@b>", []string{"a@b"}},
+		{"<a@b> <c@d>\r\n <e@f>", []string{"a@b", "c@d", "e@f"}},
+		{"<a@b>,<c@d>", []string{"a@b", "c@d"}},
+		{"a@b c@d", []string{"a@b", "c@d"}},
+		{"", []string{}},
+	}
+	for _, c := range cases {
+		res := ParseMsgIdList(c.in)
+		if fmt.Sprint(res) != fmt.Sprint(c.out) {
+			t.Errorf("ParseMsgIdList(%q) = %q, expected %q", c.in, res, c.out)
+		}
+	}
 }
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"strings"
+)
+
+// ParseMsgIdList extracts message IDs from Message-Id, In-Reply-To or
+// References header value. Angle brackets are removed.
+//
+// Malformed values without angle brackets are split by whitespace.
+func ParseMsgIdList(s string) []string {
+	res := []string{}
+	for {
+		start := strings.IndexByte(s, '<')
+		if start == -1 {
+			break
+		}
+		end := strings.IndexByte(s[start:], '>')
+		if end == -1 {
+			break
+		}
+		if id := strings.TrimSpace(s[start+1 : start+end]); id != "" {
+			res = append(res, id)
+		}
+		s = s[start+end+1:]
+	}
+	if len(res) == 0 {
+		res = append(res, strings.Fields(s)...)
+	}
+	return res
+}
+
+// ParseMsgId returns first message ID from header value or empty string.
+func ParseMsgId(s string) string {
+	ids := ParseMsgIdList(s)
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[0]
+}
+
+// FormatMsgIdList formats message IDs for use in header value.
+func FormatMsgIdList(ids []string) string {
+	formatted := make([]string, len(ids))
+	for i, id := range ids {
+		formatted[i] = "<" + id + ">"
+	}
+	return strings.Join(formatted, " ")
+}
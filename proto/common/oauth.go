@@ -0,0 +1,329 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sasl "github.com/emersion/go-sasl"
+)
+
+// AuthMethod selects SASL mechanism used to authenticate to server.
+type AuthMethod int
+
+const (
+	// Username and password, SASL PLAIN.
+	AuthPlain AuthMethod = iota
+	// OAuth 2.0 access token, SASL XOAUTH2 (used by Google and Microsoft).
+	AuthXOAuth2
+	// OAuth 2.0 access token, SASL OAUTHBEARER (RFC 7628).
+	AuthOAuthBearer
+)
+
+// Mechanism returns SASL mechanism name for method.
+func (m AuthMethod) Mechanism() string {
+	switch m {
+	case AuthXOAuth2:
+		return sasl.Xoauth2
+	case AuthOAuthBearer:
+		return OAuthBearer
+	default:
+		return Plain
+	}
+}
+
+// SASLClient creates SASL client for authentication using specified
+// configuration. For OAuth methods access token is requested from
+// conf.Token.
+func SASLClient(conf ServConfig) (sasl.Client, error) {
+	return SASLClientContext(context.Background(), conf)
+}
+
+// SASLClientContext is like SASLClient but request for access token can be
+// cancelled using ctx.
+func SASLClientContext(ctx context.Context, conf ServConfig) (sasl.Client, error) {
+	switch conf.AuthMethod {
+	case AuthXOAuth2, AuthOAuthBearer:
+		if conf.Token == nil {
+			return nil, errors.New("auth: no token source for OAuth authentication")
+		}
+		var token string
+		var err error
+		if src, ok := conf.Token.(ContextTokenSource); ok {
+			token, err = src.TokenContext(ctx)
+		} else {
+			token, err = conf.Token.Token()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("auth: %v", err)
+		}
+		if conf.AuthMethod == AuthXOAuth2 {
+			return sasl.NewXoauth2Client(conf.User, token), nil
+		}
+		return NewOAuthBearerClient(conf.User, conf.Host, conf.Port, token), nil
+	default:
+		return sasl.NewPlainClient("", conf.User, conf.Pass), nil
+	}
+}
+
+// The OAUTHBEARER mechanism name.
+const OAuthBearer = "OAUTHBEARER"
+
+// OAuthBearerError is an error reported by server during OAUTHBEARER
+// authentication.
+type OAuthBearerError struct {
+	Status  string `json:"status"`
+	Schemes string `json:"schemes"`
+	Scope   string `json:"scope"`
+}
+
+func (err *OAuthBearerError) Error() string {
+	return fmt.Sprintf("OAUTHBEARER authentication error (%v)", err.Status)
+}
+
+type oauthBearerClient struct {
+	user, host string
+	port       uint16
+	token      string
+}
+
+func (c *oauthBearerClient) Start() (mech string, ir []byte, err error) {
+	gs2 := "n,"
+	if c.user != "" {
+		gs2 += "a=" + strings.NewReplacer("=", "=3D", ",", "=2C").Replace(c.user)
+	}
+	gs2 += ","
+
+	ir = []byte(gs2 + "\x01")
+	if c.host != "" {
+		ir = append(ir, "host="+c.host+"\x01"...)
+	}
+	if c.port != 0 {
+		ir = append(ir, "port="+strconv.Itoa(int(c.port))+"\x01"...)
+	}
+	ir = append(ir, "auth=Bearer "+c.token+"\x01\x01"...)
+	return OAuthBearer, ir, nil
+}
+
+func (c *oauthBearerClient) Next(challenge []byte) ([]byte, error) {
+	// Server sent an error, RFC 7628 requires client to reply with single
+	// %x01 to which server then replies with failure.
+	bearerErr := &OAuthBearerError{}
+	if err := json.Unmarshal(challenge, bearerErr); err != nil {
+		return nil, err
+	}
+	return []byte{0x01}, nil
+}
+
+// NewOAuthBearerClient creates client for OAUTHBEARER mechanism (RFC 7628).
+// host and port are optional and may be left empty.
+func NewOAuthBearerClient(user, host string, port uint16, token string) sasl.Client {
+	return &oauthBearerClient{user, host, port, token}
+}
+
+// TokenSource provides OAuth 2.0 access tokens.
+//
+// Implementations should cache tokens and refresh them only when needed
+// since Token is called on each authentication.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// ContextTokenSource is implemented by token sources that make network
+// requests, so they can be cancelled.
+type ContextTokenSource interface {
+	TokenSource
+	TokenContext(ctx context.Context) (string, error)
+}
+
+// TokenInvalidator is implemented by token sources that cache tokens.
+// Invalidate is called if server rejected token, so new one is obtained on
+// next use.
+type TokenInvalidator interface {
+	Invalidate()
+}
+
+// InvalidateToken invalidates access token used to authenticate with conf
+// after it was rejected by server. It returns true if new token will be
+// obtained, so authentication should be retried.
+func InvalidateToken(conf ServConfig) bool {
+	if conf.AuthMethod == AuthPlain {
+		return false
+	}
+	inv, ok := conf.Token.(TokenInvalidator)
+	if ok {
+		inv.Invalidate()
+	}
+	return ok
+}
+
+// StaticToken is a TokenSource that always returns the same token.
+type StaticToken string
+
+func (t StaticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+// RefreshTokenSource obtains access tokens from OAuth 2.0 token endpoint
+// using refresh token grant (RFC 6749, section 6).
+type RefreshTokenSource struct {
+	Endpoint     string
+	ClientId     string
+	ClientSecret string
+
+	// Called when server issued new refresh token, it should be stored
+	// in place of old one. Can be nil.
+	OnRefresh func(refreshToken string)
+
+	// http.DefaultClient is used if nil. Set it (see HTTPClient) if
+	// connections to servers go through proxy, otherwise token endpoint
+	// is contacted directly. Requests time out after 30 seconds if client
+	// has no timeout set.
+	HTTPClient *http.Client
+
+	lock         sync.Mutex
+	refreshToken string
+	accessToken  string
+	expiry       time.Time
+}
+
+const (
+	// tokenExpiryDelta is a time before actual expiry when access token
+	// is already considered expired, so it will not expire during use.
+	tokenExpiryDelta = 1 * time.Minute
+
+	// defaultTokenLifetime is used if token endpoint doesn't reports
+	// expiry time of access token. Most providers issue tokens valid for
+	// an hour, shorter time causes only extra refreshes.
+	defaultTokenLifetime = 10 * time.Minute
+
+	// tokenRequestTimeout limits time of request to token endpoint so
+	// hung endpoint doesn't blocks connection to server forever.
+	tokenRequestTimeout = 30 * time.Second
+)
+
+// NewRefreshTokenSource creates RefreshTokenSource for specified token
+// endpoint and client credentials.
+func NewRefreshTokenSource(endpoint, clientId, clientSecret, refreshToken string) *RefreshTokenSource {
+	return &RefreshTokenSource{
+		Endpoint:     endpoint,
+		ClientId:     clientId,
+		ClientSecret: clientSecret,
+		refreshToken: refreshToken,
+	}
+}
+
+// RefreshToken returns current refresh token.
+func (s *RefreshTokenSource) RefreshToken() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.refreshToken
+}
+
+// Token returns cached access token or requests new one if it is expired.
+func (s *RefreshTokenSource) Token() (string, error) {
+	return s.TokenContext(context.Background())
+}
+
+// TokenContext is like Token but request to token endpoint can be cancelled
+// using ctx.
+func (s *RefreshTokenSource) TokenContext(ctx context.Context) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.accessToken != "" && time.Now().Before(s.expiry) {
+		return s.accessToken, nil
+	}
+	if err := s.refresh(ctx); err != nil {
+		return "", fmt.Errorf("token refresh: %v", err)
+	}
+	return s.accessToken, nil
+}
+
+// Invalidate drops cached access token, new one will be requested on next
+// use. Should be called if server rejected token, it may be revoked before
+// expiry.
+func (s *RefreshTokenSource) Invalidate() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.accessToken = ""
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Must be called while lock is held.
+func (s *RefreshTokenSource) refresh(ctx context.Context) error {
+	if s.refreshToken == "" {
+		return errors.New("no refresh token")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", s.refreshToken)
+	form.Set("client_id", s.ClientId)
+	if s.ClientSecret != "" {
+		form.Set("client_secret", s.ClientSecret)
+	}
+
+	cl := http.Client{}
+	if s.HTTPClient != nil {
+		cl = *s.HTTPClient
+	}
+	if cl.Timeout == 0 {
+		cl.Timeout = tokenRequestTimeout
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := cl.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	res := tokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("malformed response (%v): %v", resp.Status, err)
+	}
+	if res.Error != "" {
+		if res.ErrorDescription != "" {
+			return fmt.Errorf("%v: %v", res.Error, res.ErrorDescription)
+		}
+		return errors.New(res.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response: %v", resp.Status)
+	}
+	if res.AccessToken == "" {
+		return errors.New("no access token in response")
+	}
+
+	s.accessToken = res.AccessToken
+	s.expiry = time.Now().Add(defaultTokenLifetime)
+	if res.ExpiresIn > 0 {
+		s.expiry = time.Now().Add(time.Duration(res.ExpiresIn)*time.Second - tokenExpiryDelta)
+	}
+	if res.RefreshToken != "" && res.RefreshToken != s.refreshToken {
+		s.refreshToken = res.RefreshToken
+		if s.OnRefresh != nil {
+			s.OnRefresh(res.RefreshToken)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeTokenEndpoint is a minimal OAuth 2.0 token endpoint that issues new
+// access and refresh token on each request.
+type fakeTokenEndpoint struct {
+	refreshToken string
+	requests     int
+	expiresIn    int
+}
+
+func (e *fakeTokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" || r.FormValue("grant_type") != "refresh_token" || r.FormValue("client_id") != "client" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request"})
+		return
+	}
+	if r.FormValue("refresh_token") != e.refreshToken {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	e.requests++
+	e.refreshToken = "refresh" + string('0'+rune(e.requests))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  "access" + string('0'+rune(e.requests)),
+		"refresh_token": e.refreshToken,
+		"token_type":    "Bearer",
+		"expires_in":    e.expiresIn,
+	})
+}
+
+func TestRefreshTokenSource(t *testing.T) {
+	endpoint := &fakeTokenEndpoint{refreshToken: "refresh0", expiresIn: 3600}
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+
+	saved := ""
+	src := NewRefreshTokenSource(srv.URL, "client", "secret", "refresh0")
+	src.OnRefresh = func(token string) { saved = token }
+
+	for i := 0; i < 2; i++ {
+		token, err := src.Token()
+		if err != nil {
+			t.Fatal("Token:", err)
+		}
+		if token != "access1" {
+			t.Errorf("Wrong access token: %v", token)
+		}
+	}
+	if endpoint.requests != 1 {
+		t.Errorf("Cached token not used, %v requests made", endpoint.requests)
+	}
+	if saved != "refresh1" || src.RefreshToken() != "refresh1" {
+		t.Errorf("New refresh token not saved: %v, %v", saved, src.RefreshToken())
+	}
+
+	// Expired token should be refreshed using new refresh token.
+	endpoint.expiresIn = 1
+	src.accessToken = ""
+	if _, err := src.Token(); err != nil {
+		t.Fatal("Token:", err)
+	}
+	token, err := src.Token()
+	if err != nil {
+		t.Fatal("Token:", err)
+	}
+	if token != "access3" || endpoint.requests != 3 {
+		t.Errorf("Expired token not refreshed: %v, %v requests made", token, endpoint.requests)
+	}
+
+	// Token rejected by server is not used again.
+	src.Invalidate()
+	token, err = src.Token()
+	if err != nil {
+		t.Fatal("Token:", err)
+	}
+	if token != "access4" || endpoint.requests != 4 {
+		t.Errorf("Invalidated token is used: %v, %v requests made", token, endpoint.requests)
+	}
+
+	// Token without reported expiry time is refreshed after some time.
+	endpoint.expiresIn = 0
+	src.Invalidate()
+	if _, err := src.Token(); err != nil {
+		t.Fatal("Token:", err)
+	}
+	if src.expiry.IsZero() || src.expiry.After(time.Now().Add(defaultTokenLifetime)) {
+		t.Errorf("Wrong expiry time of token without expires_in: %v", src.expiry)
+	}
+	src.expiry = time.Now().Add(-time.Second)
+	token, err = src.Token()
+	if err != nil {
+		t.Fatal("Token:", err)
+	}
+	if token != "access6" || endpoint.requests != 6 {
+		t.Errorf("Token without expiry time is not refreshed: %v, %v requests made", token, endpoint.requests)
+	}
+
+	bad := NewRefreshTokenSource(srv.URL, "client", "", "revoked")
+	if _, err := bad.Token(); err == nil {
+		t.Error("No error for invalid refresh token")
+	}
+}
+
+func TestRefreshTokenSourceContext(t *testing.T) {
+	// Endpoint never responds.
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-hang:
+		}
+	}))
+	defer srv.Close()
+	defer close(hang)
+
+	src := NewRefreshTokenSource(srv.URL, "client", "", "refresh0")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := src.TokenContext(ctx)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("No error for cancelled request")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request is not cancelled")
+	}
+}
+
+// redirectDialer connects to target regardless of requested address and
+// remembers requested addresses.
+type redirectDialer struct {
+	target    string
+	requested []string
+}
+
+func (d *redirectDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *redirectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.requested = append(d.requested, addr)
+	return (&net.Dialer{}).DialContext(ctx, network, d.target)
+}
+
+func TestRefreshTokenSourceDialer(t *testing.T) {
+	endpoint := &fakeTokenEndpoint{refreshToken: "refresh0", expiresIn: 3600}
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+
+	dialer := &redirectDialer{target: srv.Listener.Addr().String()}
+	src := NewRefreshTokenSource("http://oauth.invalid/token", "client", "", "refresh0")
+	src.HTTPClient = HTTPClient(dialer)
+	if _, err := src.Token(); err != nil {
+		t.Fatal("Token:", err)
+	}
+	if len(dialer.requested) != 1 || dialer.requested[0] != "oauth.invalid:80" {
+		t.Errorf("Dialer is not used for token endpoint: %v", dialer.requested)
+	}
+}
+
+func TestSASLClient(t *testing.T) {
+	cases := []struct {
+		method AuthMethod
+		mech   string
+		ir     string
+	}{
+		{AuthPlain, "PLAIN", "\x00user\x00pass"},
+		{AuthXOAuth2, "XOAUTH2", "user=user\x01auth=Bearer token\x01\x01"},
+		{AuthOAuthBearer, "OAUTHBEARER", "n,a=user,\x01host=example.org\x01port=993\x01auth=Bearer token\x01\x01"},
+	}
+	for _, c := range cases {
+		cl, err := SASLClient(ServConfig{
+			Host:       "example.org",
+			Port:       993,
+			User:       "user",
+			Pass:       "pass",
+			AuthMethod: c.method,
+			Token:      StaticToken("token"),
+		})
+		if err != nil {
+			t.Fatal("SASLClient:", err)
+		}
+		mech, ir, err := cl.Start()
+		if err != nil {
+			t.Fatal("Start:", err)
+		}
+		if mech != c.mech || string(ir) != c.ir {
+			t.Errorf("Wrong initial response for %v: %q", mech, ir)
+		}
+	}
+
+	if _, err := SASLClient(ServConfig{AuthMethod: AuthXOAuth2}); err == nil {
+		t.Error("No error for missing token source")
+	}
+}
@@ -0,0 +1,162 @@
+package common
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// IsMultipart returns true if part is a multipart/* container.
+func (p *Part) IsMultipart() bool {
+	return strings.HasPrefix(strings.ToLower(p.Type.Value), "multipart/") || len(p.Children) != 0
+}
+
+// Walk calls f for part and all it's children (depth-first, parents before
+// children). Parts passed to f can be modified in-place.
+//
+// If f returns error - walk is stopped and error is returned.
+func (p *Part) Walk(f func(*Part) error) error {
+	if err := f(p); err != nil {
+		return err
+	}
+	for i := range p.Children {
+		if err := p.Children[i].Walk(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Leaves returns all non-multipart parts in tree in order of appearance.
+func (p *Part) Leaves() []*Part {
+	res := []*Part{}
+	p.Walk(func(prt *Part) error {
+		if !prt.IsMultipart() {
+			res = append(res, prt)
+		}
+		return nil
+	})
+	return res
+}
+
+var htmlTagRe = regexp.MustCompile(`(?s)<[^>]*>`)
+
+// StripHTMLTags replaces HTML tags in text with repl. It's not an HTML
+// parser, result is good enough only for quoting and indexing.
+func StripHTMLTags(html, repl string) string {
+	return htmlTagRe.ReplaceAllString(html, repl)
+}
+
+// Find returns part with specified section path or nil if there is no such
+// part.
+func (p *Part) Find(path string) *Part {
+	if p.Path == path {
+		return p
+	}
+	for i := range p.Children {
+		if res := p.Children[i].Find(path); res != nil {
+			return res
+		}
+	}
+	return nil
+}
+
+// AssignPaths sets Path field for all parts in tree assuming that p is
+// root part of message.
+func (p *Part) AssignPaths() {
+	if p.IsMultipart() {
+		p.assignPaths("")
+	} else {
+		p.Path = "1"
+	}
+}
+
+func (p *Part) assignPaths(path string) {
+	p.Path = path
+	for i := range p.Children {
+		p.Children[i].assignPaths(ChildPath(path, i+1))
+	}
+}
+
+// ChildPath returns section path of n-th (1-based) child of part with specified
+// path.
+func ChildPath(parent string, n int) string {
+	if parent == "" {
+		return strconv.Itoa(n)
+	}
+	return parent + "." + strconv.Itoa(n)
+}
+
+// ParentPath returns section path of parent part. Parent of top-level parts
+// is root with empty path.
+func ParentPath(path string) string {
+	i := strings.LastIndexByte(path, '.')
+	if i == -1 {
+		return ""
+	}
+	return path[:i]
+}
+
+// PathDepth returns nesting level of part with specified path, root is 0.
+func PathDepth(path string) int {
+	if path == "" {
+		return 0
+	}
+	return strings.Count(path, ".") + 1
+}
+
+// PathLess compares section paths numerically ("1.2" < "1.10").
+func PathLess(a, b string) bool {
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		an, _ := strconv.Atoi(aParts[i])
+		bn, _ := strconv.Atoi(bParts[i])
+		if an != bn {
+			return an < bn
+		}
+	}
+	return len(aParts) < len(bParts)
+}
+
+// BuildPartTree reconstructs MIME tree from flat list of parts with Path
+// set. Children order is restored using paths.
+//
+// Parts without parent in list are ignored.
+func BuildPartTree(parts []Part) Part {
+	byPath := make(map[string]*Part, len(parts))
+	paths := make([]string, 0, len(parts))
+	for i := range parts {
+		byPath[parts[i].Path] = &parts[i]
+		paths = append(paths, parts[i].Path)
+	}
+
+	// Deepest parts first so each part is complete when attached to parent.
+	sort.Slice(paths, func(i, j int) bool {
+		di, dj := PathDepth(paths[i]), PathDepth(paths[j])
+		if di != dj {
+			return di > dj
+		}
+		return PathLess(paths[i], paths[j])
+	})
+
+	root, prs := byPath[""]
+	if !prs {
+		root, prs = byPath["1"]
+		if !prs {
+			return Part{}
+		}
+		return *root
+	}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		parent, prs := byPath[ParentPath(path)]
+		if !prs {
+			continue
+		}
+		parent.Children = append(parent.Children, *byPath[path])
+	}
+	return *root
+}
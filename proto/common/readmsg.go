@@ -16,10 +16,12 @@ func ReadMsg(in io.Reader) (*Msg, error) {
 		return nil, err
 	}
 
-	if err := readHeaders(res, m); err != nil {
+	// Body is read first because readHeaders removes MIME headers
+	// describing root part.
+	if err := readBody(res, m); err != nil {
 		return nil, err
 	}
-	if err := readBody(res, m); err != nil {
+	if err := readHeaders(res, m); err != nil {
 		return nil, err
 	}
 
@@ -41,6 +43,11 @@ func readHeaders(res *Msg, m *message.Entity) error {
 	res.To, _ = ConvertAddrList(mail.ParseAddressList(m.Header.Get("To")))
 	res.Cc, _ = ConvertAddrList(mail.ParseAddressList(m.Header.Get("Cc")))
 	res.Bcc, _ = ConvertAddrList(mail.ParseAddressList(m.Header.Get("Bcc")))
+	res.MessageId = ParseMsgId(m.Header.Get("Message-Id"))
+	res.InReplyTo = ParseMsgId(m.Header.Get("In-Reply-To"))
+	if refs := m.Header.Get("References"); refs != "" {
+		res.References = ParseMsgIdList(refs)
+	}
 
 	delete(m.Header, "Date")
 	delete(m.Header, "Subject")
@@ -49,49 +56,68 @@ func readHeaders(res *Msg, m *message.Entity) error {
 	delete(m.Header, "To")
 	delete(m.Header, "Cc")
 	delete(m.Header, "Bcc")
+	delete(m.Header, "Message-Id")
+	delete(m.Header, "In-Reply-To")
+	delete(m.Header, "References")
+	delete(m.Header, "Content-Type")
+	delete(m.Header, "Content-Disposition")
 	delete(m.Header, "Content-Transfer-Encoding")
 	res.Misc = Header(m.Header)
 	return nil
 }
 
 func readBody(res *Msg, m *message.Entity) error {
+	var err error
+	res.Body, err = readPart(m)
+	if err != nil {
+		return err
+	}
+	// Message headers are stored in Msg.Misc.
+	res.Body.Misc = nil
+	res.Body.AssignPaths()
+	return nil
+}
+
+// readPart recursively reads entity and all nested entities (if it's
+// multipart).
+func readPart(m *message.Entity) (Part, error) {
+	res := Part{}
+	res.Type.Value, res.Type.Params, _ = m.Header.ContentType()
+	res.Disposition.Value, res.Disposition.Params, _ = m.Header.ContentDisposition()
+
 	if mr := m.MultipartReader(); mr != nil {
-		// Multipart message.
 		for {
-			outPart := Part{}
 			part, err := mr.NextPart()
 			if err != nil {
 				if err == io.EOF {
 					break
 				}
-				return err
+				return res, err
 			}
 
-			outPart.Type.Value, outPart.Type.Params, _ = part.Header.ContentType()
-			outPart.Disposition.Value, outPart.Disposition.Params, _ = part.Header.ContentDisposition()
-			outPart.Body, err = ioutil.ReadAll(part.Body)
+			child, err := readPart(part)
 			if err != nil {
-				return err
+				return res, err
 			}
-			outPart.Size = uint32(len(outPart.Body))
-			part.Header.Del("Content-Type")
-			part.Header.Del("Content-Transfer-Encoding")
-			outPart.Misc = Header(part.Header)
-
-			res.Parts = append(res.Parts, outPart)
+			res.Children = append(res.Children, child)
 		}
 	} else {
-		// Regular message.
-		outPart := Part{}
 		var err error
-		outPart.Type.Value, outPart.Type.Params, err = m.Header.ContentType()
-		outPart.Body, err = ioutil.ReadAll(m.Body)
+		res.Body, err = ioutil.ReadAll(m.Body)
 		if err != nil {
-			return err
+			return res, err
 		}
-		outPart.Size = uint32(len(outPart.Body))
+		res.Size = uint32(len(res.Body))
 
-		res.Parts = append(res.Parts, outPart)
+		// Body is converted to UTF-8 by go-message.
+		if _, prs := res.Type.Params["charset"]; prs {
+			res.Type.Params["charset"] = "utf-8"
+		}
 	}
-	return nil
+
+	m.Header.Del("Content-Type")
+	m.Header.Del("Content-Disposition")
+	m.Header.Del("Content-Transfer-Encoding")
+	res.Misc = Header(m.Header)
+	return res, nil
 }
@@ -0,0 +1,381 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"unicode"
+
+	sasl "github.com/emersion/go-sasl"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/text/unicode/norm"
+)
+
+// SASL mechanisms that use password.
+const (
+	ScramSHA256Plus = "SCRAM-SHA-256-PLUS"
+	ScramSHA256     = "SCRAM-SHA-256"
+	ScramSHA1Plus   = "SCRAM-SHA-1-PLUS"
+	ScramSHA1       = "SCRAM-SHA-1"
+	CramMD5         = "CRAM-MD5"
+	Plain           = "PLAIN"
+	Login           = "LOGIN"
+)
+
+// PasswordMechanisms lists supported password-based SASL mechanisms, most
+// preferred first.
+var PasswordMechanisms = []string{
+	ScramSHA256Plus,
+	ScramSHA256,
+	ScramSHA1Plus,
+	ScramSHA1,
+	CramMD5,
+	Plain,
+	Login,
+}
+
+// ChannelBinding is data used by SCRAM-*-PLUS mechanisms to bind
+// authentication to TLS connection (RFC 5929, RFC 9266).
+type ChannelBinding struct {
+	Type string
+	Data []byte
+}
+
+// TLSChannelBinding returns channel binding for TLS connection:
+// tls-exporter for TLS 1.3 and tls-unique for earlier versions. nil is
+// returned if state is nil or binding is not available.
+func TLSChannelBinding(state *tls.ConnectionState) *ChannelBinding {
+	if state == nil {
+		return nil
+	}
+	if state.Version >= tls.VersionTLS13 {
+		data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			return nil
+		}
+		return &ChannelBinding{Type: "tls-exporter", Data: data}
+	}
+	if len(state.TLSUnique) == 0 {
+		return nil
+	}
+	return &ChannelBinding{Type: "tls-unique", Data: state.TLSUnique}
+}
+
+// NegotiateSASL picks SASL mechanism for authentication using
+// configuration and list of mechanisms supported by server and creates
+// client for it.
+//
+// For password authentication strongest mechanism supported by both sides
+// is used, conf.Mechanisms and conf.ForbiddenMechanisms can be used to
+// restrict choice. SCRAM-*-PLUS mechanisms are used only if cb is not nil.
+// If server advertises no mechanisms PLAIN is tried, see PlainFallback.
+//
+// ctx is used to cancel request for OAuth access token, if any.
+func NegotiateSASL(ctx context.Context, conf ServConfig, serverMechs []string, cb *ChannelBinding) (sasl.Client, error) {
+	supported := make(map[string]bool, len(serverMechs))
+	for _, mech := range serverMechs {
+		supported[strings.ToUpper(mech)] = true
+	}
+	forbidden := make(map[string]bool, len(conf.ForbiddenMechanisms))
+	for _, mech := range conf.ForbiddenMechanisms {
+		forbidden[strings.ToUpper(mech)] = true
+	}
+
+	if conf.AuthMethod != AuthPlain {
+		mech := conf.AuthMethod.Mechanism()
+		if forbidden[mech] {
+			return nil, fmt.Errorf("auth: %v is forbidden by configuration", mech)
+		}
+		if !supported[mech] {
+			return nil, fmt.Errorf("auth: %v is not supported by server", mech)
+		}
+		return SASLClientContext(ctx, conf)
+	}
+
+	if len(serverMechs) == 0 && PlainFallback(conf) {
+		return newPasswordClient(Plain, conf, cb, false), nil
+	}
+
+	candidates := PasswordMechanisms
+	if len(conf.Mechanisms) != 0 {
+		candidates = conf.Mechanisms
+	}
+	for _, mech := range candidates {
+		mech = strings.ToUpper(mech)
+		if forbidden[mech] || !supported[mech] {
+			continue
+		}
+		if strings.HasSuffix(mech, "-PLUS") && cb == nil {
+			continue
+		}
+		if cl := newPasswordClient(mech, conf, cb, supported[mech+"-PLUS"]); cl != nil {
+			return cl, nil
+		}
+	}
+	return nil, fmt.Errorf("auth: no usable mechanism found (server supports: %v)", strings.Join(serverMechs, " "))
+}
+
+// PlainFallback reports whether password can be sent in plaintext when
+// server advertises no SASL mechanisms. This is the case when password
+// authentication is used without pinned mechanisms and PLAIN is not
+// forbidden.
+func PlainFallback(conf ServConfig) bool {
+	if conf.AuthMethod != AuthPlain || len(conf.Mechanisms) != 0 {
+		return false
+	}
+	for _, mech := range conf.ForbiddenMechanisms {
+		if strings.EqualFold(mech, Plain) {
+			return false
+		}
+	}
+	return true
+}
+
+// newPasswordClient creates client for password-based mechanism or returns
+// nil if mechanism is not known. serverPlus indicates whether server
+// supports channel binding variant of mechanism.
+func newPasswordClient(mech string, conf ServConfig, cb *ChannelBinding, serverPlus bool) sasl.Client {
+	switch mech {
+	case ScramSHA256Plus:
+		return newScramClient(mech, sha256.New, conf.User, conf.Pass, cb, false)
+	case ScramSHA256:
+		return newScramClient(mech, sha256.New, conf.User, conf.Pass, nil, cb != nil && !serverPlus)
+	case ScramSHA1Plus:
+		return newScramClient(mech, sha1.New, conf.User, conf.Pass, cb, false)
+	case ScramSHA1:
+		return newScramClient(mech, sha1.New, conf.User, conf.Pass, nil, cb != nil && !serverPlus)
+	case CramMD5:
+		return &cramMD5Client{conf.User, conf.Pass}
+	case Plain:
+		return sasl.NewPlainClient("", conf.User, conf.Pass)
+	case Login:
+		return &loginClient{user: conf.User, pass: conf.Pass}
+	}
+	return nil
+}
+
+// cramMD5Client implements CRAM-MD5 mechanism (RFC 2195).
+type cramMD5Client struct {
+	user, pass string
+}
+
+func (c *cramMD5Client) Start() (mech string, ir []byte, err error) {
+	return CramMD5, nil, nil
+}
+
+func (c *cramMD5Client) Next(challenge []byte) ([]byte, error) {
+	mac := hmac.New(md5.New, []byte(c.pass))
+	mac.Write(challenge)
+	return []byte(c.user + " " + hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// loginClient implements obsolete LOGIN mechanism
+// (draft-murchison-sasl-login-00). Server prompts are not interpreted,
+// first challenge is assumed to be username request, second is password
+// request.
+type loginClient struct {
+	user, pass string
+	step       int
+}
+
+func (c *loginClient) Start() (mech string, ir []byte, err error) {
+	return Login, nil, nil
+}
+
+func (c *loginClient) Next(challenge []byte) ([]byte, error) {
+	c.step++
+	switch c.step {
+	case 1:
+		return []byte(c.user), nil
+	case 2:
+		return []byte(c.pass), nil
+	default:
+		return nil, sasl.ErrUnexpectedServerChallenge
+	}
+}
+
+// scramClient implements SCRAM mechanisms family (RFC 5802, RFC 7677).
+type scramClient struct {
+	mech       string
+	hash       func() hash.Hash
+	user, pass string
+
+	// Channel binding for -PLUS variants.
+	cb *ChannelBinding
+	// Client supports channel binding but server doesn't.
+	cbSupported bool
+
+	step            int
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func newScramClient(mech string, h func() hash.Hash, user, pass string, cb *ChannelBinding, cbSupported bool) *scramClient {
+	return &scramClient{mech: mech, hash: h, user: user, pass: pass, cb: cb, cbSupported: cbSupported}
+}
+
+func (c *scramClient) gs2Header() string {
+	switch {
+	case c.cb != nil:
+		return "p=" + c.cb.Type + ",,"
+	case c.cbSupported:
+		return "y,,"
+	default:
+		return "n,,"
+	}
+}
+
+func (c *scramClient) Start() (mech string, ir []byte, err error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	c.nonce = base64.RawStdEncoding.EncodeToString(nonce)
+
+	user, err := saslPrep(c.user)
+	if err != nil {
+		return "", nil, fmt.Errorf("scram: username: %v", err)
+	}
+	if c.pass, err = saslPrep(c.pass); err != nil {
+		return "", nil, fmt.Errorf("scram: password: %v", err)
+	}
+	user = strings.NewReplacer("=", "=3D", ",", "=2C").Replace(user)
+	c.clientFirstBare = "n=" + user + ",r=" + c.nonce
+	return c.mech, []byte(c.gs2Header() + c.clientFirstBare), nil
+}
+
+func (c *scramClient) Next(challenge []byte) ([]byte, error) {
+	c.step++
+	switch c.step {
+	case 1:
+		return c.clientFinal(challenge)
+	case 2:
+		attrs := scramAttrs(challenge)
+		if e, ok := attrs["e"]; ok {
+			return nil, fmt.Errorf("scram: server error: %v", e)
+		}
+		sig, err := base64.StdEncoding.DecodeString(attrs["v"])
+		if err != nil || !hmac.Equal(sig, c.serverSignature) {
+			return nil, errors.New("scram: invalid server signature")
+		}
+		return []byte{}, nil
+	default:
+		return nil, sasl.ErrUnexpectedServerChallenge
+	}
+}
+
+func (c *scramClient) clientFinal(serverFirst []byte) ([]byte, error) {
+	attrs := scramAttrs(serverFirst)
+	if e, ok := attrs["e"]; ok {
+		return nil, fmt.Errorf("scram: server error: %v", e)
+	}
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return nil, errors.New("scram: invalid server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("scram: invalid salt")
+	}
+	iters, err := strconv.Atoi(attrs["i"])
+	if err != nil || iters <= 0 {
+		return nil, errors.New("scram: invalid iteration count")
+	}
+
+	cbind := []byte(c.gs2Header())
+	if c.cb != nil {
+		cbind = append(cbind, c.cb.Data...)
+	}
+	clientFinalBare := "c=" + base64.StdEncoding.EncodeToString(cbind) + ",r=" + nonce
+	authMsg := []byte(c.clientFirstBare + "," + string(serverFirst) + "," + clientFinalBare)
+
+	salted := pbkdf2.Key([]byte(c.pass), salt, iters, c.hash().Size(), c.hash)
+	clientKey := c.hmac(salted, []byte("Client Key"))
+	storedKey := c.hash()
+	storedKey.Write(clientKey)
+	proof := c.hmac(storedKey.Sum(nil), authMsg)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	c.serverSignature = c.hmac(c.hmac(salted, []byte("Server Key")), authMsg)
+
+	return []byte(clientFinalBare + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func (c *scramClient) hmac(key, data []byte) []byte {
+	mac := hmac.New(c.hash, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// saslPrep prepares string using SASLprep profile (RFC 4013): non-ASCII
+// spaces are replaced with space, characters "commonly mapped to nothing"
+// are removed, result is NFKC-normalized and checked for prohibited
+// characters. Bidirectional text checks are not performed.
+func saslPrep(s string) (string, error) {
+	mapped := strings.Map(func(r rune) rune {
+		switch {
+		case r != ' ' && unicode.Is(unicode.Zs, r):
+			return ' '
+		case r == 0x00AD, r == 0x034F, r == 0x1806, r >= 0x180B && r <= 0x180D,
+			r >= 0x200B && r <= 0x200D, r == 0x2060, r >= 0xFE00 && r <= 0xFE0F,
+			r == 0xFEFF:
+			return -1
+		}
+		return r
+	}, s)
+	res := norm.NFKC.String(mapped)
+	for _, r := range res {
+		if saslProhibited(r) {
+			return "", fmt.Errorf("prohibited character %U", r)
+		}
+	}
+	if res == "" && s != "" {
+		return "", errors.New("empty after preparation")
+	}
+	return res, nil
+}
+
+// saslProhibited reports whether r is prohibited by SASLprep (RFC 4013,
+// section 2.3).
+func saslProhibited(r rune) bool {
+	switch {
+	case unicode.In(r, unicode.Cc, unicode.Co, unicode.Cs):
+		return true
+	case r&0xFFFE == 0xFFFE, r >= 0xFDD0 && r <= 0xFDEF:
+		// Non-character code points.
+		return true
+	case r >= 0xFFF9 && r <= 0xFFFD, r >= 0x2FF0 && r <= 0x2FFB,
+		r == 0x0340, r == 0x0341, r == 0x200E, r == 0x200F,
+		r >= 0x202A && r <= 0x202E, r >= 0x206A && r <= 0x206F,
+		r == 0xE0001, r >= 0xE0020 && r <= 0xE007F:
+		return true
+	}
+	return false
+}
+
+// scramAttrs parses comma-separated list of SCRAM attributes.
+func scramAttrs(msg []byte) map[string]string {
+	res := make(map[string]string)
+	for _, attr := range bytes.Split(msg, []byte(",")) {
+		parts := strings.SplitN(string(attr), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		res[parts[0]] = parts[1]
+	}
+	return res
+}
@@ -0,0 +1,129 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateSASL(t *testing.T) {
+	cb := &ChannelBinding{Type: "tls-unique", Data: []byte("binding")}
+	cases := []struct {
+		server    []string
+		cb        *ChannelBinding
+		pinned    []string
+		forbidden []string
+		mech      string
+	}{
+		{[]string{"PLAIN", "LOGIN"}, nil, nil, nil, "PLAIN"},
+		{[]string{"PLAIN", "CRAM-MD5", "SCRAM-SHA-1"}, nil, nil, nil, "SCRAM-SHA-1"},
+		{[]string{"SCRAM-SHA-256", "SCRAM-SHA-256-PLUS"}, nil, nil, nil, "SCRAM-SHA-256"},
+		{[]string{"SCRAM-SHA-256", "SCRAM-SHA-256-PLUS"}, cb, nil, nil, "SCRAM-SHA-256-PLUS"},
+		{[]string{"scram-sha-256", "PLAIN"}, nil, nil, []string{"scram-sha-256"}, "PLAIN"},
+		{[]string{"SCRAM-SHA-256", "PLAIN", "LOGIN"}, nil, []string{"LOGIN", "PLAIN"}, nil, "LOGIN"},
+		{[]string{"SCRAM-SHA-256"}, nil, []string{"PLAIN"}, nil, ""},
+		{[]string{"GSSAPI"}, nil, nil, nil, ""},
+		{nil, nil, nil, nil, "PLAIN"},
+		{nil, nil, []string{"SCRAM-SHA-256"}, nil, ""},
+		{nil, nil, nil, []string{"plain"}, ""},
+	}
+	for _, c := range cases {
+		conf := ServConfig{User: "user", Pass: "pass", Mechanisms: c.pinned, ForbiddenMechanisms: c.forbidden}
+		cl, err := NegotiateSASL(context.Background(), conf, c.server, c.cb)
+		if c.mech == "" {
+			if err == nil {
+				t.Errorf("No error for %v (pinned %v)", c.server, c.pinned)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NegotiateSASL %v: %v", c.server, err)
+			continue
+		}
+		mech, _, err := cl.Start()
+		if err != nil {
+			t.Fatal("Start:", err)
+		}
+		if mech != c.mech {
+			t.Errorf("Wrong mechanism for %v: %v, expected %v", c.server, mech, c.mech)
+		}
+	}
+}
+
+func TestScramSHA256(t *testing.T) {
+	// Test vector from RFC 7677.
+	cl := newScramClient(ScramSHA256, sha256.New, "user", "pencil", nil, false)
+	if _, _, err := cl.Start(); err != nil {
+		t.Fatal("Start:", err)
+	}
+	cl.nonce = "rOprNGfwEbeRWgbNEkqO"
+	cl.clientFirstBare = "n=user,r=rOprNGfwEbeRWgbNEkqO"
+
+	resp, err := cl.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if err != nil {
+		t.Fatal("Next:", err)
+	}
+	expected := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if string(resp) != expected {
+		t.Fatalf("Wrong client-final message: %v", string(resp))
+	}
+
+	if _, err := cl.Next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err != nil {
+		t.Error("Valid server signature rejected:", err)
+	}
+}
+
+func TestSASLPrep(t *testing.T) {
+	// Examples from RFC 4013, section 3.
+	cases := []struct {
+		in, out string
+		fail    bool
+	}{
+		{"I\u00ADX", "IX", false},
+		{"user", "user", false},
+		{"USER", "USER", false},
+		{"\u00AA", "a", false},
+		{"\u2168", "IX", false},
+		{"\u0007", "", true},
+		{"a\u00A0b", "a b", false},
+		{"\u00AD", "", true},
+	}
+	for _, c := range cases {
+		out, err := saslPrep(c.in)
+		if c.fail {
+			if err == nil {
+				t.Errorf("No error for %q", c.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("saslPrep %q: %v", c.in, err)
+			continue
+		}
+		if out != c.out {
+			t.Errorf("Wrong result for %q: %q, expected %q", c.in, out, c.out)
+		}
+	}
+
+	cl := newScramClient(ScramSHA256, sha256.New, "us\u00ADer", "pass", nil, false)
+	_, ir, err := cl.Start()
+	if err != nil {
+		t.Fatal("Start:", err)
+	}
+	if !strings.HasPrefix(string(ir), "n,,n=user,") {
+		t.Errorf("Username is not prepared: %q", ir)
+	}
+}
+
+func TestCramMD5(t *testing.T) {
+	// Example from RFC 2195.
+	cl := &cramMD5Client{"tim", "tanstaaftanstaaf"}
+	resp, err := cl.Next([]byte("<1896.697170952@postoffice.reston.mci.net>"))
+	if err != nil {
+		t.Fatal("Next:", err)
+	}
+	if string(resp) != "tim b913a602c7eda7a495b4e6e7334d3890" {
+		t.Error("Wrong response:", string(resp))
+	}
+}
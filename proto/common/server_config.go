@@ -5,6 +5,9 @@ type ConnType int
 const (
 	TLS ConnType = iota
 	STARTTLS
+	// No encryption at all. Should be used only for testing with local
+	// servers.
+	Plaintext
 )
 
 type ServConfig struct {
@@ -12,4 +15,20 @@ type ServConfig struct {
 	Port       uint16
 	ConnType   ConnType
 	User, Pass string
+
+	// Default verification is used if nil.
+	TLS *TLSPolicy
+	// Direct connection is used if nil.
+	Dialer Dialer
+
+	// Pass is not used for OAuth methods, access token is requested from
+	// Token instead.
+	AuthMethod AuthMethod
+	Token      TokenSource
+
+	// If not empty, only listed SASL mechanisms are used, in order of
+	// preference. Otherwise all supported are considered, see
+	// NegotiateSASL.
+	Mechanisms          []string
+	ForbiddenMechanisms []string
 }
@@ -0,0 +1,146 @@
+package common
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// TLSPolicy controls how server certificates are verified and which client
+// certificate is presented. nil policy means default verification using
+// system CA certificates.
+type TLSPolicy struct {
+	// Trusted CA certificates, system ones are used if nil.
+	RootCAs *x509.CertPool
+
+	// Presented to server if it requests client certificate.
+	ClientCert *tls.Certificate
+
+	// Pin certificate on first connection if it can't be verified using
+	// trusted CA certificates.
+	TrustOnFirstUse bool
+
+	// Called when server certificate doesn't match pinned one. If it
+	// returns true, certificate is accepted and pinned instead of old one.
+	CertChanged func(host string, cert *x509.Certificate) bool
+
+	// Called when list of pinned fingerprints is changed, so it can be
+	// saved. Can be nil.
+	PinsChanged func(pins []string)
+
+	lock sync.Mutex
+	pins []string
+}
+
+// NewTLSPolicy creates TLSPolicy with specified pinned certificate
+// fingerprints (see CertFingerprint).
+func NewTLSPolicy(pins []string) *TLSPolicy {
+	res := &TLSPolicy{}
+	for _, pin := range pins {
+		res.pins = append(res.pins, normalizeFingerprint(pin))
+	}
+	return res
+}
+
+// Pins returns list of currently pinned fingerprints.
+func (p *TLSPolicy) Pins() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string(nil), p.pins...)
+}
+
+// CertFingerprint returns SHA-256 fingerprint of certificate as hex
+// string.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint converts fingerprint in format used by OpenSSL
+// (upper-case, colon-separated) to format used by CertFingerprint.
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.Replace(fp, ":", "", -1))
+}
+
+// TLSConfig returns TLS configuration for connection to host using policy.
+// p can be nil.
+func (p *TLSPolicy) TLSConfig(host string) *tls.Config {
+	res := &tls.Config{ServerName: host}
+	if p == nil {
+		return res
+	}
+
+	res.RootCAs = p.RootCAs
+	if p.ClientCert != nil {
+		res.Certificates = []tls.Certificate{*p.ClientCert}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.pins) != 0 || p.TrustOnFirstUse {
+		// Verification is done by verifyConnection.
+		res.InsecureSkipVerify = true
+		res.VerifyConnection = func(state tls.ConnectionState) error {
+			return p.verifyConnection(host, state)
+		}
+	}
+	return res
+}
+
+func (p *TLSPolicy) verifyConnection(host string, state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("tls: no server certificate")
+	}
+	leaf := state.PeerCertificates[0]
+	fingerprint := CertFingerprint(leaf)
+
+	p.lock.Lock()
+	pins := p.pins
+	p.lock.Unlock()
+
+	if len(pins) != 0 {
+		for _, pin := range pins {
+			if pin == fingerprint {
+				return nil
+			}
+		}
+		if p.CertChanged != nil && p.CertChanged(host, leaf) {
+			p.setPins([]string{fingerprint})
+			return nil
+		}
+		return fmt.Errorf("tls: certificate of %v doesn't match pinned one (fingerprint: %v)", host, fingerprint)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         p.RootCAs,
+		Intermediates: intermediates,
+	})
+	if err == nil {
+		return nil
+	}
+	if p.TrustOnFirstUse {
+		p.setPins([]string{fingerprint})
+		return nil
+	}
+	return err
+}
+
+func (p *TLSPolicy) setPins(pins []string) {
+	p.lock.Lock()
+	p.pins = pins
+	p.lock.Unlock()
+
+	if p.PinsChanged != nil {
+		p.PinsChanged(pins)
+	}
+}
@@ -0,0 +1,61 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTLSPolicyPinning(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+	fingerprint := CertFingerprint(srv.Certificate())
+
+	dial := func(policy *TLSPolicy) error {
+		conn, err := tls.Dial("tcp", addr, policy.TLSConfig("127.0.0.1"))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	if err := dial(nil); err == nil {
+		t.Error("Self-signed certificate accepted by default policy")
+	}
+
+	policy := NewTLSPolicy(nil)
+	policy.TrustOnFirstUse = true
+	saved := []string{}
+	policy.PinsChanged = func(pins []string) { saved = pins }
+	if err := dial(policy); err != nil {
+		t.Fatal("Certificate not accepted on first use:", err)
+	}
+	if len(saved) != 1 || saved[0] != fingerprint {
+		t.Errorf("Wrong pinned fingerprints: %v", saved)
+	}
+
+	// Pins in OpenSSL format are accepted too.
+	openssl := ""
+	for i := 0; i < len(fingerprint); i += 2 {
+		if i != 0 {
+			openssl += ":"
+		}
+		openssl += fingerprint[i : i+2]
+	}
+	if err := dial(NewTLSPolicy([]string{openssl})); err != nil {
+		t.Error("Pinned certificate not accepted:", err)
+	}
+
+	asked := false
+	policy = NewTLSPolicy([]string{"00"})
+	policy.CertChanged = func(host string, cert *x509.Certificate) bool {
+		asked = true
+		return false
+	}
+	if err := dial(policy); err == nil || !asked {
+		t.Error("Changed certificate accepted without asking")
+	}
+}
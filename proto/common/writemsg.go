@@ -55,12 +55,21 @@ func (m *Msg) Write(out io.Writer) error {
 	if !m.Date.IsZero() {
 		allHdrs.Set("Date", MarshalDate(m.Date))
 	}
+	if m.MessageId != "" {
+		allHdrs.Set("Message-Id", "<"+m.MessageId+">")
+	}
+	if m.InReplyTo != "" {
+		allHdrs.Set("In-Reply-To", "<"+m.InReplyTo+">")
+	}
+	if len(m.References) != 0 {
+		allHdrs.Set("References", FormatMsgIdList(m.References))
+	}
 	allHdrs.Set("MIME-Version", "1.0")
 	for k, v := range m.Misc {
 		allHdrs[k] = v
 	}
 
-	if len(m.Parts) == 0 {
+	if m.Body.Type.Value == "" && len(m.Body.Children) == 0 && m.Body.Body == nil {
 		w, err := message.CreateWriter(out, allHdrs)
 		if err != nil {
 			return err
@@ -68,65 +77,79 @@ func (m *Msg) Write(out io.Writer) error {
 		return w.Close()
 	}
 
-	var err error
-	if len(m.Parts) == 1 {
-		err = writeRegular(m, allHdrs, out)
-	} else {
-		err = writeMultipart(m, allHdrs, out)
-	}
-	return err
-}
-
-func writeRegular(m *Msg, hdrs message.Header, out io.Writer) error {
-	if _, prs := hdrs["Content-Type"]; !prs {
-		hdrs.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
-	}
-	hdrs.Set("Content-Transfer-Encoding", pickEncoding(m.Parts[0].Body))
-
-	w, err := message.CreateWriter(out, hdrs)
+	setPartHeaders(allHdrs, &m.Body)
+	w, err := message.CreateWriter(out, allHdrs)
 	if err != nil {
 		return err
 	}
-	w.Write(m.Parts[0].Body)
+	if err := writePartBody(w, &m.Body); err != nil {
+		return err
+	}
 	return w.Close()
 }
 
-func writeMultipart(m *Msg, hdrs message.Header, out io.Writer) error {
-	boundary := randomBoundary()
-	if _, prs := hdrs["Content-Type"]; !prs {
-		hdrs.SetContentType("multipart/mixed", map[string]string{"boundary": boundary})
-	}
-	w, err := message.CreateWriter(out, hdrs)
-	if err != nil {
-		return err
+// setPartHeaders adds MIME headers describing part to hdrs.
+func setPartHeaders(hdrs message.Header, part *Part) {
+	for k, v := range part.Misc {
+		hdrs[k] = v
 	}
 
-	for _, part := range m.Parts {
-		partHdrs := message.Header{}
+	if part.IsMultipart() {
+		subtype := "multipart/mixed"
 		if part.Type.Value != "" {
-			partHdrs.Set("Content-Type", part.Type.String())
+			subtype = part.Type.Value
 		}
-		if part.Disposition.Value != "" {
-			partHdrs.Set("Content-Disposition", part.Type.String())
+		params := make(map[string]string, len(part.Type.Params)+1)
+		for k, v := range part.Type.Params {
+			params[k] = v
 		}
-		for k, v := range part.Misc {
-			partHdrs[k] = v
+		params["boundary"] = randomBoundary()
+		hdrs.SetContentType(subtype, params)
+		hdrs.Del("Content-Transfer-Encoding")
+	} else {
+		if part.Type.Value != "" {
+			hdrs.SetContentType(part.Type.Value, part.Type.Params)
+		} else if _, prs := hdrs["Content-Type"]; !prs {
+			hdrs.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
 		}
-
-		partHdrs.Set("Content-Transfer-Encoding", pickEncoding(part.Body))
-		if _, prs := partHdrs["Content-Type"]; !prs {
-			partHdrs.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+		encoding := pickEncoding(part.Body)
+		// RFC 2046 doesn't allows encoded message/rfc822 parts.
+		if strings.EqualFold(part.Type.Value, "message/rfc822") && encoding != "7bit" {
+			encoding = "8bit"
 		}
-		pw, err := w.CreatePart(partHdrs)
+		hdrs.Set("Content-Transfer-Encoding", encoding)
+	}
+
+	if part.Disposition.Value != "" {
+		hdrs.SetContentDisposition(part.Disposition.Value, part.Disposition.Params)
+	}
+}
+
+// writePartBody writes part body or, for multipart parts, all children
+// recursively.
+func writePartBody(w *message.Writer, part *Part) error {
+	if !part.IsMultipart() {
+		_, err := w.Write(part.Body)
+		return err
+	}
+
+	for i := range part.Children {
+		child := &part.Children[i]
+		childHdrs := message.Header{}
+		setPartHeaders(childHdrs, child)
+
+		pw, err := w.CreatePart(childHdrs)
 		if err != nil {
 			return err
 		}
-		pw.Write(part.Body)
+		if err := writePartBody(pw, child); err != nil {
+			return err
+		}
 		if err := pw.Close(); err != nil {
 			return err
 		}
 	}
-	return w.Close()
+	return nil
 }
 
 func randomBoundary() string {
@@ -1,19 +1,34 @@
 package imap
 
 import (
+	"strconv"
+	"strings"
+
 	imap "github.com/emersion/go-imap"
 	"github.com/foxcpp/mailbox/proto/common"
 )
 
-// bodyStructToPart converts information about body part to common.Part used in
-// library. Body field is left as nil.
-func bodyStructToPart(s imap.BodyStructure) (res common.Part) {
+// bodyStructToPart converts information about body part (and all nested
+// parts) to common.Part used in library. Body field is left as nil.
+//
+// path is IMAP section path of s, see common.Part.Path.
+func bodyStructToPart(s imap.BodyStructure, path string) (res common.Part) {
 	res.Type = common.ParametrizedHeader{
-		s.MIMEType + "/" + s.MIMESubType,
-		s.Params,
+		Value:  strings.ToLower(s.MIMEType + "/" + s.MIMESubType),
+		Params: make(map[string]string, len(s.Params)),
+	}
+	for k, v := range s.Params {
+		res.Type.Params[k] = v
 	}
 	res.Misc = make(common.Header)
 	res.Size = s.Size
+	res.Path = path
+	if s.Id != "" {
+		res.Misc.Add("Content-Id", s.Id)
+	}
+	if s.Description != "" {
+		res.Misc.Add("Content-Description", s.Description)
+	}
 	if s.Extended {
 		res.Disposition.Value, res.Disposition.Params = s.Disposition, s.DispositionParams
 		if len(s.Language) >= 1 {
@@ -23,5 +38,38 @@ func bodyStructToPart(s imap.BodyStructure) (res common.Part) {
 			res.Misc.Add("Content-Location", s.Location[0])
 		}
 	}
+	for i, child := range s.Parts {
+		res.Children = append(res.Children, bodyStructToPart(*child, common.ChildPath(path, i+1)))
+	}
 	return res
 }
+
+// rootPath returns section path for root part of message with specified
+// structure.
+func rootPath(s *imap.BodyStructure) string {
+	if strings.EqualFold(s.MIMEType, "multipart") {
+		return ""
+	}
+	return "1"
+}
+
+// findStruct returns body structure of part with specified section path, nil
+// if there is no such part.
+func findStruct(s *imap.BodyStructure, path string) *imap.BodyStructure {
+	if path == rootPath(s) {
+		return s
+	}
+	if path == "" {
+		return nil
+	}
+
+	cur := s
+	for _, indxStr := range strings.Split(path, ".") {
+		indx, err := strconv.Atoi(indxStr)
+		if err != nil || indx < 1 || indx > len(cur.Parts) {
+			return nil
+		}
+		cur = cur.Parts[indx-1]
+	}
+	return cur
+}
@@ -1,11 +1,13 @@
 package imap
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"log"
 	"net"
-	"strconv"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,202 +16,621 @@ import (
 	"github.com/emersion/go-imap-move"
 	"github.com/emersion/go-imap-uidplus"
 	"github.com/emersion/go-imap/client"
-	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-imap/commands"
+	sasl "github.com/emersion/go-sasl"
 	"github.com/foxcpp/mailbox/proto/common"
 )
 
 /*
-	Most callbacks should manually resolve sequence number into UID if
-	necessary, client provides wrapper for this purpose: ResolveSeqNum.
+	NewMessage callback should manually resolve sequence number into UID if
+	necessary, client provides wrapper for this purpose: ResolveUid.
+	MessageRemoved gets UID of removed message or zero if it's not known (see
+	updates.go), cached message list should be reloaded in this case.
 	Also, newInfo contains partial information in special form, so callback
 	should do MessageInfo.UpdateFrom(newInfo) to update cached information (if any).
 
 	Callbacks for dirs other than INBOX usually called only during operations
 	on these directories because we monitor only INBOX. Thus notifications
-	about INBOX can be delivered at any time.
+	about INBOX can be delivered at any time. Changes in other directories
+	are reported using DirStatus if they are watched using NOTIFY (see
+	watch.go). Updates received by all connections (see pool.go) are
+	passed to callbacks, so same change can be reported several times.
 
 	Note: Callback MUST NOT ignore any calls, because sequence numbers depend
 	on each other and should be re-synced on each opeartion.
 
 	Note: Usually callbacks will be called from separate goroutine so code
-	should be thread-safe.
+	should be thread-safe. Callbacks should be set using SetCallbacks.
 */
 type UpdateCallbacks struct {
 	NewMessage     func(dir string, seqnum uint32)
 	MessageUpdate  func(dir string, newInfo *eimap.Message)
-	MessageRemoved func(dir string, seqnum uint32)
+	MessageRemoved func(dir string, uid uint32)
 
+	// Only Name, Messages, Recent, Unseen and UidValidity are set in
+	// status, UidValidity is zero if update is received during SELECT.
 	MboxUpdate func(status *eimap.MailboxStatus)
+	// Called when server reports change in watched directory (see
+	// WatchDirs). Only MESSAGES and UIDNEXT items are usually present.
+	DirStatus func(status *DirStatus)
+	// Called when some notifications for watched directories were dropped
+	// because updates dispatcher was busy, statuses of directories should
+	// be requested using DirsStatus.
+	DirStatusLost func()
 }
 
 type Client struct {
-	Callbacks         *UpdateCallbacks
-	KnownMailboxSizes map[string]uint32
-	Logger            log.Logger
-	LastConfig        common.ServConfig
+	Logger log.Logger
 
-	maxUploadSize  uint32
-	currentMailbox string
+	maxUploadSize uint32
 
-	updates               chan client.Update
+	updates               chan update
+	statusUpdates         chan *DirStatus
 	updatesDispatcherStop chan bool
+	// Set (non-blocking send) when status update is dropped.
+	statusLost chan struct{}
+
+	// Protects callbacks, see updates.go.
+	updatesLock sync.Mutex
+	callbacks   *UpdateCallbacks
+
+	// See idler.go.
+	idleKick chan struct{}
+	idleQuit chan struct{}
+	idleDone chan struct{}
+
+	// Protects fields below.
+	lock sync.Mutex
+	// Configuration used to establish new connections. Credentials are
+	// set only after successful authentication.
+	lastConfig common.ServConfig
+	// Connections are authenticated automatically using credentials from
+	// lastConfig.
+	authenticated bool
+	// Incremented by Reconnect, connections established before are
+	// considered broken.
+	generation int
+	// Directories passed to WatchDirs, watchGen is incremented on each
+	// change.
+	watchedDirs []string
+	watchGen    int
+	// Pool of worker connections, see pool.go.
+	poolSize int
+	busy     int
+	free     []*conn
+	released chan struct{}
+	closed   bool
+}
 
-	idlerInterrupt chan bool
+// conn is a single connection to server.
+type conn struct {
+	c *Client
+	// Value of Client.generation when connection was established.
+	generation int
 
-	IOLock sync.Mutex
-	cl     *client.Client
+	cl      *client.Client
+	tlsConn *tls.Conn
+	// Reports flushes of commands written to cl, see syncedSASL.
+	flushes *flushNotifier
 
 	uidplus *uidplus.Client
 	move    *move.Client
 	idle    *idle.IdleClient
+
+	qresyncEnabled bool
+	// Value of Client.watchGen when NOTIFY was sent, see watch.go.
+	watchGen      int
+	notifyEnabled bool
+	// Connection was closed to cancel operation.
+	aborted bool
+	// Used to decide whether health check is needed.
+	lastUsed time.Time
+
+	// Protects seqMaps, see updates.go.
+	updatesLock sync.Mutex
+	seqMaps     map[string]*seqMap
+	// VANISHED responses are sent here, see updates.go.
+	vanished chan<- *eimap.SeqSet
 }
 
-func tlsHandshake(conn net.Conn, hostname string) (*client.Client, error) {
-	return client.New(tls.Client(conn, &tls.Config{ServerName: hostname}))
+func tlsHandshake(conn net.Conn, hostname string, policy *common.TLSPolicy, flushes *flushNotifier) (*client.Client, *tls.Conn, error) {
+	tlsConn := tls.Client(conn, policy.TLSConfig(hostname))
+	c, err := client.New(notifyingConn{tlsConn, flushes})
+	return c, tlsConn, err
 }
 
-func starttlsHandshake(conn net.Conn, hostname string) (*client.Client, error) {
-	conf := &tls.Config{ServerName: hostname}
-	c, err := client.New(conn)
+func starttlsHandshake(conn net.Conn, hostname string, policy *common.TLSPolicy, flushes *flushNotifier) (*client.Client, *tls.Conn, error) {
+	conf := policy.TLSConfig(hostname)
+	c, err := client.New(notifyingConn{conn, flushes})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	caps, err := c.Capability()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if _, prs := caps["STARTTLS"]; !prs {
-		return nil, errors.New("starttls: not supported")
+		return nil, nil, errors.New("starttls: not supported")
 	}
 
-	if err := c.StartTLS(conf); err != nil {
-		return nil, err
+	// client.StartTLS doesn't exposes TLS connection and we need it for
+	// channel binding so upgrade is done manually.
+	var tlsConn *tls.Conn
+	err = c.Upgrade(func(conn net.Conn) (net.Conn, error) {
+		status, err := c.Execute(&commands.StartTLS{}, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := status.Err(); err != nil {
+			return nil, err
+		}
+
+		tlsConn = tls.Client(conn, conf)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		return notifyingConn{tlsConn, flushes}, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Capabilities change when TLS is enabled.
+	if _, err := c.Capability(); err != nil {
+		return nil, nil, err
 	}
-	return c, nil
+	return c, tlsConn, nil
 }
 
-func connect(target common.ServConfig) (*client.Client, error) {
-	addr := target.Host + ":" + strconv.Itoa(int(target.Port))
+func handshake(conn net.Conn, target common.ServConfig, flushes *flushNotifier) (*client.Client, *tls.Conn, error) {
+	switch target.ConnType {
+	case common.TLS:
+		return tlsHandshake(conn, target.Host, target.TLS, flushes)
+	case common.STARTTLS:
+		return starttlsHandshake(conn, target.Host, target.TLS, flushes)
+	default:
+		c, err := client.New(notifyingConn{conn, flushes})
+		return c, nil, err
+	}
+}
 
-	conn, err := net.Dial("tcp", addr)
+func connect(ctx context.Context, target common.ServConfig, flushes *flushNotifier) (*client.Client, *tls.Conn, error) {
+	conn, err := target.DialContext(ctx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Connection setup must complete in 15 seconds.
 	conn.SetDeadline(time.Now().Add(15 * time.Second))
 
-	var c *client.Client
-	if target.ConnType == common.TLS {
-		var err error
-		c, err = tlsHandshake(conn, target.Host)
-		if err != nil {
-			return nil, err
-		}
-	} else if target.ConnType == common.STARTTLS {
-		var err error
-		c, err = starttlsHandshake(conn, target.Host)
-		if err != nil {
-			return nil, err
-		}
+	type result struct {
+		c       *client.Client
+		tlsConn *tls.Conn
+		err     error
+	}
+	// client.New waits for server greeting forever even if connection is
+	// closed, so we don't wait for it directly. Goroutine is leaked in
+	// this case but there is no better way.
+	done := make(chan result, 1)
+	go func() {
+		c, tlsConn, err := handshake(conn, target, flushes)
+		done <- result{c, tlsConn, err}
+	}()
+
+	var res result
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		conn.Close()
+		return nil, nil, ctx.Err()
+	case <-time.After(15 * time.Second):
+		conn.Close()
+		return nil, nil, &common.ConnError{Err: errors.New("connection setup timed out")}
+	}
+	if res.err != nil {
+		conn.Close()
+		return nil, nil, res.err
 	}
 
 	// Reset deadline.
 	conn.SetDeadline(time.Time{})
 
 	// 30 timeout for any I/O.
-	c.Timeout = 30 * time.Second
-	return c, nil
+	res.c.Timeout = 30 * time.Second
+	return res.c, res.tlsConn, nil
 }
 
 func Connect(target common.ServConfig) (*Client, error) {
-	c, err := connect(target)
-	if err != nil {
-		return nil, err
-	}
+	return ConnectContext(context.Background(), target)
+}
 
-	res := &Client{cl: c}
+// ConnectContext is like Connect but connection attempt is aborted when
+// ctx is cancelled.
+func ConnectContext(ctx context.Context, target common.ServConfig) (*Client, error) {
+	res := &Client{
+		lastConfig: target,
+		poolSize:   DefaultPoolSize,
+		released:   make(chan struct{}),
+	}
 	// We have that small buffer to prevent updates queue from being filled
 	// with updates from different mailboxes, as this will break a lot of things.
-	res.updates = make(chan client.Update, 16)
-	res.idlerInterrupt = make(chan bool)
+	res.updates = make(chan update, 16)
+	res.statusUpdates = make(chan *DirStatus, 16)
+	res.statusLost = make(chan struct{}, 1)
 	res.updatesDispatcherStop = make(chan bool)
-	res.KnownMailboxSizes = make(map[string]uint32)
-	res.cl.Updates = res.updates
-
-	res.idle = idle.NewClient(res.cl)
-	res.move = move.NewClient(res.cl)
-	res.uidplus = uidplus.NewClient(res.cl)
-
-	//res.cl.SetDebug(os.Stderr)
-	res.LastConfig = target
+	res.idleKick = make(chan struct{}, 1)
+	res.idleQuit = make(chan struct{})
+	res.idleDone = make(chan struct{})
+
+	// First connection is established right now so connection errors are
+	// reported here.
+	w := &conn{c: res}
+	if err := w.dial(ctx, target); err != nil {
+		return nil, err
+	}
+	w.lastUsed = time.Now()
+	res.free = []*conn{w}
 
 	go res.updatesWatch()
+	// Idler will not do anything until we are authenticated.
+	go res.idleLoop()
 
 	return res, nil
 }
 
+// dial establishes new connection replacing old one (if any).
+func (w *conn) dial(ctx context.Context, target common.ServConfig) error {
+	w.terminate()
+
+	w.c.lock.Lock()
+	generation := w.c.generation
+	w.c.lock.Unlock()
+
+	flushes := &flushNotifier{}
+	cl, tlsConn, err := connect(ctx, target, flushes)
+	if err != nil {
+		return wrapError(err)
+	}
+	w.generation = generation
+	w.cl = cl
+	w.tlsConn = tlsConn
+	w.flushes = flushes
+	w.idle = idle.NewClient(w.cl)
+	w.move = move.NewClient(w.cl)
+	w.uidplus = uidplus.NewClient(w.cl)
+	w.qresyncEnabled = false
+	w.notifyEnabled = false
+	w.watchGen = 0
+	w.aborted = false
+	w.seqMaps = make(map[string]*seqMap)
+	w.forwardUpdates()
+	return nil
+}
+
+// terminate closes connection without logging out.
+func (w *conn) terminate() {
+	if w.cl != nil {
+		w.cl.Terminate()
+	}
+}
+
+// usable reports whether connection can be used without re-establishing.
+func (w *conn) usable() bool {
+	if w.cl == nil || w.aborted || !w.connected() {
+		return false
+	}
+	w.c.lock.Lock()
+	defer w.c.lock.Unlock()
+	return w.generation == w.c.generation
+}
+
 func (c *Client) Auth(conf common.ServConfig) error {
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
+	return c.AuthContext(context.Background(), conf)
+}
 
-	err := c.cl.Authenticate(sasl.NewPlainClient("", conf.User, conf.Pass))
-	if err == nil {
-		c.LastConfig.User = conf.User
-		c.LastConfig.Pass = conf.Pass
+// AuthContext is like Auth but can be cancelled using ctx (see context.go).
+//
+// Credentials are remembered and used to authenticate all connections
+// established later.
+func (c *Client) AuthContext(ctx context.Context, conf common.ServConfig) (err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.release(w)
+
+	if w.cl.State() != eimap.NotAuthenticatedState {
+		// Authenticated using previous credentials.
+		if err := w.dial(ctx, c.config()); err != nil {
+			return err
+		}
+	}
+
+	defer w.watchContext(ctx)(&err)
+	if err := w.auth(ctx, conf); err != nil {
+		return err
+	}
 
-		go c.idleOnInbox()
+	c.lock.Lock()
+	c.lastConfig.User = conf.User
+	c.lastConfig.Pass = conf.Pass
+	c.lastConfig.AuthMethod = conf.AuthMethod
+	c.lastConfig.Token = conf.Token
+	c.lastConfig.Mechanisms = conf.Mechanisms
+	c.lastConfig.ForbiddenMechanisms = conf.ForbiddenMechanisms
+	c.lastConfig.TLS = conf.TLS
+	c.authenticated = true
+	c.lock.Unlock()
+
+	c.kickIdler()
+	return nil
+}
+
+// config returns configuration used to establish new connections.
+func (c *Client) config() common.ServConfig {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lastConfig
+}
+
+// credentials returns configuration for new connections and whether it can
+// be used to authenticate them.
+func (c *Client) credentials() (common.ServConfig, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lastConfig, c.authenticated
+}
+
+// auth authenticates connection. If OAuth access token is rejected, new one
+// is requested and authentication is repeated once: token may be revoked
+// before its expiry.
+func (w *conn) auth(ctx context.Context, conf common.ServConfig) error {
+	err := w.authenticate(ctx, conf)
+	if errors.Is(err, ErrAuthFailed) && common.InvalidateToken(conf) {
+		w.c.Logger.Println("Access token rejected, requesting new one:", err)
+		err = w.authenticate(ctx, conf)
 	}
 	return err
 }
 
+func (w *conn) authenticate(ctx context.Context, conf common.ServConfig) error {
+	caps, err := w.cl.Capability()
+	if err != nil {
+		return err
+	}
+	mechs := []string{}
+	for capability := range caps {
+		if strings.HasPrefix(capability, "AUTH=") {
+			mechs = append(mechs, strings.TrimPrefix(capability, "AUTH="))
+		}
+	}
+	sort.Strings(mechs)
+
+	// Servers that don't support AUTHENTICATE may still accept password
+	// in LOGIN command.
+	if len(mechs) == 0 && !caps["LOGINDISABLED"] && common.PlainFallback(conf) {
+		if err := w.cl.Login(conf.User, conf.Pass); err != nil {
+			if err := wrapError(err); errors.Is(err, ErrConnection) {
+				return err
+			}
+			return &common.AuthError{Err: err}
+		}
+		w.enableExtensions()
+		return nil
+	}
+
+	var cb *common.ChannelBinding
+	if w.tlsConn != nil {
+		state := w.tlsConn.ConnectionState()
+		cb = common.TLSChannelBinding(&state)
+	}
+	saslCl, err := common.NegotiateSASL(ctx, conf, mechs, cb)
+	if err != nil {
+		return err
+	}
+	if err := w.cl.Authenticate(&syncedSASL{Client: saslCl, flushes: w.flushes}); err != nil {
+		if err := wrapError(err); errors.Is(err, ErrConnection) {
+			return err
+		}
+		// go-imap doesn't reports response code so any other error is
+		// considered to be rejection of credentials.
+		return &common.AuthError{Err: err}
+	}
+	w.enableExtensions()
+	return nil
+}
+
+/*
+go-imap writes commands from goroutine started for each command while
+responses to AUTHENTICATE challenges are written from reader goroutine,
+buffered writer is shared without synchronization between them. Server
+sends challenge only after it got the command so writes never overlap but
+nothing tells this to the race detector (and memory model).
+
+Connections passed to go-imap implement Flush which is called after buffer
+of command is flushed. syncedSASL waits for it before its responses are
+written.
+
+Same applies to consecutive commands: go-imap returns once response to
+command is received, goroutine that wrote it may still be finishing flush
+of the buffer when next command is written. go-imap sets deadline before
+each command, connection waits until previous writes are flushed there.
+*/
+
+// flushNotifier reports flushes of connection buffer.
+type flushNotifier struct {
+	lock    sync.Mutex
+	flushed chan struct{}
+	// Data was written to connection after the last flush.
+	unflushed bool
+}
+
+// next returns channel closed on next flush.
+func (n *flushNotifier) next() <-chan struct{} {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.flushed == nil {
+		n.flushed = make(chan struct{})
+	}
+	return n.flushed
+}
+
+// written records write to connection, following next flush.
+func (n *flushNotifier) written() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.unflushed = true
+}
+
+// wait waits until data written so far is flushed.
+func (n *flushNotifier) wait() {
+	n.lock.Lock()
+	if !n.unflushed {
+		n.lock.Unlock()
+		return
+	}
+	if n.flushed == nil {
+		n.flushed = make(chan struct{})
+	}
+	flushed := n.flushed
+	n.lock.Unlock()
+	<-flushed
+}
+
+func (n *flushNotifier) flush() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.unflushed = false
+	if n.flushed != nil {
+		close(n.flushed)
+		n.flushed = nil
+	}
+}
+
+// notifyingConn is a connection passed to go-imap, go-imap calls Flush
+// after flushing its buffer.
+type notifyingConn struct {
+	net.Conn
+	flushes *flushNotifier
+}
+
+func (c notifyingConn) Write(b []byte) (int, error) {
+	c.flushes.written()
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		// Command is aborted, flush will not follow.
+		c.flushes.flush()
+	}
+	return n, err
+}
+
+func (c notifyingConn) Flush() error {
+	c.flushes.flush()
+	return nil
+}
+
+// SetDeadline is called by go-imap before each command is written.
+func (c notifyingConn) SetDeadline(t time.Time) error {
+	c.flushes.wait()
+	return c.Conn.SetDeadline(t)
+}
+
+// syncedSASL delays responses to server challenges until AUTHENTICATE
+// command is flushed. Initial response is returned as response to first
+// empty challenge to delay it too.
+type syncedSASL struct {
+	sasl.Client
+	flushes *flushNotifier
+
+	written <-chan struct{}
+	ir      []byte
+}
+
+func (s *syncedSASL) Start() (string, []byte, error) {
+	mech, ir, err := s.Client.Start()
+	// Called right before command is written.
+	s.written = s.flushes.next()
+	s.ir = ir
+	return mech, nil, err
+}
+
+func (s *syncedSASL) Next(challenge []byte) ([]byte, error) {
+	<-s.written
+	if len(challenge) == 0 && s.ir != nil {
+		ir := s.ir
+		s.ir = nil
+		return ir, nil
+	}
+	return s.Client.Next(challenge)
+}
+
+// connected reports whether connection to server is still alive.
+func (w *conn) connected() bool {
+	select {
+	case <-w.cl.LoggedOut():
+		return false
+	default:
+		return true
+	}
+}
+
 // Reconnect recovers lost connection (note: it doesn't reauthenticates).
-// Note: If this function fails connection will be left in closed ("null") state.
+// All connections are re-established, new ones are authenticated only
+// after successful Auth call.
 func (c *Client) Reconnect() error {
-	// Exactly that order to prevent deadlock (IDLE goroutine locks IOLock so we need to stop it before locking).
-	c.updatesDispatcherStop <- true
-	<-c.updatesDispatcherStop
-	c.idlerInterrupt <- true
-	c.IOLock.Lock()
-	<-c.idlerInterrupt
-	defer c.IOLock.Unlock()
-
-	c.cl = nil
-	var err error
-	c.cl, err = connect(c.LastConfig)
+	return c.ReconnectContext(context.Background())
+}
+
+// ReconnectContext is like Reconnect but connection attempt is aborted when
+// ctx is cancelled.
+func (c *Client) ReconnectContext(ctx context.Context) error {
+	c.lock.Lock()
+	c.generation++
+	c.authenticated = false
+	c.lock.Unlock()
+
+	// Connection is established to check whether server is reachable.
+	w, err := c.acquire(ctx)
 	if err != nil {
 		return err
 	}
-	c.idle = idle.NewClient(c.cl)
-	c.move = move.NewClient(c.cl)
-	c.uidplus = uidplus.NewClient(c.cl)
-
+	c.release(w)
+	c.kickIdler()
 	return nil
 }
 
 func (c *Client) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	free := c.free
+	c.free = nil
+	c.lock.Unlock()
+
+	close(c.idleQuit)
+	<-c.idleDone
+
 	c.updatesDispatcherStop <- true
 	<-c.updatesDispatcherStop
 
-	c.idlerInterrupt <- true
-	<-c.idlerInterrupt
-
-	c.cl.Logout()
-	return c.cl.Terminate()
+	for _, w := range free {
+		if w.usable() {
+			w.cl.Logout()
+		}
+		w.terminate()
+	}
+	return nil
 }
 
+// Logout logs out all connections. Client can't be used after this.
 func (c *Client) Logout() error {
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
-	return c.cl.Logout()
+	return c.Close()
 }
 
 // Select mailbox if necessary.
-// Must be called while IOLock is held.
-func (c *Client) ensureSelected(dir string, readonly bool) (*eimap.MailboxStatus, error) {
-	if c.cl.Mailbox() == nil || c.cl.Mailbox().Name != dir || (c.cl.Mailbox().ReadOnly && !readonly) {
-		return c.cl.Select(dir, readonly)
+func (w *conn) ensureSelected(dir string, readonly bool) (*eimap.MailboxStatus, error) {
+	if w.cl.Mailbox() == nil || w.cl.Mailbox().Name != dir || (w.cl.Mailbox().ReadOnly && !readonly) {
+		return w.selectDir(dir, readonly)
 	}
-	return c.cl.Mailbox(), nil
+	return w.cl.Mailbox(), nil
 }
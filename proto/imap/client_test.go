@@ -0,0 +1,190 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-sasl"
+	"github.com/foxcpp/mailbox/proto/common"
+)
+
+// rotatingToken returns next token from the list after each Invalidate.
+type rotatingToken struct {
+	tokens      []string
+	invalidated int
+}
+
+func (t *rotatingToken) Token() (string, error) {
+	return t.tokens[t.invalidated], nil
+}
+
+func (t *rotatingToken) Invalidate() {
+	t.invalidated++
+}
+
+// xoauth2Server accepts only the specified access token.
+type xoauth2Server struct {
+	conn    server.Conn
+	be      backend.Backend
+	token   string
+	started bool
+}
+
+func (s *xoauth2Server) Next(response []byte) ([]byte, bool, error) {
+	if !s.started {
+		s.started = true
+		return []byte{}, false, nil
+	}
+	if !strings.Contains(string(response), "auth=Bearer "+s.token+"\x01") {
+		return nil, false, errors.New("invalid token")
+	}
+	user, err := s.be.Login("username", "password")
+	if err != nil {
+		return nil, false, err
+	}
+	s.conn.Context().User = user
+	return nil, true, nil
+}
+
+func authTestServer(t *testing.T, token string) (*Client, func()) {
+	be := memory.New()
+	srv := server.New(be)
+	srv.AllowInsecureAuth = true
+	srv.EnableAuth(sasl.Xoauth2, func(conn server.Conn) sasl.Server {
+		return &xoauth2Server{conn: conn, be: be, token: token}
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+
+	c, err := Connect(common.ServConfig{
+		Host:     "127.0.0.1",
+		Port:     uint16(l.Addr().(*net.TCPAddr).Port),
+		ConnType: common.Plaintext,
+	})
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	c.Logger = *log.New(ioutil.Discard, "", 0)
+	return c, func() {
+		c.Close()
+		srv.Close()
+	}
+}
+
+// testAuth authenticates worker connection directly so idler is not
+// started.
+func testAuth(t *testing.T, c *Client, conf common.ServConfig) error {
+	ctx := context.Background()
+	w, err := c.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.release(w)
+	return w.auth(ctx, conf)
+}
+
+func TestAuthRenewsRejectedToken(t *testing.T) {
+	c, cleanup := authTestServer(t, "fresh")
+	defer cleanup()
+
+	token := &rotatingToken{tokens: []string{"revoked", "fresh"}}
+	err := testAuth(t, c, common.ServConfig{
+		User:       "username",
+		AuthMethod: common.AuthXOAuth2,
+		Token:      token,
+	})
+	if err != nil {
+		t.Fatal("Auth failed:", err)
+	}
+	if token.invalidated != 1 {
+		t.Fatal("Token invalidated", token.invalidated, "times, expected 1")
+	}
+}
+
+func TestAuthRetriesTokenOnce(t *testing.T) {
+	c, cleanup := authTestServer(t, "fresh")
+	defer cleanup()
+
+	token := &rotatingToken{tokens: []string{"revoked", "revoked2", "fresh"}}
+	err := testAuth(t, c, common.ServConfig{
+		User:       "username",
+		AuthMethod: common.AuthXOAuth2,
+		Token:      token,
+	})
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatal("Auth error is not ErrAuthFailed:", err)
+	}
+	if token.invalidated != 1 {
+		t.Fatal("Token invalidated", token.invalidated, "times, expected 1")
+	}
+}
+
+// authScriptCmds authenticates with password on server that reports caps
+// and returns commands it received.
+func authScriptCmds(t *testing.T, caps string) []string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cmds := make(chan string, 32)
+	go serveScriptLog(l, map[string][]string{
+		"CAPABILITY":   {"* CAPABILITY " + caps},
+		"AUTHENTICATE": {"+ "},
+	}, cmds)
+
+	c, err := Connect(common.ServConfig{
+		Host:     "127.0.0.1",
+		Port:     uint16(l.Addr().(*net.TCPAddr).Port),
+		ConnType: common.Plaintext,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := testAuth(t, c, common.ServConfig{User: "username", Pass: "password"}); err != nil {
+		t.Fatal("Auth failed:", err)
+	}
+	return sentCommands(cmds)
+}
+
+func hasCommand(cmds []string, prefix string) bool {
+	for _, cmd := range cmds {
+		if strings.HasPrefix(strings.ToUpper(cmd), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAuthNoMechanisms(t *testing.T) {
+	cmds := authScriptCmds(t, "IMAP4rev1")
+	if !hasCommand(cmds, "LOGIN ") {
+		t.Error("LOGIN is not used when server advertises no mechanisms:", cmds)
+	}
+	if hasCommand(cmds, "AUTHENTICATE") {
+		t.Error("AUTHENTICATE used without advertised mechanisms:", cmds)
+	}
+}
+
+func TestAuthNoMechanismsLoginDisabled(t *testing.T) {
+	cmds := authScriptCmds(t, "IMAP4rev1 LOGINDISABLED")
+	if !hasCommand(cmds, "AUTHENTICATE PLAIN") {
+		t.Error("PLAIN is not tried when server advertises no mechanisms:", cmds)
+	}
+	if hasCommand(cmds, "LOGIN ") {
+		t.Error("LOGIN used despite LOGINDISABLED:", cmds)
+	}
+}
@@ -0,0 +1,59 @@
+package imap
+
+import (
+	"context"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/foxcpp/mailbox/proto/common"
+)
+
+/*
+	Context-aware variants of Client methods (FooContext for each Foo)
+	abort in-flight network I/O when context is cancelled or its deadline
+	expires.
+
+	go-imap doesn't support contexts so cancellation is implemented by
+	closing connection. Command can't be interrupted in the middle without
+	breaking protocol state anyway, so connection is unusable after
+	cancellation. It's re-established when it's needed next time (see
+	pool.go), other connections are not affected.
+
+	Errors returned by cancelled operations are replaced with ctx.Err(), so
+	callers can distinguish cancellation from real connection problems.
+	Operations are not partially applied by Client itself, server state
+	after cancellation depends on whether server received command.
+*/
+
+// watchContext closes connection if ctx is done before returned function is
+// called. Returned function replaces *err with ctx.Err() if operation was
+// cancelled, otherwise errors caused by connection loss are wrapped so they
+// match ErrConnection (see errors.go). Intended usage is:
+//
+//	func (c *Client) FooContext(ctx context.Context) (err error) {
+//		w, err := c.acquire(ctx)
+//		...
+//		defer w.watchContext(ctx)(&err)
+func (w *conn) watchContext(ctx context.Context) func(*error) {
+	stop := common.WatchConn(ctx, terminator{w.cl})
+	return func(err *error) {
+		stop()
+		if ctx.Err() == nil {
+			*err = wrapError(*err)
+			return
+		}
+		// Connection may be closed even if operation succeeded.
+		w.aborted = true
+		if *err != nil {
+			*err = ctx.Err()
+		}
+	}
+}
+
+// terminator adapts client.Client to io.Closer.
+type terminator struct {
+	cl *client.Client
+}
+
+func (t terminator) Close() error {
+	return t.cl.Terminate()
+}
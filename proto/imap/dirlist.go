@@ -1,24 +1,83 @@
 package imap
 
 import (
+	"context"
+	"strings"
+
 	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// Special-use directory attributes (RFC 6154).
+const (
+	SpecialAll     = `\All`
+	SpecialArchive = `\Archive`
+	SpecialDrafts  = `\Drafts`
+	SpecialFlagged = `\Flagged`
+	SpecialJunk    = `\Junk`
+	SpecialSent    = `\Sent`
+	SpecialTrash   = `\Trash`
 )
 
-func (c *Client) DirList() (delimiter string, list []string, err error) {
-	c.stopIdle()
-	defer c.resumeIdle()
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
+var specialUseAttrs = []string{SpecialAll, SpecialArchive, SpecialDrafts, SpecialFlagged, SpecialJunk, SpecialSent, SpecialTrash}
+
+// CanonicalSpecialUse returns Special* constant matching attribute or empty
+// string if it's not special-use attribute. Attributes are case-insensitive.
+func CanonicalSpecialUse(attr string) string {
+	for _, use := range specialUseAttrs {
+		if strings.EqualFold(attr, use) {
+			return use
+		}
+	}
+	return ""
+}
+
+// IsSpecialUse checks whether attribute is one of special-use attributes.
+func IsSpecialUse(attr string) bool {
+	return CanonicalSpecialUse(attr) != ""
+}
+
+// DirInfo is an entry of directories list.
+type DirInfo struct {
+	Name string
+	// LIST attributes, including special-use ones (if server supports
+	// them).
+	Attrs []string
+}
+
+// SpecialUse returns first special-use attribute of directory (one of
+// Special* constants) or empty string.
+func (di DirInfo) SpecialUse() string {
+	for _, attr := range di.Attrs {
+		if use := CanonicalSpecialUse(attr); use != "" {
+			return use
+		}
+	}
+	return ""
+}
+
+func (c *Client) DirList() (delimiter string, list []DirInfo, err error) {
+	return c.DirListContext(context.Background())
+}
+
+// DirListContext is like DirList but can be cancelled using ctx (see context.go).
+func (c *Client) DirListContext(ctx context.Context) (delimiter string, list []DirInfo, err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
 
 	mailboxes := make(chan *imap.MailboxInfo, 32)
 	done := make(chan error, 1)
 	go func() {
-		done <- c.cl.List("", "*", mailboxes)
+		done <- w.cl.List("", "*", mailboxes)
 	}()
 
-	res := []string{}
+	res := []DirInfo{}
 	for m := range mailboxes {
-		res = append(res, m.Name)
+		res = append(res, DirInfo{Name: m.Name, Attrs: m.Attributes})
 		delimiter = m.Delimiter
 	}
 	return delimiter, res, <-done
@@ -27,13 +86,57 @@ func (c *Client) DirList() (delimiter string, list []string, err error) {
 type DirStatus = imap.MailboxStatus
 
 func (c *Client) Status(dir string) (*DirStatus, error) {
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
+	return c.StatusContext(context.Background(), dir)
+}
 
-	mbox, err := c.cl.Select(dir, false)
+// StatusContext is like Status but can be cancelled using ctx (see context.go).
+func (c *Client) StatusContext(ctx context.Context, dir string) (_ *DirStatus, err error) {
+	w, err := c.acquire(ctx)
 	if err != nil {
-		c.currentMailbox = ""
+		return nil, err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
+
+	mbox, err := w.cl.Select(dir, false)
+	if err != nil {
+		return nil, w.dirError(dir, err)
+	}
+	if err := w.dirSelected(mbox, false); err != nil {
 		return nil, err
 	}
 	return mbox, nil
 }
+
+// CreateSpecialDir creates directory with special-use attribute (see
+// Special* constants). If server doesn't supports CREATE-SPECIAL-USE
+// extension (RFC 6154) regular directory is created.
+func (c *Client) CreateSpecialDir(name, use string) error {
+	return c.CreateSpecialDirContext(context.Background(), name, use)
+}
+
+// CreateSpecialDirContext is like CreateSpecialDir but can be cancelled using ctx (see context.go).
+func (c *Client) CreateSpecialDirContext(ctx context.Context, name, use string) (err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
+
+	if ok, err := w.cl.Support("CREATE-SPECIAL-USE"); err != nil || !ok {
+		return w.cl.Create(name)
+	}
+
+	encoded, err := utf7.Encoding.NewEncoder().String(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.execute(&imap.Command{
+		Name: "CREATE",
+		Arguments: []interface{}{encoded, []interface{}{
+			imap.Atom("USE"), []interface{}{imap.Atom(use)},
+		}},
+	}, nil)
+	return err
+}
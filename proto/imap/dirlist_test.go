@@ -0,0 +1,56 @@
+package imap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSpecialUseCase(t *testing.T) {
+	for attr, expected := range map[string]string{
+		`\Sent`:      SpecialSent,
+		`\sent`:      SpecialSent,
+		`\DRAFTS`:    SpecialDrafts,
+		`\Noselect`:  "",
+		`\SentItems`: "",
+	} {
+		if use := CanonicalSpecialUse(attr); use != expected {
+			t.Errorf("Wrong special-use for %v: %q (expected %q)", attr, use, expected)
+		}
+	}
+
+	info := DirInfo{Name: "Junk", Attrs: []string{`\HasNoChildren`, `\junk`}}
+	if use := info.SpecialUse(); use != SpecialJunk {
+		t.Errorf("Wrong special-use of directory: %q", use)
+	}
+}
+
+func TestCreateSpecialDir(t *testing.T) {
+	for caps, expected := range map[string]string{
+		"IMAP4rev1 CREATE-SPECIAL-USE": `CREATE "Sent Items" (USE (\Sent))`,
+		// Regular directory is created if extension is not supported.
+		"IMAP4rev1": `CREATE "Sent Items"`,
+	} {
+		cmds := make(chan string, 16)
+		c, stop := connectScriptLog(t, map[string][]string{
+			"CAPABILITY": {"* CAPABILITY " + caps},
+		}, cmds)
+		err := c.CreateSpecialDir("Sent Items", SpecialSent)
+		stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		created := false
+		for len(cmds) != 0 {
+			cmd := <-cmds
+			if strings.HasPrefix(strings.ToUpper(cmd), "CREATE") {
+				created = true
+				if cmd != expected {
+					t.Errorf("Wrong command with capabilities %v: %v (expected %v)", caps, cmd, expected)
+				}
+			}
+		}
+		if !created {
+			t.Errorf("Directory is not created with capabilities %v", caps)
+		}
+	}
+}
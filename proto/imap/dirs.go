@@ -1,5 +1,7 @@
 package imap
 
+import "context"
+
 // CreateDir creates directory.
 //
 // No check is done to ensure that directory can be  actually created before
@@ -8,12 +10,19 @@ package imap
 // See https://tools.ietf.org/html/rfc3501#section-6.3.3 for details
 // of underlying command semantics.
 func (c *Client) CreateDir(name string) error {
-	c.stopIdle()
-	defer c.resumeIdle()
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
+	return c.CreateDirContext(context.Background(), name)
+}
 
-	return c.cl.Create(name)
+// CreateDirContext is like CreateDir but can be cancelled using ctx (see context.go).
+func (c *Client) CreateDirContext(ctx context.Context, name string) (err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
+
+	return w.cl.Create(name)
 }
 
 // RenameDir renames directory.
@@ -21,15 +30,21 @@ func (c *Client) CreateDir(name string) error {
 // See https://tools.ietf.org/html/rfc3501#section-6.3.5 for details
 // of underlying command semantics.
 func (c *Client) RenameDir(from, to string) error {
-	c.stopIdle()
-	defer c.resumeIdle()
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
+	return c.RenameDirContext(context.Background(), from, to)
+}
 
-	err := c.cl.Rename(from, to)
+// RenameDirContext is like RenameDir but can be cancelled using ctx (see context.go).
+func (c *Client) RenameDirContext(ctx context.Context, from, to string) (err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
+
+	err = w.cl.Rename(from, to)
 	if err == nil {
-		c.KnownMailboxSizes[to] = c.KnownMailboxSizes[from]
-		delete(c.KnownMailboxSizes, from)
+		w.renameSeqMap(from, to)
 	}
 	return err
 }
@@ -39,14 +54,21 @@ func (c *Client) RenameDir(from, to string) error {
 // See https://tools.ietf.org/html/rfc3501#section-6.3.4 for details
 // of underlying command semantics.
 func (c *Client) RemoveDir(name string) error {
-	c.stopIdle()
-	defer c.resumeIdle()
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
+	return c.RemoveDirContext(context.Background(), name)
+}
+
+// RemoveDirContext is like RemoveDir but can be cancelled using ctx (see context.go).
+func (c *Client) RemoveDirContext(ctx context.Context, name string) (err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
 
-	err := c.cl.Delete(name)
+	err = w.cl.Delete(name)
 	if err == nil {
-		delete(c.KnownMailboxSizes, name)
+		w.dropSeqMap(name)
 	}
 	return err
 }
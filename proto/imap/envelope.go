@@ -3,6 +3,8 @@ package imap
 import (
 	"strings"
 
+	message "github.com/emersion/go-message"
+
 	eimap "github.com/emersion/go-imap"
 	"github.com/foxcpp/mailbox/proto/common"
 )
@@ -15,24 +17,59 @@ type MessageInfo struct {
 	common.Msg
 }
 
+func convertAddr(a *eimap.Address) common.Address {
+	return common.Address{Name: a.PersonalName, Address: a.MailboxName + "@" + a.HostName}
+}
+
 func convertAddrList(in []*eimap.Address) []common.Address {
 	res := make([]common.Address, len(in))
 	for i, a := range in {
-		res[i] = common.Address{a.PersonalName, a.MailboxName + "@" + a.HostName}
+		res[i] = convertAddr(a)
 	}
 	return res
 }
 
+// extraHeadersSection is a fetch item used to request headers that are not
+// part of envelope. References is stored in Msg.References, others are
+// placed in Msg.Misc.
+var extraHeadersSection = &eimap.BodySectionName{
+	BodyPartName: eimap.BodyPartName{
+		Specifier: eimap.HeaderSpecifier,
+		Fields:    []string{"References", "Mail-Followup-To", "Mail-Reply-To"},
+	},
+	Peek: true,
+}
+
+// envelopeItems are fetch items required for MessageToInfo.
+var envelopeItems = []eimap.FetchItem{eimap.FetchEnvelope, eimap.FetchUid, extraHeadersSection.FetchItem()}
+
 func MessageToInfo(msg *eimap.Message) MessageInfo {
 	res := MessageInfo{}
 	res.UID = msg.Uid
 	res.Msg.Date = msg.Envelope.Date
 	res.Msg.Subject = msg.Envelope.Subject
-	res.Msg.From = common.Address{msg.Envelope.From[0].PersonalName, msg.Envelope.From[0].MailboxName + "@" + msg.Envelope.From[0].HostName}
+	res.Msg.MessageId = common.ParseMsgId(msg.Envelope.MessageId)
+	res.Msg.InReplyTo = common.ParseMsgId(msg.Envelope.InReplyTo)
+	if lit := msg.GetBody(extraHeadersSection); lit != nil {
+		if hdr, err := message.Read(lit); err == nil {
+			if refs := hdr.Header.Get("References"); refs != "" {
+				res.Msg.References = common.ParseMsgIdList(refs)
+			}
+			hdr.Header.Del("References")
+			if len(hdr.Header) != 0 {
+				res.Msg.Misc = hdr.Header
+			}
+		}
+	}
+	if len(msg.Envelope.From) != 0 {
+		res.Msg.From = convertAddr(msg.Envelope.From[0])
+	}
 	res.Msg.To = convertAddrList(msg.Envelope.To)
 	res.Msg.Cc = convertAddrList(msg.Envelope.Cc)
 	res.Msg.Bcc = convertAddrList(msg.Envelope.Bcc)
-	res.Msg.ReplyTo = common.Address{msg.Envelope.ReplyTo[0].PersonalName, msg.Envelope.ReplyTo[0].MailboxName + "@" + msg.Envelope.ReplyTo[0].HostName}
+	if len(msg.Envelope.ReplyTo) != 0 {
+		res.Msg.ReplyTo = convertAddr(msg.Envelope.ReplyTo[0])
+	}
 	for _, flag := range msg.Flags {
 		switch flag {
 		case eimap.SeenFlag:
@@ -0,0 +1,140 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	eimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/foxcpp/mailbox/proto/common"
+)
+
+var (
+	// ErrConnection is matched (using errors.Is) by errors caused by loss
+	// of server connection, operation may succeed after Reconnect.
+	ErrConnection = common.ErrConnection
+
+	// ErrAuthFailed is matched by errors caused by rejected credentials.
+	ErrAuthFailed = common.ErrAuthFailed
+
+	// ErrNoSuchMailbox is matched by errors caused by operations on
+	// directory that doesn't exists.
+	ErrNoSuchMailbox = errors.New("imap: no such mailbox")
+
+	// ErrQuotaExceeded is matched by errors caused by exceeded storage
+	// quota.
+	ErrQuotaExceeded = errors.New("imap: quota exceeded")
+)
+
+// Response codes that are translated to errors above, see RFC 3501 and
+// RFC 5530.
+const (
+	CodeTryCreate            = "TRYCREATE"
+	CodeNonExistent          = "NONEXISTENT"
+	CodeOverQuota            = "OVERQUOTA"
+	CodeLimit                = "LIMIT"
+	CodeAuthenticationFailed = "AUTHENTICATIONFAILED"
+	CodeAuthorizationFailed  = "AUTHORIZATIONFAILED"
+	CodeExpired              = "EXPIRED"
+)
+
+// ResponseError is a negative (NO or BAD) server response to command.
+//
+// Use errors.Is with errors listed above to check for specific condition
+// instead of comparing Code directly.
+type ResponseError struct {
+	Type eimap.StatusRespType
+	// Response code without brackets, empty if not sent by server.
+	Code string
+	Info string
+}
+
+func (e *ResponseError) Error() string {
+	if e.Code == "" {
+		return "imap: " + string(e.Type) + " " + e.Info
+	}
+	return "imap: " + string(e.Type) + " [" + e.Code + "] " + e.Info
+}
+
+func (e *ResponseError) Is(target error) bool {
+	switch target {
+	case ErrNoSuchMailbox:
+		return e.Code == CodeTryCreate || e.Code == CodeNonExistent
+	case ErrQuotaExceeded:
+		return e.Code == CodeOverQuota || e.Code == CodeLimit
+	case ErrAuthFailed:
+		return e.Code == CodeAuthenticationFailed || e.Code == CodeAuthorizationFailed || e.Code == CodeExpired
+	}
+	return false
+}
+
+// statusError is like status.Err() but keeps response code.
+func statusError(status *eimap.StatusResp) error {
+	if status == nil || (status.Type != eimap.StatusRespNo && status.Type != eimap.StatusRespBad) {
+		return wrapError(status.Err())
+	}
+	return &ResponseError{
+		Type: status.Type,
+		Code: string(status.Code),
+		Info: status.Info,
+	}
+}
+
+// execute is like client.Client.Execute but returns *ResponseError for
+// negative responses and processes VANISHED responses (see updates.go).
+func (w *conn) execute(cmdr eimap.Commander, h responses.Handler) (*eimap.StatusResp, error) {
+	if w.vanished != nil {
+		h = &vanishedHandler{next: h, out: w.vanished}
+	}
+	status, err := w.cl.Execute(cmdr, h)
+	if err != nil {
+		return nil, err
+	}
+	return status, statusError(status)
+}
+
+// wrapError marks errors caused by connection loss using common.ConnError.
+func wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	// go-imap doesn't exports these errors.
+	if strings.HasPrefix(err.Error(), "imap: connection closed") {
+		return &common.ConnError{Err: err}
+	}
+	return common.WrapConnError(err)
+}
+
+// dirError checks whether directory dir exists if operation on it failed
+// and reason is unknown: go-imap doesn't reports response codes for SELECT
+// and some servers don't send TRYCREATE for COPY and MOVE.
+func (w *conn) dirError(dir string, err error) error {
+	if err == nil || errors.Is(err, ErrNoSuchMailbox) || common.IsConnLoss(wrapError(err)) {
+		return err
+	}
+	var respErr *ResponseError
+	if errors.As(err, &respErr) && respErr.Code != "" {
+		return err
+	}
+	if w.cl.State()&eimap.AuthenticatedState == 0 {
+		return err
+	}
+
+	infos := make(chan *eimap.MailboxInfo)
+	found := make(chan bool, 1)
+	go func() {
+		res := false
+		for info := range infos {
+			res = res || info.Name == dir
+		}
+		found <- res
+	}()
+	if listErr := w.cl.List("", dir, infos); listErr != nil {
+		return err
+	}
+	if !<-found {
+		return fmt.Errorf("%w: %v", ErrNoSuchMailbox, err)
+	}
+	return err
+}
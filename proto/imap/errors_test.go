@@ -0,0 +1,50 @@
+package imap
+
+import (
+	"errors"
+	"testing"
+
+	eimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+func TestResponseCodes(t *testing.T) {
+	cases := []struct {
+		code   string
+		target error
+	}{
+		{CodeTryCreate, ErrNoSuchMailbox},
+		{CodeNonExistent, ErrNoSuchMailbox},
+		{CodeOverQuota, ErrQuotaExceeded},
+		{CodeAuthenticationFailed, ErrAuthFailed},
+	}
+	for _, c := range cases {
+		err := statusError(&eimap.StatusResp{Type: eimap.StatusRespNo, Code: eimap.StatusRespCode(c.code), Info: "Failed"})
+		if !errors.Is(err, c.target) {
+			t.Errorf("Error for [%v] doesn't match %v", c.code, c.target)
+		}
+		var respErr *ResponseError
+		if !errors.As(err, &respErr) || respErr.Code != c.code {
+			t.Errorf("Response code is not preserved: %v", err)
+		}
+	}
+
+	if err := statusError(&eimap.StatusResp{Type: eimap.StatusRespOk}); err != nil {
+		t.Error("Error returned for OK response:", err)
+	}
+	if err := statusError(nil); !errors.Is(err, ErrConnection) {
+		t.Error("Missing response is not reported as connection loss:", err)
+	}
+}
+
+func TestMissingDir(t *testing.T) {
+	c, stop := connectTestServer(t, memory.New())
+	defer stop()
+
+	if _, err := c.Status("Missing"); !errors.Is(err, ErrNoSuchMailbox) {
+		t.Error("Expected ErrNoSuchMailbox for SELECT, got", err)
+	}
+	if err := c.CopyTo("INBOX", "Missing", 1); !errors.Is(err, ErrNoSuchMailbox) {
+		t.Error("Expected ErrNoSuchMailbox for COPY, got", err)
+	}
+}
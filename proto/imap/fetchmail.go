@@ -1,8 +1,11 @@
 package imap
 
 import (
+	"bytes"
+	"context"
 	"errors"
-	"strconv"
+	"io/ioutil"
+	"strings"
 
 	eimap "github.com/emersion/go-imap"
 	message "github.com/emersion/go-message"
@@ -10,15 +13,22 @@ import (
 )
 
 // FetchPartialMail requests text parts of message with specified uid from specified directory.
-// Returned Msg object will contain message headers, text/plain, text/html parts and information (!)
-// about other parts (body slice will be nil).
+// Returned Msg object will contain message headers, full MIME tree with bodies of parts accepted
+// by filter and information (!) about other parts (body slice will be nil).
 func (c *Client) FetchPartialMail(dir string, uid uint32, filter func(string, string) bool) (*MessageInfo, error) {
-	c.stopIdle()
-	defer c.resumeIdle()
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
+	return c.FetchPartialMailContext(context.Background(), dir, uid, filter)
+}
+
+// FetchPartialMailContext is like FetchPartialMail but can be cancelled using ctx (see context.go).
+func (c *Client) FetchPartialMailContext(ctx context.Context, dir string, uid uint32, filter func(string, string) bool) (_ *MessageInfo, err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
 
-	_, err := c.ensureSelected(dir, true)
+	_, err = w.ensureSelected(dir, true)
 	if err != nil {
 		return nil, err
 	}
@@ -27,7 +37,7 @@ func (c *Client) FetchPartialMail(dir string, uid uint32, filter func(string, st
 	seqset.AddNum(uid)
 
 	out := make(chan *eimap.Message, 1)
-	err = c.cl.UidFetch(&seqset, []eimap.FetchItem{eimap.FetchEnvelope, eimap.FetchBodyStructure}, out)
+	err = w.cl.UidFetch(&seqset, append([]eimap.FetchItem{eimap.FetchBodyStructure, eimap.FetchFlags}, envelopeItems...), out)
 	if err != nil {
 		return nil, err
 	}
@@ -36,157 +46,182 @@ func (c *Client) FetchPartialMail(dir string, uid uint32, filter func(string, st
 		return nil, errors.New("fetchmail: invalid uid")
 	}
 	res := MessageToInfo(msgStruct)
-	if msgStruct.BodyStructure.MIMEType == "multipart" {
-		res.Msg.Parts = make([]common.Part, len(msgStruct.BodyStructure.Parts))
-		// Request only parts accepted by filter.
-		toDownload := make([]int, 0, len(msgStruct.BodyStructure.Parts))
-		for i, partStruct := range msgStruct.BodyStructure.Parts {
-			if filter(partStruct.MIMEType, partStruct.MIMESubType) {
-				toDownload = append(toDownload, i)
-			} else {
-				res.Msg.Parts[i] = bodyStructToPart(*partStruct)
-			}
+	res.Msg.Body = bodyStructToPart(*msgStruct.BodyStructure, rootPath(msgStruct.BodyStructure))
+
+	// Request only parts accepted by filter.
+	toDownload := []string{}
+	for _, leaf := range res.Msg.Body.Leaves() {
+		typ := splitType(leaf.Type.Value)
+		if filter(typ[0], typ[1]) {
+			toDownload = append(toDownload, leaf.Path)
 		}
+	}
+	if len(toDownload) == 0 {
+		return &res, nil
+	}
 
-		parts, err := c.downloadParts(uid, toDownload...)
-		if err != nil {
-			return nil, err
-		}
-		// resindx - Index in res.Parts.
-		// i - index in toDownload and parts.
-		for i, resindx := range toDownload {
-			res.Msg.Parts[resindx] = parts[i]
-		}
-	} else if filter(msgStruct.BodyStructure.MIMEType, msgStruct.BodyStructure.MIMESubType) {
-		// Request entire message.
-		out := make(chan *eimap.Message, 1)
-		err := c.cl.UidFetch(&seqset, []eimap.FetchItem{"BODY.PEEK[TEXT]"}, out)
-		if err != nil {
-			return nil, err
-		}
-		msgBody := <-out
-		for _, v := range msgBody.Body {
-			part := bodyStructToPart(*msgStruct.BodyStructure)
-			part.Type = common.ParametrizedHeader{
-				msgStruct.BodyStructure.MIMEType + "/" + msgStruct.BodyStructure.MIMESubType,
-				msgStruct.BodyStructure.Params,
-			}
-
-			part.Body = make([]byte, v.Len())
-			_, err := v.Read(part.Body)
-			if err != nil {
-				return nil, err
-			}
-			res.Msg.Parts = append(res.Msg.Parts, part)
-		}
+	parts, err := w.downloadParts(uid, msgStruct.BodyStructure, toDownload...)
+	if err != nil {
+		return nil, err
+	}
+	for i, path := range toDownload {
+		*res.Msg.Body.Find(path) = parts[i]
 	}
 	return &res, nil
 }
 
-func (c *Client) DownloadPart(dir string, uid uint32, partIndex int) (*common.Part, error) {
-	c.stopIdle()
-	defer c.resumeIdle()
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
+// DownloadPart downloads single part of message specified by IMAP section
+// path (see common.Part.Path).
+func (c *Client) DownloadPart(dir string, uid uint32, path string) (*common.Part, error) {
+	return c.DownloadPartContext(context.Background(), dir, uid, path)
+}
 
-	_, err := c.ensureSelected(dir, true)
+// DownloadPartContext is like DownloadPart but can be cancelled using ctx (see context.go).
+func (c *Client) DownloadPartContext(ctx context.Context, dir string, uid uint32, path string) (_ *common.Part, err error) {
+	w, err := c.acquire(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
 
-	return c.downloadPart(uid, partIndex)
-}
-
-func (c *Client) downloadParts(uid uint32, partIndxs ...int) ([]common.Part, error) {
-	requestFIs := make([]eimap.FetchItem, 0, len(partIndxs) * 2)
-	for _, part := range partIndxs {
-		requestFIs = append(requestFIs, eimap.FetchItem("BODY.PEEK[" + strconv.Itoa(part+1) + ".MIME]"))
-		requestFIs = append(requestFIs, eimap.FetchItem("BODY.PEEK[" + strconv.Itoa(part+1) + "]"))
+	_, err = w.ensureSelected(dir, true)
+	if err != nil {
+		return nil, err
 	}
 
 	seqset := eimap.SeqSet{}
 	seqset.AddNum(uid)
 	out := make(chan *eimap.Message, 1)
-	if err := c.cl.UidFetch(&seqset, requestFIs, out); err != nil {
+	if err := w.cl.UidFetch(&seqset, []eimap.FetchItem{eimap.FetchBodyStructure}, out); err != nil {
 		return nil, err
 	}
-	msg := <- out
-
-	res := make([]common.Part, len(partIndxs))
-	for i, part := range partIndxs {
-		for fi, bodyLiteral := range msg.Body {
-			if fi.FetchItem() == eimap.FetchItem("BODY[" + strconv.Itoa(part+1) + ".MIME]") {
-				hdr, err := message.Read(bodyLiteral)
-				if err != nil {
-					return nil, err
-				}
-
-				res[i].Type.Value, res[i].Type.Params, _ = hdr.Header.ContentType()
-				hdr.Header.Del("Content-Type")
-				res[i].Disposition.Value, res[i].Disposition.Params, _ = hdr.Header.ContentDisposition()
-				hdr.Header.Del("Content-Disposition")
-				res[i].Misc = common.Header(hdr.Header)
-			}
-			if fi.FetchItem() == eimap.FetchItem("BODY[" + strconv.Itoa(part+1) + "]") {
-				buf := make([]byte, bodyLiteral.Len())
-				if _, err := bodyLiteral.Read(buf); err != nil {
-					return nil, err
-				}
-				res[i].Body = buf
-				res[i].Size = uint32(len(buf))
-			}
-		}
+	msgStruct := <-out
+	if msgStruct == nil {
+		return nil, errors.New("downloadpart: invalid uid")
 	}
 
-	return res, nil
+	parts, err := w.downloadParts(uid, msgStruct.BodyStructure, path)
+	if err != nil {
+		return nil, err
+	}
+	return &parts[0], nil
 }
 
-func (c *Client) downloadPart(uid uint32, partIndex int) (*common.Part, error) {
-	headerFI := eimap.FetchItem("BODY.PEEK[" + strconv.Itoa(partIndex+1) + ".MIME]")
-	bodyFI := eimap.FetchItem("BODY.PEEK[" + strconv.Itoa(partIndex+1) + "]")
+// FetchRaw downloads full message in RFC 822 format without any
+// processing.
+func (c *Client) FetchRaw(dir string, uid uint32) ([]byte, error) {
+	return c.FetchRawContext(context.Background(), dir, uid)
+}
 
-	// .PEEK specifier will be omitted in response.
-	headerFIRes := eimap.FetchItem("BODY[" + strconv.Itoa(partIndex+1) + ".MIME]")
-	bodyFIRes := eimap.FetchItem("BODY[" + strconv.Itoa(partIndex+1) + "]")
+// FetchRawContext is like FetchRaw but can be cancelled using ctx (see context.go).
+func (c *Client) FetchRawContext(ctx context.Context, dir string, uid uint32) (_ []byte, err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
 
+	_, err = w.ensureSelected(dir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	section := &eimap.BodySectionName{Peek: true}
 	seqset := eimap.SeqSet{}
 	seqset.AddNum(uid)
+	out := make(chan *eimap.Message, 1)
+	if err := w.cl.UidFetch(&seqset, []eimap.FetchItem{section.FetchItem()}, out); err != nil {
+		return nil, err
+	}
+	msg := <-out
+	if msg == nil {
+		return nil, errors.New("fetchraw: invalid uid")
+	}
+	literal := msg.GetBody(section)
+	if literal == nil {
+		return nil, errors.New("fetchraw: server didn't returned message body")
+	}
+	return ioutil.ReadAll(literal)
+}
 
+// downloadParts fetches bodies of parts with specified paths and decodes them
+// using information from message body structure.
+func (w *conn) downloadParts(uid uint32, structure *eimap.BodyStructure, paths ...string) ([]common.Part, error) {
+	sections := make([]*eimap.BodySectionName, len(paths))
+	requestFIs := make([]eimap.FetchItem, 0, len(paths))
+	for i, path := range paths {
+		if findStruct(structure, path) == nil {
+			return nil, errors.New("downloadparts: no such part: " + path)
+		}
+		if path == "" {
+			return nil, errors.New("downloadparts: can't download multipart part")
+		}
+
+		var err error
+		sections[i], err = eimap.ParseBodySectionName(eimap.FetchItem("BODY.PEEK[" + path + "]"))
+		if err != nil {
+			return nil, err
+		}
+		requestFIs = append(requestFIs, sections[i].FetchItem())
+	}
+
+	seqset := eimap.SeqSet{}
+	seqset.AddNum(uid)
 	out := make(chan *eimap.Message, 1)
-	err := c.cl.UidFetch(&seqset, []eimap.FetchItem{headerFI, bodyFI}, out)
-	if err != nil {
+	if err := w.cl.UidFetch(&seqset, requestFIs, out); err != nil {
 		return nil, err
 	}
 	msg := <-out
+	if msg == nil {
+		return nil, errors.New("downloadparts: invalid uid")
+	}
 
-	hdr := (*message.Entity)(nil)
-	buf := ([]byte)(nil)
-
-	for name, v := range msg.Body {
-		if name.FetchItem() == headerFIRes {
-			// Parse MIME header.
-			hdr, err = message.Read(v)
-			if err != nil {
-				return nil, err
-			}
-		} else if name.FetchItem() == bodyFIRes {
-			// Parse message body.
-			buf = make([]byte, v.Len())
-			v.Read(buf)
+	res := make([]common.Part, len(paths))
+	for i, path := range paths {
+		partStruct := findStruct(structure, path)
+		res[i] = bodyStructToPart(*partStruct, path)
+
+		literal := msg.GetBody(sections[i])
+		if literal == nil {
+			return nil, errors.New("downloadparts: server didn't returned part " + path)
+		}
+		body, err := decodeBody(partStruct, literal)
+		if err != nil {
+			return nil, err
+		}
+		res[i].Body = body
+		res[i].Size = uint32(len(body))
+		if _, prs := res[i].Type.Params["charset"]; prs {
+			res[i].Type.Params["charset"] = "utf-8"
 		}
 	}
 
-	res := common.Part{}
+	return res, nil
+}
 
-	// Split MIME header.
-	res.Type.Value, res.Type.Params, _ = hdr.Header.ContentType()
-	hdr.Header.Del("Content-Type")
-	res.Disposition.Value, res.Disposition.Params, _ = hdr.Header.ContentDisposition()
-	hdr.Header.Del("Content-Disposition")
-	res.Misc = common.Header(hdr.Header)
+// decodeBody removes transfer encoding and converts text to UTF-8.
+func decodeBody(s *eimap.BodyStructure, literal eimap.Literal) ([]byte, error) {
+	raw, err := ioutil.ReadAll(literal)
+	if err != nil {
+		return nil, err
+	}
 
-	res.Body = buf
-	res.Size = uint32(len(buf))
+	hdr := message.Header{}
+	hdr.SetContentType(s.MIMEType+"/"+s.MIMESubType, s.Params)
+	hdr.Set("Content-Transfer-Encoding", s.Encoding)
+	// Unknown encoding or charset is not fatal, we still get readable
+	// (maybe partially decoded) body.
+	entity, err := message.New(hdr, bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownEncoding(err) {
+		return nil, err
+	}
+	return ioutil.ReadAll(entity.Body)
+}
 
-	return &res, nil
+func splitType(t string) [2]string {
+	res := [2]string{}
+	copy(res[:], strings.SplitN(t, "/", 2))
+	return res
 }
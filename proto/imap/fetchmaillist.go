@@ -1,20 +1,28 @@
 package imap
 
 import (
+	"context"
 	eimap "github.com/emersion/go-imap"
 )
 
 func (c *Client) FetchMaillist(dir string) ([]MessageInfo, error) {
-	c.stopIdle()
-	defer c.resumeIdle()
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
+	return c.FetchMaillistContext(context.Background(), dir)
+}
+
+// FetchMaillistContext is like FetchMaillist but can be cancelled using ctx (see context.go).
+func (c *Client) FetchMaillistContext(ctx context.Context, dir string) (_ []MessageInfo, err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
 
-	mbox, err := c.ensureSelected(dir, true)
+	mbox, err := w.ensureSelected(dir, true)
 	if err != nil {
 		return nil, err
 	}
-	defer c.cl.Close()
+	defer w.cl.Close()
 
 	if mbox.Messages == 0 {
 		return []MessageInfo{}, nil
@@ -26,7 +34,7 @@ func (c *Client) FetchMaillist(dir string) ([]MessageInfo, error) {
 	out := make(chan *eimap.Message, 16)
 	done := make(chan error)
 	go func() {
-		done <- c.cl.Fetch(seqset, []eimap.FetchItem{eimap.FetchEnvelope, eimap.FetchUid}, out)
+		done <- w.cl.Fetch(seqset, envelopeItems, out)
 	}()
 
 	res := []MessageInfo{}
@@ -44,12 +52,19 @@ func min(a, b uint32) uint32 {
 }
 
 func (c *Client) FetchPartialMaillist(dir string, count, offset uint32) ([]MessageInfo, error) {
-	c.stopIdle()
-	defer c.resumeIdle()
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
+	return c.FetchPartialMaillistContext(context.Background(), dir, count, offset)
+}
+
+// FetchPartialMaillistContext is like FetchPartialMaillist but can be cancelled using ctx (see context.go).
+func (c *Client) FetchPartialMaillistContext(ctx context.Context, dir string, count, offset uint32) (_ []MessageInfo, err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
 
-	mbox, err := c.ensureSelected(dir, true)
+	mbox, err := w.ensureSelected(dir, true)
 	if err != nil {
 		return nil, err
 	}
@@ -64,7 +79,7 @@ func (c *Client) FetchPartialMaillist(dir string, count, offset uint32) ([]Messa
 	out := make(chan *eimap.Message, 16)
 	done := make(chan error)
 	go func() {
-		done <- c.cl.Fetch(&seqset, []eimap.FetchItem{eimap.FetchEnvelope, eimap.FetchUid}, out)
+		done <- w.cl.Fetch(&seqset, envelopeItems, out)
 	}()
 
 	res := []MessageInfo{}
@@ -1,129 +1,130 @@
 package imap
 
 import (
-	"github.com/emersion/go-imap-idle"
-	"github.com/emersion/go-imap-move"
-	"github.com/emersion/go-imap-uidplus"
+	"context"
 	"time"
 )
 
-// This function is responsive for toggling of IDLE
-func (c *Client) idleOnInbox() {
-	select {
-	case <-time.After(5 * time.Second):
-		// Wait for 5 seconds before IDLE mode entering.
-	case <-c.idlerInterrupt:
-		// If during these 5 seconds we received interrupt request
-		// - don't enter IDLE mode, ack request and return.
-		c.idlerInterrupt <- true
-		return
-	}
-
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
-
-	_, err := c.ensureSelected("INBOX", true)
-	if err != nil {
-		c.Logger.Println("Mailbox selection failed, not entering IDLE mode:", err)
-		if err := c.recoverIdler(); err != nil {
-			// ehh...
-		}
-		go c.idleOnInbox()
-		return
-	}
-	defer c.cl.Close()
+/*
+	Monitoring of INBOX.
 
-	// Used to signal error occured during IDLE.
-	idleChan := make(chan error, 1)
-	// Used to stop IDLE forcefully.
-	idleStop := make(chan struct{})
+	Dedicated connection (not included in pool, see pool.go) is kept in IDLE
+	mode with INBOX selected while Client is authenticated. If connection is
+	lost, it's re-established and authenticated again automatically,
+	attempts are repeated every idleRetryDelay. Reconnect and Auth trigger
+	immediate attempt.
+*/
 
-	c.Logger.Println("Entering IDLE mode...")
+const idleRetryDelay = 30 * time.Second
 
-	supported, err := c.idle.SupportIdle()
-	if err != nil {
-		c.Logger.Println("Capability query failed, not entering IDLE mode:", err)
-	}
-	if !supported {
-		c.Logger.Println("No IMAP IDLE support, falling back to polling.")
+// kickIdler asks idler to restart IDLE command, re-establishing connection
+// if necessary.
+func (c *Client) kickIdler() {
+	select {
+	case c.idleKick <- struct{}{}:
+	default:
 	}
+}
 
-	// Disable regular I/O timeout in IDLE mode.
-	c.cl.Timeout = time.Duration(0)
+func (c *Client) idleLoop() {
+	defer close(c.idleDone)
 
-	go func() {
-		// Setting very small "heartbeat" delay because some NATs and mail
-		// servers are really stupid to drop IDLE'ing connections.
-		idleChan <- c.idle.IdleWithFallback(idleStop, 60*time.Second)
+	ic := &conn{c: c}
+	defer func() {
+		if ic.cl != nil && ic.connected() {
+			ic.cl.Logout()
+		}
+		ic.terminate()
 	}()
 
 	for {
+		err := c.idleOnInbox(ic)
 		select {
-		case <-c.idlerInterrupt:
-			c.Logger.Println("Exiting IDLE mode...")
-			close(idleStop)
-		case idleErr := <-idleChan:
-			if idleErr != nil {
-				if idleErr.Error() == "imap: connection closed" {
-					if err := c.recoverIdler(); err != nil {
-						c.Logger.Println("Connection recovery during idle failed, bailing out:", err)
-					}
-					return
-				}
-				c.Logger.Println("Idle error:", idleErr)
-			}
-			c.idlerInterrupt <- true
-
-			// Re-enable regular I/O timeout.
-			c.cl.Timeout = 30 * time.Second
+		case <-c.idleQuit:
+			return
+		default:
+		}
+		if err == nil {
+			continue
+		}
 
+		c.Logger.Println("Idle error:", err)
+		ic.terminate()
+		select {
+		case <-c.idleQuit:
 			return
+		case <-c.idleKick:
+		case <-time.After(idleRetryDelay):
 		}
 	}
-
 }
 
-func (c *Client) stopIdle() {
-	// Ask idle goroutine to exit.
-	c.idlerInterrupt <- true
-	// Wait for ack to make sure we done with idling before doing regular requests.
-	<-c.idlerInterrupt
-}
+// idleOnInbox waits for updates in INBOX until idler is kicked or Client is
+// closed. It does nothing if Client is not authenticated.
+func (c *Client) idleOnInbox(ic *conn) error {
+	conf, authenticated := c.credentials()
+	if !authenticated {
+		ic.terminate()
+		select {
+		case <-c.idleKick:
+		case <-c.idleQuit:
+		}
+		return nil
+	}
 
-func (c *Client) resumeIdle() {
-	// TODO: Is constant goroutine restarting expensive?
-	go c.idleOnInbox()
-}
+	if !ic.usable() {
+		if ic.cl != nil {
+			c.Logger.Println("Lost connection during IDLE, trying to recover...")
+		}
+		if err := ic.dial(context.Background(), conf); err != nil {
+			return err
+		}
+		if err := ic.auth(context.Background(), conf); err != nil {
+			return err
+		}
+	}
+	if err := ic.updateNotify(); err != nil {
+		c.Logger.Println("Failed to enable NOTIFY:", err)
+	}
 
-// recoverIdler is called from idleOnInbox in attempt to reconnect after
-// unexpected connection close from server (this happens pretty often, because
-// connection is actually idle when client is in IDLE mode).
-//
-// This task is also a special case of c.Reconnect function because IDLE thing
-// on it's own is a very special snowflake which needs very careful handling.
-func (c *Client) recoverIdler() error {
-	c.Logger.Println("Lost connection during IDLE, trying to recover...")
-	c.updatesDispatcherStop <- true
-	<-c.updatesDispatcherStop
-
-	c.cl = nil
-	var err error
-	c.cl, err = connect(c.LastConfig)
-	if err != nil {
+	if _, err := ic.ensureSelected("INBOX", true); err != nil {
 		return err
 	}
-	c.idle = idle.NewClient(c.cl)
-	c.move = move.NewClient(c.cl)
-	c.uidplus = uidplus.NewClient(c.cl)
 
-	if err := c.Auth(c.LastConfig); err != nil {
+	supported, err := ic.idle.SupportIdle()
+	if err != nil {
 		return err
 	}
+	if !supported {
+		c.Logger.Println("No IMAP IDLE support, falling back to polling.")
+	}
 
-	if _, err := c.ensureSelected("INBOX", true); err != nil {
+	// Disable regular I/O timeout in IDLE mode.
+	ic.cl.Timeout = time.Duration(0)
+	defer func() {
+		// Re-enable regular I/O timeout.
+		ic.cl.Timeout = 30 * time.Second
+	}()
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	notify := ic.notifyEnabled && supported
+	go func() {
+		if notify {
+			done <- ic.idleNotify(stop)
+			return
+		}
+		// Setting very small "heartbeat" delay because some NATs and mail
+		// servers are really stupid to drop IDLE'ing connections.
+		done <- ic.idle.IdleWithFallback(stop, 60*time.Second)
+	}()
+
+	select {
+	case err := <-done:
 		return err
+	case <-c.idleKick:
+	case <-c.idleQuit:
 	}
-
-	go c.updatesWatch()
-	return nil
+	close(stop)
+	return <-done
 }
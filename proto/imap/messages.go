@@ -2,10 +2,14 @@ package imap
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"time"
 
 	eimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap-move"
+	"github.com/emersion/go-imap-uidplus"
+	"github.com/emersion/go-imap/commands"
 	"github.com/foxcpp/mailbox/proto/common"
 )
 
@@ -21,22 +25,30 @@ func (e TooBigError) Error() string {
 //
 // Invalid UIDs are ignored. Invalid dir names lead to error.
 func (c *Client) CopyTo(fromDir string, targetDir string, uids ...uint32) error {
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
-	c.stopIdle()
-	defer c.resumeIdle()
+	return c.CopyToContext(context.Background(), fromDir, targetDir, uids...)
+}
 
-	if _, err := c.ensureSelected(fromDir, false); err != nil {
+// CopyToContext is like CopyTo but can be cancelled using ctx (see context.go).
+func (c *Client) CopyToContext(ctx context.Context, fromDir string, targetDir string, uids ...uint32) (err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
 		return err
 	}
-	defer c.cl.Expunge(nil)
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
+
+	if _, err := w.ensureSelected(fromDir, false); err != nil {
+		return err
+	}
+	defer w.expunge()
 
 	seqset := eimap.SeqSet{}
 	for _, i := range uids {
 		seqset.AddNum(i)
 	}
 
-	return c.cl.UidCopy(&seqset, targetDir)
+	_, err = w.execute(&commands.Uid{Cmd: &commands.Copy{SeqSet: &seqset, Mailbox: targetDir}}, nil)
+	return w.dirError(targetDir, err)
 }
 
 // MoveTo copies all messages to specified directory and removes them from
@@ -44,38 +56,73 @@ func (c *Client) CopyTo(fromDir string, targetDir string, uids ...uint32) error
 //
 // Invalid UIDs are ignored. Invalid dir names lead to error.
 func (c *Client) MoveTo(fromDir string, targetDir string, uids ...uint32) error {
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
-	c.stopIdle()
-	defer c.resumeIdle()
+	return c.MoveToContext(context.Background(), fromDir, targetDir, uids...)
+}
 
-	if _, err := c.ensureSelected(fromDir, false); err != nil {
+// MoveToContext is like MoveTo but can be cancelled using ctx (see context.go).
+func (c *Client) MoveToContext(ctx context.Context, fromDir string, targetDir string, uids ...uint32) (err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
+
+	if _, err := w.ensureSelected(fromDir, false); err != nil {
 		return err
 	}
 
 	seqset := eimap.SeqSet{}
 	seqset.AddNum(uids...)
 
-	return c.move.UidMoveWithFallback(&seqset, targetDir)
+	return w.uidMove(&seqset, targetDir)
+}
+
+// uidMove is like move.Client.UidMoveWithFallback but keeps response codes
+// (see errors.go).
+func (w *conn) uidMove(seqset *eimap.SeqSet, targetDir string) error {
+	supported, err := w.move.SupportMove()
+	if err != nil {
+		return err
+	}
+	if supported {
+		_, err := w.execute(&commands.Uid{Cmd: &move.Command{SeqSet: seqset, Mailbox: targetDir}}, nil)
+		return w.dirError(targetDir, err)
+	}
+
+	if _, err := w.execute(&commands.Uid{Cmd: &commands.Copy{SeqSet: seqset, Mailbox: targetDir}}, nil); err != nil {
+		return w.dirError(targetDir, err)
+	}
+	if err := w.cl.UidStore(seqset, eimap.FormatFlagsOp(eimap.AddFlags, true), []interface{}{eimap.DeletedFlag}, nil); err != nil {
+		return err
+	}
+	return w.expunge()
 }
 
 // Delete deletes all specified messages.
 //
 // Invalid UIDs are ignored. Invalid dir names lead to error.
 func (c *Client) Delete(dir string, uids ...uint32) error {
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
-	c.stopIdle()
-	defer c.resumeIdle()
+	return c.DeleteContext(context.Background(), dir, uids...)
+}
+
+// DeleteContext is like Delete but can be cancelled using ctx (see context.go).
+func (c *Client) DeleteContext(ctx context.Context, dir string, uids ...uint32) (err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
 
-	if _, err := c.ensureSelected(dir, false); err != nil {
+	if _, err := w.ensureSelected(dir, false); err != nil {
 		return err
 	}
 
 	seqset := eimap.SeqSet{}
 	seqset.AddNum(uids...)
 
-	return c.cl.UidStore(&seqset, eimap.FormatFlagsOp(eimap.AddFlags, true), []interface{}{eimap.DeletedFlag}, nil)
+	return w.cl.UidStore(&seqset, eimap.FormatFlagsOp(eimap.AddFlags, true), []interface{}{eimap.DeletedFlag}, nil)
 }
 
 const (
@@ -86,48 +133,69 @@ const (
 // Tag adds a tag to listed messages.
 // Invalid UIDs are ignored!
 func (c *Client) Tag(dir string, tag string, uids ...uint32) error {
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
-	c.stopIdle()
-	defer c.resumeIdle()
+	return c.TagContext(context.Background(), dir, tag, uids...)
+}
 
-	if _, err := c.ensureSelected(dir, false); err != nil {
+// TagContext is like Tag but can be cancelled using ctx (see context.go).
+func (c *Client) TagContext(ctx context.Context, dir string, tag string, uids ...uint32) (err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
+
+	if _, err := w.ensureSelected(dir, false); err != nil {
 		return err
 	}
 
 	seqset := eimap.SeqSet{}
 	seqset.AddNum(uids...)
 
-	return c.cl.UidStore(&seqset, eimap.FormatFlagsOp(eimap.AddFlags, true), []interface{}{tag}, nil)
+	return w.cl.UidStore(&seqset, eimap.FormatFlagsOp(eimap.AddFlags, true), []interface{}{tag}, nil)
 }
 
 // UnTag removes a tag from listed messages.
 // Invalid UIDs are ignored!
 func (c *Client) UnTag(dir string, tag string, uids ...uint32) error {
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
-	c.stopIdle()
-	defer c.resumeIdle()
+	return c.UnTagContext(context.Background(), dir, tag, uids...)
+}
 
-	if _, err := c.ensureSelected(dir, false); err != nil {
+// UnTagContext is like UnTag but can be cancelled using ctx (see context.go).
+func (c *Client) UnTagContext(ctx context.Context, dir string, tag string, uids ...uint32) (err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
+
+	if _, err := w.ensureSelected(dir, false); err != nil {
 		return err
 	}
 
 	seqset := eimap.SeqSet{}
 	seqset.AddNum(uids...)
 
-	return c.cl.UidStore(&seqset, eimap.FormatFlagsOp(eimap.RemoveFlags, true), []interface{}{tag}, nil)
+	return w.cl.UidStore(&seqset, eimap.FormatFlagsOp(eimap.RemoveFlags, true), []interface{}{tag}, nil)
 }
 
 // Create creates new message in specified directory, flags and date are optional
 // and can be null.
 func (c *Client) Create(dir string, flags []string, date time.Time, msg *common.Msg) (uint32, error) {
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
-	c.stopIdle()
-	defer c.resumeIdle()
+	return c.CreateContext(context.Background(), dir, flags, date, msg)
+}
 
-	status, err := c.ensureSelected(dir, false)
+// CreateContext is like Create but can be cancelled using ctx (see context.go).
+func (c *Client) CreateContext(ctx context.Context, dir string, flags []string, date time.Time, msg *common.Msg) (_ uint32, err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
+
+	status, err := w.ensureSelected(dir, false)
 	if err != nil {
 		return 0, err
 	}
@@ -135,19 +203,37 @@ func (c *Client) Create(dir string, flags []string, date time.Time, msg *common.
 	buf := bytes.Buffer{}
 	msg.Write(&buf)
 
-	uidplus, err := c.uidplus.SupportUidPlus()
+	uidplus, err := w.uidplus.SupportUidPlus()
 	if err != nil {
 		return 0, err
 	}
-	if uidplus {
-		_, uid, err := c.uidplus.Append(dir, flags, date, &buf)
-		return uid, err
-	} else {
+	uid, err := w.append(dir, flags, date, &buf)
+	if !uidplus {
 		// This may not work correctly and break a lot of things but we can't
 		// do anything better.
 		// See https://tools.ietf.org/html/rfc3501#section-2.3.1.1
-		return status.UidNext, c.cl.Append(dir, flags, date, &buf)
+		uid = status.UidNext
+	}
+	return uid, err
+}
+
+// append is like uidplus.Client.Append but keeps response codes (see
+// errors.go). Returned UID is zero if server doesn't supports UIDPLUS.
+func (w *conn) append(dir string, flags []string, date time.Time, msg eimap.Literal) (uint32, error) {
+	status, err := w.execute(&commands.Append{
+		Mailbox: dir,
+		Flags:   flags,
+		Date:    date,
+		Message: msg,
+	}, nil)
+	if err != nil {
+		return 0, err
 	}
+	if status.Code != uidplus.CodeAppendUid || len(status.Arguments) < 2 {
+		return 0, nil
+	}
+	uid, _ := eimap.ParseNumber(status.Arguments[1])
+	return uid, nil
 }
 
 // Replace replaces existing message with different one *in one mailbox*
@@ -159,21 +245,28 @@ func (c *Client) Create(dir string, flags []string, date time.Time, msg *common.
 // This function works a bit differently from delete+create. If message
 // creation fails then no message will be deleted.
 func (c *Client) Replace(dir string, uid uint32, flags []string, date time.Time, msg *common.Msg) (uint32, error) {
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
-	c.stopIdle()
-	defer c.resumeIdle()
+	return c.ReplaceContext(context.Background(), dir, uid, flags, date, msg)
+}
+
+// ReplaceContext is like Replace but can be cancelled using ctx (see context.go).
+func (c *Client) ReplaceContext(ctx context.Context, dir string, uid uint32, flags []string, date time.Time, msg *common.Msg) (_ uint32, err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
 
-	status, err := c.cl.Select(dir, false)
+	status, err := w.selectDir(dir, false)
 	if err != nil {
 		return 0, err
 	}
-	defer c.cl.Expunge(nil)
+	defer w.expunge()
 
 	seqset := eimap.SeqSet{}
 	seqset.AddNum(uid)
 
-	if err := c.cl.UidStore(&seqset, eimap.FormatFlagsOp(eimap.AddFlags, true), []interface{}{eimap.DeletedFlag}, nil); err != nil {
+	if err := w.cl.UidStore(&seqset, eimap.FormatFlagsOp(eimap.AddFlags, true), []interface{}{eimap.DeletedFlag}, nil); err != nil {
 		return 0, err
 	}
 
@@ -181,15 +274,12 @@ func (c *Client) Replace(dir string, uid uint32, flags []string, date time.Time,
 	buf := bytes.Buffer{}
 	msg.Write(&buf)
 
-	uidplus, err := c.uidplus.SupportUidPlus()
+	uidplus, err := w.uidplus.SupportUidPlus()
 	if err != nil {
 		return 0, err
 	}
-	var nuid uint32
-	if uidplus {
-		_, nuid, err = c.uidplus.Append(dir, flags, date, &buf)
-	} else {
-		err = c.cl.Append(dir, flags, date, &buf)
+	nuid, err := w.append(dir, flags, date, &buf)
+	if !uidplus {
 		// This may not work correctly and break a lot of things but we can't
 		// do anything better.
 		// See https://tools.ietf.org/html/rfc3501#section-2.3.1.1
@@ -212,7 +302,7 @@ func (c *Client) Replace(dir string, uid uint32, flags []string, date time.Time,
 	//
 	// With message delete after creation of new one this will lead to only duplicate,
 	// but that's better  than to loss both versions.
-	if err := c.cl.UidStore(&seqset, eimap.FormatFlagsOp(eimap.AddFlags, true), []interface{}{eimap.DeletedFlag}, nil); err != nil {
+	if err := w.cl.UidStore(&seqset, eimap.FormatFlagsOp(eimap.AddFlags, true), []interface{}{eimap.DeletedFlag}, nil); err != nil {
 		return 0, err
 	}
 
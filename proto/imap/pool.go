@@ -0,0 +1,134 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/emersion/go-imap/commands"
+)
+
+/*
+	Connections pool.
+
+	Client uses several connections to server. One is dedicated to
+	monitoring of INBOX (see idler.go), all other operations are performed
+	using worker connections, so long operations (like downloading of big
+	attachment) don't block other ones.
+
+	Worker connections are established when needed, up to pool size (see
+	SetPoolSize). Connection that was not used for some time is checked
+	using NOOP command before use. Broken connections are re-established
+	and authenticated again automatically.
+*/
+
+// DefaultPoolSize is a default amount of worker connections per Client.
+const DefaultPoolSize = 2
+
+// Connection that was not used for that time is checked before use.
+const healthCheckInterval = 1 * time.Minute
+
+var ErrClosed = errors.New("imap: client is closed")
+
+// SetPoolSize changes maximum amount of worker connections. It doesn't
+// includes connection used for IDLE. Excess connections are closed when
+// they are no longer used.
+func (c *Client) SetPoolSize(size int) {
+	if size < 1 {
+		size = 1
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.poolSize = size
+	for len(c.free) != 0 && c.busy+len(c.free) > c.poolSize {
+		c.free[0].terminate()
+		c.free = c.free[1:]
+	}
+}
+
+// acquire returns worker connection ready for use, waiting for one to be
+// released if all are busy. Connection must be returned using release.
+func (c *Client) acquire(ctx context.Context) (*conn, error) {
+	c.lock.Lock()
+	for !c.closed && c.busy >= c.poolSize {
+		released := c.released
+		c.lock.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c.lock.Lock()
+	}
+	if c.closed {
+		c.lock.Unlock()
+		return nil, ErrClosed
+	}
+	c.busy++
+	var w *conn
+	if len(c.free) != 0 {
+		// Most recently used connection is most likely alive.
+		w = c.free[len(c.free)-1]
+		c.free = c.free[:len(c.free)-1]
+	} else {
+		w = &conn{c: c}
+	}
+	c.lock.Unlock()
+
+	if err := c.prepare(ctx, w); err != nil {
+		c.release(w)
+		return nil, err
+	}
+	return w, nil
+}
+
+// release returns connection to pool.
+func (c *Client) release(w *conn) {
+	w.lastUsed = time.Now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.busy--
+	if c.closed || c.busy+len(c.free) >= c.poolSize {
+		w.terminate()
+	} else {
+		c.free = append(c.free, w)
+	}
+	close(c.released)
+	c.released = make(chan struct{})
+}
+
+// prepare checks whether connection is alive and re-establishes it if
+// necessary.
+func (c *Client) prepare(ctx context.Context, w *conn) (err error) {
+	if w.usable() && time.Since(w.lastUsed) > healthCheckInterval {
+		if err := w.noop(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			c.Logger.Println("Health check failed, reconnecting:", err)
+		}
+	}
+	if w.usable() {
+		return nil
+	}
+
+	if w.cl != nil {
+		c.Logger.Println("Connection lost, reconnecting...")
+	}
+	conf, authenticated := c.credentials()
+	if err := w.dial(ctx, conf); err != nil {
+		return err
+	}
+	if !authenticated {
+		return nil
+	}
+	defer w.watchContext(ctx)(&err)
+	return w.auth(ctx, conf)
+}
+
+func (w *conn) noop(ctx context.Context) (err error) {
+	defer w.watchContext(ctx)(&err)
+	_, err = w.execute(&commands.Noop{}, nil)
+	return err
+}
@@ -0,0 +1,169 @@
+package imap
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	eimap "github.com/emersion/go-imap"
+	"github.com/foxcpp/mailbox/proto/common"
+)
+
+// sentCommands returns commands received by scripted server so far.
+func sentCommands(cmds <-chan string) []string {
+	var res []string
+	for {
+		select {
+		case cmd := <-cmds:
+			res = append(res, cmd)
+		default:
+			return res
+		}
+	}
+}
+
+func TestPoolSize(t *testing.T) {
+	c, stop := connectScript(t, map[string][]string{
+		"CAPABILITY": {"* CAPABILITY IMAP4rev1"},
+	})
+	defer stop()
+	c.SetPoolSize(2)
+
+	ctx := context.Background()
+	w1, err := c.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w2, err := c.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w1 == w2 || w1.cl == w2.cl {
+		t.Fatal("Same connection is used twice")
+	}
+
+	// All connections are busy.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.acquire(timeoutCtx); err != context.DeadlineExceeded {
+		t.Fatal("Expected timeout, got", err)
+	}
+
+	acquired := make(chan *conn, 1)
+	go func() {
+		w, err := c.acquire(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- w
+	}()
+	c.release(w1)
+	var w3 *conn
+	select {
+	case w3 = <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Released connection is not passed to waiting operation")
+	}
+	if w3 != w1 {
+		t.Error("Released connection is not reused")
+	}
+
+	c.release(w2)
+	c.release(w3)
+	c.SetPoolSize(1)
+	c.lock.Lock()
+	free := len(c.free)
+	c.lock.Unlock()
+	if free != 1 {
+		t.Errorf("Excess connections are not closed: %v free", free)
+	}
+}
+
+func TestPoolReconnect(t *testing.T) {
+	cmds := make(chan string, 64)
+	c, stop := connectScriptLog(t, map[string][]string{
+		"CAPABILITY": {"* CAPABILITY IMAP4rev1"},
+	}, cmds)
+	defer stop()
+
+	// Like after successful Auth, but without starting idler.
+	c.lock.Lock()
+	c.lastConfig.User = "username"
+	c.lastConfig.Pass = "password"
+	c.authenticated = true
+	c.lock.Unlock()
+
+	ctx := context.Background()
+	w, err := c.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.terminate()
+	c.release(w)
+	sentCommands(cmds)
+
+	w, err = c.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.usable() {
+		t.Error("Lost connection is not re-established")
+	}
+	c.release(w)
+	if sent := sentCommands(cmds); !hasCommand(sent, "LOGIN ") {
+		t.Error("Re-established connection is not authenticated:", sent)
+	}
+
+	// Reconnect drops credentials, existing connections are replaced by
+	// new unauthenticated ones.
+	if err := c.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	sentCommands(cmds)
+	w, err = c.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := w.cl.State()
+	c.release(w)
+	if sent := sentCommands(cmds); hasCommand(sent, "LOGIN ") {
+		t.Error("Connection is authenticated after Reconnect:", sent)
+	}
+	if state != eimap.NotAuthenticatedState {
+		t.Error("Wrong connection state:", state)
+	}
+}
+
+func TestIdleConnectionDedicated(t *testing.T) {
+	cmds := make(chan string, 64)
+	// No IDLE support, idler polls using NOOP.
+	c, stop := connectScriptLog(t, map[string][]string{
+		"CAPABILITY": {"* CAPABILITY IMAP4rev1"},
+	}, cmds)
+	defer stop()
+	c.SetPoolSize(1)
+
+	if err := c.Auth(common.ServConfig{User: "username", Pass: "password"}); err != nil {
+		t.Fatal(err)
+	}
+	// Worker connection is busy, idler must not need it.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	w, err := c.acquire(ctx)
+	if err != nil {
+		t.Fatal("Worker connection is not available:", err)
+	}
+	defer c.release(w)
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case cmd := <-cmds:
+			if hasCommand([]string{cmd}, "EXAMINE INBOX") {
+				return
+			}
+		case <-deadline:
+			t.Fatal("INBOX is not selected by idler while worker connection is busy")
+		}
+	}
+}
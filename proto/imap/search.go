@@ -1,16 +1,31 @@
 package imap
 
-import eimap "github.com/emersion/go-imap"
+import (
+	"context"
+
+	eimap "github.com/emersion/go-imap"
+)
 
 func (c *Client) Search(dir string, criteria eimap.SearchCriteria) ([]uint32, error) {
-	c.stopIdle()
-	defer c.resumeIdle()
-	c.IOLock.Lock()
-	defer c.IOLock.Lock()
+	return c.SearchContext(context.Background(), dir, criteria)
+}
+
+// SearchContext is like Search but can be cancelled using ctx (see context.go).
+func (c *Client) SearchContext(ctx context.Context, dir string, criteria eimap.SearchCriteria) (_ []uint32, err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
 
-	if _, err := c.cl.Select(dir, true); err != nil {
+	mbox, err := w.cl.Select(dir, true)
+	if err != nil {
+		return nil, w.dirError(dir, err)
+	}
+	if err := w.dirSelected(mbox, false); err != nil {
 		return nil, err
 	}
 
-	return c.cl.UidSearch(&criteria)
+	return w.cl.UidSearch(&criteria)
 }
@@ -0,0 +1,402 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	eimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+)
+
+/*
+Incremental directory synchronization.
+
+If server supports QRESYNC (RFC 7162) directory is selected with QRESYNC
+parameter and server reports changed flags and expunged (vanished) messages
+right in SELECT response.
+
+If server supports only CONDSTORE, changed flags are requested using
+CHANGEDSINCE FETCH modifier and expunged messages are detected by comparing
+list of UIDs on server with list of known UIDs.
+
+Otherwise flags for all messages are requested and compared with known state.
+
+In all cases envelopes are downloaded only for messages not known to client.
+
+Note: Once QRESYNC is enabled server reports expunged messages using VANISHED
+responses instead of EXPUNGE, they are passed to UpdateCallbacks.MessageRemoved
+like EXPUNGE (see updates.go).
+*/
+
+// DirSyncState describes what client already knows about directory.
+type DirSyncState struct {
+	// Zero if nothing is known, full download will be performed.
+	UidValidity uint32
+	// Zero if unknown or server doesn't supports CONDSTORE.
+	HighestModSeq uint64
+	// UIDs of messages client have information about.
+	KnownUids []uint32
+}
+
+// FlagsUpdate is a new flags list for message.
+type FlagsUpdate struct {
+	UID   uint32
+	Flags []string
+}
+
+// DirChanges is a difference between state known to client and
+// actual state on server.
+type DirChanges struct {
+	UidValidity uint32
+	// Zero if server doesn't supports CONDSTORE for this directory.
+	HighestModSeq uint64
+
+	// Reset is set if UIDVALIDITY changed or state was empty. In this
+	// case all information about directory should be discarded and New
+	// contains full list of messages.
+	Reset bool
+
+	// Messages not known to client (only envelope and flags).
+	New []MessageInfo
+	// Flags changes for known messages.
+	Changed []FlagsUpdate
+	// UIDs of known messages that no longer exist on server.
+	Vanished []uint32
+}
+
+// enableExtensions enables extensions that require explicit ENABLE command.
+// Must be called after authentication.
+func (w *conn) enableExtensions() {
+	w.qresyncEnabled = false
+	if ok, _ := w.cl.Support("QRESYNC"); !ok {
+		return
+	}
+	if ok, _ := w.cl.Support("ENABLE"); !ok {
+		return
+	}
+
+	status, err := w.cl.Execute(&eimap.Command{
+		Name:      "ENABLE",
+		Arguments: []interface{}{eimap.Atom("QRESYNC")},
+	}, nil)
+	if err != nil || status.Err() != nil {
+		w.c.Logger.Println("Failed to enable QRESYNC:", err, status)
+		return
+	}
+	w.qresyncEnabled = true
+}
+
+// SyncDir compares known state of directory with state on server and
+// returns changes.
+func (c *Client) SyncDir(dir string, known DirSyncState) (*DirChanges, error) {
+	return c.SyncDirContext(context.Background(), dir, known)
+}
+
+// SyncDirContext is like SyncDir but can be cancelled using ctx (see context.go).
+func (c *Client) SyncDirContext(ctx context.Context, dir string, known DirSyncState) (_ *DirChanges, err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
+
+	condstore, err := w.cl.Support("CONDSTORE")
+	if err != nil {
+		return nil, err
+	}
+	useQresync := w.qresyncEnabled && known.UidValidity != 0 && known.HighestModSeq != 0
+
+	sel := selectResult{}
+	if useQresync {
+		err = w.selectExt(dir, []interface{}{eimap.Atom("QRESYNC"), []interface{}{
+			known.UidValidity, eimap.Atom(strconv.FormatUint(known.HighestModSeq, 10)),
+		}}, &sel)
+	} else if condstore || w.qresyncEnabled {
+		err = w.selectExt(dir, []interface{}{eimap.Atom("CONDSTORE")}, &sel)
+	} else {
+		err = w.selectExt(dir, nil, &sel)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer w.cl.Close()
+
+	res := &DirChanges{
+		UidValidity:   sel.mbox.UidValidity,
+		HighestModSeq: sel.highestModSeq,
+	}
+
+	knownSet := make(map[uint32]bool, len(known.KnownUids))
+	maxKnown := uint32(0)
+	for _, uid := range known.KnownUids {
+		knownSet[uid] = true
+		if uid > maxKnown {
+			maxKnown = uid
+		}
+	}
+
+	if known.UidValidity == 0 || known.UidValidity != sel.mbox.UidValidity {
+		res.Reset = true
+		if sel.mbox.Messages == 0 {
+			return res, nil
+		}
+		seqset := eimap.SeqSet{}
+		seqset.AddRange(1, 0)
+		res.New, err = w.fetchEnvelopes(false, &seqset)
+		if err != nil {
+			return nil, err
+		}
+		uids := make([]uint32, len(res.New))
+		for i, msg := range res.New {
+			uids[i] = msg.UID
+		}
+		w.learnUids(sel.mbox, uids)
+		return res, nil
+	}
+
+	var newUids []uint32
+	if useQresync {
+		// Server already told us about changes in SELECT response.
+		for _, msg := range sel.changed {
+			if knownSet[msg.Uid] {
+				res.Changed = append(res.Changed, FlagsUpdate{msg.Uid, msg.Flags})
+			}
+		}
+		for _, uid := range known.KnownUids {
+			if sel.vanished.Contains(uid) {
+				res.Vanished = append(res.Vanished, uid)
+			}
+		}
+
+		if sel.mbox.Messages != 0 {
+			seqset := eimap.SeqSet{}
+			seqset.AddRange(maxKnown+1, 0)
+			msgs, err := w.fetchEnvelopes(true, &seqset)
+			if err != nil {
+				return nil, err
+			}
+			// n:* always matches at least one message, even if it's UID is
+			// lower than n.
+			for _, msg := range msgs {
+				if msg.UID > maxKnown {
+					res.New = append(res.New, msg)
+				}
+			}
+		}
+		return res, nil
+	}
+
+	if sel.mbox.Messages == 0 {
+		res.Vanished = known.KnownUids
+		return res, nil
+	}
+
+	allUids := eimap.SeqSet{}
+	allUids.AddRange(1, 0)
+	var present []uint32
+	if condstore && known.HighestModSeq != 0 && sel.highestModSeq != 0 {
+		changed, err := w.fetchFlags(&allUids, known.HighestModSeq)
+		if err != nil {
+			return nil, err
+		}
+		for _, upd := range changed {
+			if knownSet[upd.UID] {
+				res.Changed = append(res.Changed, upd)
+			}
+		}
+
+		present, err = w.cl.UidSearch(&eimap.SearchCriteria{Uid: &allUids})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Full resync, compare flags of all messages.
+		all, err := w.fetchFlags(&allUids, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, upd := range all {
+			present = append(present, upd.UID)
+			if knownSet[upd.UID] {
+				res.Changed = append(res.Changed, upd)
+			}
+		}
+	}
+
+	w.learnUids(sel.mbox, present)
+
+	presentSet := make(map[uint32]bool, len(present))
+	for _, uid := range present {
+		presentSet[uid] = true
+		if !knownSet[uid] {
+			newUids = append(newUids, uid)
+		}
+	}
+	for _, uid := range known.KnownUids {
+		if !presentSet[uid] {
+			res.Vanished = append(res.Vanished, uid)
+		}
+	}
+
+	if len(newUids) != 0 {
+		seqset := eimap.SeqSet{}
+		seqset.AddNum(newUids...)
+		res.New, err = w.fetchEnvelopes(true, &seqset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+type selectResult struct {
+	mbox          *eimap.MailboxStatus
+	highestModSeq uint64
+	// Filled only when QRESYNC is used.
+	changed  []*eimap.Message
+	vanished eimap.SeqSet
+}
+
+// selectHandler processes responses to SELECT with CONDSTORE/QRESYNC
+// parameters in addition to regular ones.
+type selectHandler struct {
+	responses.Select
+	res *selectResult
+}
+
+func (h *selectHandler) Handle(resp eimap.Resp) error {
+	switch resp := resp.(type) {
+	case *eimap.StatusResp:
+		switch resp.Code {
+		case "HIGHESTMODSEQ":
+			if len(resp.Arguments) < 1 {
+				return nil
+			}
+			h.res.highestModSeq, _ = parseModSeq(resp.Arguments[0])
+			return nil
+		case "NOMODSEQ":
+			h.res.highestModSeq = 0
+			return nil
+		}
+	case *eimap.DataResp:
+		name, fields, ok := eimap.ParseNamedResp(resp)
+		if !ok {
+			break
+		}
+		switch name {
+		case "VANISHED":
+			if len(fields) < 1 {
+				return nil
+			}
+			// * VANISHED (EARLIER) uid-set
+			setStr, ok := fields[len(fields)-1].(string)
+			if !ok {
+				return nil
+			}
+			if err := h.res.vanished.Add(setStr); err != nil {
+				return err
+			}
+			return nil
+		case "FETCH":
+			if len(fields) < 2 {
+				return nil
+			}
+			seqNum, _ := eimap.ParseNumber(fields[0])
+			msgFields, _ := fields[1].([]interface{})
+			msg := &eimap.Message{SeqNum: seqNum}
+			if err := msg.Parse(msgFields); err != nil {
+				return err
+			}
+			h.res.changed = append(h.res.changed, msg)
+			return nil
+		}
+	}
+	return h.Select.Handle(resp)
+}
+
+// selectExt selects directory in read-only mode with additional parameters.
+func (w *conn) selectExt(dir string, params []interface{}, res *selectResult) error {
+	encoded, err := utf7.Encoding.NewEncoder().String(dir)
+	if err != nil {
+		return err
+	}
+	args := []interface{}{encoded}
+	if params != nil {
+		args = append(args, params)
+	}
+
+	res.mbox = &eimap.MailboxStatus{Name: dir, Items: make(map[eimap.StatusItem]interface{})}
+	handler := &selectHandler{responses.Select{Mailbox: res.mbox}, res}
+
+	// Make client library update our status with EXISTS and RECENT
+	// responses.
+	prevState := w.cl.State()
+	if prevState == eimap.SelectedState {
+		prevState = eimap.AuthenticatedState
+	}
+	w.cl.SetState(prevState, res.mbox)
+
+	if _, err := w.execute(&eimap.Command{Name: "EXAMINE", Arguments: args}, handler); err != nil {
+		w.cl.SetState(prevState, nil)
+		return w.dirError(dir, err)
+	}
+	res.mbox.ReadOnly = true
+	w.cl.SetState(eimap.SelectedState, res.mbox)
+	// Mapping is filled by SyncDir using UIDs it gets anyway.
+	return w.dirSelected(res.mbox, false)
+}
+
+// fetchFlags requests flags for messages with UIDs from set. If
+// changedSince is not zero - only messages with flags changed after that
+// MODSEQ are returned.
+func (w *conn) fetchFlags(uids *eimap.SeqSet, changedSince uint64) ([]FlagsUpdate, error) {
+	args := []interface{}{"FETCH", uids, []interface{}{eimap.Atom("UID"), eimap.Atom("FLAGS")}}
+	if changedSince != 0 {
+		args = append(args, []interface{}{eimap.Atom("CHANGEDSINCE"), eimap.Atom(strconv.FormatUint(changedSince, 10))})
+	}
+
+	out := make(chan *eimap.Message, 16)
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.execute(&eimap.Command{Name: "UID", Arguments: args}, &responses.Fetch{Messages: out})
+		close(out)
+		done <- err
+	}()
+
+	res := []FlagsUpdate{}
+	for msg := range out {
+		res = append(res, FlagsUpdate{msg.Uid, msg.Flags})
+	}
+	return res, <-done
+}
+
+// fetchEnvelopes requests envelopes and flags for messages from set.
+func (w *conn) fetchEnvelopes(uid bool, set *eimap.SeqSet) ([]MessageInfo, error) {
+	out := make(chan *eimap.Message, 16)
+	done := make(chan error, 1)
+	items := append([]eimap.FetchItem{eimap.FetchFlags}, envelopeItems...)
+	go func() {
+		if uid {
+			done <- w.cl.UidFetch(set, items, out)
+		} else {
+			done <- w.cl.Fetch(set, items, out)
+		}
+	}()
+
+	res := []MessageInfo{}
+	for msg := range out {
+		res = append(res, MessageToInfo(msg))
+	}
+	return res, <-done
+}
+
+func parseModSeq(f interface{}) (uint64, error) {
+	s, ok := f.(string)
+	if !ok {
+		return 0, errors.New("modseq: not a number")
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
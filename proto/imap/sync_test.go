@@ -0,0 +1,214 @@
+package imap
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	eimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/foxcpp/mailbox/proto/common"
+)
+
+func ignoreUpdates(c *Client) {
+	c.SetCallbacks(&UpdateCallbacks{
+		NewMessage:     func(dir string, seqnum uint32) {},
+		MessageUpdate:  func(dir string, newInfo *eimap.Message) {},
+		MessageRemoved: func(dir string, uid uint32) {},
+		MboxUpdate:     func(status *eimap.MailboxStatus) {},
+		DirStatus:      func(status *DirStatus) {},
+	})
+}
+
+// connectScript starts scripted server (see serveScript) and returns Client
+// logged in to it. Returned function stops both.
+func connectScript(t *testing.T, script map[string][]string) (*Client, func()) {
+	return connectScriptLog(t, script, nil)
+}
+
+// connectScriptLog is like connectScript but received commands are sent to
+// cmds (see serveScriptLog).
+func connectScriptLog(t *testing.T, script map[string][]string, cmds chan<- string) (*Client, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveScriptLog(l, script, cmds)
+
+	c, err := Connect(common.ServConfig{
+		Host:     "127.0.0.1",
+		Port:     uint16(l.Addr().(*net.TCPAddr).Port),
+		ConnType: common.Plaintext,
+	})
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	c.Logger = *log.New(ioutil.Discard, "", 0)
+	ignoreUpdates(c)
+
+	w, err := c.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.cl.Login("username", "password")
+	if err == nil {
+		w.enableExtensions()
+	}
+	c.release(w)
+	if err != nil {
+		c.Close()
+		l.Close()
+		t.Fatal(err)
+	}
+	return c, func() {
+		c.Close()
+		l.Close()
+	}
+}
+
+const newMsgFetch = `* 4 FETCH (UID 11 FLAGS () ENVELOPE ("Wed, 11 May 2016 14:31:59 +0000" "New" NIL NIL NIL NIL NIL NIL NIL "<new@example.org>"))`
+
+// checkChanges checks changes reported for known UIDs 4, 7, 10: flags of 4
+// are changed to \Seen, 7 is expunged and 11 is added.
+func checkChanges(t *testing.T, changes *DirChanges) {
+	t.Helper()
+	if changes.Reset || changes.UidValidity != 1 || changes.HighestModSeq != 20 {
+		t.Errorf("Wrong state: reset %v, uidvalidity %v, modseq %v", changes.Reset, changes.UidValidity, changes.HighestModSeq)
+	}
+	if len(changes.Changed) != 1 || changes.Changed[0].UID != 4 || strings.Join(changes.Changed[0].Flags, " ") != eimap.SeenFlag {
+		t.Errorf("Wrong flag changes: %+v", changes.Changed)
+	}
+	if len(changes.Vanished) != 1 || changes.Vanished[0] != 7 {
+		t.Errorf("Wrong vanished messages: %v", changes.Vanished)
+	}
+	if len(changes.New) != 1 || changes.New[0].UID != 11 || changes.New[0].Msg.Subject != "New" {
+		t.Errorf("Wrong new messages: %+v", changes.New)
+	}
+}
+
+var knownState = DirSyncState{UidValidity: 1, HighestModSeq: 10, KnownUids: []uint32{4, 7, 10}}
+
+func TestSyncDirCondstore(t *testing.T) {
+	c, stop := connectScript(t, map[string][]string{
+		"CAPABILITY":                {"* CAPABILITY IMAP4rev1 CONDSTORE"},
+		"EXAMINE INBOX (CONDSTORE)": {"* 3 EXISTS", "* OK [UIDVALIDITY 1] UIDs valid", "* OK [UIDNEXT 12] Predicted next UID", "* OK [HIGHESTMODSEQ 20] Highest"},
+		"UID FETCH 1:* (UID FLAGS) (CHANGEDSINCE 10)": {`* 1 FETCH (UID 4 FLAGS (\Seen) MODSEQ (15))`},
+		"UID SEARCH":    {"* SEARCH 4 10 11"},
+		"UID FETCH 11 ": {newMsgFetch},
+	})
+	defer stop()
+
+	changes, err := c.SyncDir("INBOX", knownState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChanges(t, changes)
+}
+
+func TestSyncDirQresync(t *testing.T) {
+	// Responses for CONDSTORE requests are missing, so changes are
+	// reported correctly only if they are taken from SELECT response.
+	c, stop := connectScript(t, map[string][]string{
+		"CAPABILITY": {"* CAPABILITY IMAP4rev1 CONDSTORE QRESYNC ENABLE"},
+		"ENABLE":     {"* ENABLED QRESYNC"},
+		"EXAMINE INBOX (QRESYNC (1 10))": {
+			"* 3 EXISTS", "* OK [UIDVALIDITY 1] UIDs valid", "* OK [UIDNEXT 12] Predicted next UID", "* OK [HIGHESTMODSEQ 20] Highest",
+			"* VANISHED (EARLIER) 7",
+			`* 1 FETCH (UID 4 FLAGS (\Seen) MODSEQ (15))`,
+		},
+		"UID FETCH 11:* ": {newMsgFetch},
+	})
+	defer stop()
+
+	changes, err := c.SyncDir("INBOX", knownState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChanges(t, changes)
+}
+
+func TestSyncDirFullResync(t *testing.T) {
+	be := memory.New()
+	u, err := be.Login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"INBOX", "INBOX", "Archive"} {
+		mbox, err := u.GetMailbox(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mbox.CreateMessage(nil, time.Now(), strings.NewReader(testMsg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Memory backend doesn't supports CONDSTORE.
+	c, stop := connectTestServer(t, be)
+	defer stop()
+	ignoreUpdates(c)
+
+	initial, err := c.SyncDir("INBOX", DirSyncState{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !initial.Reset || len(initial.New) != 3 {
+		t.Fatalf("Expected full list of 3 messages, got reset %v, %v messages", initial.Reset, len(initial.New))
+	}
+	known := DirSyncState{UidValidity: initial.UidValidity}
+	for _, msg := range initial.New {
+		known.KnownUids = append(known.KnownUids, msg.UID)
+	}
+	flagged, moved := known.KnownUids[0], known.KnownUids[1]
+
+	if err := c.Tag("INBOX", eimap.FlaggedFlag, flagged); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MoveTo("INBOX", "Archive", moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CopyTo("Archive", "INBOX", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := c.SyncDir("INBOX", known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes.Reset || changes.HighestModSeq != 0 {
+		t.Errorf("Wrong state: reset %v, modseq %v", changes.Reset, changes.HighestModSeq)
+	}
+	// Flags of all known messages are reported.
+	if len(changes.Changed) != 2 {
+		t.Errorf("Expected flags for 2 messages, got %+v", changes.Changed)
+	}
+	for _, upd := range changes.Changed {
+		if upd.UID == flagged && !strings.Contains(strings.Join(upd.Flags, " "), eimap.FlaggedFlag) {
+			t.Errorf("Added flag is not reported: %v", upd.Flags)
+		}
+	}
+	if len(changes.Vanished) != 1 || changes.Vanished[0] != moved {
+		t.Errorf("Wrong vanished messages: %v (expected %v)", changes.Vanished, moved)
+	}
+	if len(changes.New) != 1 || changes.New[0].UID <= known.KnownUids[2] {
+		t.Errorf("Wrong new messages: %+v", changes.New)
+	}
+
+	// Everything is downloaded again if UIDVALIDITY changed.
+	known.UidValidity++
+	changes, err = c.SyncDir("INBOX", known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changes.Reset || len(changes.New) != 3 {
+		t.Errorf("Expected full list of 3 messages, got reset %v, %v messages", changes.Reset, len(changes.New))
+	}
+}
@@ -0,0 +1,119 @@
+package imap
+
+import (
+	"context"
+	"errors"
+
+	eimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+)
+
+// ThreadNode is a message in thread tree returned by server.
+type ThreadNode struct {
+	// Zero for placeholder of missing message that is a parent of
+	// several threads.
+	UID      uint32
+	Children []*ThreadNode
+}
+
+// SupportsThreading checks whether server can build threads using
+// REFERENCES algorithm (RFC 5256).
+func (c *Client) SupportsThreading() (bool, error) {
+	w, err := c.acquire(context.Background())
+	if err != nil {
+		return false, err
+	}
+	defer c.release(w)
+	return w.cl.Support("THREAD=REFERENCES")
+}
+
+// Threads requests threads for all messages in directory built by
+// server using REFERENCES algorithm.
+func (c *Client) Threads(dir string) ([]*ThreadNode, error) {
+	return c.ThreadsContext(context.Background(), dir)
+}
+
+// ThreadsContext is like Threads but can be cancelled using ctx (see context.go).
+func (c *Client) ThreadsContext(ctx context.Context, dir string) (_ []*ThreadNode, err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
+
+	if _, err := w.ensureSelected(dir, true); err != nil {
+		return nil, err
+	}
+
+	handler := &threadHandler{}
+	_, err = w.execute(&eimap.Command{
+		Name:      "UID",
+		Arguments: []interface{}{eimap.Atom("THREAD"), eimap.Atom("REFERENCES"), eimap.Atom("UTF-8"), eimap.Atom("ALL")},
+	}, handler)
+	if err != nil {
+		return nil, err
+	}
+	return handler.threads, handler.err
+}
+
+type threadHandler struct {
+	threads []*ThreadNode
+	err     error
+}
+
+func (h *threadHandler) Handle(resp eimap.Resp) error {
+	name, fields, ok := eimap.ParseNamedResp(resp)
+	if !ok || name != "THREAD" {
+		return responses.ErrUnhandled
+	}
+	for _, f := range fields {
+		list, ok := f.([]interface{})
+		if !ok {
+			h.err = errors.New("thread: malformed response")
+			return nil
+		}
+		node, err := parseThreadList(list)
+		if err != nil {
+			h.err = err
+			return nil
+		}
+		h.threads = append(h.threads, node)
+	}
+	return nil
+}
+
+// parseThreadList converts thread list (RFC 5256, section 4) into tree.
+//
+// (3 6 (4 23)(44 7 96)) means that 6 is a reply to 3 and 4 and 44 are
+// replies to 6. Leading nested lists without messages before them mean that
+// parent message is missing.
+func parseThreadList(list []interface{}) (*ThreadNode, error) {
+	root := &ThreadNode{}
+	current := root
+	first := true
+	for _, f := range list {
+		if sublist, ok := f.([]interface{}); ok {
+			child, err := parseThreadList(sublist)
+			if err != nil {
+				return nil, err
+			}
+			current.Children = append(current.Children, child)
+			continue
+		}
+
+		uid, err := eimap.ParseNumber(f)
+		if err != nil {
+			return nil, errors.New("thread: malformed response")
+		}
+		if first {
+			root.UID = uid
+			first = false
+			continue
+		}
+		node := &ThreadNode{UID: uid}
+		current.Children = append(current.Children, node)
+		current = node
+	}
+	return root, nil
+}
@@ -0,0 +1,65 @@
+package imap
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"testing"
+
+	eimap "github.com/emersion/go-imap"
+)
+
+// dumpThreadNode formats thread tree like thread list in THREAD response
+// (without root parentheses), 0 is used for placeholders.
+func dumpThreadNode(node *ThreadNode) string {
+	res := strconv.Itoa(int(node.UID))
+	switch len(node.Children) {
+	case 0:
+	case 1:
+		res += " " + dumpThreadNode(node.Children[0])
+	default:
+		for _, child := range node.Children {
+			res += " (" + dumpThreadNode(child) + ")"
+		}
+	}
+	return res
+}
+
+func TestParseThreadList(t *testing.T) {
+	cases := []struct {
+		response string
+		expected []string
+	}{
+		{"* THREAD (2)(3 6 (4 23)(44 7 96))", []string{"2", "3 6 (4 23) (44 7 96)"}},
+		{"* THREAD (1 2 3)", []string{"1 2 3"}},
+		// Parent message is missing.
+		{"* THREAD ((3)(5))", []string{"0 (3) (5)"}},
+		{"* THREAD (1 ((2)(3 4)))", []string{"1 0 (2) (3 4)"}},
+		{"* THREAD ((1 (2 (3)(4)))(5))", []string{"0 (1 2 (3) (4)) (5)"}},
+		{"* THREAD", nil},
+	}
+	for _, c := range cases {
+		resp, err := eimap.ReadResp(eimap.NewReader(bufio.NewReader(strings.NewReader(c.response + "\r\n"))))
+		if err != nil {
+			t.Fatalf("%v: %v", c.response, err)
+		}
+		handler := &threadHandler{}
+		if err := handler.Handle(resp); err != nil || handler.err != nil {
+			t.Fatalf("%v: %v, %v", c.response, err, handler.err)
+		}
+
+		res := make([]string, len(handler.threads))
+		for i, node := range handler.threads {
+			res[i] = dumpThreadNode(node)
+		}
+		if strings.Join(res, "|") != strings.Join(c.expected, "|") {
+			t.Errorf("%v: wrong threads: %q (expected %q)", c.response, res, c.expected)
+		}
+	}
+}
+
+func TestParseThreadListMalformed(t *testing.T) {
+	if _, err := parseThreadList([]interface{}{"1", "abc"}); err == nil {
+		t.Error("Error is not returned for non-number in thread list")
+	}
+}
@@ -1,56 +1,335 @@
 package imap
 
 import (
+	"context"
+	"errors"
+	"sort"
+
 	eimap "github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
 )
 
+/*
+	Unsolicited updates processing.
+
+	go-imap reports updates without information about directory they are
+	related to. Each connection has a goroutine (see forwardUpdates) that
+	receives them synchronously with connection reader, tags them with
+	directory selected at that moment and passes them to dispatcher
+	goroutine (updatesWatch) that is shared by all connections and calls
+	callbacks.
+
+	Sequence numbers are tracked for each directory on each connection (see
+	seqMap) so expunged messages are reported using UIDs. Mapping is filled
+	when directory is selected and updated when messages are added and
+	removed. It is kept between selections of directory only if state of
+	directory reported by server is the same as expected, otherwise it's
+	filled again.
+
+	With QRESYNC enabled server reports removed messages using VANISHED
+	responses (RFC 7162) instead of EXPUNGE. go-imap drops them, so
+	handlers of commands sent using conn.execute are wrapped to catch them
+	(see vanishedHandler). Caught responses are passed to the same
+	goroutine as other updates so order is preserved. If VANISHED response
+	is lost anyway (it's sent during command issued by go-imap itself),
+	mapping is discarded once server reports less messages than expected.
+
+	Sequence numbers mapping is protected by conn.updatesLock, callbacks
+	are protected by Client.updatesLock.
+*/
+
+// seqMap is a mapping of sequence numbers to UIDs for directory.
+type seqMap struct {
+	// Status of selection mapping is valid for, it's a new object for each
+	// SELECT.
+	session *eimap.MailboxStatus
+
+	uidValidity uint32
+	// Expected value of UIDNEXT, zero if UIDs of some messages are not
+	// known.
+	uidNext uint32
+	// New messages were reported after SELECT, UIDNEXT reported by it is
+	// outdated.
+	added bool
+	// UIDs in order of sequence numbers, zero for unknown.
+	uids []uint32
+}
+
+// learn records UID of message with sequence number seq.
+func (m *seqMap) learn(seq, uid uint32) {
+	if seq == 0 || seq > uint32(len(m.uids)) {
+		return
+	}
+	m.uids[seq-1] = uid
+
+	if m.uidNext != 0 || seq != uint32(len(m.uids)) {
+		return
+	}
+	for _, uid := range m.uids {
+		if uid == 0 {
+			return
+		}
+	}
+	// UIDs of all messages are known now. Server may report greater value
+	// if some messages were added and removed meanwhile, mapping will be
+	// filled again on next selection in this case.
+	m.uidNext = uid + 1
+}
+
+// update is an unsolicited update together with directory it is related to.
+type update struct {
+	dir string
+	upd client.Update
+
+	// For ExpungeUpdate - UID of removed message, zero if unknown.
+	uid uint32
+	// For VANISHED response (upd is nil) - UIDs of removed messages.
+	vanished []uint32
+	// For MailboxUpdate - range of sequence numbers of new messages.
+	firstNew, lastNew uint32
+}
+
+// SetCallbacks sets callbacks for unsolicited updates. It's safe to call it
+// while connection is used.
+func (c *Client) SetCallbacks(callbacks *UpdateCallbacks) {
+	c.updatesLock.Lock()
+	defer c.updatesLock.Unlock()
+	c.callbacks = callbacks
+}
+
+// forwardUpdates starts passing updates from connection to dispatcher.
+func (w *conn) forwardUpdates() {
+	cl := w.cl
+	// Unbuffered, so update is tagged right after it's received, before
+	// next command is sent and selected directory can change.
+	raw := make(chan client.Update)
+	vanished := make(chan *eimap.SeqSet)
+	cl.Updates = raw
+	w.vanished = vanished
+	go func() {
+		for {
+			select {
+			case upd := <-raw:
+				w.c.updates <- w.tagUpdate(cl.Mailbox(), upd)
+			case uids := <-vanished:
+				w.c.updates <- w.tagVanished(cl.Mailbox(), uids)
+			case <-cl.LoggedOut():
+				return
+			}
+		}
+	}()
+}
+
+// tagUpdate applies update to sequence numbers mapping of directory
+// selected when update was received (mbox).
+func (w *conn) tagUpdate(mbox *eimap.MailboxStatus, upd client.Update) update {
+	// Status object is modified by go-imap when further responses are
+	// received, dispatcher gets a copy.
+	var snapshot *eimap.MailboxStatus
+	if mboxUpd, ok := upd.(*client.MailboxUpdate); ok {
+		snapshot = mailboxSnapshot(mboxUpd.Mailbox)
+		upd = &client.MailboxUpdate{Mailbox: snapshot}
+	}
+	res := update{upd: upd}
+	if mbox == nil {
+		return res
+	}
+	res.dir = mbox.Name
+
+	w.updatesLock.Lock()
+	defer w.updatesLock.Unlock()
+
+	m := w.seqMaps[mbox.Name]
+	if m == nil || m.session != mbox {
+		// Received during SELECT (before mapping is created) or from
+		// previous selection.
+		return res
+	}
+
+	switch upd := upd.(type) {
+	case *client.MailboxUpdate:
+		snapshot.UidValidity = m.uidValidity
+		// Note: go-imap doesn't decrements amount of messages on EXPUNGE,
+		// so RECENT without EXISTS after EXPUNGE is seen as new message.
+		// Servers send RECENT only together with EXISTS in practice.
+		known := uint32(len(m.uids))
+		count := upd.Mailbox.Messages
+		if count > known {
+			res.firstNew, res.lastNew = known+1, count
+			m.uids = append(m.uids, make([]uint32, count-known)...)
+			m.uidNext = 0
+			m.added = true
+		} else if count < known {
+			// Removal of some messages was not reported to us.
+			delete(w.seqMaps, mbox.Name)
+		}
+	case *client.ExpungeUpdate:
+		seq := upd.SeqNum
+		if seq == 0 || seq > uint32(len(m.uids)) {
+			delete(w.seqMaps, mbox.Name)
+			return res
+		}
+		res.uid = m.uids[seq-1]
+		m.uids = append(m.uids[:seq-1], m.uids[seq:]...)
+	case *client.MessageUpdate:
+		msg := upd.Message
+		if msg.SeqNum == 0 || msg.SeqNum > uint32(len(m.uids)) {
+			return res
+		}
+		if msg.Uid == 0 {
+			msg.Uid = m.uids[msg.SeqNum-1]
+		} else {
+			m.learn(msg.SeqNum, msg.Uid)
+		}
+	}
+	return res
+}
+
+// mailboxSnapshot copies fields of mailbox status that are not changed
+// after update is sent by go-imap. Other fields (e.g. UIDVALIDITY) may
+// still be filled by SELECT that is in progress, UidValidity is taken from
+// sequence numbers mapping instead and left zero if it's not known.
+func mailboxSnapshot(mbox *eimap.MailboxStatus) *eimap.MailboxStatus {
+	return &eimap.MailboxStatus{
+		Name:     mbox.Name,
+		Messages: mbox.Messages,
+		Recent:   mbox.Recent,
+		Unseen:   mbox.Unseen,
+	}
+}
+
+// tagVanished removes messages reported by VANISHED response from sequence
+// numbers mapping of directory selected when response was received (mbox).
+func (w *conn) tagVanished(mbox *eimap.MailboxStatus, uids *eimap.SeqSet) update {
+	res := update{}
+	for _, seq := range uids.Set {
+		for uid := seq.Start; uid != 0 && uid <= seq.Stop; uid++ {
+			res.vanished = append(res.vanished, uid)
+		}
+	}
+	if mbox == nil {
+		return res
+	}
+	res.dir = mbox.Name
+
+	w.updatesLock.Lock()
+	defer w.updatesLock.Unlock()
+
+	m := w.seqMaps[mbox.Name]
+	if m == nil || m.session != mbox {
+		return res
+	}
+
+	kept := make([]uint32, 0, len(m.uids))
+	unknown := false
+	for _, uid := range m.uids {
+		if uid == 0 {
+			unknown = true
+		}
+		if !uids.Contains(uid) {
+			kept = append(kept, uid)
+		}
+	}
+	if unknown && len(m.uids)-len(kept) != len(res.vanished) {
+		// Some of removed messages have unknown UIDs, we can't tell which.
+		delete(w.seqMaps, mbox.Name)
+		return res
+	}
+	m.uids = kept
+	return res
+}
+
+// vanishedHandler passes VANISHED responses without EARLIER tag to
+// forwardUpdates goroutine, other responses are passed to next handler.
+type vanishedHandler struct {
+	next responses.Handler
+	out  chan<- *eimap.SeqSet
+}
+
+func (h *vanishedHandler) Handle(resp eimap.Resp) error {
+	if uids := parseVanished(resp); uids != nil {
+		// Blocks until previous updates are tagged, like go-imap does.
+		h.out <- uids
+		return nil
+	}
+	if h.next == nil {
+		return responses.ErrUnhandled
+	}
+	return h.next.Handle(resp)
+}
+
+// parseVanished returns UIDs from VANISHED response or nil if resp is not
+// VANISHED response or it has EARLIER tag (it's a part of response to
+// command then, see selectHandler).
+func parseVanished(resp eimap.Resp) *eimap.SeqSet {
+	name, fields, ok := eimap.ParseNamedResp(resp)
+	if !ok || name != "VANISHED" || len(fields) != 1 {
+		return nil
+	}
+	setStr, ok := fields[0].(string)
+	if !ok {
+		return nil
+	}
+	uids, err := eimap.ParseSeqSet(setStr)
+	if err != nil {
+		return nil
+	}
+	return uids
+}
+
+// expunge is like client.Client.Expunge but sends command using
+// conn.execute so VANISHED responses are not lost.
+func (w *conn) expunge() error {
+	_, err := w.execute(&commands.Expunge{}, nil)
+	return err
+}
+
+func (c *Client) getCallbacks() *UpdateCallbacks {
+	c.updatesLock.Lock()
+	defer c.updatesLock.Unlock()
+	return c.callbacks
+}
+
 func (c *Client) updatesWatch() {
-	lastMbox := ""
 	for {
 		select {
-		case update := <-c.updates:
-			switch update.(type) {
-			case *client.MailboxUpdate:
-				mboxUpd := update.(*client.MailboxUpdate)
-				if c.Callbacks != nil {
-					c.Callbacks.MboxUpdate(mboxUpd.Mailbox)
-				}
-				if _, prs := c.KnownMailboxSizes[mboxUpd.Mailbox.Name]; !prs {
-					// We didn't seen this mailbox before, just record size.
-					c.KnownMailboxSizes[mboxUpd.Mailbox.Name] = mboxUpd.Mailbox.Messages
-					continue
-				}
-				knownSize := c.KnownMailboxSizes[mboxUpd.Mailbox.Name]
-				if knownSize < mboxUpd.Mailbox.Messages {
-					// There are new messages we didn't seen before!
-					if c.Callbacks != nil {
-						for i := knownSize + 1; i <= mboxUpd.Mailbox.Messages; i++ {
-							c.Callbacks.NewMessage(mboxUpd.Mailbox.Name, i)
-						}
+		case upd := <-c.updates:
+			callbacks := c.getCallbacks()
+			if callbacks == nil {
+				continue
+			}
+
+			switch u := upd.upd.(type) {
+			case nil:
+				if upd.dir != "" {
+					for _, uid := range upd.vanished {
+						callbacks.MessageRemoved(upd.dir, uid)
 					}
 				}
-				c.KnownMailboxSizes[mboxUpd.Mailbox.Name] = mboxUpd.Mailbox.Messages
-			case *client.ExpungeUpdate:
-				// XXX: This still can explode when current mailbox != mailbox when update
-				// was received.
-				if c.cl.Mailbox() != nil {
-					lastMbox = c.cl.Mailbox().Name
+			case *client.MailboxUpdate:
+				callbacks.MboxUpdate(u.Mailbox)
+				for seq := upd.firstNew; seq != 0 && seq <= upd.lastNew; seq++ {
+					callbacks.NewMessage(upd.dir, seq)
 				}
-				c.KnownMailboxSizes[lastMbox] -= 1
-				if c.Callbacks != nil {
-					c.Callbacks.MessageRemoved(lastMbox, update.(*client.ExpungeUpdate).SeqNum)
+			case *client.ExpungeUpdate:
+				if upd.dir != "" {
+					callbacks.MessageRemoved(upd.dir, upd.uid)
 				}
 			case *client.MessageUpdate:
-				// XXX: This still can explode when current mailbox != mailbox when update
-				// was received.
-				if c.cl.Mailbox() != nil {
-					lastMbox = c.cl.Mailbox().Name
-				}
-				if c.Callbacks != nil {
-					c.Callbacks.MessageUpdate(lastMbox, update.(*client.MessageUpdate).Message)
+				if upd.dir != "" {
+					callbacks.MessageUpdate(upd.dir, u.Message)
 				}
 			}
+		case status := <-c.statusUpdates:
+			if callbacks := c.getCallbacks(); callbacks != nil {
+				callbacks.DirStatus(status)
+			}
+		case <-c.statusLost:
+			if callbacks := c.getCallbacks(); callbacks != nil && callbacks.DirStatusLost != nil {
+				callbacks.DirStatusLost()
+			}
 		case <-c.updatesDispatcherStop:
 			c.updatesDispatcherStop <- true
 			return
@@ -58,25 +337,151 @@ func (c *Client) updatesWatch() {
 	}
 }
 
+// selectDir selects directory and prepares sequence numbers mapping for it.
+func (w *conn) selectDir(dir string, readonly bool) (*eimap.MailboxStatus, error) {
+	mbox, err := w.cl.Select(dir, readonly)
+	if err != nil {
+		return nil, w.dirError(dir, err)
+	}
+	if err := w.dirSelected(mbox, true); err != nil {
+		return nil, err
+	}
+	return mbox, nil
+}
+
+// dirSelected checks whether sequence numbers mapping for directory
+// selected just now is still valid and resets it if it's not. If fill is
+// true - UIDs of all messages are requested from server in this case.
+func (w *conn) dirSelected(mbox *eimap.MailboxStatus, fill bool) error {
+	w.updatesLock.Lock()
+	m := w.seqMaps[mbox.Name]
+	if m != nil && m.uidValidity == mbox.UidValidity && m.uidNext != 0 &&
+		m.uidNext == mbox.UidNext && uint32(len(m.uids)) == mbox.Messages {
+
+		m.session = mbox
+		w.updatesLock.Unlock()
+		return nil
+	}
+	m = &seqMap{
+		session:     mbox,
+		uidValidity: mbox.UidValidity,
+		uids:        make([]uint32, mbox.Messages),
+	}
+	if mbox.Messages == 0 {
+		m.uidNext = mbox.UidNext
+	}
+	w.seqMaps[mbox.Name] = m
+	w.updatesLock.Unlock()
+
+	if !fill || mbox.Messages == 0 {
+		return nil
+	}
+	uids, err := w.cl.UidSearch(eimap.NewSearchCriteria())
+	if err != nil {
+		return err
+	}
+	w.learnUids(mbox, uids)
+	return nil
+}
+
+// learnUids records UIDs of all messages in directory selected now (mbox).
+// Mapping is not changed if amount of UIDs doesn't match amount of
+// messages.
+func (w *conn) learnUids(mbox *eimap.MailboxStatus, uids []uint32) {
+	w.updatesLock.Lock()
+	defer w.updatesLock.Unlock()
+
+	m := w.seqMaps[mbox.Name]
+	if m == nil || m.session != mbox || len(uids) != len(m.uids) {
+		return
+	}
+	sorted := append([]uint32(nil), uids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	copy(m.uids, sorted)
+	if !m.added {
+		m.uidNext = mbox.UidNext
+	}
+}
+
+// knownUid returns UID of message with sequence number seq in directory
+// selected now (mbox) or zero if it's unknown.
+func (w *conn) knownUid(mbox *eimap.MailboxStatus, seq uint32) uint32 {
+	w.updatesLock.Lock()
+	defer w.updatesLock.Unlock()
+
+	m := w.seqMaps[mbox.Name]
+	if m == nil || m.session != mbox || seq == 0 || seq > uint32(len(m.uids)) {
+		return 0
+	}
+	return m.uids[seq-1]
+}
+
+// learnUid records UID of message with sequence number seq in directory
+// selected now (mbox).
+func (w *conn) learnUid(mbox *eimap.MailboxStatus, seq, uid uint32) {
+	w.updatesLock.Lock()
+	defer w.updatesLock.Unlock()
+
+	m := w.seqMaps[mbox.Name]
+	if m == nil || m.session != mbox {
+		return
+	}
+	m.learn(seq, uid)
+}
+
+// renameSeqMap moves sequence numbers mapping to new directory name.
+func (w *conn) renameSeqMap(from, to string) {
+	w.updatesLock.Lock()
+	defer w.updatesLock.Unlock()
+	if m := w.seqMaps[from]; m != nil {
+		w.seqMaps[to] = m
+	}
+	delete(w.seqMaps, from)
+}
+
+// dropSeqMap discards sequence numbers mapping for directory.
+func (w *conn) dropSeqMap(dir string) {
+	w.updatesLock.Lock()
+	defer w.updatesLock.Unlock()
+	delete(w.seqMaps, dir)
+}
+
 func (c *Client) ResolveUid(dir string, seqnum uint32) (uint32, error) {
-	c.stopIdle()
-	defer c.resumeIdle()
-	c.IOLock.Lock()
-	defer c.IOLock.Unlock()
+	return c.ResolveUidContext(context.Background(), dir, seqnum)
+}
 
-	_, err := c.cl.Select(dir, true)
+// ResolveUidContext is like ResolveUid but can be cancelled using ctx (see context.go).
+func (c *Client) ResolveUidContext(ctx context.Context, dir string, seqnum uint32) (_ uint32, err error) {
+	w, err := c.acquire(ctx)
 	if err != nil {
 		return 0, err
 	}
-	defer c.cl.Close()
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
+
+	mbox, err := w.selectDir(dir, true)
+	if err != nil {
+		return 0, err
+	}
+	defer w.cl.Close()
+
+	if uid := w.knownUid(mbox, seqnum); uid != 0 {
+		return uid, nil
+	}
 
 	seqset := eimap.SeqSet{}
 	seqset.AddNum(seqnum)
 
 	out := make(chan *eimap.Message, 1)
-	err = c.cl.Fetch(&seqset, []eimap.FetchItem{eimap.FetchUid}, out)
+	err = w.cl.Fetch(&seqset, []eimap.FetchItem{eimap.FetchUid}, out)
 	if err != nil {
 		return 0, err
 	}
-	return (<-out).Uid, nil
+	msg := <-out
+	if msg == nil {
+		// Message is already expunged.
+		return 0, errors.New("resolveuid: no such message")
+	}
+	w.learnUid(mbox, seqnum, msg.Uid)
+	return msg.Uid, nil
 }
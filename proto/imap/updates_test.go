@@ -0,0 +1,260 @@
+package imap
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	eimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/foxcpp/mailbox/proto/common"
+)
+
+const testMsg = `From: contact@example.org
+To: contact@example.org
+Subject: Test
+Date: Wed, 11 May 2016 14:31:59 +0000
+Content-Type: text/plain
+
+Hello!`
+
+// connectTestServer starts server with backend be and returns Client
+// logged in as "username". Returned function stops both.
+func connectTestServer(t *testing.T, be backend.Backend) (*Client, func()) {
+	srv := server.New(be)
+	srv.AllowInsecureAuth = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+
+	c, err := Connect(common.ServConfig{
+		Host:     "127.0.0.1",
+		Port:     uint16(l.Addr().(*net.TCPAddr).Port),
+		ConnType: common.Plaintext,
+	})
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+
+	// LOGIN is used instead of Auth so idler is not started, memory
+	// backend is not safe for concurrent use by several connections.
+	// Operations in tests are sequential so this connection is reused.
+	w, err := c.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.cl.Login("username", "password")
+	c.release(w)
+	if err != nil {
+		c.Close()
+		srv.Close()
+		t.Fatal(err)
+	}
+	return c, func() {
+		c.Close()
+		srv.Close()
+	}
+}
+
+type removedMsg struct {
+	dir string
+	uid uint32
+}
+
+func TestExpungeReportsUid(t *testing.T) {
+	be := memory.New()
+	u, err := be.Login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := mbox.CreateMessage(nil, time.Now(), strings.NewReader(testMsg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+
+	c, stop := connectTestServer(t, be)
+	defer stop()
+
+	removed := make(chan removedMsg, 1)
+	c.SetCallbacks(&UpdateCallbacks{
+		NewMessage:    func(dir string, seqnum uint32) {},
+		MessageUpdate: func(dir string, newInfo *eimap.Message) {},
+		MessageRemoved: func(dir string, uid uint32) {
+			removed <- removedMsg{dir, uid}
+		},
+		MboxUpdate: func(status *eimap.MailboxStatus) {},
+		DirStatus:  func(status *DirStatus) {},
+	})
+
+	changes, err := c.SyncDir("INBOX", DirSyncState{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.New) != 3 {
+		t.Fatalf("Expected 3 messages, got %v", len(changes.New))
+	}
+	// Message in the middle is removed so its UID can't be confused with
+	// sequence number.
+	uid := changes.New[1].UID
+
+	if err := c.Delete("INBOX", uid); err != nil {
+		t.Fatal(err)
+	}
+	// Expunges messages marked for deletion.
+	if err := c.CopyTo("INBOX", "Archive", changes.New[0].UID); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-removed:
+		if msg.dir != "INBOX" || msg.uid != uid {
+			t.Errorf("Wrong message reported as removed: %v, %v (expected INBOX, %v)", msg.dir, msg.uid, uid)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message removal is not reported")
+	}
+}
+
+// serveScript answers commands sent to connections accepted by l with
+// untagged responses from script, all commands complete successfully. Used
+// for responses go-imap server can't send.
+//
+// Script is keyed by command name or beginning of command line (without
+// tag) if different responses are needed for commands with the same name,
+// longest matching key is used.
+func serveScript(l net.Listener, script map[string][]string) {
+	serveScriptLog(l, script, nil)
+}
+
+// serveScriptLog is like serveScript but also sends received command lines
+// (without tag) to cmds if it's not nil.
+func serveScriptLog(l net.Listener, script map[string][]string, cmds chan<- string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			fmt.Fprint(conn, "* OK IMAP4rev1 Service Ready\r\n")
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				fields := strings.Fields(scanner.Text())
+				if len(fields) < 2 {
+					continue
+				}
+				tag, cmd := fields[0], strings.ToUpper(fields[1])
+				if cmds != nil {
+					cmds <- strings.TrimPrefix(scanner.Text(), tag+" ")
+				}
+				line := strings.ToUpper(strings.TrimPrefix(scanner.Text(), tag+" "))
+				key := cmd
+				for k := range script {
+					if len(k) > len(key) && strings.HasPrefix(line, strings.ToUpper(k)) {
+						key = k
+					}
+				}
+				for _, resp := range script[key] {
+					fmt.Fprint(conn, resp+"\r\n")
+				}
+				if cmd == "LOGOUT" {
+					fmt.Fprint(conn, "* BYE\r\n")
+				}
+				fmt.Fprintf(conn, "%s OK %s completed\r\n", tag, cmd)
+			}
+		}()
+	}
+}
+
+func TestVanishedReportsUids(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveScript(l, map[string][]string{
+		"CAPABILITY": {"* CAPABILITY IMAP4rev1"},
+		"EXAMINE":    {"* 3 EXISTS", "* OK [UIDVALIDITY 1] UIDs valid", "* OK [UIDNEXT 11] Predicted next UID"},
+		"UID":        {"* SEARCH 4 7 10"},
+		// Message in the middle is removed and new one is added, amount of
+		// messages is the same.
+		"NOOP": {"* VANISHED 7", "* 3 EXISTS"},
+	})
+
+	c, err := Connect(common.ServConfig{
+		Host:     "127.0.0.1",
+		Port:     uint16(l.Addr().(*net.TCPAddr).Port),
+		ConnType: common.Plaintext,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	removed := make(chan removedMsg, 1)
+	added := make(chan uint32, 1)
+	c.SetCallbacks(&UpdateCallbacks{
+		NewMessage: func(dir string, seqnum uint32) {
+			added <- seqnum
+		},
+		MessageUpdate: func(dir string, newInfo *eimap.Message) {},
+		MessageRemoved: func(dir string, uid uint32) {
+			removed <- removedMsg{dir, uid}
+		},
+		MboxUpdate: func(status *eimap.MailboxStatus) {},
+		DirStatus:  func(status *DirStatus) {},
+	})
+
+	w, err := c.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.release(w)
+	if err := w.cl.Login("username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := w.selectDir("INBOX", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.noop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-removed:
+		if msg.dir != "INBOX" || msg.uid != 7 {
+			t.Errorf("Wrong message reported as removed: %v, %v (expected INBOX, 7)", msg.dir, msg.uid)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message removal is not reported")
+	}
+	select {
+	case seq := <-added:
+		if seq != 3 {
+			t.Errorf("Wrong sequence number of new message: %v (expected 3)", seq)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("New message is not reported")
+	}
+	if uid := w.knownUid(mbox, 2); uid != 10 {
+		t.Errorf("Wrong UID of second message: %v (expected 10)", uid)
+	}
+}
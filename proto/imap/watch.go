@@ -0,0 +1,309 @@
+package imap
+
+import (
+	"context"
+	"log"
+	"time"
+
+	eimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap-idle"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+)
+
+/*
+	Monitoring of directories other than INBOX.
+
+	Only selected directory (INBOX, see idler.go) is monitored using IDLE.
+	If server supports NOTIFY extension (RFC 5465), it can report new and
+	removed messages in other directories too, WatchDirs enables this for
+	connection used for IDLE and notifications are passed to DirStatus
+	callback. Otherwise directories should be polled using DirsStatus.
+*/
+
+// Items requested by DirsStatus.
+var watchStatusItems = []eimap.StatusItem{
+	eimap.StatusMessages, eimap.StatusUidNext, eimap.StatusUidValidity, eimap.StatusUnseen,
+}
+
+// WatchDirs asks server to report changes in directories using NOTIFY
+// extension. Reported changes are passed to DirStatus callback. false is
+// returned if server doesn't supports NOTIFY, DirsStatus should be used to
+// poll directories in this case.
+//
+// List of directories is remembered and NOTIFY is enabled again after
+// reconnection. Empty list disables notifications. NOTIFY command is sent
+// in background, errors are only logged.
+func (c *Client) WatchDirs(dirs []string) (bool, error) {
+	return c.WatchDirsContext(context.Background(), dirs)
+}
+
+// WatchDirsContext is like WatchDirs but can be cancelled using ctx (see context.go).
+func (c *Client) WatchDirsContext(ctx context.Context, dirs []string) (_ bool, err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
+
+	supported, err := w.cl.Support("NOTIFY")
+	if err != nil {
+		return false, err
+	}
+
+	c.lock.Lock()
+	c.watchedDirs = dirs
+	c.watchGen++
+	c.lock.Unlock()
+	c.kickIdler()
+
+	return supported && len(dirs) != 0, nil
+}
+
+// updateNotify sends NOTIFY command for watched directories if server
+// supports it and list was changed since last call. Must be called after
+// authentication.
+func (w *conn) updateNotify() error {
+	w.c.lock.Lock()
+	dirs, gen := w.c.watchedDirs, w.c.watchGen
+	w.c.lock.Unlock()
+	if gen == w.watchGen {
+		return nil
+	}
+	w.watchGen = gen
+
+	wasEnabled := w.notifyEnabled
+	w.notifyEnabled = false
+	if ok, err := w.cl.Support("NOTIFY"); err != nil || !ok {
+		return err
+	}
+
+	var args []interface{}
+	if len(dirs) == 0 {
+		if !wasEnabled {
+			return nil
+		}
+		args = []interface{}{eimap.Atom("NONE")}
+	} else {
+		mboxes := make([]interface{}, 0, len(dirs))
+		for _, dir := range dirs {
+			encoded, err := utf7.Encoding.NewEncoder().String(dir)
+			if err != nil {
+				return err
+			}
+			mboxes = append(mboxes, encoded)
+		}
+		args = []interface{}{
+			eimap.Atom("SET"),
+			// Without this server will stop sending usual updates for
+			// selected directory.
+			[]interface{}{eimap.Atom("selected"), []interface{}{
+				eimap.Atom("MessageNew"), eimap.Atom("MessageExpunge"), eimap.Atom("FlagChange"),
+			}},
+			[]interface{}{eimap.Atom("mailboxes"), mboxes, []interface{}{
+				eimap.Atom("MessageNew"), eimap.Atom("MessageExpunge"),
+			}},
+		}
+	}
+
+	if _, err := w.execute(&eimap.Command{Name: "NOTIFY", Arguments: args}, nil); err != nil {
+		return err
+	}
+	w.notifyEnabled = len(dirs) != 0
+	return nil
+}
+
+// DirsStatus requests brief information (amount of messages, UIDNEXT,
+// UIDVALIDITY and amount of unread messages) about each directory from list.
+// Returned map is keyed by directory name. Directories that don't exist are
+// not included in it.
+//
+// Single LIST command is used if server supports LIST-STATUS extension (RFC
+// 5819), otherwise STATUS command is sent for each directory.
+func (c *Client) DirsStatus(dirs []string) (map[string]*DirStatus, error) {
+	return c.DirsStatusContext(context.Background(), dirs)
+}
+
+// DirsStatusContext is like DirsStatus but can be cancelled using ctx (see context.go).
+func (c *Client) DirsStatusContext(ctx context.Context, dirs []string) (_ map[string]*DirStatus, err error) {
+	w, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(w)
+	defer w.watchContext(ctx)(&err)
+
+	if ok, err := w.cl.Support("LIST-STATUS"); err != nil {
+		return nil, err
+	} else if ok {
+		return w.listStatus(dirs)
+	}
+
+	res := make(map[string]*DirStatus, len(dirs))
+	for _, dir := range dirs {
+		status, err := w.cl.Status(dir, watchStatusItems)
+		if err != nil {
+			if !w.connected() {
+				return nil, err
+			}
+			// Probably directory doesn't exist.
+			c.Logger.Printf("STATUS for %v failed: %v\n", dir, err)
+			continue
+		}
+		res[dir] = status
+	}
+	return res, nil
+}
+
+// listStatus implements DirsStatus using LIST-STATUS extension.
+func (w *conn) listStatus(dirs []string) (map[string]*DirStatus, error) {
+	items := make([]interface{}, len(watchStatusItems))
+	for i, item := range watchStatusItems {
+		items[i] = eimap.Atom(item)
+	}
+
+	handler := &statusHandler{statuses: make(map[string]*DirStatus)}
+	_, err := w.execute(&eimap.Command{
+		Name: "LIST",
+		Arguments: []interface{}{"", "*", eimap.Atom("RETURN"), []interface{}{
+			eimap.Atom("STATUS"), items,
+		}},
+	}, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]*DirStatus, len(dirs))
+	for _, dir := range dirs {
+		if status, prs := handler.statuses[dir]; prs {
+			res[dir] = status
+		}
+	}
+	return res, nil
+}
+
+// statusHandler collects STATUS responses, other responses (LIST) are
+// ignored.
+type statusHandler struct {
+	statuses map[string]*DirStatus
+}
+
+func (h *statusHandler) Handle(resp eimap.Resp) error {
+	name, _, ok := eimap.ParseNamedResp(resp)
+	if !ok {
+		return responses.ErrUnhandled
+	}
+	switch name {
+	case "STATUS":
+		status := &responses.Status{}
+		if err := status.Handle(resp); err != nil {
+			return err
+		}
+		h.statuses[status.Mailbox.Name] = status.Mailbox
+		return nil
+	case "LIST":
+		return nil
+	}
+	return responses.ErrUnhandled
+}
+
+// idleNotify is like idle.Client.Idle but also passes STATUS responses sent
+// by server because of NOTIFY to updates dispatcher. go-imap drops them if
+// they are not a result of STATUS command.
+func (w *conn) idleNotify(stop <-chan struct{}) error {
+	// Restart IDLE periodically to not get logged out by server, like
+	// idle.Client does.
+	t := time.NewTicker(25 * time.Minute)
+	defer t.Stop()
+
+	for {
+		stopOrRestart := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			done <- w.idleOnce(stopOrRestart)
+		}()
+
+		select {
+		case <-t.C:
+			close(stopOrRestart)
+			if err := <-done; err != nil {
+				return err
+			}
+		case <-stop:
+			close(stopOrRestart)
+			return <-done
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (w *conn) idleOnce(stop <-chan struct{}) error {
+	// DONE is written by idle.Response in separate goroutine, it should
+	// not race with flush of IDLE command (see flushNotifier).
+	flushedStop := make(chan struct{})
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-stop:
+			w.flushes.wait()
+			close(flushedStop)
+		case <-finished:
+		}
+	}()
+
+	done := make(chan error, 1)
+	handler := &notifyHandler{
+		idle: &idle.Response{
+			Stop:   flushedStop,
+			Done:   done,
+			Writer: w.cl.Writer(),
+		},
+		statuses: w.c.statusUpdates,
+		lost:     w.c.statusLost,
+		logger:   &w.c.Logger,
+	}
+
+	if _, err := w.execute(&idle.Command{}, handler); err != nil {
+		return err
+	}
+	return <-done
+}
+
+type notifyHandler struct {
+	idle     *idle.Response
+	statuses chan<- *DirStatus
+	// Flag set when notification is dropped, see DirStatusLost callback.
+	lost   chan<- struct{}
+	logger *log.Logger
+}
+
+func (h *notifyHandler) Handle(resp eimap.Resp) error {
+	name, _, ok := eimap.ParseNamedResp(resp)
+	if !ok || name != "STATUS" {
+		return h.idle.Handle(resp)
+	}
+
+	status := &responses.Status{}
+	if err := status.Handle(resp); err != nil {
+		h.logger.Println("Malformed STATUS notification:", err)
+		return nil
+	}
+	// Handler is called by connection reader goroutine, it should never
+	// block.
+	select {
+	case h.statuses <- status.Mailbox:
+	default:
+		h.logger.Println("Updates dispatcher is busy, dropping STATUS notification for", status.Mailbox.Name)
+		select {
+		case h.lost <- struct{}{}:
+		default:
+			// Already set.
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package imap
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	eimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+func TestDirsStatus(t *testing.T) {
+	be := memory.New()
+	u, err := be.Login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox("Archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := mbox.CreateMessage(nil, time.Now(), strings.NewReader(testMsg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, stop := connectTestServer(t, be)
+	defer stop()
+	c.Logger = *log.New(ioutil.Discard, "", 0)
+
+	statuses, err := c.DirsStatus([]string{"Archive", "Missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, prs := statuses["Missing"]; prs {
+		t.Error("Status returned for missing directory")
+	}
+	status, prs := statuses["Archive"]
+	if !prs {
+		t.Fatal("Status is not returned for Archive")
+	}
+	if status.Messages != 2 || status.UidNext != 3 || status.UidValidity != 1 {
+		t.Errorf("Wrong status: %+v", status)
+	}
+}
+
+func TestDirsStatusListStatus(t *testing.T) {
+	cmds := make(chan string, 32)
+	c, stop := connectScriptLog(t, map[string][]string{
+		"CAPABILITY": {"* CAPABILITY IMAP4rev1 LIST-STATUS"},
+		"LIST": {
+			`* LIST () "." INBOX`,
+			`* STATUS INBOX (MESSAGES 1 UIDNEXT 2 UIDVALIDITY 5 UNSEEN 0)`,
+			`* LIST () "." Archive`,
+			`* STATUS Archive (MESSAGES 3 UIDNEXT 10 UIDVALIDITY 5 UNSEEN 1)`,
+		},
+	}, cmds)
+	defer stop()
+
+	statuses, err := c.DirsStatus([]string{"Archive", "Missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 {
+		t.Errorf("Expected status only for Archive, got %v", statuses)
+	}
+	status, prs := statuses["Archive"]
+	if !prs {
+		t.Fatal("Status is not returned for Archive")
+	}
+	if status.Messages != 3 || status.UidNext != 10 || status.Unseen != 1 {
+		t.Errorf("Wrong status: %+v", status)
+	}
+
+	sent := sentCommands(cmds)
+	if hasCommand(sent, "STATUS") {
+		t.Error("STATUS used despite LIST-STATUS support:", sent)
+	}
+	if !hasCommand(sent, `LIST "" "*" RETURN (STATUS (`) {
+		t.Error("LIST-STATUS is not used:", sent)
+	}
+}
+
+func readResp(t *testing.T, line string) eimap.Resp {
+	resp, err := eimap.ReadResp(eimap.NewReader(bufio.NewReader(strings.NewReader(line + "\r\n"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestNotifyHandlerDrop(t *testing.T) {
+	statuses := make(chan *DirStatus, 1)
+	lost := make(chan struct{}, 1)
+	h := &notifyHandler{
+		statuses: statuses,
+		lost:     lost,
+		logger:   log.New(ioutil.Discard, "", 0),
+	}
+
+	for _, mbox := range []string{"Archive", "Sent", "Trash"} {
+		if err := h.Handle(readResp(t, "* STATUS "+mbox+" (MESSAGES 3 UIDNEXT 10)")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case status := <-statuses:
+		if status.Name != "Archive" || status.Messages != 3 || status.UidNext != 10 {
+			t.Errorf("Wrong status delivered: %+v", status)
+		}
+	default:
+		t.Fatal("Status is not delivered")
+	}
+	select {
+	case <-lost:
+	default:
+		t.Fatal("Lost flag is not set after dropped notification")
+	}
+}
+
+func TestIdleNotifyStatus(t *testing.T) {
+	c, stop := connectScript(t, map[string][]string{
+		"CAPABILITY": {"* CAPABILITY IMAP4rev1 IDLE NOTIFY"},
+		"IDLE":       {"+ idling", "* STATUS Archive (MESSAGES 3 UIDNEXT 10)"},
+	})
+	defer stop()
+
+	dirStatus := make(chan *DirStatus, 1)
+	c.SetCallbacks(&UpdateCallbacks{
+		NewMessage:     func(dir string, seqnum uint32) {},
+		MessageUpdate:  func(dir string, newInfo *eimap.Message) {},
+		MessageRemoved: func(dir string, uid uint32) {},
+		MboxUpdate:     func(status *eimap.MailboxStatus) {},
+		DirStatus: func(status *DirStatus) {
+			dirStatus <- status
+		},
+	})
+
+	w, err := c.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.release(w)
+	stopIdle := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- w.idleNotify(stopIdle)
+	}()
+
+	select {
+	case status := <-dirStatus:
+		if status.Name != "Archive" || status.Messages != 3 {
+			t.Errorf("Wrong status reported: %+v", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("STATUS notification is not reported")
+	}
+	close(stopIdle)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
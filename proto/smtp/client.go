@@ -1,10 +1,10 @@
 package smtp
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"net"
-	"strconv"
 	"strings"
 	"time"
 
@@ -13,14 +13,17 @@ import (
 	"github.com/foxcpp/mailbox/proto/common"
 )
 
-type Client smtp.Client
+type Client struct {
+	cl   *smtp.Client
+	conn net.Conn
+}
 
-func tlsHandshake(conn net.Conn, hostname string) (*smtp.Client, error) {
-	return smtp.NewClient(tls.Client(conn, &tls.Config{ServerName: hostname}), hostname)
+func tlsHandshake(conn net.Conn, hostname string, policy *common.TLSPolicy) (*smtp.Client, error) {
+	return smtp.NewClient(tls.Client(conn, policy.TLSConfig(hostname)), hostname)
 }
 
-func starttlsHandshake(conn net.Conn, hostname string) (*smtp.Client, error) {
-	conf := &tls.Config{ServerName: hostname}
+func starttlsHandshake(conn net.Conn, hostname string, policy *common.TLSPolicy) (*smtp.Client, error) {
+	conf := policy.TLSConfig(hostname)
 	c, err := smtp.NewClient(conn, hostname)
 	if err != nil {
 		return nil, err
@@ -39,56 +42,126 @@ func starttlsHandshake(conn net.Conn, hostname string) (*smtp.Client, error) {
 
 // Connect connects to server using specified configuration.
 func Connect(target common.ServConfig) (*Client, error) {
-	addr := target.Host + ":" + strconv.Itoa(int(target.Port))
+	return ConnectContext(context.Background(), target)
+}
 
-	conn, err := net.Dial("tcp", addr)
+// ConnectContext is like Connect but connection attempt is aborted when
+// ctx is cancelled.
+func ConnectContext(ctx context.Context, target common.ServConfig) (_ *Client, err error) {
+	conn, err := target.DialContext(ctx)
 	if err != nil {
-		return nil, err
+		return nil, common.WrapConnError(err)
 	}
+	res := &Client{conn: conn}
+	defer res.watchContext(ctx)(&err)
 
 	// Connection must complete in 30 seconds.
 	conn.SetDeadline(time.Now().Add(30 * time.Second))
 
-	var c *smtp.Client
 	if target.ConnType == common.TLS {
-		var err error
-		c, err = tlsHandshake(conn, target.Host)
-		if err != nil {
-			return nil, err
-		}
+		res.cl, err = tlsHandshake(conn, target.Host, target.TLS)
 	} else if target.ConnType == common.STARTTLS {
-		var err error
-		c, err = starttlsHandshake(conn, target.Host)
-		if err != nil {
-			return nil, err
-		}
+		res.cl, err = starttlsHandshake(conn, target.Host, target.TLS)
+	} else if target.ConnType == common.Plaintext {
+		res.cl, err = smtp.NewClient(conn, target.Host)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := res.cl.Hello("localhost.localdomain"); err != nil {
+		conn.Close()
+		return nil, err
 	}
 
-	// Reset deadline.
+	// Reset deadline, further I/O timeouts are set by watchContext.
 	conn.SetDeadline(time.Time{})
-	// TODO: Timeout for other I/O.
 
-	return (*Client)(c), c.Hello("localhost.localdomain")
+	return res, nil
+}
+
+// ioTimeout limits time single operation (authentication or message
+// submission) can take.
+const ioTimeout = 5 * time.Minute
+
+// watchContext sets I/O deadline and closes connection if ctx is done
+// before returned function is called. Returned function replaces *err with
+// ctx.Err() if operation was cancelled, otherwise errors caused by
+// connection loss are wrapped so they match ErrConnection.
+//
+// Connection can't be used after cancellation.
+func (c *Client) watchContext(ctx context.Context) func(*error) {
+	deadline := time.Now().Add(ioTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	c.conn.SetDeadline(deadline)
+
+	stop := common.WatchConn(ctx, c.conn)
+	return func(err *error) {
+		stop()
+		if *err != nil && ctx.Err() != nil {
+			*err = ctx.Err()
+		}
+		*err = common.WrapConnError(*err)
+	}
 }
 
 // Auth authenticates using specified configuration if possible.
+//
+// Mechanism is picked using common.NegotiateSASL. If no user is
+// specified, ANONYMOUS mechanism is used if supported.
 func (c *Client) Auth(conf common.ServConfig) error {
-	cl := (*smtp.Client)(c)
+	return c.AuthContext(context.Background(), conf)
+}
+
+// AuthContext is like Auth but is aborted when ctx is cancelled.
+func (c *Client) AuthContext(ctx context.Context, conf common.ServConfig) (err error) {
+	defer c.watchContext(ctx)(&err)
+
+	cl := c.cl
 	if ok, kinds := cl.Extension("AUTH"); ok {
-		if strings.Contains(kinds, "PLAIN") && conf.User != "" {
-			return cl.Auth(sasl.NewPlainClient("", conf.User, conf.Pass))
-		} else if strings.Contains(kinds, "ANONYMOUS") {
-			return cl.Auth(sasl.NewAnonymousClient(""))
-		} else if conf.User == "" {
+		if conf.User == "" && conf.AuthMethod == common.AuthPlain {
+			if hasMechanism(kinds, "ANONYMOUS") {
+				return authError(cl.Auth(sasl.NewAnonymousClient("")))
+			}
 			return nil
-		} else {
-			return errors.New("auth: no supported auth method found")
 		}
+
+		var cb *common.ChannelBinding
+		if state, ok := cl.TLSConnectionState(); ok {
+			cb = common.TLSChannelBinding(&state)
+		}
+		auth := func() error {
+			saslCl, err := common.NegotiateSASL(ctx, conf, strings.Fields(kinds), cb)
+			if err != nil {
+				return err
+			}
+			return authError(cl.Auth(saslCl))
+		}
+		err := auth()
+		if errors.Is(err, ErrAuthFailed) && common.InvalidateToken(conf) {
+			// OAuth access token may be revoked before its expiry,
+			// try again with new one.
+			err = auth()
+		}
+		return err
 	} else {
 		return errors.New("auth: not supported")
 	}
 }
 
+func hasMechanism(kinds, mech string) bool {
+	for _, kind := range strings.Fields(kinds) {
+		if strings.EqualFold(kind, mech) {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Client) Close() error {
-	return (*smtp.Client)(c).Quit()
+	// Don't hang forever if server is not responding.
+	c.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	return c.cl.Quit()
 }
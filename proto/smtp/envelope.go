@@ -0,0 +1,70 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/foxcpp/mailbox/proto/common"
+)
+
+// Envelope is a SMTP envelope (MAIL FROM and RCPT TO addresses) built from
+// message headers.
+type Envelope struct {
+	From       string
+	Recipients []string
+}
+
+// BuildEnvelope collects sender and recipients (To, Cc and Bcc) from message
+// headers.
+//
+// Duplicate addresses are removed (comparison is case-insensitive), empty
+// addresses are skipped. Order of recipients is preserved.
+func BuildEnvelope(msg *common.Msg) Envelope {
+	res := Envelope{From: msg.From.Address}
+
+	seen := make(map[string]bool)
+	for _, list := range [][]common.Address{msg.To, msg.Cc, msg.Bcc} {
+		for _, addr := range list {
+			if addr.Address == "" {
+				continue
+			}
+			key := strings.ToLower(addr.Address)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			res.Recipients = append(res.Recipients, addr.Address)
+		}
+	}
+	return res
+}
+
+// RcptError describes rejection of single recipient by server.
+type RcptError struct {
+	Addr string
+	Err  error
+}
+
+func (e RcptError) Error() string {
+	return fmt.Sprintf("rcpt %v: %v", e.Addr, e.Err)
+}
+
+// RejectedRcptsError is returned by Send when server rejected some
+// recipients.
+//
+// If Delivered is true, message was still sent to remaining recipients.
+type RejectedRcptsError struct {
+	Rejected  []RcptError
+	Delivered bool
+}
+
+func (e RejectedRcptsError) Error() string {
+	addrs := make([]string, len(e.Rejected))
+	for i, r := range e.Rejected {
+		addrs[i] = r.Error()
+	}
+	if e.Delivered {
+		return "send: some recipients rejected: " + strings.Join(addrs, "; ")
+	}
+	return "send: all recipients rejected: " + strings.Join(addrs, "; ")
+}
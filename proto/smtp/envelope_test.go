@@ -0,0 +1,102 @@
+package smtp
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	smtp "github.com/emersion/go-smtp"
+	"github.com/foxcpp/mailbox/proto/common"
+)
+
+func TestBuildEnvelope(t *testing.T) {
+	msg := common.Msg{
+		From: common.Address{Name: "me", Address: "me@example.org"},
+		To:   []common.Address{{Address: "a@example.org"}, {Address: "b@example.org"}},
+		Cc:   []common.Address{{Address: "B@example.org"}, {Address: "c@example.org"}},
+		Bcc:  []common.Address{{Address: "d@example.org"}, {Address: ""}, {Address: "a@example.org"}},
+	}
+
+	env := BuildEnvelope(&msg)
+	if env.From != "me@example.org" {
+		t.Errorf("Wrong envelope sender: %v", env.From)
+	}
+	expected := []string{"a@example.org", "b@example.org", "c@example.org", "d@example.org"}
+	if !reflect.DeepEqual(env.Recipients, expected) {
+		t.Errorf("Recipients mismatch:\n- Expected: %v\n- Actual: %v", expected, env.Recipients)
+	}
+}
+
+type testBackend struct {
+	from string
+	to   []string
+	data []byte
+}
+
+func (be *testBackend) Login(username, password string) (smtp.User, error) {
+	return nil, smtp.ErrAuthUnsupported
+}
+
+func (be *testBackend) AnonymousLogin() (smtp.User, error) {
+	return be, nil
+}
+
+func (be *testBackend) Send(from string, to []string, r io.Reader) error {
+	be.from, be.to = from, to
+	var err error
+	be.data, err = ioutil.ReadAll(r)
+	return err
+}
+
+func (be *testBackend) Logout() error {
+	return nil
+}
+
+func TestSendStripsBcc(t *testing.T) {
+	be := &testBackend{}
+	srv := smtp.NewServer(be)
+	srv.Domain = "localhost"
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := smtp.NewClient(conn, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{cl: cl, conn: conn}
+	defer c.Close()
+
+	msg := common.Msg{
+		From: common.Address{Address: "me@example.org"},
+		To:   []common.Address{{Address: "a@example.org"}},
+		Cc:   []common.Address{{Address: "b@example.org"}},
+		Bcc:  []common.Address{{Address: "secret@example.org"}},
+		Misc: common.Header{"Bcc": {"hidden@example.org"}},
+		Body: common.Part{Body: []byte("Hello!")},
+	}
+	if err := c.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"a@example.org", "b@example.org", "secret@example.org"}
+	if !reflect.DeepEqual(be.to, expected) {
+		t.Errorf("Recipients mismatch:\n- Expected: %v\n- Actual: %v", expected, be.to)
+	}
+	if strings.Contains(string(be.data), "secret@example.org") || strings.Contains(string(be.data), "hidden@example.org") {
+		t.Errorf("Bcc leaked into transmitted message:\n%s", be.data)
+	}
+	if len(msg.Bcc) != 1 || msg.Misc.Get("Bcc") == "" {
+		t.Errorf("Bcc removed from caller's message")
+	}
+}
@@ -0,0 +1,119 @@
+package smtp
+
+import (
+	"errors"
+	"net/textproto"
+	"strings"
+
+	"github.com/foxcpp/mailbox/proto/common"
+)
+
+var (
+	// ErrConnection is matched (using errors.Is) by errors caused by loss
+	// of server connection.
+	ErrConnection = common.ErrConnection
+
+	// ErrAuthFailed is matched by errors caused by rejected credentials.
+	ErrAuthFailed = common.ErrAuthFailed
+
+	// ErrNoSuchMailbox is matched by errors caused by recipient mailbox
+	// that doesn't exist.
+	ErrNoSuchMailbox = errors.New("smtp: no such mailbox")
+
+	// ErrQuotaExceeded is matched by errors caused by exceeded storage
+	// quota of recipient or exceeded message size limit.
+	ErrQuotaExceeded = errors.New("smtp: quota exceeded")
+)
+
+// ReplyError is a negative server reply to command.
+//
+// Use errors.Is with errors listed above to check for specific condition
+// instead of looking at reply codes directly.
+type ReplyError struct {
+	Err *textproto.Error
+}
+
+func (e *ReplyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ReplyError) Unwrap() error {
+	return e.Err
+}
+
+// EnhancedCode returns enhanced status code (RFC 3463) from reply text or
+// empty string if server didn't send it.
+func (e *ReplyError) EnhancedCode() string {
+	code := strings.SplitN(e.Err.Msg, " ", 2)[0]
+	parts := strings.Split(code, ".")
+	if len(parts) != 3 || len(parts[0]) != 1 || parts[0][0] != byte('0'+e.Err.Code/100) {
+		return ""
+	}
+	for _, part := range parts {
+		if part == "" || strings.Trim(part, "0123456789") != "" {
+			return ""
+		}
+	}
+	return code
+}
+
+func (e *ReplyError) Is(target error) bool {
+	// Enhanced code is more specific than reply code (e.g. 452 is also
+	// used for "too many recipients"), so it's used if present.
+	enhanced := e.EnhancedCode()
+	if enhanced != "" {
+		enhanced = enhanced[1:]
+	}
+	switch target {
+	case ErrNoSuchMailbox:
+		if enhanced != "" {
+			return enhanced == ".1.1"
+		}
+		return e.Err.Code == 550
+	case ErrQuotaExceeded:
+		if enhanced != "" {
+			return enhanced == ".2.2" || enhanced == ".3.4"
+		}
+		return e.Err.Code == 552 || e.Err.Code == 452
+	}
+	return false
+}
+
+// replyError wraps err using ReplyError if it's a negative server reply.
+func replyError(err error) error {
+	if replyErr, ok := err.(*textproto.Error); ok {
+		return &ReplyError{replyErr}
+	}
+	return err
+}
+
+// authError wraps err using common.AuthError if it's a reply rejecting
+// credentials (see RFC 4954).
+func authError(err error) error {
+	var replyErr *textproto.Error
+	if errors.As(err, &replyErr) && (replyErr.Code == 534 || replyErr.Code == 535) {
+		return &common.AuthError{Err: err}
+	}
+	return err
+}
+
+// IsTemporary reports whether err is a transient negative reply (4xx code)
+// from server, so operation may succeed if repeated later.
+//
+// RejectedRcptsError is temporary if all rejections are temporary.
+func IsTemporary(err error) bool {
+	var replyErr *textproto.Error
+	if errors.As(err, &replyErr) {
+		return replyErr.Code >= 400 && replyErr.Code < 500
+	}
+	var rcptsErr RejectedRcptsError
+	if errors.As(err, &rcptsErr) {
+		for _, rcpt := range rcptsErr.Rejected {
+			if !IsTemporary(rcpt.Err) {
+				return false
+			}
+		}
+		return len(rcptsErr.Rejected) != 0
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package smtp
+
+import (
+	"errors"
+	"net/textproto"
+	"testing"
+)
+
+func TestReplyCodes(t *testing.T) {
+	cases := []struct {
+		code      int
+		msg       string
+		noMailbox bool
+		quota     bool
+	}{
+		{550, "5.1.1 User unknown", true, false},
+		{550, "No such user", true, false},
+		{550, "5.7.1 Rejected by policy", false, false},
+		{552, "5.2.2 Mailbox full", false, true},
+		{452, "4.2.2 Mailbox full", false, true},
+		{552, "Message too big", false, true},
+		{452, "4.5.3 Too many recipients", false, false},
+		{554, "5.3.4 Message too big for system", false, true},
+		{451, "Local error", false, false},
+	}
+	for _, c := range cases {
+		err := replyError(&textproto.Error{Code: c.code, Msg: c.msg})
+		if errors.Is(err, ErrNoSuchMailbox) != c.noMailbox {
+			t.Errorf("%v %v: ErrNoSuchMailbox match is not %v", c.code, c.msg, c.noMailbox)
+		}
+		if errors.Is(err, ErrQuotaExceeded) != c.quota {
+			t.Errorf("%v %v: ErrQuotaExceeded match is not %v", c.code, c.msg, c.quota)
+		}
+		if IsTemporary(err) != (c.code < 500) {
+			t.Errorf("%v %v: wrong IsTemporary result", c.code, c.msg)
+		}
+	}
+
+	other := errors.New("other")
+	if replyError(other) != other {
+		t.Error("Non-reply error is wrapped")
+	}
+}
@@ -1,40 +1,80 @@
 package smtp
 
 import (
-	"github.com/emersion/go-smtp"
+	"context"
+	"errors"
+
 	"github.com/foxcpp/mailbox/proto/common"
 )
 
+// Send sends message to all recipients listed in To, Cc and Bcc.
+//
+// Bcc header is never transmitted to server. If some recipients were
+// rejected by server, message is still sent to remaining ones and
+// RejectedRcptsError is returned.
 func (c *Client) Send(msg common.Msg) error {
-	cl := (*smtp.Client)(c)
-	if err := cl.Mail(msg.From.Address); err != nil {
-		return err
+	return c.SendContext(context.Background(), msg)
+}
+
+// SendContext is like Send but is aborted when ctx is cancelled.
+//
+// Message is not delivered if submission was aborted before server
+// acknowledged end of data. However, cancellation after that moment can't be
+// detected by client, so message may be delivered even if error is returned.
+func (c *Client) SendContext(ctx context.Context, msg common.Msg) (err error) {
+	defer c.watchContext(ctx)(&err)
+
+	env := BuildEnvelope(&msg)
+	if len(env.Recipients) == 0 {
+		return errors.New("send: no recipients")
+	}
+
+	cl := c.cl
+	if err := cl.Mail(env.From); err != nil {
+		return replyError(err)
 	}
 
-	for _, to := range msg.To {
-		if err := cl.Rcpt(to.Address); err != nil {
-			if err := cl.Reset(); err != nil {
-				return err
-			}
-			return err
+	var rejected []RcptError
+	for _, to := range env.Recipients {
+		if err := cl.Rcpt(to); err != nil {
+			rejected = append(rejected, RcptError{to, replyError(err)})
 		}
 	}
+	// Errors of RSET are ignored below, server reply to the failed command
+	// is more useful and broken connection is detected by next command
+	// anyway.
+	if len(rejected) == len(env.Recipients) {
+		cl.Reset()
+		return RejectedRcptsError{Rejected: rejected}
+	}
 
 	w, err := cl.Data()
 	if err != nil {
-		if err := cl.Reset(); err != nil {
-			return err
-		}
-		return err
+		cl.Reset()
+		return replyError(err)
 	}
 
+	// Blind recipients must not be visible to anybody. Misc is copied so
+	// caller's message is not modified.
+	msg.Bcc = nil
+	if _, prs := msg.Misc["Bcc"]; prs {
+		misc := make(common.Header, len(msg.Misc))
+		for k, v := range msg.Misc {
+			misc[k] = v
+		}
+		misc.Del("Bcc")
+		msg.Misc = misc
+	}
 	if err := msg.Write(w); err != nil {
 		return err
 	}
 
 	if err := w.Close(); err != nil {
-		return err
+		return replyError(err)
 	}
 
+	if len(rejected) != 0 {
+		return RejectedRcptsError{Rejected: rejected, Delivered: true}
+	}
 	return nil
 }
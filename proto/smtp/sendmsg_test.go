@@ -0,0 +1,127 @@
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	smtp "github.com/emersion/go-smtp"
+	"github.com/foxcpp/mailbox/proto/common"
+)
+
+// connectScript connects to server that sends replies from script for
+// commands (first word of line, e.g. "DATA"), other commands get 250.
+// Message data is skipped, reply for its end is stored under ".".
+func connectScript(t *testing.T, script map[string]string) (*Client, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+		scanner := bufio.NewScanner(conn)
+		inData := false
+		for scanner.Scan() {
+			if inData && scanner.Text() != "." {
+				continue
+			}
+			inData = false
+			cmd := strings.ToUpper(strings.SplitN(scanner.Text(), " ", 2)[0])
+			if cmd == "DATA" && strings.HasPrefix(script[cmd], "354") {
+				inData = true
+			}
+			if reply, ok := script[cmd]; ok {
+				fmt.Fprint(conn, reply+"\r\n")
+			} else {
+				fmt.Fprint(conn, "250 OK\r\n")
+			}
+			if cmd == "QUIT" {
+				return
+			}
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	cl, err := smtp.NewClient(conn, "localhost")
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	c := &Client{cl: cl, conn: conn}
+	return c, func() {
+		c.Close()
+		l.Close()
+	}
+}
+
+var testSendMsg = common.Msg{
+	From: common.Address{Address: "me@example.org"},
+	To:   []common.Address{{Address: "a@example.org"}},
+	Body: common.Part{Body: []byte("Hello!")},
+}
+
+func TestSendDataError(t *testing.T) {
+	c, cleanup := connectScript(t, map[string]string{
+		"DATA": "452 4.2.2 Mailbox full",
+		"RSET": "421 4.3.0 Shutting down",
+	})
+	defer cleanup()
+
+	err := c.Send(testSendMsg)
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Err.Code != 452 {
+		t.Fatal("DATA reply is not returned:", err)
+	}
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Error("Error doesn't match ErrQuotaExceeded:", err)
+	}
+	if !IsTemporary(err) {
+		t.Error("Error is not temporary:", err)
+	}
+}
+
+func TestSendRcptErrors(t *testing.T) {
+	c, cleanup := connectScript(t, map[string]string{
+		"RCPT": "550 5.1.1 User unknown",
+		"RSET": "421 4.3.0 Shutting down",
+	})
+	defer cleanup()
+
+	err := c.Send(testSendMsg)
+	var rcptsErr RejectedRcptsError
+	if !errors.As(err, &rcptsErr) || len(rcptsErr.Rejected) != 1 {
+		t.Fatal("RejectedRcptsError is not returned:", err)
+	}
+	if !errors.Is(rcptsErr.Rejected[0].Err, ErrNoSuchMailbox) {
+		t.Error("Recipient error doesn't match ErrNoSuchMailbox:", rcptsErr.Rejected[0].Err)
+	}
+	var protoErr *textproto.Error
+	if !errors.As(rcptsErr.Rejected[0].Err, &protoErr) || protoErr.Code != 550 {
+		t.Error("Reply is not preserved:", rcptsErr.Rejected[0].Err)
+	}
+}
+
+func TestSendEndOfDataError(t *testing.T) {
+	c, cleanup := connectScript(t, map[string]string{
+		"DATA": "354 Go ahead",
+		".":    "552 5.2.2 Quota exceeded",
+	})
+	defer cleanup()
+
+	if err := c.Send(testSendMsg); !errors.Is(err, ErrQuotaExceeded) {
+		t.Error("Error doesn't match ErrQuotaExceeded:", err)
+	}
+}
@@ -10,33 +10,102 @@ import (
 	yaml "gopkg.in/yaml.v2"
 )
 
+// TLSCfg is a TLS configuration for server connection.
+type TLSCfg struct {
+	// PEM file with CA certificates to trust instead of system ones.
+	CAFile string `yaml:",omitempty"`
+	// PEM files with client certificate and its private key.
+	ClientCert string `yaml:",omitempty"`
+	ClientKey  string `yaml:",omitempty"`
+
+	// SHA-256 fingerprints of accepted server certificates. If set,
+	// certificate is not verified using CA certificates.
+	Pins []string `yaml:",omitempty"`
+	// Pin server certificate on first connection if it can't be verified.
+	TOFU bool `yaml:",omitempty"`
+}
+
+// Identity is an address messages can be sent from.
+type Identity struct {
+	Name  string
+	Email string
+	// Address replies should be sent to, if different from Email.
+	ReplyTo string `yaml:",omitempty"`
+	// Send copy of each message to Email.
+	BccSelf bool `yaml:",omitempty"`
+	// Appended to text of new messages.
+	Signature string `yaml:",omitempty"`
+	// Appended to HTML bodies, Signature is used if empty.
+	HTMLSignature string `yaml:",omitempty"`
+	// Directory to copy sent messages to instead of Dirs.Sent.
+	SentDir string `yaml:",omitempty"`
+}
+
 type AccountCfg struct {
 	AccountName string
+	// Primary identity.
 	SenderName  string
 	SenderEmail string
-	Server      struct {
+	// Additional addresses (aliases, role addresses) messages can be sent
+	// from. Entry with SenderEmail address can be used to set options for
+	// primary identity.
+	Identities []Identity `yaml:",omitempty"`
+
+	Server struct {
 		Imap struct {
 			Host       string
 			Port       uint16
 			Encryption string
+			TLS        TLSCfg
 		}
 		Smtp struct {
 			Host       string
 			Port       uint16
 			Encryption string
+			TLS        TLSCfg
 		}
 	}
 	Credentials struct {
 		User string
 		Pass string // IV + encrypted password actually
+
+		// Authentication method: "plain" (default), "xoauth2" or
+		// "oauthbearer".
+		Auth  string
+		OAuth struct {
+			TokenEndpoint string
+			ClientId      string
+			ClientSecret  string
+			RefreshToken  string // IV + encrypted token, like Pass
+		}
+
+		// SASL mechanisms to use, in order of preference. By default
+		// strongest mechanism supported by server is picked.
+		Mechanisms []string
+		// SASL mechanisms that should never be used.
+		ForbidMechanisms []string
 	}
+	// Special directories not set here are detected by core using
+	// special-use attributes (RFC 6154).
 	Dirs struct {
 		Drafts             string
 		Sent               string
 		Trash              string
+		Junk               string
+		Archive            string
 		DownloadForOffline []string
+		// Directories new messages in which are reported to frontend,
+		// "*" means all directories.
+		Watch []string
 	}
 	CopyToSent *bool
+	// Use server-side threading (THREAD=REFERENCES) if available. Such
+	// threads don't include messages from other directories.
+	ServerThreading bool
+
+	// Values from global.yml sections overridden for this account, see
+	// GlobalCfg.Override.
+	Overrides GlobalCfg `yaml:",inline"`
 }
 
 // LoadAccount reads configuration for account 'name'
@@ -60,26 +129,32 @@ func LoadAccount(name string) (*AccountCfg, error) {
 	if err != nil {
 		return nil, fmt.Errorf("loadaccount %v: %v", name, err)
 	}
-	if res.Server.Imap.Encryption != "tls" &&
-		res.Server.Imap.Encryption != "starttls" ||
-		res.Server.Smtp.Encryption != "tls" &&
-			res.Server.Smtp.Encryption != "starttls" {
-		return nil, fmt.Errorf("loadaccount %v: encryption field may contain only 'tls' or 'starttls' strings", name)
+	if !validEncryption(res.Server.Imap.Encryption) || !validEncryption(res.Server.Smtp.Encryption) {
+		return nil, fmt.Errorf("loadaccount %v: encryption field may contain only 'tls', 'starttls' or 'none' strings", name)
 	}
-
-	// Assign default values to possibly-missing fields.
-	if res.Dirs.Drafts == "" {
-		res.Dirs.Drafts = "Drafts"
+	switch res.Credentials.Auth {
+	case "", "plain", "xoauth2", "oauthbearer":
+	default:
+		return nil, fmt.Errorf("loadaccount %v: auth field may contain only 'plain', 'xoauth2' or 'oauthbearer' strings", name)
 	}
-	if res.Dirs.Sent == "" {
-		res.Dirs.Sent = "Sent"
+
+	if res.Overrides.Encryption != (EncryptionCfg{}) {
+		return nil, fmt.Errorf("loadaccount %v: encryption section can be set only in global configuration", name)
 	}
-	if res.Dirs.Trash == "" {
-		res.Dirs.Trash = "Trash"
+
+	for _, id := range res.Identities {
+		if id.Email == "" {
+			return nil, fmt.Errorf("loadaccount %v: identity without email", name)
+		}
 	}
+
+	// Assign default values to possibly-missing fields.
 	if res.Dirs.DownloadForOffline == nil {
 		res.Dirs.DownloadForOffline = []string{"INBOX"}
 	}
+	if res.Dirs.Watch == nil {
+		res.Dirs.Watch = []string{"INBOX"}
+	}
 	if res.CopyToSent == nil {
 		copyToSent := true
 		res.CopyToSent = &copyToSent
@@ -88,6 +163,30 @@ func LoadAccount(name string) (*AccountCfg, error) {
 	return &res, nil
 }
 
+// AllIdentities returns list of addresses messages can be sent from,
+// primary identity is first.
+func (cfg AccountCfg) AllIdentities() []Identity {
+	res := []Identity{}
+	if cfg.SenderEmail != "" {
+		res = append(res, Identity{Name: cfg.SenderName, Email: cfg.SenderEmail})
+	}
+	for _, id := range cfg.Identities {
+		if len(res) != 0 && strings.EqualFold(id.Email, cfg.SenderEmail) {
+			if id.Name == "" {
+				id.Name = cfg.SenderName
+			}
+			res[0] = id
+			continue
+		}
+		res = append(res, id)
+	}
+	return res
+}
+
+func validEncryption(s string) bool {
+	return s == "tls" || s == "starttls" || s == "none"
+}
+
 func basename(s string) string {
 	n := strings.LastIndexByte(s, '.')
 	if n >= 0 {
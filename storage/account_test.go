@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadAccountOverrides(t *testing.T) {
+	t.Setenv("MAILBOX_HOME", t.TempDir())
+
+	conf := AccountCfg{}
+	conf.Server.Imap.Encryption = "tls"
+	conf.Server.Smtp.Encryption = "tls"
+	poolSize := 2
+	conf.Overrides.Connection.PoolSize = &poolSize
+	if err := SaveAccount("test", conf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadAccount("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Overrides.Connection.PoolSize == nil || *loaded.Overrides.Connection.PoolSize != 2 {
+		t.Errorf("Override is not loaded: %+v", loaded.Overrides.Connection)
+	}
+
+	// Master key is shared by all accounts.
+	useMasterPass := true
+	conf.Overrides.Encryption.UseMasterPass = &useMasterPass
+	if err := SaveAccount("test", conf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadAccount("test"); err == nil {
+		t.Error("Encryption override is accepted")
+	}
+}
+
+func TestLoadAccountIdentities(t *testing.T) {
+	t.Setenv("MAILBOX_HOME", t.TempDir())
+
+	conf := AccountCfg{SenderName: "Me", SenderEmail: "me@example.org"}
+	conf.Server.Imap.Encryption = "tls"
+	conf.Server.Smtp.Encryption = "tls"
+	conf.Identities = []Identity{
+		{Name: "Support", Email: "support@example.org", BccSelf: true},
+		{Email: "ME@example.org", Signature: "Me"},
+	}
+	if err := SaveAccount("test", conf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadAccount("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := loaded.AllIdentities()
+	if len(ids) != 2 {
+		t.Fatalf("Expected 2 identities, got %+v", ids)
+	}
+	// Entry for primary address sets its options.
+	if !strings.EqualFold(ids[0].Email, "me@example.org") || ids[0].Name != "Me" || ids[0].Signature != "Me" {
+		t.Errorf("Wrong primary identity: %+v", ids[0])
+	}
+	if ids[1].Email != "support@example.org" || !ids[1].BccSelf {
+		t.Errorf("Wrong additional identity: %+v", ids[1])
+	}
+
+	conf.Identities = append(conf.Identities, Identity{Name: "Nobody"})
+	if err := SaveAccount("test", conf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadAccount("test"); err == nil {
+		t.Error("Identity without email is accepted")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/mail"
 	"strings"
 	"time"
@@ -36,12 +37,16 @@ Columns:
   Currently not used correctly. Reserved for future additions.
 - msglistvalid (int)
   Used to separate "empty" and "missing" directory cache.
+- highestmodseq (int, nullable)
+  HIGHESTMODSEQ (RFC 7162) value for cached state, NULL if server doesn't
+  supports CONDSTORE.
 
 meta:
 Various meta-information extracted from headers.
 
 Indexes:
 - dir + uid
+- threadid
 Columns:
 - dir (string)
   Directory, where message stored.
@@ -64,6 +69,13 @@ Columns:
 - subject (string)
   Subject header.
 - hdrs (blob)
+- inreplyto (string)
+  In-Reply-To header (first message ID).
+- refs (space-separated string)
+  References header.
+- threadid (string, nullable)
+  Message ID of thread root, see threads.go. NULL if thread is not computed
+  yet.
 
 tags table simply stores information about message tags (flags), one row for message-tag pair.
 Indexes:
@@ -76,17 +88,17 @@ Columns:
 - tag (string)
   Tag name.
 
-parts table stores information about each message body part (as defined by proto
-abstraction level).
+parts table stores information about each node of message MIME tree (as
+defined by proto abstraction level), including multipart/* containers.
 Indexes:
-- dir + uid + indx
+- dir + uid + path
 Columns:
 - dir (string)
   Dirctory name, where corresponing message stored.
 - uid (int)
   UID of corresponding message.
-- indx (int)
-  Sequence number of part in message. 1-based.
+- path (string)
+  IMAP section path of part ("1.2.3"), empty for root of multipart message.
 - attachment (int)
   1 if message part considered as an attachment. 0 otherwise.
   Body is never cached for attachments.
@@ -103,10 +115,59 @@ Columns:
   MIME-headers blob containing all other headers.
 - body (blob, nullable)
   Body without MIME-header.
+
+fts and ftsidx tables contain full-text index, see fts.go.
+
+journal table stores operations performed while server was not reachable, see
+journal.go.
+Indexes:
+- id
+Columns:
+- id (int)
+  Increasing number, defines order of operations.
+- timestamp (int, unix timestamp)
+  When operation was performed.
+- op (string)
+  Operation type, meaning is defined by core.
+- dir (string)
+  Directory operation applies to.
+- uidvalidity (int)
+  UIDVALIDITY of dir when operation was performed, 0 if not known or not
+  relevant.
+- args (blob)
+  Operation arguments, format is defined by core.
+
+outbox table stores messages waiting for delivery, see outbox.go.
+Indexes:
+- id
+Columns:
+- id (int)
+  Increasing number, defines order of delivery.
+- timestamp (int, unix timestamp)
+  When message was queued.
+- msg (blob)
+  RFC 822 message.
+- attempts (int)
+  Amount of failed delivery attempts.
+- nextattempt (int, unix timestamp)
+  When to try delivery next time, 0 if message should not be delivered
+  automatically.
+- lasterror (string)
+  Error from last delivery attempt.
+- draftuid (int)
+  UID of message copy in drafts directory, 0 if there is none. Used for
+  scheduled messages.
+
+Schema version is stored in user_version pragma. Since all information in
+database can be downloaded again, tables changed between versions are just
+recreated.
 */
 type CacheDB struct {
 	d *sql.DB
 
+	// Whether full-text index is available (see fts.go).
+	fts bool
+
 	// List directories.
 	dirList *sql.Stmt
 
@@ -114,6 +175,10 @@ type CacheDB struct {
 	uidValidity    *sql.Stmt
 	setUidValidity *sql.Stmt
 
+	// Set/Get HIGHESTMODSEQ value for dir.
+	highestModSeq    *sql.Stmt
+	setHighestModSeq *sql.Stmt
+
 	// Set/Get unread count value for dir.
 	unreadCount    *sql.Stmt
 	setUnreadCount *sql.Stmt
@@ -136,6 +201,9 @@ type CacheDB struct {
 	// Get message meta-data using dir + UID.
 	getAllMsgs *sql.Stmt
 
+	// List UIDs of all messages in dir.
+	getAllUids *sql.Stmt
+
 	// Get message headers blob using dir + UID.
 	getMsgHdrs *sql.Stmt
 
@@ -153,7 +221,10 @@ type CacheDB struct {
 	// Get information about message parts by UID + dir.
 	getMsgPartInfo *sql.Stmt
 
-	// Get message part using UID and part index + dir.
+	// Get information about message parts + bodies by UID + dir.
+	getMsgParts *sql.Stmt
+
+	// Get message part using UID and part path + dir.
 	getMsgPart *sql.Stmt
 
 	// Remove message meta-information.
@@ -204,6 +275,73 @@ func (db *CacheDB) Close() error {
 	return db.d.Close()
 }
 
+// Current schema version, see migrateSchema.
+const schemaVersion = 4
+
+// migrateSchema drops tables with outdated schema so initSchema will recreate
+// them or adds missing columns.
+func (db *CacheDB) migrateSchema() error {
+	version := 0
+	if err := db.d.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	switch version {
+	case 0:
+		// parts.indx replaced with parts.path.
+		if _, err := db.d.Exec(`DROP TABLE IF EXISTS parts`); err != nil {
+			return err
+		}
+		fallthrough
+	case 1:
+		// dirinfo.highestmodseq added.
+		exists := 0
+		row := db.d.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'dirinfo'`)
+		if err := row.Scan(&exists); err != nil {
+			return err
+		}
+		if exists != 0 {
+			if _, err := db.d.Exec(`ALTER TABLE dirinfo ADD COLUMN highestmodseq INT DEFAULT NULL`); err != nil {
+				return err
+			}
+		}
+		fallthrough
+	case 2:
+		// meta.inreplyto, meta.refs, meta.threadid added. Message-Id
+		// was not stored before, so already cached messages are threaded
+		// only by subject.
+		exists := 0
+		row := db.d.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'meta'`)
+		if err := row.Scan(&exists); err != nil {
+			return err
+		}
+		if exists != 0 {
+			for _, column := range []string{`inreplyto TEXT DEFAULT ""`, `refs TEXT DEFAULT ""`, `threadid TEXT DEFAULT NULL`} {
+				if _, err := db.d.Exec(`ALTER TABLE meta ADD COLUMN ` + column); err != nil {
+					return err
+				}
+			}
+		}
+		fallthrough
+	case 3:
+		// outbox.draftuid added.
+		exists := 0
+		row := db.d.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'outbox'`)
+		if err := row.Scan(&exists); err != nil {
+			return err
+		}
+		if exists != 0 {
+			if _, err := db.d.Exec(`ALTER TABLE outbox ADD COLUMN draftuid INT NOT NULL DEFAULT 0`); err != nil {
+				return err
+			}
+		}
+	}
+
+	// PRAGMA doesn't supports parameter binding.
+	_, err := db.d.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, schemaVersion))
+	return err
+}
+
 func (db *CacheDB) initSchema() error {
 	db.d.Exec(`PRAGMA foreign_keys = ON`)
 	db.d.Exec(`PRAGMA auto_vacuum = INCREMENTAL`)
@@ -215,12 +353,17 @@ func (db *CacheDB) initSchema() error {
 	db.d.Exec(`PRAGMA cache_size = 5000`)
 	db.d.Exec(`PRAGMA optimize`)
 
+	if err := db.migrateSchema(); err != nil {
+		return err
+	}
+
 	_, err := db.d.Exec(`
 		CREATE TABLE IF NOT EXISTS dirinfo (
 			dir TEXT PRIMARY KEY NOT NULL,
 			uidvalidity INT DEFAULT NULL,
 			unreadcount INT DEFAULT NULL,
-			msglistvalid INT DEFAULT 0
+			msglistvalid INT DEFAULT 0,
+			highestmodseq INT DEFAULT NULL
 		)`)
 	if err != nil {
 		return err
@@ -238,9 +381,19 @@ func (db *CacheDB) initSchema() error {
 			replyto TEXT DEFAULT "",
 			subject TEXT DEFAULT "",
 			hdrs BLOB DEFAULT NULL,
+			inreplyto TEXT DEFAULT "",
+			refs TEXT DEFAULT "",
+			threadid TEXT DEFAULT NULL,
 			PRIMARY KEY (dir, uid),
 			FOREIGN KEY (dir) REFERENCES dirinfo(dir)
 		)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.d.Exec(`CREATE INDEX IF NOT EXISTS meta_threadid ON meta(threadid)`)
+	if err != nil {
+		return err
+	}
 
 	_, err = db.d.Exec(`
 		CREATE TABLE IF NOT EXISTS tags (
@@ -258,7 +411,7 @@ func (db *CacheDB) initSchema() error {
 		CREATE TABLE IF NOT EXISTS parts (
 			dir TEXT NOT NULL,
 			uid INT NOT NULL,
-			indx INT NOT NULL,
+			path TEXT NOT NULL,
 			attachment INT NOT NULL DEFAULT 0,
 			content_type TEXT NOT NULL DEFAULT "text",
 			content_subtype TEXT NOT NULL DEFAULT "plain",
@@ -267,10 +420,41 @@ func (db *CacheDB) initSchema() error {
 			filename TEXT NOT NULL DEFAULT "",
 			hdrs BLOB NOT NULL,
 			body BLOB DEFAULT NULL,
-			PRIMARY KEY (dir, uid, indx),
+			PRIMARY KEY (dir, uid, path),
 			FOREIGN KEY (dir, uid) REFERENCES meta(dir, uid)
 		)`)
-	return err
+	if err != nil {
+		return err
+	}
+
+	_, err = db.d.Exec(`
+		CREATE TABLE IF NOT EXISTS journal (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp INT NOT NULL,
+			op TEXT NOT NULL,
+			dir TEXT NOT NULL DEFAULT "",
+			uidvalidity INT NOT NULL DEFAULT 0,
+			args BLOB DEFAULT NULL
+		)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.d.Exec(`
+		CREATE TABLE IF NOT EXISTS outbox (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp INT NOT NULL,
+			msg BLOB NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			nextattempt INT NOT NULL DEFAULT 0,
+			lasterror TEXT NOT NULL DEFAULT "",
+			draftuid INT NOT NULL DEFAULT 0
+		)`)
+	if err != nil {
+		return err
+	}
+
+	return db.initFTS()
 }
 
 func (db *CacheDB) initStmts() error {
@@ -290,6 +474,16 @@ func (db *CacheDB) initStmts() error {
 		return err
 	}
 
+	db.highestModSeq, err = db.d.Prepare(`SELECT highestmodseq FROM dirinfo WHERE dir = ?`)
+	if err != nil {
+		return err
+	}
+
+	db.setHighestModSeq, err = db.d.Prepare(`UPDATE dirinfo SET highestmodseq = ? WHERE dir = ?`)
+	if err != nil {
+		return err
+	}
+
 	db.unreadCount, err = db.d.Prepare(`SELECT unreadcount FROM dirinfo WHERE dir = ?`)
 	if err != nil {
 		return err
@@ -305,7 +499,7 @@ func (db *CacheDB) initStmts() error {
 		return err
 	}
 
-	db.invalidateDirinfo, err = db.d.Prepare(`UPDATE dirinfo SET unreadcount = NULL, uidvalidity = NULL, msglistvalid = 0 WHERE dir = ?`)
+	db.invalidateDirinfo, err = db.d.Prepare(`UPDATE dirinfo SET unreadcount = NULL, uidvalidity = NULL, highestmodseq = NULL, msglistvalid = 0 WHERE dir = ?`)
 	if err != nil {
 		return err
 	}
@@ -341,11 +535,15 @@ func (db *CacheDB) initStmts() error {
 	}
 
 	db.getAllMsgs, err = db.d.Prepare(`
-		SELECT uid,timestamp,sender,recipients,cc,bcc,messageid,replyto,subject,hdrs
+		SELECT uid,timestamp,sender,recipients,cc,bcc,messageid,replyto,subject,hdrs,inreplyto,refs
 		FROM meta WHERE dir = ?`)
 	if err != nil {
 		return err
 	}
+	db.getAllUids, err = db.d.Prepare(`SELECT uid FROM meta WHERE dir = ?`)
+	if err != nil {
+		return err
+	}
 	db.getMsgHdrs, err = db.d.Prepare(`SELECT hdrs FROM meta WHERE dir = ? AND uid = ?`)
 	if err != nil {
 		return err
@@ -357,13 +555,13 @@ func (db *CacheDB) initStmts() error {
 	}
 
 	db.getMsgBySeq, err = db.d.Prepare(`
-		SELECT uid,timestamp,sender,recipients,cc,bcc,messageid,replyto,subject,hdrs
+		SELECT uid,timestamp,sender,recipients,cc,bcc,messageid,replyto,subject,hdrs,inreplyto,refs
 		FROM meta WHERE dir = ? LIMIT 1 OFFSET ?-1`)
 	if err != nil {
 		return err
 	}
 	db.getMsgByUid, err = db.d.Prepare(`
-		SELECT uid,timestamp,sender,recipients,cc,bcc,messageid,replyto,subject,hdrs
+		SELECT uid,timestamp,sender,recipients,cc,bcc,messageid,replyto,subject,hdrs,inreplyto,refs
 		FROM meta
 		WHERE dir = ? AND uid = ?`)
 	if err != nil {
@@ -376,7 +574,15 @@ func (db *CacheDB) initStmts() error {
 	}
 
 	db.getMsgPartInfo, err = db.d.Prepare(`
-		SELECT attachment,content_type,content_subtype,content_type_params,size,filename,hdrs
+		SELECT path,attachment,content_type,content_subtype,content_type_params,size,filename,hdrs,NULL
+		FROM parts
+		WHERE dir = ? AND uid = ?`)
+	if err != nil {
+		return err
+	}
+
+	db.getMsgParts, err = db.d.Prepare(`
+		SELECT path,attachment,content_type,content_subtype,content_type_params,size,filename,hdrs,body
 		FROM parts
 		WHERE dir = ? AND uid = ?`)
 	if err != nil {
@@ -385,7 +591,7 @@ func (db *CacheDB) initStmts() error {
 
 	db.getMsgPart, err = db.d.Prepare(`
 		SELECT body FROM parts
-		WHERE dir = ? AND uid = ? AND indx = ?`)
+		WHERE dir = ? AND uid = ? AND path = ?`)
 	if err != nil {
 		return err
 	}
@@ -423,7 +629,7 @@ func (db *CacheDB) initStmts() error {
 	db.addMsg, err = db.d.Prepare(`
 		INSERT OR REPLACE
 		INTO meta
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULL)`)
 	if err != nil {
 		return err
 	}
@@ -472,6 +678,9 @@ func (db *CacheDB) RemoveDir(name string) error {
 	if err != nil {
 		return err
 	}
+	if err := db.unindexDir(tx, name); err != nil {
+		return err
+	}
 	_, err = tx.Stmt(db.remDirMsgs2).Exec(name)
 	if err != nil {
 		return err
@@ -490,18 +699,29 @@ func (db *CacheDB) RenameDir(old string, new string) error {
 	}
 	defer tx.Rollback()
 
-	if _, err := tx.Exec(`UPDATE dirinfo SET dir = ? WHERE dir = ?`, old, new); err != nil {
+	// Rows in other tables reference dirinfo, check constraints only after
+	// all of them are updated. Reset automatically on commit.
+	if _, err := tx.Exec(`PRAGMA defer_foreign_keys = ON`); err != nil {
 		return err
 	}
-	if _, err := tx.Exec(`UPDATE meta SET dir = ? WHERE dir = ?`, old, new); err != nil {
+
+	if _, err := tx.Exec(`UPDATE dirinfo SET dir = ? WHERE dir = ?`, new, old); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE meta SET dir = ? WHERE dir = ?`, new, old); err != nil {
 		return err
 	}
-	if _, err := tx.Exec(`UPDATE tags SET dir = ? WHERE dir = ?`, old, new); err != nil {
+	if _, err := tx.Exec(`UPDATE tags SET dir = ? WHERE dir = ?`, new, old); err != nil {
 		return err
 	}
-	if _, err := tx.Exec(`UPDATE parts SET dir = ? WHERE dir = ?`, old, new); err != nil {
+	if _, err := tx.Exec(`UPDATE parts SET dir = ? WHERE dir = ?`, new, old); err != nil {
 		return err
 	}
+	if db.fts {
+		if _, err := tx.Exec(`UPDATE ftsidx SET dir = ? WHERE dir = ?`, new, old); err != nil {
+			return err
+		}
+	}
 
 	return tx.Commit()
 }
@@ -567,6 +787,100 @@ func (d *Dirwrapper) SetUidValidity(newVal uint32) error {
 	return err
 }
 
+// HighestModSeq returns HIGHESTMODSEQ value for cached state of directory.
+func (d *Dirwrapper) HighestModSeq() (uint64, error) {
+	row := d.parent.highestModSeq.QueryRow(d.dir)
+	value := sql.NullInt64{}
+	if err := row.Scan(&value); err != nil {
+		return 0, err
+	}
+	if !value.Valid {
+		return 0, ErrNullValue
+	}
+	return uint64(value.Int64), nil
+}
+
+// SetHighestModSeq sets HIGHESTMODSEQ value for directory, zero value
+// resets it to NULL.
+func (d *Dirwrapper) SetHighestModSeq(newVal uint64) error {
+	val := sql.NullInt64{Int64: int64(newVal), Valid: newVal != 0}
+	_, err := d.parent.setHighestModSeq.Exec(val, d.dir)
+	return err
+}
+
+// Uids returns list of UIDs for all cached messages in directory.
+func (d *Dirwrapper) Uids() ([]uint32, error) {
+	rows, err := d.parent.getAllUids.Query(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []uint32{}
+	for rows.Next() {
+		uid := uint32(0)
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		res = append(res, uid)
+	}
+	return res, rows.Err()
+}
+
+// ApplyChanges updates cached directory state using result of
+// imap.Client.SyncDir. Directory cache is marked as valid afterwards.
+func (d *Dirwrapper) ApplyChanges(changes *imap.DirChanges) error {
+	tx, err := d.parent.d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if changes.Reset {
+		if _, err := tx.Stmt(d.parent.remDirMsgs).Exec(d.dir, d.dir); err != nil {
+			return err
+		}
+		if err := d.parent.unindexDir(tx, d.dir); err != nil {
+			return err
+		}
+		if _, err := tx.Stmt(d.parent.remDirMsgs3).Exec(d.dir); err != nil {
+			return err
+		}
+		if _, err := tx.Stmt(d.parent.remDirMsgs2).Exec(d.dir); err != nil {
+			return err
+		}
+	}
+
+	for _, uid := range changes.Vanished {
+		if err := d.delMsg(tx, uid); err != nil {
+			return err
+		}
+	}
+	for _, upd := range changes.Changed {
+		if err := d.replaceTagList(tx, upd.UID, upd.Flags); err != nil {
+			return err
+		}
+	}
+	for _, msg := range changes.New {
+		if err := d.addMsg(tx, &msg); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Stmt(d.parent.setUidValidity).Exec(changes.UidValidity, d.dir); err != nil {
+		return err
+	}
+	modseq := sql.NullInt64{Int64: int64(changes.HighestModSeq), Valid: changes.HighestModSeq != 0}
+	if _, err := tx.Stmt(d.parent.setHighestModSeq).Exec(modseq, d.dir); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE dirinfo SET msglistvalid = 1 WHERE dir = ?`, d.dir); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func (d *Dirwrapper) UnreadCount() (uint, error) {
 	row := d.parent.unreadCount.QueryRow(d.dir)
 	value := sql.NullInt64{}
@@ -688,7 +1002,8 @@ type Scannable interface {
 func readMessageInfo(r Scannable) (*imap.MessageInfo, error) {
 	uid, timestamp, sender, recipientsStr, ccStr := uint32(0), int64(0), "", "", ""
 	bccStr, messageId, replyTo, subject, hdrs := "", "", "", "", []byte{}
-	err := r.Scan(&uid, &timestamp, &sender, &recipientsStr, &ccStr, &bccStr, &messageId, &replyTo, &subject, &hdrs)
+	inReplyTo, refs := "", ""
+	err := r.Scan(&uid, &timestamp, &sender, &recipientsStr, &ccStr, &bccStr, &messageId, &replyTo, &subject, &hdrs, &inReplyTo, &refs)
 	if err != nil {
 		return nil, err
 	}
@@ -697,6 +1012,11 @@ func readMessageInfo(r Scannable) (*imap.MessageInfo, error) {
 	msg.UID = uid
 	msg.Msg.Date = time.Unix(timestamp, 0)
 	msg.Msg.Subject = subject
+	msg.Msg.MessageId = messageId
+	msg.Msg.InReplyTo = inReplyTo
+	if refs != "" {
+		msg.Msg.References = strings.Fields(refs)
+	}
 	senderAddr, err := mail.ParseAddress(sender)
 	if err == nil {
 		msg.Msg.From = common.Address(*senderAddr)
@@ -746,14 +1066,21 @@ func readTagList(out *imap.MessageInfo, in *sql.Rows) error {
 	return nil
 }
 
+// readPartInfo reads rows from parts table and reconstructs MIME tree.
 func readPartInfo(out *imap.MessageInfo, in *sql.Rows) error {
-	out.Msg.Parts = []common.Part{}
+	parts := []common.Part{}
 	for in.Next() {
-		attachment, contentType, contentSubtype, contentTypeParams, size, filename, hdrs := 0, "", "", "", 0, "", []byte{}
-		in.Scan(&attachment, &contentType, &contentSubtype, &size, &filename, hdrs)
+		path, attachment, contentType, contentSubtype, contentTypeParams, size, filename, hdrs, body := "", 0, "", "", "", 0, "", []byte{}, []byte(nil)
+		if err := in.Scan(&path, &attachment, &contentType, &contentSubtype, &contentTypeParams, &size, &filename, &hdrs, &body); err != nil {
+			return err
+		}
 
-		part := common.Part{}
-		part.Type, _ = common.ParseParamHdr(contentType + "/" + contentSubtype + ";" + contentTypeParams)
+		part := common.Part{Path: path, Body: body}
+		typeHdr := contentType + "/" + contentSubtype
+		if contentTypeParams != "" {
+			typeHdr += "; " + contentTypeParams
+		}
+		part.Type, _ = common.ParseParamHdr(typeHdr)
 		part.Size = uint32(size)
 
 		hdrsParsed, err := common.ReadHeader(hdrs)
@@ -765,12 +1092,16 @@ func readPartInfo(out *imap.MessageInfo, in *sql.Rows) error {
 			}
 		}
 		v, params, _ := hdrsParsed.ContentDisposition()
-		part.Disposition = common.ParametrizedHeader{v, params}
+		part.Disposition = common.ParametrizedHeader{Value: v, Params: params}
 		hdrsParsed.Del("Content-Disposition")
 		part.Misc = hdrsParsed
 
-		out.Msg.Parts = append(out.Msg.Parts, part)
+		parts = append(parts, part)
+	}
+	if err := in.Err(); err != nil {
+		return err
 	}
+	out.Msg.Body = common.BuildPartTree(parts)
 	return nil
 }
 
@@ -788,6 +1119,9 @@ func (d *Dirwrapper) InvalidateMsglist() error {
 	if _, err := tx.Stmt(d.parent.remDirMsgs).Exec(d.dir, d.dir); err != nil {
 		return err
 	}
+	if err := d.parent.unindexDir(tx, d.dir); err != nil {
+		return err
+	}
 	if _, err := tx.Stmt(d.parent.remDirMsgs2).Exec(d.dir); err != nil {
 		return err
 	}
@@ -814,16 +1148,19 @@ func (d *Dirwrapper) GetMsg(uid uint32) (*imap.MessageInfo, error) {
 		return nil, err
 	}
 	if err == nil {
-		if err := readTagList(msg, rows); err != nil {
+		err := readTagList(msg, rows)
+		rows.Close()
+		if err != nil {
 			return nil, err
 		}
 	} else {
 		msg.CustomTags = []string{}
 	}
-	rows, err = d.parent.getMsgPartInfo.Query(d.dir, uid)
+	rows, err = d.parent.getMsgParts.Query(d.dir, uid)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	if err := readPartInfo(msg, rows); err != nil {
 		return nil, err
 	}
@@ -837,22 +1174,24 @@ func (d *Dirwrapper) DelMsg(uid uint32) error {
 	}
 	defer tx.Rollback()
 
-	_, err = d.parent.delMsgParts.Exec(d.dir, uid)
-	if err != nil {
+	if err := d.delMsg(tx, uid); err != nil {
 		return err
 	}
 
-	_, err = d.parent.delMsgTags.Exec(d.dir, uid)
-	if err != nil {
+	return tx.Commit()
+}
+
+func (d *Dirwrapper) delMsg(tx *sql.Tx, uid uint32) error {
+	if _, err := tx.Stmt(d.parent.delMsgParts).Exec(d.dir, uid); err != nil {
 		return err
 	}
-
-	_, err = d.parent.delMsg.Exec(d.dir, uid)
-	if err != nil {
+	if _, err := tx.Stmt(d.parent.delMsgTags).Exec(d.dir, uid); err != nil {
 		return err
 	}
-
-	return tx.Commit()
+	if _, err := tx.Stmt(d.parent.delMsg).Exec(d.dir, uid); err != nil {
+		return err
+	}
+	return d.unindexMsg(tx, uid)
 }
 
 func (d *Dirwrapper) AddTag(uid uint32, tag string) error {
@@ -865,10 +1204,20 @@ func (d *Dirwrapper) RemTag(uid uint32, tag string) error {
 	return err
 }
 
-func (d *Dirwrapper) GetPartBody(uid uint32, indx uint) ([]byte, error) {
-	row := d.parent.getMsgPart.QueryRow(d.dir, uid, indx)
-	out := []byte{}
-	return out, row.Scan(out)
+// GetPartBody returns cached body of part with specified section path.
+func (d *Dirwrapper) GetPartBody(uid uint32, path string) ([]byte, error) {
+	row := d.parent.getMsgPart.QueryRow(d.dir, uid, path)
+	out := []byte(nil)
+	if err := row.Scan(&out); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNullValue
+		}
+		return nil, err
+	}
+	if out == nil {
+		return nil, ErrNullValue
+	}
+	return out, nil
 }
 
 func (d *Dirwrapper) AddMsg(msg *imap.MessageInfo) error {
@@ -895,8 +1244,8 @@ func (d *Dirwrapper) addMsg(tx *sql.Tx, msg *imap.MessageInfo) error {
 
 	_, err = tx.Stmt(d.parent.addMsg).Exec(d.dir, msg.UID, unixStamp, common.MarshalAddress(msg.Msg.From),
 		common.MarshalAddressList(msg.Msg.To), common.MarshalAddressList(msg.Msg.Cc),
-		common.MarshalAddressList(msg.Msg.Bcc) /* TODO: msgid */, "", common.MarshalAddress(msg.Msg.ReplyTo),
-		msg.Msg.Subject, hdrs)
+		common.MarshalAddressList(msg.Msg.Bcc), msg.Msg.MessageId, common.MarshalAddress(msg.Msg.ReplyTo),
+		msg.Msg.Subject, hdrs, msg.Msg.InReplyTo, strings.Join(msg.Msg.References, " "))
 	if err != nil {
 		return err
 	}
@@ -922,13 +1271,10 @@ func (d *Dirwrapper) addMsg(tx *sql.Tx, msg *imap.MessageInfo) error {
 		}
 	}
 
-	for i, prt := range msg.Msg.Parts {
-		if err := d.addPart(tx, msg.UID, uint(i), &prt); err != nil {
-			return err
-		}
+	if err := d.addPartTree(tx, msg.UID, &msg.Msg.Body); err != nil {
+		return err
 	}
-
-	return nil
+	return d.indexMsg(tx, msg.UID)
 }
 
 func (d *Dirwrapper) ReplaceTagList(msgUid uint32, newList []string) error {
@@ -938,14 +1284,33 @@ func (d *Dirwrapper) ReplaceTagList(msgUid uint32, newList []string) error {
 	}
 	defer tx.Rollback()
 
-	if _, err := tx.Stmt(d.parent.delMsgTags).Exec(d.dir, msgUid); err != nil {
+	if err := d.replaceTagList(tx, msgUid, newList); err != nil {
 		return err
 	}
 
 	return tx.Commit()
 }
 
-func (d *Dirwrapper) ReplacePartList(msgUid uint32, newParts []common.Part) error {
+func (d *Dirwrapper) replaceTagList(tx *sql.Tx, msgUid uint32, newList []string) error {
+	if _, err := tx.Stmt(d.parent.delMsgTags).Exec(d.dir, msgUid); err != nil {
+		return err
+	}
+	for _, tag := range newList {
+		// Keep in sync with imap.MessageToInfo: other system flags are not
+		// stored.
+		if strings.HasPrefix(tag, "\\") && tag != eimap.SeenFlag && tag != eimap.AnsweredFlag && tag != eimap.RecentFlag {
+			continue
+		}
+		if _, err := tx.Stmt(d.parent.addTag).Exec(d.dir, msgUid, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplacePartTree replaces all information about message parts with new
+// MIME tree.
+func (d *Dirwrapper) ReplacePartTree(msgUid uint32, root *common.Part) error {
 	tx, err := d.parent.d.Begin()
 	if err != nil {
 		return err
@@ -956,10 +1321,11 @@ func (d *Dirwrapper) ReplacePartList(msgUid uint32, newParts []common.Part) erro
 		return err
 	}
 
-	for i, prt := range newParts {
-		if err := d.addPart(tx, msgUid, uint(i), &prt); err != nil {
-			return err
-		}
+	if err := d.addPartTree(tx, msgUid, root); err != nil {
+		return err
+	}
+	if err := d.indexMsg(tx, msgUid); err != nil {
+		return err
 	}
 
 	return tx.Commit()
@@ -975,8 +1341,26 @@ func (d *Dirwrapper) MsgsCount() uint {
 	return count
 }
 
-func (d *Dirwrapper) addPart(tx *sql.Tx, msgUid uint32, indx uint, prt *common.Part) error {
-	hdrsBytes, err := common.WriteHeader(prt.Misc)
+// addPartTree adds all nodes of MIME tree to parts table. Zero root (message
+// without known body structure) is ignored.
+func (d *Dirwrapper) addPartTree(tx *sql.Tx, msgUid uint32, root *common.Part) error {
+	if root.Type.Value == "" && len(root.Children) == 0 {
+		return nil
+	}
+	return root.Walk(func(prt *common.Part) error {
+		return d.addPart(tx, msgUid, prt)
+	})
+}
+
+func (d *Dirwrapper) addPart(tx *sql.Tx, msgUid uint32, prt *common.Part) error {
+	hdrs := make(common.Header, len(prt.Misc)+1)
+	for k, v := range prt.Misc {
+		hdrs[k] = v
+	}
+	if prt.Disposition.Value != "" {
+		hdrs.SetContentDisposition(prt.Disposition.Value, prt.Disposition.Params)
+	}
+	hdrsBytes, err := common.WriteHeader(hdrs)
 	if err != nil {
 		return err
 	}
@@ -986,14 +1370,15 @@ func (d *Dirwrapper) addPart(tx *sql.Tx, msgUid uint32, indx uint, prt *common.P
 		size = uint32(len(prt.Body))
 	}
 
-	typeParts := strings.Split(prt.Type.Value, "/")
+	typeParts := strings.SplitN(prt.Type.Value, "/", 2)
 	if len(typeParts) == 1 {
 		typeParts = []string{"", ""}
 	}
 	type_, subtype := typeParts[0], typeParts[1]
-	typeParams := []string{}
-	for name, value := range prt.Type.Params {
-		typeParams = append(typeParams, fmt.Sprintf("%v=%v", name, value))
+	// Let mime package handle quoting, then strip type itself.
+	typeParams := ""
+	if formatted := mime.FormatMediaType("x/x", prt.Type.Params); formatted != "" {
+		typeParams = strings.TrimPrefix(strings.TrimPrefix(formatted, "x/x"), "; ")
 	}
 
 	attachment := 0
@@ -1005,16 +1390,26 @@ func (d *Dirwrapper) addPart(tx *sql.Tx, msgUid uint32, indx uint, prt *common.P
 		}
 	}
 
-	if tx != nil {
-		_, err = tx.Stmt(d.parent.addPart).Exec(d.dir, msgUid, indx, attachment, type_, subtype, strings.Join(typeParams, "; "), size, filename, hdrsBytes, prt.Body)
-	} else {
-		_, err = d.parent.addPart.Exec(d.dir, msgUid, indx, attachment, type_, subtype, strings.Join(typeParams, "; "), size, filename, hdrsBytes, prt.Body)
-	}
+	_, err = tx.Stmt(d.parent.addPart).Exec(d.dir, msgUid, prt.Path, attachment, type_, subtype, typeParams, size, filename, hdrsBytes, prt.Body)
 	return err
 }
 
-func (d *Dirwrapper) AddPart(msgUid uint32, indx uint, prt *common.Part) error {
-	return d.addPart(nil, msgUid, indx, prt)
+// AddPart adds single part (identified by prt.Path) to message.
+func (d *Dirwrapper) AddPart(msgUid uint32, prt *common.Part) error {
+	tx, err := d.parent.d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := d.addPart(tx, msgUid, prt); err != nil {
+		return err
+	}
+	if err := d.indexMsg(tx, msgUid); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func (d *Dirwrapper) ResolveUid(seq uint32) (uint32, error) {
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateV2(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	old, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE dirinfo (
+			dir TEXT PRIMARY KEY NOT NULL,
+			uidvalidity INT DEFAULT NULL,
+			unreadcount INT DEFAULT NULL,
+			msglistvalid INT DEFAULT 0,
+			highestmodseq INT DEFAULT NULL
+		)`,
+		`CREATE TABLE meta (
+			dir TEXT NOT NULL,
+			uid INT NOT NULL,
+			timestamp INT DEFAULT "",
+			sender TEXT DEFAULT "",
+			recipients TEXT DEFAULT "",
+			cc TEXT DEFAULT "",
+			bcc TEXT DEFAULT "",
+			messageid TEXT DEFAULT "",
+			replyto TEXT DEFAULT "",
+			subject TEXT DEFAULT "",
+			hdrs BLOB DEFAULT NULL,
+			PRIMARY KEY (dir, uid),
+			FOREIGN KEY (dir) REFERENCES dirinfo(dir)
+		)`,
+		`INSERT INTO dirinfo VALUES ('INBOX', 42, 0, 1, 100)`,
+		`INSERT INTO meta(dir, uid, timestamp, subject) VALUES ('INBOX', 1, 0, 'Hello')`,
+		`PRAGMA user_version = 2`,
+	} {
+		if _, err := old.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old.Close()
+
+	db, err := OpenCacheDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Cached information is kept.
+	uidValidity, err := db.Dir("INBOX").UidValidity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uidValidity != 42 {
+		t.Errorf("UIDVALIDITY is reset: %v", uidValidity)
+	}
+	msgs, err := db.ThreadMsgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Uid != 1 || msgs[0].Subject != "Hello" {
+		t.Fatalf("Cached messages are lost: %+v", msgs)
+	}
+	if msgs[0].ThreadId != "" || len(msgs[0].References) != 0 {
+		t.Errorf("Wrong values of added columns: %+v", msgs[0])
+	}
+	outdated, err := db.ThreadsNeedUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !outdated {
+		t.Error("Threads are not recomputed for migrated messages")
+	}
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"strings"
+	"time"
+)
+
+// MsgFilter selects cached messages, see FilterMsgs. Zero values of fields
+// don't restrict result.
+type MsgFilter struct {
+	// Directories to include, all if empty.
+	Dirs []string
+	// Directories to exclude.
+	ExcludeDirs []string
+	// Tag (flag) message should have.
+	Tag string
+	// Tag (flag) message should not have.
+	NoTag string
+	// Messages sent at or after specific time.
+	Since time.Time
+}
+
+// FilterMsgs returns keys of cached messages matching filter, ordered by
+// date (newest first).
+func (db *CacheDB) FilterMsgs(f MsgFilter) ([]MsgKey, error) {
+	query := strings.Builder{}
+	args := []interface{}{}
+	query.WriteString(`SELECT dir, uid FROM meta WHERE 1`)
+	if len(f.Dirs) != 0 {
+		query.WriteString(` AND dir IN (?` + strings.Repeat(`, ?`, len(f.Dirs)-1) + `)`)
+		for _, dir := range f.Dirs {
+			args = append(args, dir)
+		}
+	}
+	if len(f.ExcludeDirs) != 0 {
+		query.WriteString(` AND dir NOT IN (?` + strings.Repeat(`, ?`, len(f.ExcludeDirs)-1) + `)`)
+		for _, dir := range f.ExcludeDirs {
+			args = append(args, dir)
+		}
+	}
+	if f.Tag != "" {
+		query.WriteString(` AND EXISTS (SELECT 1 FROM tags WHERE tags.dir = meta.dir AND tags.uid = meta.uid AND tags.tag = ?)`)
+		args = append(args, f.Tag)
+	}
+	if f.NoTag != "" {
+		query.WriteString(` AND NOT EXISTS (SELECT 1 FROM tags WHERE tags.dir = meta.dir AND tags.uid = meta.uid AND tags.tag = ?)`)
+		args = append(args, f.NoTag)
+	}
+	if !f.Since.IsZero() {
+		query.WriteString(` AND timestamp >= ?`)
+		args = append(args, f.Since.Unix())
+	}
+	query.WriteString(` ORDER BY timestamp DESC`)
+
+	rows, err := db.d.Query(query.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []MsgKey{}
+	for rows.Next() {
+		key := MsgKey{}
+		if err := rows.Scan(&key.Dir, &key.Uid); err != nil {
+			return nil, err
+		}
+		res = append(res, key)
+	}
+	return res, rows.Err()
+}
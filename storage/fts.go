@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/mailbox/proto/common"
+)
+
+/*
+Full-text index over cached messages.
+
+Index is stored in FTS5 virtual table fts with following columns:
+- subject
+- addresses
+  From, To, Cc, Bcc and Reply-To headers.
+- body
+  Decoded bodies of cached text/* parts (HTML tags stripped).
+
+Row ID of fts table is ID from ftsidx table which maps it to dir + uid pair.
+
+Index is updated by Dirwrapper methods that change meta and parts tables so
+it always reflects cached information (i.e. message without downloaded text
+is searchable only by headers).
+
+FTS5 is not enabled in go-sqlite3 by default, build with sqlite_fts5 tag to
+enable it. Without it index is not maintained and Search returns ErrNoFTS.
+*/
+
+// Returned by Search if SQLite library is built without FTS5 support.
+var ErrNoFTS = errors.New("cachedb: full-text search is not available")
+
+// initFTS creates full-text index tables if FTS5 is available. Index is
+// populated from existing cache if it's newly created.
+func (db *CacheDB) initFTS() error {
+	exists := 0
+	row := db.d.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'fts'`)
+	if err := row.Scan(&exists); err != nil {
+		return err
+	}
+
+	_, err := db.d.Exec(`
+		CREATE VIRTUAL TABLE IF NOT EXISTS fts USING fts5(
+			subject, addresses, body,
+			tokenize = 'unicode61 remove_diacritics 1'
+		)`)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such module") {
+			db.fts = false
+			return nil
+		}
+		return err
+	}
+	db.fts = true
+
+	_, err = db.d.Exec(`
+		CREATE TABLE IF NOT EXISTS ftsidx (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			dir TEXT NOT NULL,
+			uid INT NOT NULL,
+			UNIQUE (dir, uid)
+		)`)
+	if err != nil {
+		return err
+	}
+
+	if exists == 0 {
+		return db.rebuildFTS()
+	}
+	return nil
+}
+
+// rebuildFTS indexes all cached messages.
+func (db *CacheDB) rebuildFTS() error {
+	tx, err := db.d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM fts`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM ftsidx`); err != nil {
+		return err
+	}
+
+	type msgKey struct {
+		dir string
+		uid uint32
+	}
+	keys := []msgKey{}
+	rows, err := tx.Query(`SELECT dir, uid FROM meta`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		key := msgKey{}
+		if err := rows.Scan(&key.dir, &key.uid); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+
+	for _, key := range keys {
+		if err := db.Dir(key.dir).indexMsg(tx, key.uid); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// indexMsg (re-)builds index entry for message using information from meta
+// and parts tables.
+func (d *Dirwrapper) indexMsg(tx *sql.Tx, uid uint32) error {
+	if !d.parent.fts {
+		return nil
+	}
+
+	subject, sender, recipients, cc, bcc, replyTo := "", "", "", "", "", ""
+	row := tx.QueryRow(`SELECT subject,sender,recipients,cc,bcc,replyto FROM meta WHERE dir = ? AND uid = ?`, d.dir, uid)
+	if err := row.Scan(&subject, &sender, &recipients, &cc, &bcc, &replyTo); err != nil {
+		if err == sql.ErrNoRows {
+			return d.unindexMsg(tx, uid)
+		}
+		return err
+	}
+	addresses := strings.Join([]string{sender, recipients, cc, bcc, replyTo}, " ")
+
+	type textPart struct {
+		path, text string
+	}
+	parts := []textPart{}
+	rows, err := tx.Query(`
+		SELECT path, content_subtype, body FROM parts
+		WHERE dir = ? AND uid = ? AND content_type = 'text' AND attachment = 0 AND body IS NOT NULL`, d.dir, uid)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		path, subtype := "", ""
+		body := []byte{}
+		if err := rows.Scan(&path, &subtype, &body); err != nil {
+			rows.Close()
+			return err
+		}
+		text := string(body)
+		if subtype == "html" {
+			text = common.StripHTMLTags(text, " ")
+		}
+		parts = append(parts, textPart{path, text})
+	}
+	rows.Close()
+
+	// Paths are compared numerically, SQLite would place "1.10" before "1.2".
+	sort.Slice(parts, func(i, j int) bool {
+		return common.PathLess(parts[i].path, parts[j].path)
+	})
+	bodies := make([]string, len(parts))
+	for i, part := range parts {
+		bodies[i] = part.text
+	}
+
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO ftsidx(dir, uid) VALUES (?, ?)`, d.dir, uid); err != nil {
+		return err
+	}
+	id := int64(0)
+	if err := tx.QueryRow(`SELECT id FROM ftsidx WHERE dir = ? AND uid = ?`, d.dir, uid).Scan(&id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM fts WHERE rowid = ?`, id); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO fts(rowid, subject, addresses, body) VALUES (?, ?, ?, ?)`,
+		id, subject, addresses, strings.Join(bodies, "\n"))
+	return err
+}
+
+func (d *Dirwrapper) unindexMsg(tx *sql.Tx, uid uint32) error {
+	if !d.parent.fts {
+		return nil
+	}
+	_, err := tx.Exec(`DELETE FROM fts WHERE rowid IN (SELECT id FROM ftsidx WHERE dir = ? AND uid = ?)`, d.dir, uid)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM ftsidx WHERE dir = ? AND uid = ?`, d.dir, uid)
+	return err
+}
+
+func (db *CacheDB) unindexDir(tx *sql.Tx, dir string) error {
+	if !db.fts {
+		return nil
+	}
+	_, err := tx.Exec(`DELETE FROM fts WHERE rowid IN (SELECT id FROM ftsidx WHERE dir = ?)`, dir)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM ftsidx WHERE dir = ?`, dir)
+	return err
+}
+
+// SearchQuery describes local search request. All non-empty fields should
+// match.
+type SearchQuery struct {
+	// Words to search for in subject, addresses and text, every word should
+	// be present. Words are matched by prefix.
+	Text string
+	// Substring of From header.
+	From string
+	// Sent before/after specific time (exclusive).
+	Before, After time.Time
+	// Directories to search in, all if empty.
+	Dirs []string
+	// Maximum amount of results, 0 means no limit.
+	Limit int
+}
+
+// SearchHit is a message matched by Search.
+type SearchHit struct {
+	Dir string
+	Uid uint32
+	// Relevance of match, lower is better. Zero if Text is empty.
+	Rank float64
+	// Fragment of matched text with matches enclosed in [ and ], empty if
+	// Text is empty.
+	Snippet string
+}
+
+// Search performs search over cached messages. Results are ordered by
+// relevance (if Text is specified) or by date (newest first).
+func (db *CacheDB) Search(q SearchQuery) ([]SearchHit, error) {
+	query := strings.Builder{}
+	args := []interface{}{}
+	if q.Text != "" {
+		if !db.fts {
+			return nil, ErrNoFTS
+		}
+		query.WriteString(`
+			SELECT meta.dir, meta.uid, bm25(fts), snippet(fts, -1, '[', ']', '...', 12)
+			FROM fts
+			JOIN ftsidx ON ftsidx.id = fts.rowid
+			JOIN meta ON meta.dir = ftsidx.dir AND meta.uid = ftsidx.uid
+			WHERE fts MATCH ?`)
+		args = append(args, ftsQuery(q.Text))
+	} else {
+		query.WriteString(`SELECT meta.dir, meta.uid, 0, '' FROM meta WHERE 1`)
+	}
+
+	if q.From != "" {
+		query.WriteString(` AND meta.sender LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(q.From)+"%")
+	}
+	if !q.Before.IsZero() {
+		query.WriteString(` AND meta.timestamp < ?`)
+		args = append(args, q.Before.Unix())
+	}
+	if !q.After.IsZero() {
+		query.WriteString(` AND meta.timestamp > ?`)
+		args = append(args, q.After.Unix())
+	}
+	if len(q.Dirs) != 0 {
+		query.WriteString(` AND meta.dir IN (?` + strings.Repeat(`, ?`, len(q.Dirs)-1) + `)`)
+		for _, dir := range q.Dirs {
+			args = append(args, dir)
+		}
+	}
+
+	if q.Text != "" {
+		query.WriteString(` ORDER BY bm25(fts)`)
+	} else {
+		query.WriteString(` ORDER BY meta.timestamp DESC`)
+	}
+	if q.Limit != 0 {
+		query.WriteString(` LIMIT ?`)
+		args = append(args, q.Limit)
+	}
+
+	rows, err := db.d.Query(query.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []SearchHit{}
+	for rows.Next() {
+		hit := SearchHit{}
+		if err := rows.Scan(&hit.Dir, &hit.Uid, &hit.Rank, &hit.Snippet); err != nil {
+			return nil, err
+		}
+		res = append(res, hit)
+	}
+	return res, rows.Err()
+}
+
+// ftsQuery converts user input into FTS5 query: each word is quoted (so
+// operators and special characters are not interpreted) and matched as
+// prefix.
+func ftsQuery(text string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		words[i] = `"` + strings.Replace(word, `"`, `""`, -1) + `"*`
+	}
+	return strings.Join(words, " ")
+}
+
+func escapeLike(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `%`, `\%`, -1)
+	return strings.Replace(s, `_`, `\_`, -1)
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/mailbox/proto/common"
+	"github.com/foxcpp/mailbox/proto/imap"
+)
+
+func openTestCache(t *testing.T) *CacheDB {
+	db, err := OpenCacheDB(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.AddDir("INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// testMsg returns message with text parts 1.1 - 1.10 containing words
+// "partN" and HTML part 2.
+func testMsg(uid uint32) *imap.MessageInfo {
+	nested := common.Part{Type: common.ParametrizedHeader{Value: "multipart/mixed"}}
+	for i := 1; i <= 10; i++ {
+		nested.Children = append(nested.Children, common.Part{
+			Type: common.ParametrizedHeader{Value: "text/plain"},
+			Body: []byte("part" + strconv.Itoa(i)),
+		})
+	}
+	root := common.Part{
+		Type: common.ParametrizedHeader{Value: "multipart/mixed"},
+		Children: []common.Part{
+			nested,
+			{
+				Type: common.ParametrizedHeader{Value: "text/html"},
+				Body: []byte("<p>Formatted <b>text</b></p>"),
+			},
+		},
+	}
+	root.AssignPaths()
+
+	return &imap.MessageInfo{
+		UID: uid,
+		Msg: common.Msg{
+			Date:    time.Date(2018, 9, 1, 12, 0, 0, 0, time.UTC),
+			Subject: "Quarterly report",
+			From:    common.Address{Name: "Alice", Address: "alice@example.org"},
+			To:      []common.Address{{Address: "bob@example.org"}},
+			Body:    root,
+		},
+	}
+}
+
+func TestSearchNoFTS(t *testing.T) {
+	db := openTestCache(t)
+	if db.fts {
+		t.Skip("FTS5 is available")
+	}
+	if err := db.Dir("INBOX").AddMsg(testMsg(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Search(SearchQuery{Text: "report"}); !errors.Is(err, ErrNoFTS) {
+		t.Errorf("Expected ErrNoFTS, got %v", err)
+	}
+	// Search without text doesn't needs index.
+	hits, err := db.Search(SearchQuery{From: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].Uid != 1 {
+		t.Errorf("Wrong search results: %+v", hits)
+	}
+}
+
+func TestIndexMsg(t *testing.T) {
+	db := openTestCache(t)
+	if !db.fts {
+		t.Skip("FTS5 is not available, build with sqlite_fts5 tag")
+	}
+	dir := db.Dir("INBOX")
+	if err := dir.AddMsg(testMsg(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	body := ""
+	row := db.d.QueryRow(`SELECT body FROM fts JOIN ftsidx ON ftsidx.id = fts.rowid WHERE dir = 'INBOX' AND uid = 1`)
+	if err := row.Scan(&body); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(body, "\n")
+	if len(lines) != 11 {
+		t.Fatalf("Expected 11 indexed parts, got %v: %q", len(lines), body)
+	}
+	for i := 0; i < 10; i++ {
+		if expected := "part" + strconv.Itoa(i+1); lines[i] != expected {
+			t.Errorf("Wrong order of indexed parts: %v at %v (expected %v)", lines[i], i, expected)
+		}
+	}
+	if strings.Contains(lines[10], "<") {
+		t.Errorf("HTML tags are not stripped: %q", lines[10])
+	}
+
+	cases := []struct {
+		query SearchQuery
+		found bool
+	}{
+		{SearchQuery{Text: "quarter"}, true},
+		{SearchQuery{Text: "part10"}, true},
+		{SearchQuery{Text: "formatted text"}, true},
+		{SearchQuery{Text: "bob"}, true},
+		{SearchQuery{Text: "report", From: "alice"}, true},
+		{SearchQuery{Text: "report", From: "bob"}, false},
+		{SearchQuery{Text: "report", Dirs: []string{"Archive"}}, false},
+		{SearchQuery{Text: "missing"}, false},
+	}
+	for _, c := range cases {
+		hits, err := db.Search(c.query)
+		if err != nil {
+			t.Fatalf("%+v: %v", c.query, err)
+		}
+		if found := len(hits) == 1 && hits[0].Dir == "INBOX" && hits[0].Uid == 1; found != c.found {
+			t.Errorf("%+v: wrong search results: %+v", c.query, hits)
+		}
+	}
+
+	if err := dir.DelMsg(1); err != nil {
+		t.Fatal(err)
+	}
+	hits, err := db.Search(SearchQuery{Text: "report"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 0 {
+		t.Errorf("Removed message is still indexed: %+v", hits)
+	}
+}
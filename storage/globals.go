@@ -4,17 +4,64 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
 type GlobalCfg struct {
-	Connection struct {
-		MaxTries *int `yaml:"maxtries"`
-	} `yaml:"connection"`
-	Encryption struct {
-		UseMasterPass *bool
-		MasterKeySalt string
+	Connection ConnectionCfg `yaml:"connection,omitempty"`
+	Encryption EncryptionCfg `yaml:"encryption,omitempty"`
+	Sending    SendingCfg    `yaml:"sending,omitempty"`
+}
+
+type ConnectionCfg struct {
+	MaxTries *int `yaml:"maxtries,omitempty"`
+	// Proxy URL (socks5://, socks5h:// or http://), "tor" or "none" to
+	// connect directly (useful to override global value for account).
+	Proxy string `yaml:"proxy,omitempty"`
+	// Interval in seconds between checks for new messages in watched
+	// directories if server can't report them.
+	PollInterval *int `yaml:"pollinterval,omitempty"`
+	// Amount of IMAP connections used for regular operations, in addition
+	// to connection used for IDLE.
+	PoolSize *int `yaml:"poolsize,omitempty"`
+}
+
+type SendingCfg struct {
+	// Delay in seconds during which message sent using SendUndoable can be
+	// cancelled, 0 to disable.
+	UndoDelay *int `yaml:"undodelay,omitempty"`
+}
+
+type EncryptionCfg struct {
+	UseMasterPass *bool  `yaml:"usemasterpass,omitempty"`
+	MasterKeySalt string `yaml:"masterkeysalt,omitempty"`
+}
+
+// Override returns copy of configuration with values set in overrides
+// replacing corresponding values. Nil pointers, slices and maps and zero
+// values of other types are considered unset.
+func (cfg GlobalCfg) Override(overrides GlobalCfg) GlobalCfg {
+	res := cfg
+	overrideValue(reflect.ValueOf(&res).Elem(), reflect.ValueOf(overrides))
+	return res
+}
+
+func overrideValue(dst, src reflect.Value) {
+	switch src.Kind() {
+	case reflect.Struct:
+		for i := 0; i < src.NumField(); i++ {
+			overrideValue(dst.Field(i), src.Field(i))
+		}
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+		if !src.IsNil() {
+			dst.Set(src)
+		}
+	default:
+		if src.Interface() != reflect.Zero(src.Type()).Interface() {
+			dst.Set(src)
+		}
 	}
 }
 
@@ -51,6 +98,18 @@ func LoadGlobal() (*GlobalCfg, error) {
 		f := 5
 		res.Connection.MaxTries = &f
 	}
+	if res.Connection.PollInterval == nil {
+		f := 120
+		res.Connection.PollInterval = &f
+	}
+	if res.Connection.PoolSize == nil {
+		f := 2
+		res.Connection.PoolSize = &f
+	}
+	if res.Sending.UndoDelay == nil {
+		f := 0
+		res.Sending.UndoDelay = &f
+	}
 	if res.Encryption.UseMasterPass == nil {
 		f := false
 		res.Encryption.UseMasterPass = &f
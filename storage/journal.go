@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"time"
+)
+
+// JournalEntry is an operation performed while server was not reachable.
+// Such operations are replayed in order of their Id once connection is
+// restored.
+type JournalEntry struct {
+	Id          int64
+	Time        time.Time
+	Op          string
+	Dir         string
+	UidValidity uint32
+	Args        []byte
+}
+
+// AddJournalEntry appends entry to the end of journal. Id and Time fields are
+// ignored, new Id is returned.
+func (db *CacheDB) AddJournalEntry(entry JournalEntry) (int64, error) {
+	res, err := db.d.Exec(`INSERT INTO journal(timestamp, op, dir, uidvalidity, args) VALUES (?, ?, ?, ?, ?)`,
+		time.Now().Unix(), entry.Op, entry.Dir, entry.UidValidity, entry.Args)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// Journal returns all pending operations in order they were added.
+func (db *CacheDB) Journal() ([]JournalEntry, error) {
+	rows, err := db.d.Query(`SELECT id, timestamp, op, dir, uidvalidity, args FROM journal ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []JournalEntry{}
+	for rows.Next() {
+		entry := JournalEntry{}
+		stamp := int64(0)
+		if err := rows.Scan(&entry.Id, &stamp, &entry.Op, &entry.Dir, &entry.UidValidity, &entry.Args); err != nil {
+			return nil, err
+		}
+		entry.Time = time.Unix(stamp, 0)
+		res = append(res, entry)
+	}
+	return res, rows.Err()
+}
+
+// JournalLen returns amount of pending operations.
+func (db *CacheDB) JournalLen() (int, error) {
+	count := 0
+	return count, db.d.QueryRow(`SELECT COUNT(*) FROM journal`).Scan(&count)
+}
+
+// UpdateJournalEntry replaces arguments of operation, used to record progress
+// of replay.
+func (db *CacheDB) UpdateJournalEntry(id int64, args []byte) error {
+	_, err := db.d.Exec(`UPDATE journal SET args = ? WHERE id = ?`, args, id)
+	return err
+}
+
+// RemoveJournalEntry removes operation from journal, usually after it was
+// replayed.
+func (db *CacheDB) RemoveJournalEntry(id int64) error {
+	_, err := db.d.Exec(`DELETE FROM journal WHERE id = ?`, id)
+	return err
+}
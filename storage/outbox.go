@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// OutboxEntry is a message waiting for delivery.
+type OutboxEntry struct {
+	Id int64
+	// When message was queued.
+	Time time.Time
+	// RFC 822 message.
+	Msg []byte
+
+	Attempts int
+	// Zero if message should not be delivered automatically (last attempt
+	// failed permanently).
+	NextAttempt time.Time
+	// Error from last delivery attempt.
+	LastError string
+	// UID of message copy in drafts directory, zero if there is none.
+	DraftUid uint32
+}
+
+// AddOutboxEntry appends message to outbox. Id and Time fields are ignored,
+// new Id is returned.
+func (db *CacheDB) AddOutboxEntry(entry OutboxEntry) (int64, error) {
+	res, err := db.d.Exec(`INSERT INTO outbox(timestamp, msg, attempts, nextattempt, lasterror, draftuid) VALUES (?, ?, ?, ?, ?, ?)`,
+		time.Now().Unix(), entry.Msg, entry.Attempts, unixOrZero(entry.NextAttempt), entry.LastError, entry.DraftUid)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// Outbox returns all queued messages in order they were added.
+func (db *CacheDB) Outbox() ([]OutboxEntry, error) {
+	rows, err := db.d.Query(`SELECT id, timestamp, msg, attempts, nextattempt, lasterror, draftuid FROM outbox ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []OutboxEntry{}
+	for rows.Next() {
+		entry, err := scanOutboxEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, *entry)
+	}
+	return res, rows.Err()
+}
+
+// OutboxEntry returns queued message with specified id. ErrNullValue is
+// returned if there is no such message.
+func (db *CacheDB) OutboxEntry(id int64) (*OutboxEntry, error) {
+	row := db.d.QueryRow(`SELECT id, timestamp, msg, attempts, nextattempt, lasterror, draftuid FROM outbox WHERE id = ?`, id)
+	entry, err := scanOutboxEntry(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNullValue
+	}
+	return entry, err
+}
+
+// UpdateOutboxEntry saves all fields of entry except Id and Time.
+func (db *CacheDB) UpdateOutboxEntry(entry OutboxEntry) error {
+	_, err := db.d.Exec(`UPDATE outbox SET msg = ?, attempts = ?, nextattempt = ?, lasterror = ?, draftuid = ? WHERE id = ?`,
+		entry.Msg, entry.Attempts, unixOrZero(entry.NextAttempt), entry.LastError, entry.DraftUid, entry.Id)
+	return err
+}
+
+// RemoveOutboxEntry removes message from outbox, usually after it was
+// delivered.
+func (db *CacheDB) RemoveOutboxEntry(id int64) error {
+	_, err := db.d.Exec(`DELETE FROM outbox WHERE id = ?`, id)
+	return err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOutboxEntry(row scanner) (*OutboxEntry, error) {
+	entry := OutboxEntry{}
+	stamp, next := int64(0), int64(0)
+	if err := row.Scan(&entry.Id, &stamp, &entry.Msg, &entry.Attempts, &next, &entry.LastError, &entry.DraftUid); err != nil {
+		return nil, err
+	}
+	entry.Time = time.Unix(stamp, 0)
+	if next != 0 {
+		entry.NextAttempt = time.Unix(next, 0)
+	}
+	return &entry, nil
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Template is a stored message template. Subject and bodies may contain
+// placeholders, see core.TemplateData.
+type Template struct {
+	Subject string `yaml:",omitempty"`
+	// Default recipients.
+	To  []string `yaml:",omitempty"`
+	Cc  []string `yaml:",omitempty"`
+	Bcc []string `yaml:",omitempty"`
+
+	Text string `yaml:",omitempty"`
+	// Optional, sent as alternative to Text if present.
+	HTML string `yaml:",omitempty"`
+
+	// Files attached to message. Relative paths are relative to templates
+	// directory.
+	Attachments []string `yaml:",omitempty"`
+}
+
+// TemplatesDir returns directory templates are stored in.
+func TemplatesDir() string {
+	return filepath.Join(GetDirectory(), "templates")
+}
+
+func templatePath(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid template name: %v", name)
+	}
+	return filepath.Join(TemplatesDir(), name+".yml"), nil
+}
+
+// LoadTemplate reads template 'name'.
+func LoadTemplate(name string) (*Template, error) {
+	path, err := templatePath(name)
+	if err != nil {
+		return nil, fmt.Errorf("loadtemplate %v: %v", name, err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("loadtemplate %v: %v", name, err)
+	}
+
+	res := Template{}
+	if err := yaml.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("loadtemplate %v: %v", name, err)
+	}
+	return &res, nil
+}
+
+// LoadAllTemplates reads all templates, result is indexed by name.
+func LoadAllTemplates() (map[string]Template, error) {
+	res := make(map[string]Template)
+	info, err := ioutil.ReadDir(TemplatesDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return res, nil
+		}
+		return nil, fmt.Errorf("loadalltemplates: %v", err)
+	}
+	for _, i := range info {
+		if i.IsDir() || filepath.Ext(i.Name()) != ".yml" {
+			continue
+		}
+
+		tmpl, err := LoadTemplate(basename(i.Name()))
+		if err != nil {
+			return nil, err
+		}
+		res[basename(i.Name())] = *tmpl
+	}
+	return res, nil
+}
+
+// SaveTemplate saves template 'name', replacing existing one.
+func SaveTemplate(name string, tmpl Template) error {
+	path, err := templatePath(name)
+	if err != nil {
+		return fmt.Errorf("savetemplate %v: %v", name, err)
+	}
+
+	if err := os.MkdirAll(TemplatesDir(), 0700); err != nil {
+		return fmt.Errorf("savetemplate %v: %v", name, err)
+	}
+
+	bytes, err := yaml.Marshal(tmpl)
+	if err != nil {
+		return fmt.Errorf("savetemplate %v: %v", name, err)
+	}
+
+	return ioutil.WriteFile(path, bytes, 0600)
+}
+
+// DeleteTemplate removes template 'name'.
+func DeleteTemplate(name string) error {
+	path, err := templatePath(name)
+	if err != nil {
+		return fmt.Errorf("deletetemplate %v: %v", name, err)
+	}
+	return os.Remove(path)
+}
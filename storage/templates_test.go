@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestTemplates(t *testing.T) {
+	t.Setenv("MAILBOX_HOME", t.TempDir())
+
+	if all, err := LoadAllTemplates(); err != nil || len(all) != 0 {
+		t.Fatal("Unexpected templates:", all, err)
+	}
+
+	tmpl := Template{
+		Subject:     "Hello",
+		To:          []string{"Alice <alice@example.org>"},
+		Text:        "Hello {{.RecipientName}}",
+		Attachments: []string{"terms.pdf"},
+	}
+	if err := SaveTemplate("greeting", tmpl); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadTemplate("greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Subject != tmpl.Subject || loaded.Text != tmpl.Text || len(loaded.To) != 1 || len(loaded.Attachments) != 1 {
+		t.Errorf("Wrong template loaded: %+v", loaded)
+	}
+	if all, err := LoadAllTemplates(); err != nil || len(all) != 1 || all["greeting"].Subject != "Hello" {
+		t.Error("Wrong list of templates:", all, err)
+	}
+
+	if err := DeleteTemplate("greeting"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTemplate("greeting"); err == nil {
+		t.Error("Template is not deleted")
+	}
+}
+
+func TestTemplateName(t *testing.T) {
+	t.Setenv("MAILBOX_HOME", t.TempDir())
+
+	for _, name := range []string{"", "../global", `a\b`, ".hidden"} {
+		if err := SaveTemplate(name, Template{}); err == nil {
+			t.Errorf("Invalid name %q is accepted", name)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// ThreadMsg is information about message used to build threads.
+type ThreadMsg struct {
+	Dir string
+	Uid uint32
+
+	MessageId  string
+	InReplyTo  string
+	References []string
+	Subject    string
+	Date       time.Time
+
+	// Empty if thread is not computed yet.
+	ThreadId string
+}
+
+// MsgKey identifies message in cache.
+type MsgKey struct {
+	Dir string
+	Uid uint32
+}
+
+const threadMsgColumns = `dir,uid,messageid,inreplyto,refs,subject,timestamp,threadid`
+
+func readThreadMsgs(rows *sql.Rows) ([]ThreadMsg, error) {
+	defer rows.Close()
+	res := []ThreadMsg{}
+	for rows.Next() {
+		msg := ThreadMsg{}
+		refs, timestamp, threadId := "", int64(0), sql.NullString{}
+		if err := rows.Scan(&msg.Dir, &msg.Uid, &msg.MessageId, &msg.InReplyTo, &refs, &msg.Subject, &timestamp, &threadId); err != nil {
+			return nil, err
+		}
+		msg.References = strings.Fields(refs)
+		msg.Date = time.Unix(timestamp, 0)
+		msg.ThreadId = threadId.String
+		res = append(res, msg)
+	}
+	return res, rows.Err()
+}
+
+// ThreadMsgs returns threading information for all cached messages in all
+// directories.
+func (db *CacheDB) ThreadMsgs() ([]ThreadMsg, error) {
+	rows, err := db.d.Query(`SELECT ` + threadMsgColumns + ` FROM meta`)
+	if err != nil {
+		return nil, err
+	}
+	return readThreadMsgs(rows)
+}
+
+// ThreadsNeedUpdate checks whether there are messages without computed
+// thread ID.
+func (db *CacheDB) ThreadsNeedUpdate() (bool, error) {
+	count := 0
+	if err := db.d.QueryRow(`SELECT COUNT(*) FROM meta WHERE threadid IS NULL`).Scan(&count); err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
+
+// SetThreadIds replaces thread IDs for listed messages.
+func (db *CacheDB) SetThreadIds(ids map[MsgKey]string) error {
+	tx, err := db.d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`UPDATE meta SET threadid = ? WHERE dir = ? AND uid = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for key, id := range ids {
+		if _, err := stmt.Exec(id, key.Dir, key.Uid); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ThreadMsgs returns threading information for all messages (from all
+// directories) that belong to threads containing messages from this
+// directory.
+func (d *Dirwrapper) ThreadMsgs() ([]ThreadMsg, error) {
+	rows, err := d.parent.d.Query(`
+		SELECT `+threadMsgColumns+` FROM meta
+		WHERE threadid IN (SELECT DISTINCT threadid FROM meta WHERE dir = ?)`, d.dir)
+	if err != nil {
+		return nil, err
+	}
+	return readThreadMsgs(rows)
+}
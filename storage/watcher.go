@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ConfigChange describes configuration file that was added, modified or
+// removed.
+type ConfigChange struct {
+	// Account ID, empty for global.yml.
+	Account string
+	// File no longer exists.
+	Removed bool
+}
+
+// ConfigWatcher reports changes of global.yml and accounts/*.yml files.
+//
+// Changes are debounced: batch is sent only when no new events arrived during
+// specified delay, each file is listed in batch at most once. This way
+// editors that write file in several steps cause only one reload.
+type ConfigWatcher struct {
+	// Closed when watcher is closed.
+	Changes chan []ConfigChange
+
+	events       chan string
+	stop         chan struct{}
+	closeBackend func() error
+}
+
+// WatchConfig starts watching configuration directory for changes.
+func WatchConfig(delay time.Duration) (*ConfigWatcher, error) {
+	dirs := []string{GetDirectory(), filepath.Join(GetDirectory(), "accounts")}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	w := &ConfigWatcher{
+		Changes: make(chan []ConfigChange, 1),
+		events:  make(chan string, 16),
+		stop:    make(chan struct{}),
+	}
+	var err error
+	w.closeBackend, err = watchDirs(dirs, w.events, w.stop)
+	if err != nil {
+		return nil, err
+	}
+	go w.debounce(delay)
+	return w, nil
+}
+
+// Close stops watcher. Changes channel is closed after that.
+func (w *ConfigWatcher) Close() error {
+	close(w.stop)
+	return w.closeBackend()
+}
+
+func (w *ConfigWatcher) debounce(delay time.Duration) {
+	defer close(w.Changes)
+
+	pending := make(map[string]bool)
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-w.stop:
+			return
+		case path := <-w.events:
+			if _, ok := configChange(path); !ok {
+				continue
+			}
+			pending[path] = true
+			timer = time.After(delay)
+		case <-timer:
+			changes := make([]ConfigChange, 0, len(pending))
+			for path := range pending {
+				change, _ := configChange(path)
+				changes = append(changes, change)
+			}
+			pending = make(map[string]bool)
+			timer = nil
+
+			select {
+			case w.Changes <- changes:
+			case <-w.stop:
+				return
+			}
+		}
+	}
+}
+
+// configChange checks whether path is a configuration file and
+// returns description of it's current state.
+func configChange(path string) (ConfigChange, bool) {
+	dir, name := filepath.Dir(path), filepath.Base(path)
+	res := ConfigChange{}
+	switch {
+	case dir == GetDirectory() && name == "global.yml":
+	case dir == filepath.Join(GetDirectory(), "accounts") && filepath.Ext(name) == ".yml" && !strings.HasPrefix(name, "."):
+		res.Account = basename(name)
+	default:
+		return res, false
+	}
+
+	_, err := os.Stat(path)
+	res.Removed = os.IsNotExist(err)
+	return res, true
+}
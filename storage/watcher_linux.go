@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// watchDirs sends paths of files changed in any of listed directories to
+// events channel until stop is closed. Returned function releases
+// resources.
+func watchDirs(dirs []string, events chan<- string, stop <-chan struct{}) (func() error, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// Non-blocking file is handled by runtime poller so Close will interrupt
+	// pending Read.
+	file := os.NewFile(uintptr(fd), "inotify")
+
+	watches := make(map[int32]string, len(dirs))
+	for _, dir := range dirs {
+		wd, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO|syscall.IN_MOVED_FROM|syscall.IN_DELETE)
+		if err != nil {
+			file.Close()
+			return nil, os.NewSyscallError("inotify_add_watch", err)
+		}
+		watches[int32(wd)] = dir
+	}
+
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := file.Read(buf)
+			if err != nil {
+				return
+			}
+
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameStart := offset + syscall.SizeofInotifyEvent
+				offset = nameStart + int(event.Len)
+
+				dir, ok := watches[event.Wd]
+				if !ok || event.Len == 0 || offset > n {
+					continue
+				}
+				name := strings.TrimRight(string(buf[nameStart:offset]), "\x00")
+
+				select {
+				case events <- filepath.Join(dir, name):
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+
+	return file.Close, nil
+}
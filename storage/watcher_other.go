@@ -0,0 +1,77 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// How often directories are checked for changes if inotify is not available.
+const pollInterval = 2 * time.Second
+
+// watchDirs sends paths of files changed in any of listed directories to
+// events channel until stop is closed. Returned function releases
+// resources.
+//
+// Modification times are polled on platforms without inotify.
+func watchDirs(dirs []string, events chan<- string, stop <-chan struct{}) (func() error, error) {
+	type fileState struct {
+		modTime time.Time
+		size    int64
+	}
+	scan := func() map[string]fileState {
+		res := make(map[string]fileState)
+		for _, dir := range dirs {
+			infos, err := ioutil.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, info := range infos {
+				if !info.IsDir() {
+					res[filepath.Join(dir, info.Name())] = fileState{info.ModTime(), info.Size()}
+				}
+			}
+		}
+		return res
+	}
+
+	known := scan()
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			current := scan()
+			changed := []string{}
+			for path, state := range current {
+				if old, prs := known[path]; !prs || old != state {
+					changed = append(changed, path)
+				}
+			}
+			for path := range known {
+				if _, prs := current[path]; !prs {
+					changed = append(changed, path)
+				}
+			}
+			known = current
+
+			for _, path := range changed {
+				select {
+				case events <- path:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+
+	return func() error { return nil }, nil
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func waitChanges(t *testing.T, w *ConfigWatcher) []ConfigChange {
+	t.Helper()
+	select {
+	case changes := <-w.Changes:
+		sort.Slice(changes, func(i, j int) bool {
+			return changes[i].Account < changes[j].Account
+		})
+		return changes
+	case <-time.After(10 * time.Second):
+		t.Fatal("No changes reported")
+		return nil
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	t.Setenv("MAILBOX_HOME", t.TempDir())
+	w, err := WatchConfig(200 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// Several writes in quick succession are reported once.
+	for i := 0; i < 3; i++ {
+		if err := SaveAccount("test", AccountCfg{AccountName: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := SaveGlobal(&GlobalCfg{}); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := waitChanges(t, w)
+	if len(changes) != 2 || changes[0] != (ConfigChange{}) || changes[1] != (ConfigChange{Account: "test"}) {
+		t.Errorf("Wrong changes: %+v", changes)
+	}
+	select {
+	case changes := <-w.Changes:
+		t.Errorf("Changes are reported twice: %+v", changes)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if err := DeleteAccount("test"); err != nil {
+		t.Fatal(err)
+	}
+	changes = waitChanges(t, w)
+	if len(changes) != 1 || changes[0] != (ConfigChange{Account: "test", Removed: true}) {
+		t.Errorf("Wrong changes: %+v", changes)
+	}
+}